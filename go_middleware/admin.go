@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// adminRoutes builds the handler served on ADMIN_ADDR, kept off the public mux so profiles
+// and other internals are never reachable through PORT
+func adminRoutes() http.Handler {
+	mux := http.NewServeMux()
+	if cfg().enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	// with no token configured the listener's address is the only guard
+	if cfg().adminToken == "" {
+		return mux
+	}
+	return requireAdmin(mux)
+}
+
+// requireAdmin rejects requests without "Authorization: Bearer <ADMIN_TOKEN>". Admin endpoints
+// on the public mux are switched off entirely until a token is configured.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg().adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if !isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAdmin reports whether r carries the configured ADMIN_TOKEN, never true when there isn't one
+func isAdmin(r *http.Request) bool {
+	if cfg().adminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(cfg().adminToken)) == 1
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPprofOnAdminListener(t *testing.T) {
+	for _, enabled := range []string{"false", "true"} {
+		t.Run(enabled, func(t *testing.T) {
+			t.Setenv("ENABLE_PPROF", enabled)
+			t.Setenv("ADMIN_TOKEN", "secret")
+			_, srv := newTestServer(t)
+			admin := httptest.NewServer(adminRoutes())
+			defer admin.Close()
+
+			resp, body := do(t, "GET", admin.URL+"/debug/pprof/", "", "Authorization", "Bearer secret")
+			if enabled == "false" {
+				if resp.StatusCode != http.StatusNotFound {
+					t.Fatalf("pprof index while disabled: got %d, want 404", resp.StatusCode)
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusOK || !strings.Contains(body, "goroutine") {
+				t.Fatalf("pprof index: got %d", resp.StatusCode)
+			}
+			if resp, _ := do(t, "GET", admin.URL+"/debug/pprof/", ""); resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("pprof without the admin token: got %d, want 401", resp.StatusCode)
+			}
+			// never on the public listener
+			if _, body := do(t, "GET", srv.URL+"/debug/pprof/", "", "Authorization", "Bearer secret"); strings.Contains(body, "goroutine") {
+				t.Fatal("pprof served on the public listener")
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// limits on POST /api/fileserver/archive
+const (
+	maxArchiveFiles     = 1000
+	maxArchiveBodyBytes = 1 << 20
+)
+
+// archiveManifestName is the last entry of every archive, saying which files made it in and
+// why the rest didn't
+const archiveManifestName = ".manifest.json"
+
+type archiveRequest struct {
+	Files []string `json:"files"`
+}
+
+type archiveManifest struct {
+	Files   []string          `json:"files"`
+	Skipped map[string]string `json:"skipped"` // file to why it was left out
+}
+
+// archiveFiles answers POST /api/fileserver/archive with the files in {"files":[...]} as a zip,
+// written entry by entry so the archive is never held whole, and a file the cache doesn't have
+// is copied straight from storage. Files that are missing or can't be read are left out and
+// listed in the manifest entry at the end.
+func archiveFiles(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req archiveRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxArchiveBodyBytes)).Decode(&req)
+	if err != nil || len(req.Files) == 0 {
+		http.Error(w, "invalid request body, want {\"files\":[...]}", http.StatusBadRequest)
+		return
+	}
+	if len(req.Files) > maxArchiveFiles {
+		http.Error(w, fmt.Sprintf("at most %d files per request", maxArchiveFiles), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="archive.zip"`)
+	w.WriteHeader(http.StatusOK)
+
+	zw := zip.NewWriter(w)
+	manifest := archiveManifest{Files: []string{}, Skipped: map[string]string{}}
+	seen := map[string]bool{}
+	for _, file := range req.Files {
+		name, err := resolveFileName(r, file)
+		if err != nil {
+			manifest.Skipped[file] = err.Error()
+			continue
+		}
+		// names that normalize onto one file only go in once
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		err = archiveFile(ctx, zw, file, name)
+		if errors.Is(err, errNotFound) {
+			manifest.Skipped[file] = "file not found"
+			continue
+		}
+		if err != nil {
+			slog.Warn("Could not add file to archive", "file", name, "err", err)
+			manifest.Skipped[file] = err.Error()
+			continue
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	entry, err := zw.Create(archiveManifestName)
+	if err == nil {
+		b, _ := json.MarshalIndent(manifest, "", "  ")
+		entry.Write(b)
+	}
+	err = zw.Close()
+	if err != nil {
+		// the status is already out, all we can do is cut the response short
+		slog.Warn("Archive interrupted", "err", err)
+	}
+}
+
+// archiveFile writes fileName into zw as entry, from the pending combined write or the cache
+// if either has it, otherwise straight from storage. It holds the file's read lock throughout,
+// like a GET. A file that fails partway has a truncated entry, there's no taking it back.
+func archiveFile(ctx context.Context, zw *zip.Writer, entry string, fileName string) error {
+	lockCtx, cancel := context.WithTimeout(ctx, cfg().lockTimeout)
+	err := fileLocks.get(fileName).RLock(lockCtx)
+	cancel()
+	if err != nil {
+		return errors.New("timed out waiting for file lock")
+	}
+	defer fileLocks.get(fileName).RUnlock()
+
+	bodyBytes, meta, pending := fileOps.pendingWrite(fileName)
+	if !pending {
+		bodyBytes, meta, err = cacheGet(ctx, fileName)
+	}
+	var body io.Reader
+	if pending || err == nil {
+		body = bytes.NewReader(bodyBytes)
+	} else {
+		stored, storedMeta, err := store.Get(ctx, fileName)
+		if err != nil {
+			return err
+		}
+		defer stored.Close()
+		body, meta = stored, storedMeta
+	}
+
+	header := &zip.FileHeader{Name: entry, Method: zip.Deflate, Modified: meta.Modified}
+	if header.Modified.IsZero() {
+		header.Modified = time.Now()
+	}
+	dst, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, body)
+	return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	mr, srv := newTestServer(t)
+	do(t, "PUT", srv.URL+"/api/fileserver/one", "first")
+	do(t, "PUT", srv.URL+"/api/fileserver/two", "second file")
+	waitForWrites(t)
+	mr.Del(bodyKey("two")) // so one entry is copied from storage
+
+	resp, body := do(t, "POST", srv.URL+"/api/fileserver/archive", `{"files":["one","two","nope","bad/name","one"]}`)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/zip" {
+		t.Fatalf("archive: got %d as %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	zr, err := zip.NewReader(strings.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	entries := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		names = append(names, f.Name)
+		entries[f.Name] = string(b)
+	}
+	// each file once, in the order asked for, then the manifest
+	if want := []string{"one", "two", archiveManifestName}; !slices.Equal(names, want) {
+		t.Fatalf("entries %q, want %q", names, want)
+	}
+	if entries["one"] != "first" || entries["two"] != "second file" {
+		t.Fatalf("entries one %q and two %q", entries["one"], entries["two"])
+	}
+
+	var manifest archiveManifest
+	if err := json.Unmarshal([]byte(entries[archiveManifestName]), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(manifest.Files, []string{"one", "two"}) || manifest.Skipped["nope"] != "file not found" || manifest.Skipped["bad/name"] == "" {
+		t.Fatalf("manifest: %s", entries[archiveManifestName])
+	}
+}
+
+func TestArchiveBadRequests(t *testing.T) {
+	_, srv := newTestServer(t)
+	tooMany := `{"files":["f"` + strings.Repeat(`,"f"`, maxArchiveFiles) + `]}`
+	for _, body := range []string{"", "{}", `{"files":[]}`, "not json", tooMany} {
+		if resp, _ := do(t, "POST", srv.URL+"/api/fileserver/archive", body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("archive %.20q: got %d, want 400", body, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Batch endpoints answer every item on its own. The body is always
+//
+//	{"results": {"<name>": {"status": 200, ...}}, "summary": {"total": 3, "succeeded": 2, "failed": 1}}
+//
+// with each item's status the one a single-file request would have got, plus any
+// endpoint-specific fields and an "error" message for failures. An item fails when its status is
+// 400 or above. The response is a 200 when every item succeeded and a 207 Multi-Status when any
+// failed. Problems with the request as a whole, like a body that isn't JSON, are plain errors.
+
+// batchItem is one name's result in a batch response
+type batchItem struct {
+	Status int    `json:"status"`
+	Exists *bool  `json:"exists,omitempty"`
+	Action string `json:"action,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type batchSummary struct {
+	Total     int `json:"total"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+}
+
+type batchResponse struct {
+	Results map[string]batchItem `json:"results"`
+	Summary batchSummary         `json:"summary"`
+}
+
+// batchFailure is an item that failed with status
+func batchFailure(status int, err error) batchItem {
+	return batchItem{Status: status, Error: err.Error()}
+}
+
+func writeBatch(w http.ResponseWriter, results map[string]batchItem) {
+	resp := batchResponse{Results: results, Summary: batchSummary{Total: len(results)}}
+	for _, item := range results {
+		if item.Status >= 400 {
+			resp.Summary.Failed++
+		} else {
+			resp.Summary.Succeeded++
+		}
+	}
+
+	status := http.StatusOK
+	if resp.Summary.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	yes := true
+	tests := []struct {
+		name    string
+		results map[string]batchItem
+		status  int
+		summary batchSummary
+	}{
+		{"all succeeded", map[string]batchItem{"a": {Status: http.StatusOK, Exists: &yes}, "b": {Status: http.StatusOK}}, http.StatusOK, batchSummary{2, 2, 0}},
+		{"mixed", map[string]batchItem{
+			"a": {Status: http.StatusOK},
+			"b": batchFailure(http.StatusNotFound, errNotFound),
+			"c": batchFailure(http.StatusBadGateway, errors.New("fileserver down")),
+		}, http.StatusMultiStatus, batchSummary{3, 1, 2}},
+		{"empty", map[string]batchItem{}, http.StatusOK, batchSummary{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeBatch(w, tt.results)
+
+			var got batchResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tt.status || got.Summary != tt.summary {
+				t.Fatalf("got %d with %+v, want %d with %+v", w.Code, got.Summary, tt.status, tt.summary)
+			}
+			for name, want := range tt.results {
+				if item := got.Results[name]; item.Status != want.Status || item.Error != want.Error {
+					t.Errorf("%s: got %+v, want %+v", name, item, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errBreakerOpen = errors.New("fileserver shard's circuit breaker is open")
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitBreaker stops sending requests to a shard after BREAKER_FAILURES failures in a row, so
+// a dead fileserver fails fast instead of holding every request to it for the client timeout.
+// After BREAKER_COOLDOWN it goes half-open and lets a single probe request through, failing the
+// rest fast until the probe's answer closes it or trips it for another cooldown. Unreachable
+// shards and 5xx answers count as failures, anything else the fileserver says is it working.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    string
+	failures int         // in a row, since the last success
+	lastTrip time.Time   // zero until it first opens
+	probing  atomic.Bool // a half-open probe is out and hasn't been answered yet
+}
+
+// allow reports whether a request may go to the shard now, and whether it's the half-open probe
+func (b *circuitBreaker) allow() (ok bool, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.lastTrip) < cfg().breakerCooldown {
+			return false, false
+		}
+		b.state = breakerHalfOpen
+		fallthrough
+	case breakerHalfOpen:
+		probe = b.probing.CompareAndSwap(false, true)
+		return probe, probe
+	}
+	return true, false
+}
+
+// abandon frees the probe slot for a probe that went out but won't be counted, so the next
+// request can probe instead
+func (b *circuitBreaker) abandon() {
+	b.probing.Store(false)
+}
+
+// record counts a request's outcome, shard is only for the log
+func (b *circuitBreaker) record(shard uint32, failed bool) {
+	limit := cfg().breakerFailures
+	if limit <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing.Store(false)
+	if !failed {
+		b.failures = 0
+		b.state = breakerClosed
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state != breakerOpen && b.failures >= limit) {
+		b.state = breakerOpen
+		b.lastTrip = time.Now()
+		slog.Warn("Shard circuit breaker opened", "shard", shard, "failures", b.failures)
+	}
+}
+
+// reset force-closes the breaker, for POST /admin/breakers/{shard}/reset
+func (b *circuitBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing.Store(false)
+}
+
+// breakerStatus is one shard's entry in GET /admin/breakers
+type breakerStatus struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	LastTrip string `json:"lastTrip,omitempty"`
+}
+
+func (b *circuitBreaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := breakerStatus{State: b.state, Failures: b.failures}
+	if status.State == "" {
+		status.State = breakerClosed
+	}
+	if !b.lastTrip.IsZero() {
+		status.LastTrip = b.lastTrip.UTC().Format(time.RFC3339)
+	}
+	return status
+}
+
+// do sends req to shard unless its breaker is open, counting the outcome against it. A request
+// the caller gave up on says nothing about the shard, so it isn't counted either way.
+func (s *httpStorage) do(req *http.Request, shard uint32) (*http.Response, error) {
+	b := &s.breakers[shard]
+	ok, probe := b.allow()
+	if !ok {
+		return nil, fmt.Errorf("shard %d: %w", shard, errBreakerOpen)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil && req.Context().Err() != nil {
+		if probe {
+			b.abandon()
+		}
+		return nil, err
+	}
+	b.record(shard, err != nil || resp.StatusCode >= 500)
+	return resp, err
+}
+
+// breakerShards are the shards requests go to, just shard 0 with sharding off
+func breakerShards() []uint32 {
+	if !cfg().shardingEnabled {
+		return []uint32{0}
+	}
+	shards := make([]uint32, 0, shardCount)
+	for shard := uint32(1); shard <= shardCount; shard++ {
+		shards = append(shards, shard)
+	}
+	return shards
+}
+
+// breakersHandler answers GET /admin/breakers with every shard's breaker, keyed by shard number.
+// Like draining, the state is this replica's alone.
+func breakersHandler(w http.ResponseWriter, r *http.Request) {
+	hs, ok := httpBackend()
+	if !ok {
+		http.Error(w, "circuit breakers need STORAGE=http", http.StatusNotImplemented)
+		return
+	}
+
+	shards := map[string]breakerStatus{}
+	for _, shard := range breakerShards() {
+		shards[strconv.Itoa(int(shard))] = hs.breakers[shard].status()
+	}
+	b, _ := json.Marshal(map[string]any{"shards": shards})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// resetBreakerHandler answers POST /admin/breakers/{shard}/reset, closing the shard's breaker
+// without waiting out BREAKER_COOLDOWN
+func resetBreakerHandler(w http.ResponseWriter, r *http.Request) {
+	hs, ok := httpBackend()
+	if !ok {
+		http.Error(w, "circuit breakers need STORAGE=http", http.StatusNotImplemented)
+		return
+	}
+	first, last := uint64(1), uint64(shardCount)
+	if !cfg().shardingEnabled {
+		first, last = 0, 0
+	}
+	shard, err := strconv.ParseUint(r.PathValue("shard"), 10, 32)
+	if err != nil || shard < first || shard > last {
+		http.Error(w, fmt.Sprintf("shard must be from %d to %d", first, last), http.StatusBadRequest)
+		return
+	}
+
+	hs.breakers[shard].reset()
+	slog.Info("Shard circuit breaker reset", "shard", shard)
+
+	b, _ := json.Marshal(map[string]any{"shard": shard, "breaker": hs.breakers[shard].status()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBreakerAdmin(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", backend.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	t.Setenv("BREAKER_FAILURES", "2")
+	t.Setenv("BREAKER_COOLDOWN", "1h")
+	t.Setenv("ADMIN_TOKEN", "secret")
+	// one backend request per GET, so the failures can be counted
+	t.Setenv("BACKEND_RETRIES", "0")
+	_, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/a.txt"
+	auth := []string{"Authorization", "Bearer secret"}
+
+	breaker := func() breakerStatus {
+		t.Helper()
+		resp, body := do(t, "GET", srv.URL+"/admin/breakers", "", auth...)
+		var got struct {
+			Shards map[string]breakerStatus `json:"shards"`
+		}
+		if err := json.Unmarshal([]byte(body), &got); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /admin/breakers: got %d %q: %v", resp.StatusCode, body, err)
+		}
+		return got.Shards["0"]
+	}
+
+	if resp, _ := do(t, "GET", srv.URL+"/admin/breakers", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("without the admin token: got %d, want 401", resp.StatusCode)
+	}
+	if got := breaker(); got.State != breakerClosed || got.Failures != 0 {
+		t.Fatalf("before any failures: %+v", got)
+	}
+
+	do(t, "GET", u, "")
+	do(t, "GET", u, "")
+	got := breaker()
+	if got.State != breakerOpen || got.Failures != 2 || got.LastTrip == "" {
+		t.Fatalf("after two failures: %+v", got)
+	}
+	// open, so the shard isn't asked at all
+	if resp, _ := do(t, "GET", u, ""); resp.StatusCode != http.StatusServiceUnavailable || hits.Load() != 2 {
+		t.Fatalf("with the breaker open: got %d after %d backend requests", resp.StatusCode, hits.Load())
+	}
+
+	if resp, _ := do(t, "POST", srv.URL+"/admin/breakers/1/reset", "", auth...); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("reset of a shard not in use: got %d, want 400", resp.StatusCode)
+	}
+	if resp, body := do(t, "POST", srv.URL+"/admin/breakers/0/reset", "", auth...); resp.StatusCode != http.StatusOK {
+		t.Fatalf("reset: got %d %q", resp.StatusCode, body)
+	}
+	if got := breaker(); got.State != breakerClosed || got.Failures != 0 {
+		t.Fatalf("after a reset: %+v", got)
+	}
+	do(t, "GET", u, "")
+	if hits.Load() != 3 {
+		t.Fatal("reset breaker still failing requests without asking the shard")
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	t.Setenv("BREAKER_FAILURES", "1")
+	t.Setenv("BREAKER_COOLDOWN", "0s")
+	current.Store(loadConfig())
+	var b circuitBreaker
+
+	b.record(1, true)
+	if got := b.status(); got.State != breakerOpen {
+		t.Fatalf("after a failure: %+v", got)
+	}
+	// the cooldown is over straight away, so the next request is let through to decide
+	if ok, probe := b.allow(); !ok || !probe || b.status().State != breakerHalfOpen {
+		t.Fatalf("after the cooldown: %+v", b.status())
+	}
+	// and only that one, the rest fail fast until it's answered
+	if ok, _ := b.allow(); ok {
+		t.Fatal("second request let through while the probe is out")
+	}
+	// a probe the caller gave up on says nothing, so another request gets to probe
+	b.abandon()
+	if ok, probe := b.allow(); !ok || !probe {
+		t.Fatal("no new probe after the first was abandoned")
+	}
+	b.record(1, true)
+	if got := b.status(); got.State != breakerOpen {
+		t.Fatalf("after a failed trial: %+v", got)
+	}
+	b.allow()
+	b.record(1, false)
+	if got := b.status(); got.State != breakerClosed || got.Failures != 0 {
+		t.Fatalf("after a successful trial: %+v", got)
+	}
+}
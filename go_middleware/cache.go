@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+// bodyKey is where a file's bytes are cached. It has a prefix like every other per-file key, so no
+// file name can land on the bookkeeping kept for another.
+func bodyKey(fileName string) string {
+	return "file:" + fileName
+}
+
+// dropLegacyBody deletes a body cached under its bare file name, where bodies went before bodyKey
+// had a prefix. Nothing reads them any more, so each is dropped the next time its file is written
+// or invalidated rather than left to take up memory. Only string keys are touched, and names with
+// a colon are skipped: their bare key may be bookkeeping for another file, like a lock or counter.
+// This can go once the cache has turned over since the prefix was added.
+var dropLegacyBody = redis.NewScript(`
+if redis.call("TYPE", KEYS[1]).ok == "string" then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// dropLegacyBodyIn queues dropLegacyBody for fileName on pipe, if its bare name is safe to drop
+func dropLegacyBodyIn(ctx context.Context, pipe redis.Pipeliner, fileName string) {
+	if !strings.Contains(fileName, ":") {
+		dropLegacyBody.Eval(ctx, pipe, []string{fileName})
+	}
+}
+
+// errCacheUnavailable fails a write the backend took but the cache couldn't, with REQUIRE_CACHE_ON_WRITE
+var errCacheUnavailable = errors.New("file was stored but the cache could not be updated")
+
+// metadata is cached in a redis hash next to the file's bytes
+func metaKey(fileName string) string {
+	return "meta:" + fileName
+}
+
+const metaFieldPrefix = "x-meta-"
+
+// cacheSet stores a file and its metadata together, for CACHE_TTL when it's set
+func cacheSet(ctx context.Context, fileName string, data []byte, meta fileMeta) error {
+	return cacheSetFetched(ctx, fileName, data, meta, 0)
+}
+
+// cacheSetFetched is cacheSet for a body that took fetchTime to load from storage, kept with the
+// entry so refreshDue knows how early to refresh it. 0 records nothing. Files matching
+// CACHE_EXCLUDE_PATTERNS are dropped instead, in case they were cached before the pattern was
+// added.
+func cacheSetFetched(ctx context.Context, fileName string, data []byte, meta fileMeta, fetchTime time.Duration) error {
+	if cacheExcluded(fileName) {
+		return cacheDel(ctx, fileName)
+	}
+
+	fields := map[string]string{}
+	if meta.ContentType != "" {
+		fields["contentType"] = meta.ContentType
+	}
+	for key, value := range meta.Metadata {
+		fields[metaFieldPrefix+key] = value
+	}
+	if len(meta.Encodings) > 0 {
+		fields["encodings"] = strings.Join(meta.Encodings, ",")
+	}
+	if !meta.Modified.IsZero() {
+		fields["modified"] = meta.Modified.UTC().Format(time.RFC3339Nano)
+	}
+	if fetchTime > 0 {
+		fields["fetchTime"] = strconv.FormatInt(fetchTime.Microseconds(), 10)
+	}
+	// with CACHE_COMPRESSION the body is kept gzipped, unless that doesn't make it any smaller
+	if cfg().cacheCompression {
+		compressed, err := compressBytes("gzip", data)
+		if err == nil && len(compressed) < len(data) {
+			data = compressed
+			fields["cacheEncoding"] = "gzip"
+		}
+	}
+
+	ttl := cacheTTL()
+	pipe := redisClient.TxPipeline()
+	pipe.Set(ctx, bodyKey(fileName), data, ttl)
+	pipe.Del(ctx, metaKey(fileName), missingKey(fileName))
+	dropLegacyBodyIn(ctx, pipe, fileName)
+	if len(fields) > 0 {
+		pipe.HSet(ctx, metaKey(fileName), fields)
+		if ttl > 0 {
+			pipe.PExpire(ctx, metaKey(fileName), ttl)
+		}
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// cacheTTL is how long a new cache entry lives, CACHE_TTL moved by a random amount of up to
+// CACHE_TTL_JITTER percent either way, so files written together don't all expire together
+// and send their misses to the backend at once. 0 keeps entries until they're replaced.
+func cacheTTL() time.Duration {
+	ttl := cfg().cacheTTL
+	if ttl <= 0 || cfg().cacheTTLJitter <= 0 {
+		return ttl
+	}
+	spread := float64(ttl) * float64(min(cfg().cacheTTLJitter, 100)) / 100
+	return ttl + time.Duration((rand.Float64()*2-1)*spread)
+}
+
+// cacheable reports whether files of contentType may be kept in redis. With no
+// CACHEABLE_CONTENT_TYPES everything is, otherwise the media type has to match an entry
+// exactly or a "type/*" one. Files without a content type only match "*/*".
+func cacheable(contentType string) bool {
+	if len(cfg().cacheableTypes) == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ""
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	for _, allowed := range cfg().cacheableTypes {
+		if allowed == "*/*" || allowed == mediaType || (mediaType != "" && allowed == major+"/*") {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheExcluded reports whether fileName matches one of CACHE_EXCLUDE_PATTERNS, globs like
+// "*.tmp" matched against the name without any tenant scope
+func cacheExcluded(fileName string) bool {
+	name := unscoped(fileName)
+	for _, pattern := range cfg().cacheExcludePatterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseGlobList splits CACHE_EXCLUDE_PATTERNS, e.g. "*.lock, *.tmp"
+func parseGlobList(list string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if _, err := path.Match(pattern, ""); pattern != "" && err == nil {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// parseMediaTypeList splits CACHEABLE_CONTENT_TYPES, e.g. "application/json, text/*"
+func parseMediaTypeList(list string) []string {
+	var types []string
+	for _, t := range strings.Split(list, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// readRepair loads fileName like loadFile, caching it on a miss. With CACHE_ON_WRITE off this is
+// the only way a file gets into the cache, so only ones that are read take up memory, and with
+// CACHE_TTL it's how expired entries come back. Callers hold the file's read lock, no write can
+// land between the fetch and the SET.
+func readRepair(ctx context.Context, fileName string) ([]byte, fileMeta, error) {
+	bodyBytes, meta, err := cacheGet(ctx, fileName)
+	if err == nil {
+		return bodyBytes, meta, nil
+	}
+	slog.Debug("Cache Miss!", "file", fileName)
+	return refill(ctx, fileName)
+}
+
+// refills shares one backend fetch and cache SET between concurrent refills of a file
+var refills singleflight.Group
+
+// refill fetches fileName from storage and caches it, timing the fetch for refreshDue. Callers
+// hold the file's read lock, no write can land between the fetch and the SET.
+func refill(ctx context.Context, fileName string) ([]byte, fileMeta, error) {
+	result, err, _ := refills.Do(fileName, func() (interface{}, error) {
+		start := time.Now()
+		body, meta, err := store.Get(context.WithoutCancel(ctx), fileName)
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+
+		bodyBytes, err := io.ReadAll(body)
+		if err != nil {
+			return nil, fmt.Errorf("reading fileserver body: %w", err)
+		}
+		if cacheable(meta.ContentType) {
+			err = cacheSetFetched(ctx, fileName, bodyBytes, meta, time.Since(start))
+			if err != nil {
+				slog.Error("Redis SET error", "file", fileName, "err", err)
+			}
+		}
+		return loadedFile{bodyBytes: bodyBytes, meta: meta}, nil
+	})
+	if err != nil {
+		return nil, fileMeta{}, err
+	}
+
+	loaded := result.(loadedFile)
+	return loaded.bodyBytes, loaded.meta, nil
+}
+
+// loadFresh is getFile's read with CACHE_TTL. A miss, which is how an expired entry looks, is
+// refilled from storage, and a hit close to expiry is refreshed early by one request while every
+// other one keeps serving the cached copy, so a busy file is never missing from the cache for
+// all its readers at once. Callers hold the file's read lock.
+func loadFresh(ctx context.Context, fileName string) ([]byte, fileMeta, error) {
+	bodyBytes, meta, err := cacheGet(ctx, fileName)
+	if err != nil {
+		slog.Debug("Cache Miss!", "file", fileName)
+		return refill(ctx, fileName)
+	}
+	if fresh, freshMeta, refreshed := refreshEarly(ctx, fileName); refreshed {
+		return fresh, freshMeta, nil
+	}
+	return bodyBytes, meta, nil
+}
+
+// refreshEarly refills fileName's cache entry after a hit when refreshDue says it's time, and
+// refreshed is true with the new copy if it did. Only the request that claims the refresh does
+// it, the others keep what they read. Callers hold the file's read lock.
+func refreshEarly(ctx context.Context, fileName string) (bodyBytes []byte, meta fileMeta, refreshed bool) {
+	ttl, due := refreshDue(ctx, fileName)
+	if !due {
+		return nil, fileMeta{}, false
+	}
+	// one refresh at a time across replicas, for no longer than the entry has left
+	claimed, err := redisClient.SetNX(ctx, refreshKey(fileName), 1, ttl).Result()
+	if err != nil || !claimed {
+		return nil, fileMeta{}, false
+	}
+	defer redisClient.Del(ctx, refreshKey(fileName))
+
+	bodyBytes, meta, err = refill(ctx, fileName)
+	if err != nil {
+		// what's cached is still good until it expires
+		slog.Warn("Could not refresh cache entry early", "file", fileName, "err", err)
+		return nil, fileMeta{}, false
+	}
+	slog.Debug("Refreshed cache entry early", "file", fileName, "ttl", ttl)
+	return bodyBytes, meta, true
+}
+
+func refreshKey(fileName string) string {
+	return "refresh:" + fileName
+}
+
+// refreshDue decides whether to refresh a cached file early, with XFetch: the chance rises as
+// the entry nears expiry, and starts sooner for files that were slow to fetch. Entries cached
+// from a write have no fetch time and simply expire. ttl is what the entry has left.
+func refreshDue(ctx context.Context, fileName string) (ttl time.Duration, due bool) {
+	pipe := redisClient.Pipeline()
+	ttlCmd := pipe.PTTL(ctx, bodyKey(fileName))
+	fetchCmd := pipe.HGet(ctx, metaKey(fileName), "fetchTime")
+	pipe.Exec(ctx)
+
+	ttl = ttlCmd.Val()
+	micros, err := fetchCmd.Int64()
+	if err != nil || ttl <= 0 {
+		return 0, false
+	}
+	fetchTime := time.Duration(micros) * time.Microsecond
+	return ttl, float64(fetchTime)*-math.Log(rand.Float64()) >= float64(ttl)
+}
+
+// cacheGet returns a cached file and its metadata. A miss is reported as redis.Nil, which is
+// all an excluded file ever gets, without asking redis. A nil error is a hit even when the body
+// is empty, an empty file is cached as an empty string, so callers test err and never the bytes.
+func cacheGet(ctx context.Context, fileName string) ([]byte, fileMeta, error) {
+	bodyBytes, gzipped, meta, err := cacheGetEncoded(ctx, fileName)
+	if err != nil || !gzipped {
+		return bodyBytes, meta, err
+	}
+	bodyBytes, err = gunzipBytes(bodyBytes)
+	if err != nil {
+		return nil, fileMeta{}, fmt.Errorf("decompressing cached body: %w", err)
+	}
+	return bodyBytes, meta, nil
+}
+
+// cacheGetEncoded is cacheGet with a CACHE_COMPRESSION entry left gzipped, gzipped says if it is
+func cacheGetEncoded(ctx context.Context, fileName string) (bodyBytes []byte, gzipped bool, meta fileMeta, err error) {
+	if cacheExcluded(fileName) {
+		return nil, false, fileMeta{}, redis.Nil
+	}
+
+	pipe := redisClient.Pipeline()
+	bodyCmd := pipe.Get(ctx, bodyKey(fileName))
+	metaCmd := pipe.HGetAll(ctx, metaKey(fileName))
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		return nil, false, fileMeta{}, err
+	}
+
+	bodyBytes, _ = bodyCmd.Bytes()
+	for field, value := range metaCmd.Val() {
+		if field == "contentType" {
+			meta.ContentType = value
+		} else if field == "encodings" {
+			meta.Encodings = strings.Split(value, ",")
+		} else if field == "modified" {
+			meta.Modified, _ = time.Parse(time.RFC3339Nano, value)
+		} else if field == "cacheEncoding" {
+			gzipped = value == "gzip"
+		} else if key, ok := strings.CutPrefix(field, metaFieldPrefix); ok {
+			if meta.Metadata == nil {
+				meta.Metadata = make(map[string]string)
+			}
+			meta.Metadata[key] = value
+		}
+	}
+	return bodyBytes, gzipped, meta, nil
+}
+
+// cacheDel drops a file and its metadata from the cache, along with any remembered miss
+func cacheDel(ctx context.Context, fileName string) error {
+	pipe := redisClient.TxPipeline()
+	pipe.Del(ctx, bodyKey(fileName), metaKey(fileName), missingKey(fileName))
+	dropLegacyBodyIn(ctx, pipe, fileName)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// a backend 404 is remembered under its own key, so it can't be mistaken for an empty file
+func missingKey(fileName string) string {
+	return "missing:" + fileName
+}
+
+// knownMissing is true when NEGATIVE_CACHE_ENABLED has remembered the backend saying fileName
+// isn't there. Every write goes through cacheSet or cacheDel, which forget it.
+func knownMissing(ctx context.Context, fileName string) bool {
+	if !negativeCacheOn(ctx) || cacheExcluded(fileName) {
+		return false
+	}
+	n, err := redisClient.Exists(ctx, missingKey(fileName)).Result()
+	if err != nil {
+		slog.Error("Redis EXISTS error", "file", fileName, "err", err)
+	}
+	return n > 0
+}
+
+// rememberMissing records a backend 404 for NEGATIVE_CACHE_TTL
+func rememberMissing(ctx context.Context, fileName string) {
+	if !negativeCacheOn(ctx) || cacheExcluded(fileName) {
+		return
+	}
+	err := redisClient.Set(ctx, missingKey(fileName), "", cfg().negativeCacheTTL).Err()
+	if err != nil {
+		slog.Error("Redis SET error", "file", fileName, "err", err)
+	}
+}
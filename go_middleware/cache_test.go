@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheableContentTypes(t *testing.T) {
+	// on write, or from read repair on the first miss
+	for _, onWrite := range []string{"true", "false"} {
+		t.Run("CACHE_ON_WRITE="+onWrite, func(t *testing.T) {
+			t.Setenv("CACHEABLE_CONTENT_TYPES", "application/json, text/*")
+			t.Setenv("CACHE_ON_WRITE", onWrite)
+			mr, srv := newTestServer(t)
+			do(t, "PUT", srv.URL+"/api/fileserver/a.json", `{"a":1}`, "Content-Type", "application/json")
+			do(t, "PUT", srv.URL+"/api/fileserver/blob.bin", "\x00\x01", "Content-Type", "application/octet-stream")
+			waitForWrites(t)
+
+			resp, body := do(t, "GET", srv.URL+"/api/fileserver/blob.bin", "")
+			if resp.StatusCode != http.StatusOK || body != "\x00\x01" || resp.Header.Get("X-Cache") != "BYPASS" {
+				t.Fatalf("uncacheable GET: got %d %q, X-Cache %q", resp.StatusCode, body, resp.Header.Get("X-Cache"))
+			}
+			if resp, _ := do(t, "GET", srv.URL+"/api/fileserver/a.json", ""); resp.Header.Get("X-Cache") == "BYPASS" {
+				t.Fatal("cacheable GET marked BYPASS")
+			}
+			if !mr.Exists(bodyKey("a.json")) || mr.Exists(bodyKey("blob.bin")) {
+				t.Fatalf("cache keys: %v, want a.json and not blob.bin", mr.Keys())
+			}
+		})
+	}
+}
+
+// fetchCountingStorage counts Gets, each taking delay, like a backend that's slow to read from
+type fetchCountingStorage struct {
+	Storage
+	delay time.Duration
+	gets  atomic.Int32
+}
+
+func (s *fetchCountingStorage) Get(ctx context.Context, name string) (io.ReadCloser, fileMeta, error) {
+	s.gets.Add(1)
+	time.Sleep(s.delay)
+	return s.Storage.Get(ctx, name)
+}
+
+func TestCacheTTLRefill(t *testing.T) {
+	t.Setenv("CACHE_TTL", "10s")
+	t.Setenv("CACHE_TTL_JITTER", "0")
+	mr, srv := newTestServer(t)
+	counting := &fetchCountingStorage{Storage: store}
+	store = counting
+	u := srv.URL + "/api/fileserver/a.txt"
+	do(t, "PUT", u, "v1")
+	waitForWrites(t)
+
+	// once expired, the next read puts the file back
+	mr.FastForward(11 * time.Second)
+	if mr.Exists(bodyKey("a.txt")) {
+		t.Fatal("entry outlived CACHE_TTL")
+	}
+	do(t, "GET", u, "")
+	if !mr.Exists(bodyKey("a.txt")) || counting.gets.Load() != 1 {
+		t.Fatalf("after a miss: cached %v, %d backend reads", mr.Exists(bodyKey("a.txt")), counting.gets.Load())
+	}
+	if ttl := mr.TTL(bodyKey("a.txt")); ttl <= 0 || ttl > 10*time.Second {
+		t.Fatalf("refilled entry has TTL %v", ttl)
+	}
+}
+
+func TestCacheEarlyRefresh(t *testing.T) {
+	t.Setenv("CACHE_TTL", "10s")
+	t.Setenv("CACHE_TTL_JITTER", "0")
+	mr, srv := newTestServer(t)
+	counting := &fetchCountingStorage{Storage: store, delay: 50 * time.Millisecond}
+	store = counting
+	u := srv.URL + "/api/fileserver/a.txt"
+	if err := store.Put(t.Context(), "a.txt", strings.NewReader("hot"), fileMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	do(t, "GET", u, "")
+	if counting.gets.Load() != 1 {
+		t.Fatalf("%d backend reads filling the cache, want 1", counting.gets.Load())
+	}
+
+	// a millisecond left against a 50ms fetch, so nearly every reader wants to refresh
+	mr.FastForward(10*time.Second - time.Millisecond)
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Go(func() {
+			if resp, body := do(t, "GET", u, ""); resp.StatusCode != http.StatusOK || body != "hot" {
+				t.Errorf("near expiry: got %d %q", resp.StatusCode, body)
+			}
+		})
+	}
+	wg.Wait()
+	if n := counting.gets.Load(); n != 2 {
+		t.Fatalf("%d backend reads, want 1 early refresh", n-1)
+	}
+	if ttl := mr.TTL(bodyKey("a.txt")); ttl < 9*time.Second {
+		t.Fatalf("refreshed entry has TTL %v", ttl)
+	}
+}
+
+func TestCacheExcludePatterns(t *testing.T) {
+	t.Setenv("CACHE_EXCLUDE_PATTERNS", "*.tmp, *.lock")
+	t.Setenv("RANGE_CACHE_MODE", rangeCacheRange)
+	mr, srv := newTestServer(t)
+	do(t, "PUT", srv.URL+"/api/fileserver/x.tmp", "scratch")
+	do(t, "PUT", srv.URL+"/api/fileserver/x.json", "{}")
+	waitForWrites(t)
+
+	resp, body := do(t, "GET", srv.URL+"/api/fileserver/x.tmp", "")
+	if body != "scratch" || resp.Header.Get("X-Cache") != "BYPASS" {
+		t.Fatalf("excluded GET: got %q, X-Cache %q", body, resp.Header.Get("X-Cache"))
+	}
+	if resp, body := do(t, "GET", srv.URL+"/api/fileserver/x.tmp", "", "Range", "bytes=0-2"); body != "scr" || resp.Header.Get("X-Cache") != "BYPASS" {
+		t.Fatalf("excluded range: got %q, X-Cache %q", body, resp.Header.Get("X-Cache"))
+	}
+	// version counters are bookkeeping, not a cached copy
+	for _, key := range mr.Keys() {
+		if strings.Contains(key, "x.tmp") && !strings.HasPrefix(key, "version") {
+			t.Fatalf("excluded file cached under %q", key)
+		}
+	}
+
+	if !mr.Exists(bodyKey("x.json")) {
+		t.Fatalf("cache keys %v, want x.json", mr.Keys())
+	}
+	if resp, _ := do(t, "GET", srv.URL+"/api/fileserver/x.json", ""); resp.Header.Get("X-Cache") != "" {
+		t.Fatalf("cached file marked X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+}
+
+func TestCacheExcludePatternsByTenant(t *testing.T) {
+	t.Setenv("MULTI_TENANT", "true")
+	// anchored at the start, so it only matches once the tenant scope is off
+	t.Setenv("CACHE_EXCLUDE_PATTERNS", "lock-*")
+	mr, srv := newTestServer(t)
+	do(t, "PUT", srv.URL+"/api/fileserver/lock-1", "held", tenantHeader, "acme")
+	waitForWrites(t)
+
+	resp, body := do(t, "GET", srv.URL+"/api/fileserver/lock-1", "", tenantHeader, "acme")
+	if body != "held" || resp.Header.Get("X-Cache") != "BYPASS" {
+		t.Fatalf("excluded tenant GET: got %q, X-Cache %q", body, resp.Header.Get("X-Cache"))
+	}
+	if mr.Exists(bodyKey("tenant:acme:lock-1")) {
+		t.Fatalf("excluded tenant file cached: %v", mr.Keys())
+	}
+}
+
+func TestEmptyFileIsACacheHit(t *testing.T) {
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/empty.txt"
+	if resp, _ := do(t, "PUT", u, ""); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: got %d, want 201", resp.StatusCode)
+	}
+	waitForWrites(t)
+	if v, err := mr.Get(bodyKey("empty.txt")); err != nil || v != "" {
+		t.Fatalf("empty file not cached: %q, %v", v, err)
+	}
+
+	// with the backend copy gone only a hit can answer
+	if err := store.Delete(context.Background(), "empty.txt"); err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{"GET", "HEAD"} {
+		resp, body := do(t, method, u, "")
+		if resp.StatusCode != http.StatusOK || body != "" || resp.Header.Get("Content-Length") != "0" {
+			t.Fatalf("%s: got %d %q, Content-Length %q", method, resp.StatusCode, body, resp.Header.Get("Content-Length"))
+		}
+	}
+}
+
+func TestCacheTTLJitter(t *testing.T) {
+	t.Setenv("CACHE_TTL", "100s")
+	t.Setenv("CACHE_TTL_JITTER", "20")
+	t.Setenv("RANGE_CACHE_MODE", rangeCacheRange)
+	mr, srv := newTestServer(t)
+	for i := range 30 {
+		do(t, "PUT", srv.URL+fmt.Sprintf("/api/fileserver/t%d", i), "hello", "X-Meta-Owner", "me")
+	}
+	waitForWrites(t)
+
+	inBand := func(ttl time.Duration) bool { return ttl >= 80*time.Second && ttl <= 120*time.Second }
+	distinct := map[time.Duration]bool{}
+	for i := range 30 {
+		name := fmt.Sprintf("t%d", i)
+		ttl := mr.TTL(bodyKey(name))
+		if !inBand(ttl) {
+			t.Fatalf("%s has TTL %v, want 100s ±20%%", name, ttl)
+		}
+		if meta := mr.TTL(metaKey(name)); meta != ttl {
+			t.Fatalf("%s has TTL %v but its metadata %v", name, ttl, meta)
+		}
+		distinct[ttl] = true
+	}
+	if len(distinct) < 10 {
+		t.Fatalf("only %d distinct TTLs over 30 writes", len(distinct))
+	}
+
+	// cached ranges expire too, their index no sooner than any of them
+	do(t, "GET", srv.URL+"/api/fileserver/t0", "", "Range", "bytes=0-1")
+	if ttl := mr.TTL(rangeCacheKey("t0", "bytes=0-1")); !inBand(ttl) {
+		t.Fatalf("cached range has TTL %v, want 100s ±20%%", ttl)
+	}
+	if ttl := mr.TTL(rangeIndexKey("t0")); ttl < 120*time.Second {
+		t.Fatalf("range index has TTL %v, want it to outlast its ranges", ttl)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	t.Setenv("NEGATIVE_CACHE_ENABLED", "true")
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/gone.txt"
+
+	for range 3 {
+		if resp, body := do(t, "GET", u, ""); resp.StatusCode != http.StatusNotFound || body != "File not found.\n" {
+			t.Fatalf("got %d %q", resp.StatusCode, body)
+		}
+	}
+	if n := fs.count(http.MethodGet); n != 1 || !mr.Exists(missingKey("gone.txt")) {
+		t.Fatalf("%d backend GETs for three misses, want 1 and a remembered 404", n)
+	}
+
+	do(t, "PUT", u, "here")
+	waitForWrites(t)
+	if mr.Exists(missingKey("gone.txt")) {
+		t.Fatal("404 still remembered after a write")
+	}
+	if _, body := do(t, "GET", u, ""); body != "here" {
+		t.Fatalf("after the write: got %q", body)
+	}
+}
+
+func TestNegativeCacheForRanges(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	t.Setenv("NEGATIVE_CACHE_ENABLED", "true")
+	t.Setenv("RANGE_CACHE_MODE", rangeCacheFull)
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/gone.txt"
+
+	for range 3 {
+		if resp, _ := do(t, "GET", u, "", "Range", "bytes=0-3"); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("got %d, want 404", resp.StatusCode)
+		}
+	}
+	if n := fs.count(http.MethodGet); n != 1 || !mr.Exists(missingKey("gone.txt")) {
+		t.Fatalf("%d backend GETs for three range misses, want 1 and a remembered 404", n)
+	}
+}
+
+func TestNotFoundFormats(t *testing.T) {
+	tests := []struct {
+		format, contentType, body string
+	}{
+		{notFoundPassthrough, "text/plain; charset=utf-8", "File not found.\n"},
+		{notFoundJSON, "application/json", `{"error":"file not found","status":404}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			t.Setenv("404_RESPONSE_FORMAT", tt.format)
+			_, srv := newTestServer(t)
+			resp, body := do(t, "GET", srv.URL+"/api/fileserver/none", "")
+			if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Content-Type") != tt.contentType || body != tt.body {
+				t.Fatalf("got %d %q %q", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+			}
+		})
+	}
+}
+
+func TestCacheOnWriteOff(t *testing.T) {
+	t.Setenv("CACHE_ON_WRITE", "false")
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/f"
+
+	do(t, "PUT", u, "one")
+	waitForWrites(t)
+	if mr.Exists(bodyKey("f")) {
+		t.Fatal("a PUT was cached with CACHE_ON_WRITE off")
+	}
+	// the first read caches it
+	if _, body := do(t, "GET", u, ""); body != "one" || !mr.Exists(bodyKey("f")) {
+		t.Fatalf("first GET: got %q, cached %v", body, mr.Exists(bodyKey("f")))
+	}
+
+	// an overwrite drops the old entry rather than leave it to be served
+	do(t, "PUT", u, "two")
+	waitForWrites(t)
+	if mr.Exists(bodyKey("f")) {
+		t.Fatal("an overwrite left the old body cached")
+	}
+	if _, body := do(t, "GET", u, ""); body != "two" {
+		t.Fatalf("GET after the overwrite: got %q, want two", body)
+	}
+	if got, _ := mr.Get(bodyKey("f")); got != "two" {
+		t.Fatalf("cached %q after the overwrite, want two", got)
+	}
+}
+
+func TestLegacyBodyKeysDropped(t *testing.T) {
+	mr, srv := newTestServer(t)
+	api := srv.URL + "/api/fileserver/"
+	// bodies cached before bodyKey had a prefix, and bookkeeping a bare name also lands on
+	mr.Set("a.txt", "old a")
+	mr.Set("b.txt", "old b")
+	mr.Set("versions:x.txt", "7")
+	mr.HSet("pointers", "f", "{}")
+
+	do(t, "PUT", api+"a.txt", "new a")
+	do(t, "DELETE", api+"b.txt", "")
+	do(t, "PUT", api+"versions:x.txt", "squatter")
+	do(t, "PUT", api+"pointers", "squatter")
+	waitForWrites(t)
+
+	if mr.Exists("a.txt") || mr.Exists("b.txt") {
+		t.Fatalf("legacy bodies kept: %v", mr.Keys())
+	}
+	if !mr.Exists("versions:x.txt") || !mr.Exists("pointers") {
+		t.Fatalf("bookkeeping dropped: %v", mr.Keys())
+	}
+}
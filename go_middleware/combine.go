@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// combinedWrite is a PUT held back for WRITE_COMBINE_WINDOW so PUTs to the same file arriving
+// behind it can replace its body instead of each making a backend round trip. Its fields are
+// guarded by fileOps.mu until the write starts. A PATCH arriving behind it is applied to the
+// body it holds, whose size is known, so the PATCH joins the same write. Once the write has
+// started a PATCH queues behind it as usual and ends its window for later PUTs.
+type combinedWrite struct {
+	ctx      context.Context
+	body     []byte
+	meta     fileMeta
+	version  int64
+	release  func() // frees body's share of MAX_INFLIGHT_BYTES
+	queued   time.Time
+	started  bool
+	combined int     // PUTs and PATCHes folded into this one after the first
+	folded   []int64 // versions whose bodies were replaced, which fail along with it
+}
+
+// flushCombined is closed once draining starts, cutting every combine window short
+var (
+	flushCombined     = make(chan struct{})
+	flushCombinedOnce sync.Once
+)
+
+func flushCombinedWrites() {
+	flushCombinedOnce.Do(func() { close(flushCombined) })
+}
+
+// enqueueCombined queues a PUT to be combined with the ones after it, run does the write once
+// the window is up. When the newest op on key's queue is a combined write that hasn't started,
+// write's body replaces the one it holds, which is released, and merged is true. Only the tail
+// is ever replaced, so a PUT never jumps a DELETE or anything else queued before it.
+func (q *fileQueues) enqueueCombined(key string, write *combinedWrite, run func(*combinedWrite)) (merged bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if fq, ok := q.queues[key]; ok && fq.combined != nil && !fq.combined.started {
+		pending := fq.combined
+		pending.release()
+		pending.folded = append(pending.folded, pending.version)
+		pending.ctx, pending.body, pending.meta, pending.version, pending.release = write.ctx, write.body, write.meta, write.version, write.release
+		pending.combined++
+		fq.putHash = hashBody(write.body)
+		return true
+	}
+
+	write.queued = time.Now()
+	fq := q.pushPut(key, hashBody(write.body), func() {
+		select {
+		case <-time.After(time.Until(write.queued.Add(cfg().writeCombineWindow))):
+		case <-flushCombined:
+		}
+		q.mu.Lock()
+		write.started = true
+		q.mu.Unlock()
+		run(write)
+	})
+	fq.combined = write
+	return false
+}
+
+// patchCombined applies a PATCH to the body a combined write is still holding back for key,
+// taking version as the write's own. held is false when there's no such write, the PATCH then
+// has to go through the queue. A range that doesn't fit the held body is errRangeNotSatisfiable,
+// size is the held body's length either way.
+func (q *fileQueues) patchCombined(key string, cr contentRange, patch []byte, version int64) (size int64, held bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	fq, ok := q.queues[key]
+	if !ok || fq.combined == nil || fq.combined.started {
+		return 0, false, nil
+	}
+	pending := fq.combined
+	size = int64(len(pending.body))
+	if cr.end >= size || (cr.size >= 0 && cr.size != size) {
+		return size, true, errRangeNotSatisfiable
+	}
+
+	// the held body may have been handed to a reader by pendingWrite
+	next := slices.Clone(pending.body)
+	copy(next[cr.start:], patch)
+	pending.folded = append(pending.folded, pending.version)
+	pending.body, pending.version = next, version
+	pending.meta.Encodings, pending.meta.Modified = nil, time.Now()
+	pending.combined++
+	fq.putHash = hashBody(next)
+	return size, true, nil
+}
+
+// pendingWrite is the newest body a combined PUT is still holding back for key, so reads see
+// it before the backend does
+func (q *fileQueues) pendingWrite(key string) ([]byte, fileMeta, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	fq, ok := q.queues[key]
+	if !ok || fq.combined == nil || fq.combined.started {
+		return nil, fileMeta{}, false
+	}
+	return fq.combined.body, fq.combined.meta, true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWriteCombining(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	t.Setenv("WRITE_COMBINE_WINDOW", "1s")
+	_, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/app.log"
+
+	content := ""
+	for i := range 10 {
+		content += strings.Repeat(string(rune('a'+i)), 3)
+		if resp, _ := do(t, "PUT", u, content); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("PUT %d: got %d, want 201", i, resp.StatusCode)
+		}
+	}
+
+	// still inside the window, reads come from the combined body
+	if _, body := do(t, "GET", u, ""); body != content {
+		t.Fatalf("GET during the window: got %q, want %q", body, content)
+	}
+	resp, body := do(t, "GET", u, "", "Range", "bytes=27-")
+	if resp.StatusCode != http.StatusPartialContent || body != "jjj" || resp.Header.Get("Content-Range") != "bytes 27-29/30" {
+		t.Fatalf("range during the window: got %d %q, Content-Range %q", resp.StatusCode, body, resp.Header.Get("Content-Range"))
+	}
+	if n := fs.count(http.MethodGet); n != 0 {
+		t.Fatalf("%d backend reads during the window, want none", n)
+	}
+
+	// draining cuts the window short
+	flushCombinedWrites()
+	waitForWrites(t)
+	if n := fs.count(http.MethodPut); n != 1 {
+		t.Fatalf("%d backend PUTs, want the 10 combined into 1", n)
+	}
+	if stored, _ := fs.file("/app.log"); stored != content {
+		t.Fatalf("backend has %q, want %q", stored, content)
+	}
+}
+
+func TestWriteCombiningFoldsPatches(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	t.Setenv("WRITE_COMBINE_WINDOW", "1s")
+	_, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/app.log"
+
+	do(t, "PUT", u, "..........")
+	for i := range 5 {
+		resp, body := do(t, "PATCH", u, "ab", "Content-Range", fmt.Sprintf("bytes %d-%d/*", 2*i, 2*i+1))
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Version") == "" {
+			t.Fatalf("PATCH %d: got %d %q", i, resp.StatusCode, body)
+		}
+	}
+	resp, _ := do(t, "PATCH", u, "xy", "Content-Range", "bytes 9-10/*")
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Content-Range") != "bytes */10" {
+		t.Fatalf("PATCH past the held body: got %d, Content-Range %q", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+	if _, body := do(t, "GET", u, ""); body != "ababababab" {
+		t.Fatalf("GET during the window: got %q", body)
+	}
+
+	flushCombinedWrites()
+	waitForWrites(t)
+	if n, reads := fs.count(http.MethodPut), fs.count(http.MethodGet); n != 1 || reads != 0 {
+		t.Fatalf("%d backend PUTs and %d GETs, want the PUT and PATCHes combined into 1 write", n, reads)
+	}
+	if stored, _ := fs.file("/app.log"); stored != "ababababab" {
+		t.Fatalf("backend has %q", stored)
+	}
+}
+
+func TestWriteCombiningKeepsDeleteOrder(t *testing.T) {
+	t.Setenv("WRITE_COMBINE_WINDOW", "20ms")
+	_, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/o.txt"
+	do(t, "PUT", u, "1")
+	do(t, "DELETE", u, "")
+	do(t, "PUT", u, "2")
+	waitForWrites(t)
+
+	if _, body := do(t, "GET", u, ""); body != "2" {
+		t.Fatalf("got %q, want the PUT after the DELETE", body)
+	}
+}
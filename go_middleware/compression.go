@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressionBest asks each algorithm for its best ratio, variants are compressed once and served many times
+const compressionBest = -1
+
+// encoding is a Content-Encoding we can store precompressed variants in
+type encoding struct {
+	suffix   string // appended to the file name for the variant, in the cache and storage
+	maxLevel int
+	writer   func(w io.Writer, level int) (io.WriteCloser, error)
+}
+
+var encodings = map[string]encoding{
+	"br": {suffix: ".br", maxLevel: brotli.BestCompression, writer: func(w io.Writer, level int) (io.WriteCloser, error) {
+		return brotli.NewWriterLevel(w, level), nil
+	}},
+	"gzip": {suffix: ".gz", maxLevel: gzip.BestCompression, writer: func(w io.Writer, level int) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, level)
+	}},
+	// http's "deflate" is the zlib format, not a raw deflate stream
+	"deflate": {suffix: ".zz", maxLevel: zlib.BestCompression, writer: func(w io.Writer, level int) (io.WriteCloser, error) {
+		return zlib.NewWriterLevel(w, level)
+	}},
+}
+
+// variantName is where a file's copy precompressed with enc lives, in both the cache and storage
+func variantName(fileName string, enc string) string {
+	return fileName + encodings[enc].suffix
+}
+
+// compressBytes compresses data with enc at COMPRESSION_LEVEL, clamped to what enc supports
+func compressBytes(enc string, data []byte) ([]byte, error) {
+	e := encodings[enc]
+	level := cfg().compressionLevel
+	if level == compressionBest || level > e.maxLevel {
+		level = e.maxLevel
+	}
+
+	var buf bytes.Buffer
+	zw, err := e.writer(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	_, err = zw.Write(data)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// parseEncodingList reads COMPRESSION_ALGO, a comma separated list in order of preference,
+// dropping anything we can't produce
+func parseEncodingList(list string) []string {
+	encs := []string{}
+	for _, enc := range strings.Split(list, ",") {
+		enc = strings.ToLower(strings.TrimSpace(enc))
+		if _, ok := encodings[enc]; ok {
+			encs = append(encs, enc)
+		}
+	}
+	return encs
+}
+
+const noCompressionHeader = "X-No-Compression"
+
+// compressionWanted is false when NO_COMPRESSION is on or the request sends X-No-Compression,
+// e.g. from a proxy that compresses responses itself, so it gets the plain file whatever its
+// Accept-Encoding says. Any value but a false one counts.
+func compressionWanted(r *http.Request) bool {
+	if cfg().noCompression {
+		return false
+	}
+	value, sent := r.Header[noCompressionHeader]
+	if !sent {
+		return true
+	}
+	off, err := strconv.ParseBool(strings.TrimSpace(value[0]))
+	return err == nil && !off
+}
+
+// negotiateEncoding picks the best of available for an Accept-Encoding header, by the client's
+// q-values and then our order of preference. An explicit entry wins over "*", q=0 refuses a
+// coding, and "" means the client should get the plain file.
+func negotiateEncoding(header string, available []string) string {
+	weights := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if found && strings.EqualFold(strings.TrimSpace(key), "q") {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if coding != "" {
+			weights[coding] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, enc := range available {
+		q, ok := weights[enc]
+		if !ok {
+			q = weights["*"]
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// loadOrServeCompressed is getFile's read with CACHE_COMPRESSION. A cache hit is read once, a
+// client that takes gzip is sent its bytes as they're stored and served is true, anyone else
+// gets them decompressed back for getFile to serve. Misses load like any other read, and with
+// CACHE_TTL a hit may be refreshed early like loadFresh's, getFile serving the new copy.
+func loadOrServeCompressed(w http.ResponseWriter, r *http.Request, fileName string) (bodyBytes []byte, meta fileMeta, served bool, err error) {
+	ctx := r.Context()
+	stored, gzipped, meta, err := cacheGetEncoded(ctx, fileName)
+	if err != nil {
+		if !cfg().cacheOnWrite || cfg().cacheTTL > 0 {
+			bodyBytes, meta, err = readRepair(ctx, fileName)
+		} else {
+			bodyBytes, meta, err = loadFile(ctx, fileName)
+		}
+		return bodyBytes, meta, false, err
+	}
+	// a hit still gets CACHE_TTL's early refresh, which hands back the new copy as it is
+	if cfg().cacheTTL > 0 {
+		if fresh, freshMeta, refreshed := refreshEarly(ctx, fileName); refreshed {
+			return fresh, freshMeta, false, nil
+		}
+	}
+	if !gzipped {
+		return stored, meta, false, nil
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Add("Vary", noCompressionHeader)
+	if !compressionWanted(r) || negotiateEncoding(r.Header.Get("Accept-Encoding"), []string{"gzip"}) != "gzip" {
+		bodyBytes, err = gunzipBytes(stored)
+		if err != nil {
+			return nil, fileMeta{}, false, fmt.Errorf("decompressing cached body: %w", err)
+		}
+		return bodyBytes, meta, false, nil
+	}
+
+	if notModified(w, r, etagFor(stored), meta.Modified) {
+		return nil, meta, true, nil
+	}
+	meta.writeHeaders(w.Header())
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Length", strconv.Itoa(len(stored)))
+	w.Header().Set("ETag", etagFor(stored))
+	w.WriteHeader(http.StatusOK)
+	w.Write(stored)
+	return nil, meta, true, nil
+}
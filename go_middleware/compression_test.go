@@ -0,0 +1,224 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stored is what store has under name, failing the test if it has nothing
+func stored(t *testing.T, name string) string {
+	t.Helper()
+	body, _, err := store.Get(context.Background(), name)
+	if err != nil {
+		t.Fatalf("%s in storage: %v", name, err)
+	}
+	defer body.Close()
+	b, _ := io.ReadAll(body)
+	return string(b)
+}
+
+func TestPrecompressedGzipVariant(t *testing.T) {
+	t.Setenv("STORAGE", "fs")
+	t.Setenv("GZIP_VARIANTS", "true")
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/app.js"
+	body := strings.Repeat("console.log('hi');\n", 200)
+	do(t, "PUT", u, body)
+	waitFor(t, func() bool { return mr.Exists(bodyKey("app.js")) })
+	variant := stored(t, "app.js.gz")
+
+	resp, got := do(t, "GET", u, "", "Accept-Encoding", "gzip")
+	if resp.Header.Get("Content-Encoding") != "gzip" || !strings.Contains(resp.Header.Get("Vary"), "Accept-Encoding") {
+		t.Fatalf("gzip client: got headers %v", resp.Header)
+	}
+	// byte for byte the stored variant, nothing was compressed for this request
+	if got != variant {
+		t.Fatalf("gzip client got %d bytes, not the %d byte stored variant", len(got), len(variant))
+	}
+	zr, err := gzip.NewReader(strings.NewReader(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := io.ReadAll(zr); err != nil || string(plain) != body {
+		t.Fatalf("variant doesn't decompress to the file: %v", err)
+	}
+
+	mr.FlushAll()
+	resp, got = do(t, "GET", u, "", "Accept-Encoding", "gzip")
+	if resp.Header.Get("Content-Encoding") != "gzip" || got != variant {
+		t.Fatalf("gzip client after a cache flush: got %v", resp.Header)
+	}
+
+	resp, got = do(t, "GET", u, "", "Accept-Encoding", "identity")
+	if resp.Header.Get("Content-Encoding") != "" || got != body {
+		t.Fatalf("plain client: got Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	do(t, "DELETE", u, "")
+	waitFor(t, func() bool {
+		_, _, err := store.Get(context.Background(), "app.js.gz")
+		return err != nil
+	})
+	if resp, _ := do(t, "GET", srv.URL+"/api/fileserver/app.js.gz", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("variant by name: got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header    string
+		available []string
+		want      string
+	}{
+		{"br, gzip", []string{"br", "gzip"}, "br"},
+		{"br, gzip", []string{"gzip"}, "gzip"},
+		{"gzip;q=0.5, br;q=0.9", []string{"gzip", "br"}, "br"},
+		{"gzip, deflate", []string{"br", "gzip", "deflate"}, "gzip"},
+		{"*", []string{"br", "gzip"}, "br"},
+		{"gzip;q=0, *", []string{"gzip"}, ""},
+		{"x-gzip", []string{"gzip"}, "gzip"},
+		{"identity", []string{"gzip"}, ""},
+		{"", []string{"gzip"}, ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.header, tt.available); got != tt.want {
+			t.Errorf("negotiateEncoding(%q, %v) = %q, want %q", tt.header, tt.available, got, tt.want)
+		}
+	}
+}
+
+func TestBrotliChosenWhenEnabled(t *testing.T) {
+	for algos, want := range map[string]string{"br,gzip": "br", "gzip": "gzip"} {
+		t.Run(algos, func(t *testing.T) {
+			t.Setenv("PRECOMPRESS", "true")
+			t.Setenv("COMPRESSION_ALGO", algos)
+			_, srv := newTestServer(t)
+			u := srv.URL + "/api/fileserver/style.css"
+			body := strings.Repeat("body { margin: 0; }\n", 100)
+			do(t, "PUT", u, body)
+			waitForWrites(t)
+
+			resp, got := do(t, "GET", u, "", "Accept-Encoding", "br, gzip")
+			if enc := resp.Header.Get("Content-Encoding"); enc != want {
+				t.Fatalf("Content-Encoding: got %q, want %q", enc, want)
+			}
+			if got != stored(t, variantName("style.css", want)) {
+				t.Fatalf("body isn't the stored %s variant", want)
+			}
+		})
+	}
+}
+
+func TestNoCompression(t *testing.T) {
+	t.Setenv("PRECOMPRESS", "true")
+	_, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/z.txt"
+	body := strings.Repeat("hello ", 50)
+	do(t, "PUT", u, body)
+	waitForWrites(t)
+
+	tests := []struct {
+		header   string
+		encoding string
+	}{
+		{"", "gzip"},
+		{"1", ""},
+		{"true", ""},
+		{"false", "gzip"},
+	}
+	for _, tt := range tests {
+		headers := []string{"Accept-Encoding", "gzip"}
+		if tt.header != "" {
+			headers = append(headers, noCompressionHeader, tt.header)
+		}
+		resp, got := do(t, "GET", u, "", headers...)
+		if enc := resp.Header.Get("Content-Encoding"); enc != tt.encoding {
+			t.Fatalf("X-No-Compression %q: got Content-Encoding %q, want %q", tt.header, enc, tt.encoding)
+		}
+		if tt.encoding == "" && got != body {
+			t.Fatalf("X-No-Compression %q: got %d bytes, want the plain file", tt.header, len(got))
+		}
+	}
+
+	t.Setenv("NO_COMPRESSION", "true")
+	current.Store(loadConfig())
+	if resp, _ := do(t, "GET", u, "", "Accept-Encoding", "gzip"); resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("NO_COMPRESSION: got Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestCacheCompression(t *testing.T) {
+	t.Setenv("CACHE_COMPRESSION", "true")
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/big.txt"
+	body := strings.Repeat("hello world\n", 500)
+	do(t, "PUT", u, body)
+	waitForWrites(t)
+
+	cached, _ := mr.Get(bodyKey("big.txt"))
+	if len(cached) >= len(body) || mr.HGet(metaKey("big.txt"), "cacheEncoding") != "gzip" {
+		t.Fatalf("cached %d bytes of %d, want them gzipped", len(cached), len(body))
+	}
+
+	// a gzip client gets the cached bytes as they are, nothing is recompressed
+	resp, got := do(t, "GET", u, "", "Accept-Encoding", "gzip")
+	if resp.Header.Get("Content-Encoding") != "gzip" || got != cached {
+		t.Fatalf("gzip GET: got %d bytes as %q, want the %d cached", len(got), resp.Header.Get("Content-Encoding"), len(cached))
+	}
+	if resp, _ := do(t, "GET", u, "", "Accept-Encoding", "gzip", "If-None-Match", resp.Header.Get("ETag")); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("revalidating the gzipped body: got %d, want 304", resp.StatusCode)
+	}
+
+	// anyone else gets it decompressed
+	resp, got = do(t, "GET", u, "", "Accept-Encoding", "identity")
+	if resp.Header.Get("Content-Encoding") != "" || got != body {
+		t.Fatalf("plain GET: got %d bytes as %q", len(got), resp.Header.Get("Content-Encoding"))
+	}
+	mr.FlushAll()
+	if _, got := do(t, "GET", u, "", "Accept-Encoding", "identity"); got != body {
+		t.Fatalf("plain GET on a miss: got %d bytes", len(got))
+	}
+
+	// a body gzip can't shrink is cached plain
+	do(t, "PUT", srv.URL+"/api/fileserver/tiny", "ab")
+	waitForWrites(t)
+	resp, got = do(t, "GET", srv.URL+"/api/fileserver/tiny", "", "Accept-Encoding", "gzip")
+	if got != "ab" || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("tiny GET: got %q as %q", got, resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestCacheCompressionEarlyRefresh(t *testing.T) {
+	t.Setenv("CACHE_COMPRESSION", "true")
+	t.Setenv("CACHE_TTL", "10s")
+	t.Setenv("CACHE_TTL_JITTER", "0")
+	mr, srv := newTestServer(t)
+	counting := &fetchCountingStorage{Storage: store, delay: 50 * time.Millisecond}
+	store = counting
+	u := srv.URL + "/api/fileserver/hot.txt"
+	body := strings.Repeat("hello world\n", 500)
+	if err := store.Put(t.Context(), "hot.txt", strings.NewReader(body), fileMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	do(t, "GET", u, "", "Accept-Encoding", "gzip")
+	if mr.HGet(metaKey("hot.txt"), "cacheEncoding") != "gzip" {
+		t.Fatal("entry not cached gzipped")
+	}
+
+	// gzip readers of a hit near expiry refresh it early like anyone else
+	mr.FastForward(10*time.Second - time.Millisecond)
+	for range 5 {
+		do(t, "GET", u, "", "Accept-Encoding", "gzip")
+	}
+	if n := counting.gets.Load(); n != 2 {
+		t.Fatalf("%d backend reads, want the fill and 1 early refresh", n)
+	}
+	if ttl := mr.TTL(bodyKey("hot.txt")); ttl < 9*time.Second {
+		t.Fatalf("refreshed entry has TTL %v", ttl)
+	}
+}
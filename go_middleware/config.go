@@ -0,0 +1,283 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// current is replaced whole by POST /admin/reload and never modified in place
+var current atomic.Pointer[config]
+
+// cfg returns the config in effect
+func cfg() *config {
+	return current.Load()
+}
+
+// config holds the middleware settings read from the environment at startup
+type config struct {
+	logLevel              string        // debug, info, warn or error
+	storage               string        // storage backend, http, fs, s3 or memory
+	fsRoot                string        // root directory for the fs backend
+	s3Bucket              string        // bucket for the s3 backend
+	s3Prefix              string        // key prefix prepended to every file name in the bucket
+	s3Region              string        // overrides the sdk's default region lookup
+	s3Endpoint            string        // custom endpoint, e.g. a MinIO server
+	fileServerURL         string        // backend url template, "#" is replaced by the shard number
+	shardingEnabled       bool          // false sends every file to fileServerURL untouched
+	readFallbackShards    int           // shards to probe after an unreachable primary on GET, 0 disables
+	maxConcurrentRequests int           // 0 disables the limiter
+	maxQueuedRequests     int           // requests allowed to wait for a free slot
+	queueTimeout          time.Duration // how long a queued request waits before being shed
+	rangeCacheMode        string        // rangeCacheFull or rangeCacheRange
+	lockTimeout           time.Duration // how long a request waits on a file lock before giving up with a 503
+	maxReadersPerFile     int           // concurrent GETs allowed per file, 0 disables the cap
+	readerWaitTimeout     time.Duration // how long a GET over the cap waits for a slot before a 503
+	precompress           bool          // store precompressed variants of each upload, one per compressionAlgos
+	compressionAlgos      []string      // br, gzip and/or deflate, in order of preference on ties
+	compressionLevel      int           // passed to each algorithm, compressionBest for its best ratio
+	adminAddr             string        // listen address for the admin server, keep it off public interfaces
+	adminToken            string        // bearer token for admin endpoints, empty leaves ADMIN_ADDR open and public ones off
+	enablePprof           bool          // serve net/http/pprof under /debug/pprof/ on the admin server
+	normalizeFileNames    bool          // lower-case and NFC-normalize names before hashing and caching
+	strictMode            bool          // 400 on query params, X- headers and methods a handler doesn't expect
+	writeLatencyThreshold time.Duration // shed new PUTs while the write-behind queue lags more than this, 0 disables
+	maxWriteLag           time.Duration // alert once an acked write has waited this long for the backend, 0 disables
+	readyMaxWriteLag      time.Duration // /ready answers 503 while an acked write has waited longer than this, 0 disables
+	minVersionWait        time.Duration // how long a GET with X-Min-Version waits for that version before a 503
+	forwardHeaders        []string      // client request headers copied onto http backend requests
+	requestIDHeader       string        // header a request's ID is read from, answered in and sent to backends on
+	backendAuthName       string        // header set on every http backend request, from BACKEND_AUTH_HEADER
+	backendAuthValue      string        // and its value
+	versioning            bool          // keep a copy of every PUT under <name>@v<version>
+	maxVersions           int           // copies kept per file when versioning, oldest dropped first, 0 keeps all
+	softDelete            bool          // DELETE moves files into the trash, restorable until trashTTL
+	dedup                 bool          // store each distinct body once, file names pointing at it from redis
+	trashTTL              time.Duration // how long trashed files are kept
+	trashSweepInterval    time.Duration // how often expired trash is purged
+	maxInflightBytes      int64         // upload bytes buffered across all requests before PUTs get a 503, 0 disables
+	streamThreshold       int64         // GET misses larger than this stream from storage uncached, 0 always buffers
+	canaryFeatures        []string      // features a request may turn on for itself with X-Feature, see knownFeatures
+	checkContentLength    bool          // 400 on uploads shorter than their Content-Length, false keeps what arrived
+	allowShardOverride    bool          // honour X-Override-Shard from callers with the admin token
+	allowMethodOverride   bool          // handle a POST with X-HTTP-Method-Override as the PUT or DELETE it names
+	verifyWrites          bool          // read each write back from the backend before caching it
+	verifyRetries         int           // extra PUTs after a failed verification before giving up
+	cacheableTypes        []string      // media types kept in redis, "type/*" wildcards allowed, empty caches everything
+	contentTypeExts       string        // extension to media type mappings for untyped uploads, ".csv=text/csv", see parseExtensionTypes
+	allowedExtensions     []string      // file extensions PUT accepts, lower-cased with the dot, empty allows any
+	minWriteInterval      time.Duration // PUTs to a file sooner than this after the last get a 429, 0 disables
+	readHeaderTimeout     time.Duration // how long a client gets to send its request headers
+	readTimeout           time.Duration // how long a client gets to send the whole request, body included, 0 disables
+	tcpKeepAlive          bool          // send TCP keep-alive probes on client connections
+	tcpKeepAliveIdle      time.Duration // how long a connection sits idle before the first probe, 0 uses Go's 15s
+	tcpKeepAliveInterval  time.Duration // wait between unanswered probes, 0 uses Go's 15s
+	tcpKeepAliveCount     int           // unanswered probes before the connection is dropped, 0 uses Go's 9
+	bodyReadTimeout       time.Duration // longest an upload may go without sending anything before a 408, 0 disables
+	drFileServerURL       string        // DR cluster url template writes are mirrored to, sharded like fileServerURL, empty disables
+	drQueueSize           int           // writes waiting for the DR cluster before new ones are dropped
+	drRetries             int           // extra attempts at a DR write before giving up on it
+	drRetryBackoff        time.Duration // wait before the first DR retry, doubled for each one after
+	securityHeaders       bool          // add nosniff, frame options, referrer policy and HSTS headers to every response
+	frameOptions          string        // X-Frame-Options value, DENY or SAMEORIGIN
+	maxUploadBytes        int64         // largest PUT body accepted, anything bigger gets a 413, 0 disables
+	maxResponseBytes      int64         // largest fileserver GET body read before giving up with a 502, 0 disables
+	followRedirects       bool          // follow fileserver redirects, otherwise a redirected GET is a 502
+	multiTenant           bool          // require X-Tenant and keep each tenant's files under tenant:<tenant>:
+	retryBudget           int           // backend retries allowed per second across all replicas, 0 leaves them uncapped
+	maxRetryAfter         time.Duration // longest a backend's Retry-After may hold up a retry, 0 ignores it
+	backendRetries        int           // extra attempts at a fileserver request answered with a 429 or 5xx, or not at all
+	backendRetryBackoff   time.Duration // wait before the first backend retry, doubled for each one after
+	drainTimeout          time.Duration // how long shutdown waits for queued writes, and then for open requests
+	trailingSlash         string        // trailingSlashStrip, trailingSlashRedirect or trailingSlashOff
+	indexListings         bool          // serve GET /api/fileserver/<prefix>/ as a listing instead of the file <prefix>
+	uploadTimeSkew        time.Duration // how far into the future an X-Upload-Time may be, for clock drift
+	existsConcurrency     int           // storage lookups one bulk exists request may have in flight
+	cacheExcludePatterns  []string      // file name globs never cached, e.g. *.tmp
+	hstsMaxAge            time.Duration // Strict-Transport-Security max-age on TLS responses, 0 leaves it off
+	breakerFailures       int           // consecutive failures that open a shard's circuit breaker, 0 disables
+	breakerCooldown       time.Duration // how long an open breaker fails requests before letting one through again
+	cacheTTL              time.Duration // how long a file stays cached before it's refetched, 0 keeps it until replaced
+	cacheTTLJitter        int           // percent each cache TTL is randomly moved by either way, 0 disables
+	listMaxResults        int           // most file names one list page returns, whatever limit a client asks for, 0 disables
+	noCompression         bool          // never serve precompressed variants, as if every request sent X-No-Compression
+	maxEventStreams       int           // event streams open at once, past MAX_CONCURRENT_REQUESTS which they skip, 0 disables
+	webhookURL            string        // file change events are POSTed here, empty disables
+	passResponseHeaders   []string      // fileserver response headers passed on to the client when a GET misses the cache
+	maxFileNameLength     int           // longest file name in bytes, before tenant scoping, 0 disables
+	windowsSafeNames      bool          // also refuse names Windows can't store, all dots or a device name like CON
+	writeThrough          bool          // PUTs and DELETEs answer once the backend and cache have them, with the backend's error if it refused
+	syncBackgroundOps     bool          // like writeThrough, and trash sweeps finish each purge before the next, so tests can check state without waiting
+	asyncWriteAccepted    bool          // answer write-behind PUTs 202 with a Location to check on them, not 201
+	cacheOnWrite          bool          // cache a PUT's body as it's written, off leaves caching to the first GET
+	cacheCompression      bool          // keep cached bodies gzipped, sent as stored to clients that accept gzip
+	requireCacheOnWrite   bool          // with writeThrough, a PUT the cache couldn't take is a 503 even though the backend has it
+	writeCombineWindow    time.Duration // PUTs and PATCHes to a file this close together go to the backend as one write, 0 disables
+	shardHealthInterval   time.Duration // how often each http fileserver's health is probed, 0 disables
+	shardHealthPath       string        // path probed on each fileserver, appended to its base url
+	shardHealthStatus     int           // status a healthy fileserver answers the probe with
+	shardHealthBody       string        // text a healthy probe response has to contain, empty skips the check
+	shardHealthTimeout    time.Duration // how long a probe waits before counting the shard as down
+	shardAuth             string        // per shard auth header values, "1=Bearer abc,2=Bearer def", see parseShardAuth
+	datasetLabels         string        // filename prefix to metrics label mappings, "users-=users,logs-=logs", see parseDatasetLabels
+	negativeCache         bool          // remember backend 404s in redis so repeated GETs of a missing file skip the backend
+	negativeCacheTTL      time.Duration // how long a remembered 404 lasts, writes to the file clear it sooner
+	notFoundFormat        string        // notFoundPassthrough or notFoundJSON
+	hotspotWindow         time.Duration // how far back GET /admin/hotspots ranks file reads, 0 stops counting them
+	webhookSecret         string        // HMAC key for the X-Webhook-Signature header, empty sends no signature
+	webhookQueueSize      int           // events waiting for delivery before new ones are dropped
+	webhookRetries        int           // extra attempts at delivering an event before giving up on it
+	webhookRetryBackoff   time.Duration // wait before the first webhook retry, doubled for each one after
+}
+
+func loadConfig() *config {
+	maxConcurrent := getEnvInt("MAX_CONCURRENT_REQUESTS", 0)
+	authName, authValue := parseHeaderLine(os.Getenv("BACKEND_AUTH_HEADER"))
+	return &config{
+		logLevel:              getEnv("LOG_LEVEL", "info"),
+		storage:               getEnv("STORAGE", "http"),
+		fsRoot:                getEnv("FS_ROOT", "./data"),
+		s3Bucket:              os.Getenv("S3_BUCKET"),
+		s3Prefix:              os.Getenv("S3_PREFIX"),
+		s3Region:              os.Getenv("S3_REGION"),
+		s3Endpoint:            os.Getenv("S3_ENDPOINT"),
+		fileServerURL:         os.Getenv("FILE_SERVER_URL"),
+		shardingEnabled:       getEnvBool("SHARDING_ENABLED", true),
+		readFallbackShards:    getEnvInt("READ_FALLBACK_SHARDS", 0),
+		maxConcurrentRequests: maxConcurrent,
+		maxQueuedRequests:     getEnvInt("MAX_QUEUED_REQUESTS", maxConcurrent),
+		queueTimeout:          getEnvDuration("QUEUE_TIMEOUT", 100*time.Millisecond),
+		rangeCacheMode:        getEnv("RANGE_CACHE_MODE", rangeCacheFull),
+		lockTimeout:           getEnvDuration("LOCK_TIMEOUT", 5*time.Second),
+		maxReadersPerFile:     getEnvInt("MAX_READERS_PER_FILE", 0),
+		readerWaitTimeout:     getEnvDuration("READER_WAIT_TIMEOUT", 100*time.Millisecond),
+		precompress:           getEnvBool("PRECOMPRESS", getEnvBool("GZIP_VARIANTS", false)),
+		compressionAlgos:      parseEncodingList(getEnv("COMPRESSION_ALGO", "gzip")),
+		compressionLevel:      getEnvInt("COMPRESSION_LEVEL", compressionBest),
+		adminAddr:             getEnv("ADMIN_ADDR", "localhost:6060"),
+		adminToken:            os.Getenv("ADMIN_TOKEN"),
+		enablePprof:           getEnvBool("ENABLE_PPROF", false),
+		normalizeFileNames:    getEnvBool("NORMALIZE_FILENAMES", false),
+		strictMode:            getEnvBool("STRICT_MODE", false),
+		writeLatencyThreshold: getEnvDuration("WRITE_LATENCY_THRESHOLD", 0),
+		maxWriteLag:           getEnvDuration("MAX_WRITE_LAG", 0),
+		readyMaxWriteLag:      getEnvDuration("READY_MAX_WRITE_LAG", 0),
+		minVersionWait:        getEnvDuration("MIN_VERSION_WAIT", 2*time.Second),
+		forwardHeaders:        parseHeaderList(os.Getenv("FORWARD_HEADERS")),
+		requestIDHeader:       getEnv("REQUEST_ID_HEADER", "X-Request-ID"),
+		backendAuthName:       authName,
+		backendAuthValue:      authValue,
+		versioning:            getEnvBool("VERSIONING", false),
+		maxVersions:           getEnvInt("MAX_VERSIONS", 10),
+		softDelete:            getEnvBool("SOFT_DELETE", false),
+		dedup:                 getEnvBool("DEDUP_ENABLED", false),
+		trashTTL:              getEnvDuration("TRASH_TTL", 7*24*time.Hour),
+		trashSweepInterval:    getEnvDuration("TRASH_SWEEP_INTERVAL", time.Minute),
+		maxInflightBytes:      int64(getEnvInt("MAX_INFLIGHT_BYTES", 0)),
+		streamThreshold:       int64(getEnvInt("STREAM_THRESHOLD", 0)),
+		canaryFeatures:        parseFeatureList(os.Getenv("CANARY_FEATURES")),
+		checkContentLength:    getEnvBool("CHECK_CONTENT_LENGTH", true),
+		allowShardOverride:    getEnvBool("ALLOW_SHARD_OVERRIDE", false),
+		allowMethodOverride:   getEnvBool("ALLOW_METHOD_OVERRIDE", false),
+		verifyWrites:          getEnvBool("VERIFY_WRITES", false),
+		verifyRetries:         getEnvInt("VERIFY_RETRIES", 2),
+		cacheableTypes:        parseMediaTypeList(os.Getenv("CACHEABLE_CONTENT_TYPES")),
+		contentTypeExts:       os.Getenv("CONTENT_TYPE_EXTENSIONS"),
+		allowedExtensions:     parseExtensionList(os.Getenv("ALLOWED_EXTENSIONS")),
+		minWriteInterval:      getEnvDuration("MIN_WRITE_INTERVAL", 0),
+		readHeaderTimeout:     getEnvDuration("READ_HEADER_TIMEOUT", 10*time.Second),
+		readTimeout:           getEnvDuration("READ_TIMEOUT", 5*time.Minute),
+		tcpKeepAlive:          getEnvBool("TCP_KEEPALIVE", true),
+		tcpKeepAliveIdle:      getEnvDuration("TCP_KEEPALIVE_IDLE", 0),
+		tcpKeepAliveInterval:  getEnvDuration("TCP_KEEPALIVE_INTERVAL", 0),
+		tcpKeepAliveCount:     getEnvInt("TCP_KEEPALIVE_COUNT", 0),
+		bodyReadTimeout:       getEnvDuration("BODY_READ_TIMEOUT", 30*time.Second),
+		drFileServerURL:       os.Getenv("DR_FILE_SERVER_URL"),
+		drQueueSize:           getEnvInt("DR_QUEUE_SIZE", 1000),
+		drRetries:             getEnvInt("DR_RETRIES", 3),
+		drRetryBackoff:        getEnvDuration("DR_RETRY_BACKOFF", 100*time.Millisecond),
+		securityHeaders:       getEnvBool("SECURITY_HEADERS", true),
+		frameOptions:          getEnv("FRAME_OPTIONS", "DENY"),
+		maxUploadBytes:        int64(getEnvInt("MAX_UPLOAD_BYTES", 0)),
+		maxResponseBytes:      int64(getEnvInt("MAX_BACKEND_RESPONSE_BYTES", 0)),
+		followRedirects:       getEnvBool("FOLLOW_BACKEND_REDIRECTS", false),
+		multiTenant:           getEnvBool("MULTI_TENANT", false),
+		retryBudget:           getEnvInt("RETRY_BUDGET", 0),
+		maxRetryAfter:         getEnvDuration("MAX_RETRY_AFTER", 30*time.Second),
+		backendRetries:        getEnvInt("BACKEND_RETRIES", 2),
+		backendRetryBackoff:   getEnvDuration("BACKEND_RETRY_BACKOFF", 100*time.Millisecond),
+		drainTimeout:          getEnvDuration("DRAIN_TIMEOUT", 30*time.Second),
+		trailingSlash:         getEnv("TRAILING_SLASH", trailingSlashStrip),
+		indexListings:         getEnvBool("INDEX_LISTINGS", false),
+		uploadTimeSkew:        getEnvDuration("UPLOAD_TIME_SKEW", time.Minute),
+		existsConcurrency:     getEnvInt("EXISTS_CONCURRENCY", 4),
+		cacheExcludePatterns:  parseGlobList(os.Getenv("CACHE_EXCLUDE_PATTERNS")),
+		hstsMaxAge:            getEnvDuration("HSTS_MAX_AGE", 365*24*time.Hour),
+		breakerFailures:       getEnvInt("BREAKER_FAILURES", 0),
+		breakerCooldown:       getEnvDuration("BREAKER_COOLDOWN", 30*time.Second),
+		cacheTTL:              getEnvDuration("CACHE_TTL", 0),
+		cacheTTLJitter:        getEnvInt("CACHE_TTL_JITTER", 10),
+		listMaxResults:        getEnvInt("LIST_MAX_RESULTS", 1000),
+		noCompression:         getEnvBool("NO_COMPRESSION", false),
+		maxEventStreams:       getEnvInt("MAX_EVENT_STREAMS", 100),
+		webhookURL:            os.Getenv("WEBHOOK_URL"),
+		passResponseHeaders:   parseHeaderList(getEnv("BACKEND_RESPONSE_HEADERS", "Cache-Control")),
+		maxFileNameLength:     getEnvInt("MAX_FILENAME_LENGTH", 0),
+		windowsSafeNames:      getEnvBool("WINDOWS_SAFE_NAMES", false),
+		writeThrough:          getEnvBool("WRITE_THROUGH", false),
+		syncBackgroundOps:     getEnvBool("SYNC_BACKGROUND_OPS", false),
+		asyncWriteAccepted:    getEnvBool("ASYNC_WRITE_ACCEPTED", false),
+		cacheOnWrite:          getEnvBool("CACHE_ON_WRITE", true),
+		cacheCompression:      getEnvBool("CACHE_COMPRESSION", false),
+		requireCacheOnWrite:   getEnvBool("REQUIRE_CACHE_ON_WRITE", false),
+		writeCombineWindow:    getEnvDuration("WRITE_COMBINE_WINDOW", 0),
+		shardHealthInterval:   getEnvDuration("SHARD_HEALTH_INTERVAL", 0),
+		shardHealthPath:       getEnv("SHARD_HEALTH_PATH", "/health"),
+		shardHealthStatus:     getEnvInt("SHARD_HEALTH_STATUS", 200),
+		shardHealthBody:       os.Getenv("SHARD_HEALTH_BODY"),
+		shardHealthTimeout:    getEnvDuration("SHARD_HEALTH_TIMEOUT", 2*time.Second),
+		shardAuth:             os.Getenv("SHARD_AUTH"),
+		datasetLabels:         os.Getenv("DATASET_LABELS"),
+		negativeCache:         getEnvBool("NEGATIVE_CACHE_ENABLED", false),
+		negativeCacheTTL:      getEnvDuration("NEGATIVE_CACHE_TTL", 5*time.Second),
+		notFoundFormat:        getEnv("404_RESPONSE_FORMAT", notFoundPassthrough),
+		hotspotWindow:         getEnvDuration("HOTSPOT_WINDOW", 0),
+		webhookSecret:         os.Getenv("WEBHOOK_SECRET"),
+		webhookQueueSize:      getEnvInt("WEBHOOK_QUEUE_SIZE", 1000),
+		webhookRetries:        getEnvInt("WEBHOOK_RETRIES", 3),
+		webhookRetryBackoff:   getEnvDuration("WEBHOOK_RETRY_BACKOFF", 100*time.Millisecond),
+	}
+}
+
+func getEnv(name string, fallback string) string {
+	val := os.Getenv(name)
+	if val == "" {
+		return fallback
+	}
+	return val
+}
+
+func getEnvInt(name string, fallback int) int {
+	val, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return val
+}
+
+func getEnvBool(name string, fallback bool) bool {
+	val, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return val
+}
+
+func getEnvDuration(name string, fallback time.Duration) time.Duration {
+	val, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return val
+}
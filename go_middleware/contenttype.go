@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log/slog"
+	"maps"
+	"mime"
+	"path"
+	"slices"
+	"strings"
+)
+
+// defaultExtensionTypes covers common text formats Go's mime table doesn't know, which would
+// otherwise be stored without a type
+var defaultExtensionTypes = map[string]string{
+	".csv":  "text/csv",
+	".tsv":  "text/tab-separated-values",
+	".md":   "text/markdown",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+	".toml": "application/toml",
+	".log":  "text/plain",
+}
+
+// extensionTypes is defaultExtensionTypes with CONTENT_TYPE_EXTENSIONS applied, set at startup
+var extensionTypes = defaultExtensionTypes
+
+// parseExtensionTypes reads CONTENT_TYPE_EXTENSIONS, comma separated extension=type pairs like
+// ".csv=text/csv,.log=text/x-log" added to or replacing the defaults. Bad entries are skipped
+// with a warning.
+func parseExtensionTypes(list string) map[string]string {
+	types := maps.Clone(defaultExtensionTypes)
+	for i, entry := range strings.Split(list, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		ext, mediaType, found := strings.Cut(entry, "=")
+		ext, mediaType = strings.ToLower(strings.TrimSpace(ext)), strings.TrimSpace(mediaType)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if !found || ext == "." || !mediaTypePattern.MatchString(mediaType) {
+			slog.Warn("Ignoring invalid CONTENT_TYPE_EXTENSIONS entry", "position", i+1)
+			continue
+		}
+		types[ext] = mediaType
+	}
+	return types
+}
+
+// typeByExtension is the media type for fileName's extension, from extensionTypes and then
+// Go's mime table, or empty when neither knows it
+func typeByExtension(fileName string) string {
+	ext := strings.ToLower(path.Ext(fileName))
+	if ext == "" {
+		return ""
+	}
+	if t, ok := extensionTypes[ext]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// parseExtensionList reads ALLOWED_EXTENSIONS, comma separated extensions with or without the
+// dot, like ".csv,txt,.JSON"
+func parseExtensionList(list string) []string {
+	var exts []string
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		exts = append(exts, ext)
+	}
+	return exts
+}
+
+// extensionAllowed is whether ALLOWED_EXTENSIONS lets a file called fileName be stored. A name
+// without an extension is only allowed when the list is empty.
+func extensionAllowed(fileName string) bool {
+	if len(cfg().allowedExtensions) == 0 {
+		return true
+	}
+	return slices.Contains(cfg().allowedExtensions, strings.ToLower(path.Ext(fileName)))
+}
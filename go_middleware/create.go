@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// reservations outlive a crashed creator by at most this long
+const reservationTTL = time.Minute
+
+var errFileExists = errors.New("file already exists")
+
+func reservationKey(fileName string) string {
+	return "create:" + fileName
+}
+
+// reserveName claims fileName for a create-only PUT, false means another creator holds it
+func reserveName(ctx context.Context, fileName string) (bool, error) {
+	return redisClient.SetNX(ctx, reservationKey(fileName), 1, reservationTTL).Result()
+}
+
+func releaseName(ctx context.Context, fileName string) {
+	redisClient.Del(ctx, reservationKey(fileName))
+}
+
+// fileExists checks the cache and then storage, preferring a stat over fetching the whole file.
+// Callers run it from the file's queue so earlier writes have landed.
+func fileExists(ctx context.Context, fileName string) (bool, error) {
+	cached, err := redisClient.Exists(ctx, bodyKey(fileName)).Result()
+	if err == nil && cached > 0 {
+		return true, nil
+	}
+	return storageHas(ctx, fileName)
+}
+
+// storageHas asks storage alone whether fileName exists
+func storageHas(ctx context.Context, fileName string) (bool, error) {
+	var err error
+	if st, ok := store.(statter); ok {
+		_, err = st.Stat(ctx, fileName)
+	} else {
+		var body io.ReadCloser
+		body, _, err = store.Get(ctx, fileName)
+		if err == nil {
+			body.Close()
+		}
+	}
+	if errors.Is(err, errNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCreateOnlyPutRace(t *testing.T) {
+	mr, srv := newTestServer(t)
+	store = slowStorage{Storage: store, delay: 30 * time.Millisecond}
+	u := srv.URL + "/api/fileserver/lease"
+
+	statuses := make([]int, 2)
+	bodies := []string{"first", "second"}
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Go(func() {
+			resp, _ := do(t, "PUT", u, bodies[i], "If-None-Match", "*")
+			statuses[i] = resp.StatusCode
+		})
+	}
+	wg.Wait()
+	winner := slices.Index(statuses, http.StatusCreated)
+	if winner < 0 || !slices.Contains(statuses, http.StatusPreconditionFailed) {
+		t.Fatalf("two create-only PUTs: got %v, want one 201 and one 412", statuses)
+	}
+	waitForWrites(t)
+
+	// the winner's body is the file, in the cache and the backend
+	for _, source := range []string{"cache", "storage"} {
+		if source == "storage" {
+			mr.FlushAll()
+		}
+		if _, body := do(t, "GET", u, ""); body != bodies[winner] {
+			t.Fatalf("from %s: got %q, want %q", source, body, bodies[winner])
+		}
+	}
+	if resp, _ := do(t, "PUT", u, "late", "If-None-Match", "*"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("create-only PUT on an existing file: got %d, want 412", resp.StatusCode)
+	}
+}
+
+func TestCreateOnlySeesQueuedPut(t *testing.T) {
+	_, srv := newTestServer(t)
+	store = slowStorage{Storage: store, delay: 30 * time.Millisecond}
+	u := srv.URL + "/api/fileserver/queued"
+
+	// still on its way to the backend when the create-only PUT checks
+	do(t, "PUT", u, "a")
+	if resp, _ := do(t, "PUT", u, "b", "If-None-Match", "*"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("create-only PUT behind a queued PUT: got %d, want 412", resp.StatusCode)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// most DATASET_LABELS entries kept, each one is another set of series on every file metric
+const maxDatasets = 20
+
+// otherDataset labels files matching no DATASET_LABELS prefix
+const otherDataset = "other"
+
+var fileRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "middleware_file_requests_total",
+	Help: "File GETs, HEADs, PUTs, PATCHes and DELETEs answered, by method, DATASET_LABELS dataset and status code.",
+}, []string{"method", "dataset", "code"})
+
+type datasetLabel struct {
+	prefix string
+	label  string
+}
+
+// parseDatasetLabels reads DATASET_LABELS, comma separated prefix=label pairs like
+// "users-=users,logs-=logs". Bad entries, and any after the first maxDatasets labels, are
+// skipped with a warning.
+func parseDatasetLabels(list string) []datasetLabel {
+	labels := []datasetLabel{}
+	seen := map[string]bool{}
+	for i, entry := range strings.Split(list, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		prefix, label, found := strings.Cut(entry, "=")
+		prefix, label = strings.TrimSpace(prefix), strings.TrimSpace(label)
+		if !found || prefix == "" || label == "" {
+			slog.Warn("Ignoring invalid DATASET_LABELS entry", "position", i+1)
+			continue
+		}
+		if !seen[label] && len(seen) == maxDatasets {
+			slog.Warn("Ignoring DATASET_LABELS entry past the label limit", "position", i+1, "limit", maxDatasets)
+			continue
+		}
+		seen[label] = true
+		labels = append(labels, datasetLabel{prefix: prefix, label: label})
+	}
+	return labels
+}
+
+// datasetFor is the label of the longest prefix fileName starts with, otherDataset if none
+func datasetFor(labels []datasetLabel, fileName string) string {
+	dataset, longest := otherDataset, 0
+	for _, l := range labels {
+		if len(l.prefix) > longest && strings.HasPrefix(fileName, l.prefix) {
+			dataset, longest = l.label, len(l.prefix)
+		}
+	}
+	return dataset
+}
+
+// countFileRequests counts each request to a file route under the dataset its name falls in.
+// Names are matched as stored, after tenant scoping, so with MULTI_TENANT a "tenant:<tenant>:"
+// prefix labels a whole tenant. A name that won't resolve is matched as the client sent it.
+func countFileRequests(labels []datasetLabel, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		fileName, err := fileNameFromRequest(r)
+		if err != nil {
+			fileName = r.PathValue("fileName")
+		}
+		fileRequests.WithLabelValues(r.Method, datasetFor(labels, fileName), strconv.Itoa(rec.status)).Inc()
+	}
+}
+
+// statusRecorder notes the status a handler answered with
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if !w.wroteHeader && status >= 200 {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps the early PUT and DELETE acks going out before their handlers return
+func (w *statusRecorder) Flush() {
+	w.wroteHeader = true
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the real writer, for streaming and deadlines
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDatasetLabels(t *testing.T) {
+	t.Setenv("DATASET_LABELS", "users-=users, logs-=logs,logs-audit-=audit,bad")
+	_, srv := newTestServer(t)
+	count := func(method, dataset string, code int) float64 {
+		return testutil.ToFloat64(fileRequests.WithLabelValues(method, dataset, fmt.Sprint(code)))
+	}
+
+	tests := []struct {
+		method, name, dataset string
+		code                  int
+	}{
+		{"PUT", "users-bob", "users", http.StatusCreated},
+		{"GET", "logs-missing", "logs", http.StatusNotFound},
+		// the longest matching prefix wins
+		{"GET", "logs-audit-x", "audit", http.StatusNotFound},
+		{"GET", "other", otherDataset, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		before := count(tt.method, tt.dataset, tt.code)
+		do(t, tt.method, srv.URL+"/api/fileserver/"+tt.name, "x")
+		if got := count(tt.method, tt.dataset, tt.code) - before; got != 1 {
+			t.Errorf("%s %s: %s count went up by %v, want 1", tt.method, tt.name, tt.dataset, got)
+		}
+	}
+}
+
+func TestDatasetLabelsByTenant(t *testing.T) {
+	t.Setenv("MULTI_TENANT", "true")
+	t.Setenv("DATASET_LABELS", "tenant:acme:=acme")
+	_, srv := newTestServer(t)
+
+	before := testutil.ToFloat64(fileRequests.WithLabelValues("GET", "acme", "404"))
+	do(t, "GET", srv.URL+"/api/fileserver/f", "", tenantHeader, "acme")
+	if got := testutil.ToFloat64(fileRequests.WithLabelValues("GET", "acme", "404")) - before; got != 1 {
+		t.Fatalf("acme count went up by %v, want 1", got)
+	}
+}
+
+func TestDatasetLabelLimit(t *testing.T) {
+	var entries []string
+	for i := range maxDatasets + 10 {
+		entries = append(entries, fmt.Sprintf("p%d-=l%d", i, i))
+	}
+	if n := len(parseDatasetLabels(strings.Join(entries, ","))); n != maxDatasets {
+		t.Fatalf("kept %d labels, want %d", n, maxDatasets)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// With DEDUP_ENABLED each distinct body is stored once, as a blob named for its SHA-256, and a
+// file name is only a pointer to its blob. Both live in redis, shared by every replica:
+// pointersKey is a hash from file name to its dedupPointer, blobRefsKey one from content hash to
+// the number of pointers at it. A blob is deleted with its last pointer. Blobs get a namespace
+// clients can't use, like trashPrefix, that every backend can store.
+const (
+	pointersKey = "pointers"
+	blobRefsKey = "blob-refs"
+	blobPrefix  = "blob:sha256:"
+)
+
+const (
+	// a replica that dies holding a blob's lock holds it at most this long
+	blobLockTTL = time.Minute
+	// how often a reference waiting on a blob's lock tries again
+	blobLockPoll = 10 * time.Millisecond
+)
+
+var errBlobLocked = errors.New("timed out waiting for blob lock")
+
+// blobLockKey is held in redis by whichever replica is taking or dropping a reference to the
+// blob, so a blob can't be deleted by its last release while another replica's new reference
+// is uploading it
+func blobLockKey(hash string) string {
+	return "blob-lock:" + hash
+}
+
+// releaseBlobLock deletes a blob's lock only if it's still ours, not one taken after ours expired
+var releaseBlobLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+type dedupPointer struct {
+	Hash string   `json:"hash"`
+	Meta fileMeta `json:"meta"` // each name keeps its own type and metadata, the blob has none
+}
+
+// dedupStorage stores files content addressed on top of another backend. Files written before
+// dedup was turned on have no pointer and are read and deleted where they are, their first
+// write through dedup moves them into a blob. It doesn't pass on ranges, stats or renames,
+// those fall back to whole reads and copies, which cost a blob nothing.
+type dedupStorage struct {
+	inner Storage
+}
+
+func newDedupStorage(inner Storage) *dedupStorage {
+	return &dedupStorage{inner: inner}
+}
+
+// Unwrap is the backend the blobs are stored in
+func (s *dedupStorage) Unwrap() Storage {
+	return s.inner
+}
+
+func isBlobName(name string) bool {
+	return strings.HasPrefix(name, blobPrefix)
+}
+
+func (s *dedupStorage) pointer(ctx context.Context, name string) (dedupPointer, bool, error) {
+	raw, err := redisClient.HGet(ctx, pointersKey, name).Result()
+	if errors.Is(err, redis.Nil) {
+		return dedupPointer{}, false, nil
+	}
+	if err != nil {
+		return dedupPointer{}, false, err
+	}
+	var p dedupPointer
+	if err := json.Unmarshal([]byte(raw), &p); err != nil {
+		return dedupPointer{}, false, err
+	}
+	return p, true, nil
+}
+
+func (s *dedupStorage) Put(ctx context.Context, name string, r io.Reader, meta fileMeta) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	old, hadPointer, err := s.pointer(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !hadPointer || old.Hash != hash {
+		err = s.addRef(ctx, hash, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	b, _ := json.Marshal(dedupPointer{Hash: hash, Meta: meta})
+	err = redisClient.HSet(ctx, pointersKey, name, b).Err()
+	if err != nil {
+		if !hadPointer || old.Hash != hash {
+			s.dropRef(ctx, hash)
+		}
+		return err
+	}
+
+	switch {
+	case hadPointer && old.Hash != hash:
+		s.dropRef(ctx, old.Hash)
+	case !hadPointer:
+		// a copy from before dedup would be read again once this pointer is deleted
+		err = s.inner.Delete(ctx, name)
+		if err != nil && !errors.Is(err, errNotFound) {
+			slog.Error("Storage DELETE error", "file", name, "err", err)
+		}
+	}
+	return nil
+}
+
+// lockBlob takes hash's lock in redis, waiting up to blobLockTTL for another holder to finish
+func lockBlob(ctx context.Context, hash string) (unlock func(), err error) {
+	ctx, cancel := context.WithTimeout(ctx, blobLockTTL)
+	defer cancel()
+
+	token := rand.Text()
+	for {
+		locked, err := redisClient.SetNX(ctx, blobLockKey(hash), token, blobLockTTL).Result()
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			return func() {
+				// the caller's context may be done by now, the lock still has to go
+				releaseBlobLock.Run(context.WithoutCancel(ctx), redisClient, []string{blobLockKey(hash)}, token)
+			}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errBlobLocked
+		case <-time.After(blobLockPoll):
+		}
+	}
+}
+
+// addRef takes a reference to hash's blob, uploading data as the blob if it's the first
+func (s *dedupStorage) addRef(ctx context.Context, hash string, data []byte) error {
+	unlock, err := lockBlob(ctx, hash)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	refs, err := redisClient.HIncrBy(ctx, blobRefsKey, hash, 1).Result()
+	if err != nil {
+		return err
+	}
+	if refs > 1 {
+		return nil
+	}
+	err = s.inner.Put(ctx, blobPrefix+hash, bytes.NewReader(data), fileMeta{})
+	if err != nil {
+		redisClient.HIncrBy(ctx, blobRefsKey, hash, -1)
+		return err
+	}
+	return nil
+}
+
+// dropRef releases a reference to hash's blob, deleting the blob with the last one. A blob that
+// can't be deleted is left behind unreferenced and logged.
+func (s *dedupStorage) dropRef(ctx context.Context, hash string) {
+	unlock, err := lockBlob(ctx, hash)
+	if err != nil {
+		slog.Error("Could not lock blob", "blob", hash, "err", err)
+		return
+	}
+	defer unlock()
+
+	refs, err := redisClient.HIncrBy(ctx, blobRefsKey, hash, -1).Result()
+	if err != nil {
+		slog.Error("Redis HINCRBY error", "blob", hash, "err", err)
+		return
+	}
+	if refs > 0 {
+		return
+	}
+	redisClient.HDel(ctx, blobRefsKey, hash)
+	err = s.inner.Delete(ctx, blobPrefix+hash)
+	if err != nil && !errors.Is(err, errNotFound) {
+		slog.Error("Storage DELETE error", "file", blobPrefix+hash, "err", err)
+	}
+}
+
+func (s *dedupStorage) Get(ctx context.Context, name string) (io.ReadCloser, fileMeta, error) {
+	p, ok, err := s.pointer(ctx, name)
+	if err != nil {
+		return nil, fileMeta{}, err
+	}
+	if !ok {
+		return s.inner.Get(ctx, name)
+	}
+	body, blobMeta, err := s.inner.Get(ctx, blobPrefix+p.Hash)
+	if err != nil {
+		return nil, fileMeta{}, err
+	}
+	p.Meta.Backend = blobMeta.Backend
+	return body, p.Meta, nil
+}
+
+func (s *dedupStorage) Delete(ctx context.Context, name string) error {
+	p, ok, err := s.pointer(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return s.inner.Delete(ctx, name)
+	}
+	err = redisClient.HDel(ctx, pointersKey, name).Err()
+	if err != nil {
+		return err
+	}
+	s.dropRef(ctx, p.Hash)
+	return nil
+}
+
+// List merges the pointers under prefix with any files from before dedup, never the blobs
+func (s *dedupStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	stored, err := s.inner.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	pointers, err := redisClient.HKeys(ctx, pointersKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, name := range append(stored, pointers...) {
+		if strings.HasPrefix(name, prefix) && !isBlobName(name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names), nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func blobHash(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestDedup(t *testing.T) {
+	// the fs backend refuses names it would hide, so blobs have to be storable there
+	t.Setenv("STORAGE", "fs")
+	t.Setenv("DEDUP_ENABLED", "true")
+	mr, srv := newTestServer(t)
+	inner := store.(*dedupStorage).Unwrap()
+	ctx := t.Context()
+	stored := func() []string {
+		t.Helper()
+		names, err := inner.List(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+	blob := blobPrefix + blobHash("same")
+
+	do(t, "PUT", srv.URL+"/api/fileserver/a", "same", "Content-Type", "text/plain")
+	do(t, "PUT", srv.URL+"/api/fileserver/b", "same", "Content-Type", "text/csv")
+	waitForWrites(t)
+	if names := stored(); len(names) != 1 || names[0] != blob {
+		t.Fatalf("stored %q, want just %s", names, blob)
+	}
+	if names, _ := store.List(ctx, ""); len(names) != 2 {
+		t.Fatalf("listed %q, want a and b", names)
+	}
+	if refs := mr.HGet(blobRefsKey, blobHash("same")); refs != "2" {
+		t.Fatalf("blob has %s refs, want 2", refs)
+	}
+
+	// each name keeps its own type
+	mr.FlushAll()
+	mr.HSet(pointersKey, "a", mustPointer(t, "same", "text/plain"))
+	mr.HSet(pointersKey, "b", mustPointer(t, "same", "text/csv"))
+	mr.HSet(blobRefsKey, blobHash("same"), "2")
+	resp, body := do(t, "GET", srv.URL+"/api/fileserver/b", "")
+	if body != "same" || resp.Header.Get("Content-Type") != "text/csv" {
+		t.Fatalf("GET b: got %q as %q", body, resp.Header.Get("Content-Type"))
+	}
+	if resp, _ := do(t, "GET", srv.URL+"/api/fileserver/"+blob, ""); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("GET of a blob by name: got %d, want 400", resp.StatusCode)
+	}
+
+	// the blob outlives a but not b
+	do(t, "DELETE", srv.URL+"/api/fileserver/a", "")
+	waitForWrites(t)
+	if names := stored(); len(names) != 1 {
+		t.Fatalf("stored %q after deleting a, want the blob b still points at", names)
+	}
+	do(t, "PUT", srv.URL+"/api/fileserver/b", "different")
+	waitForWrites(t)
+	if names := stored(); len(names) != 1 || names[0] != blobPrefix+blobHash("different") {
+		t.Fatalf("stored %q after overwriting b, want only its new blob", names)
+	}
+	do(t, "DELETE", srv.URL+"/api/fileserver/b", "")
+	waitForWrites(t)
+	if refs, _ := mr.HKeys(blobRefsKey); len(stored()) != 0 || len(refs) != 0 {
+		t.Fatalf("stored %q with refs %q after deleting everything", stored(), refs)
+	}
+	if mr.Exists(blobLockKey(blobHash("same"))) {
+		t.Fatal("a blob lock was left behind")
+	}
+
+	// files from before dedup are read in place and moved into a blob by their next write
+	inner.Put(ctx, "legacy", strings.NewReader("old"), fileMeta{})
+	if _, body := do(t, "GET", srv.URL+"/api/fileserver/legacy", ""); body != "old" {
+		t.Fatalf("GET legacy: got %q", body)
+	}
+	do(t, "PUT", srv.URL+"/api/fileserver/legacy", "new")
+	waitForWrites(t)
+	if names := stored(); len(names) != 1 || !isBlobName(names[0]) {
+		t.Fatalf("stored %q after rewriting legacy, want one blob", names)
+	}
+}
+
+func mustPointer(t *testing.T, body string, contentType string) string {
+	t.Helper()
+	b, err := json.Marshal(dedupPointer{Hash: blobHash(body), Meta: fileMeta{ContentType: contentType}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestDedupBlobLockIsShared(t *testing.T) {
+	t.Setenv("DEDUP_ENABLED", "true")
+	t.Setenv("WRITE_THROUGH", "true")
+	mr, srv := newTestServer(t)
+
+	// another replica is taking or dropping a reference to the blob
+	lock := blobLockKey(blobHash("same"))
+	mr.Set(lock, "other replica")
+	written := make(chan int, 1)
+	go func() {
+		resp, _ := do(t, "PUT", srv.URL+"/api/fileserver/a", "same")
+		written <- resp.StatusCode
+	}()
+	select {
+	case code := <-written:
+		t.Fatalf("PUT answered %d while another replica held the blob's lock", code)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	mr.Del(lock)
+	if code := <-written; code != http.StatusCreated {
+		t.Fatalf("PUT once the lock was free: got %d, want 201", code)
+	}
+	if refs := mr.HGet(blobRefsKey, blobHash("same")); refs != "1" || mr.Exists(lock) {
+		t.Fatalf("blob has %s refs, lock left behind %v", refs, mr.Exists(lock))
+	}
+}
+
+func TestDedupOverHTTPBackend(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL+"/s#")
+	t.Setenv("DEDUP_ENABLED", "true")
+	t.Setenv("ADMIN_TOKEN", "secret")
+	_, srv := newTestServer(t)
+	auth := []string{"Authorization", "Bearer secret"}
+	do(t, "PUT", srv.URL+"/api/fileserver/a.txt", "hello")
+	waitForWrites(t)
+
+	// the admin endpoints reach the fileservers under the dedup layer
+	for _, req := range []struct{ method, path string }{
+		{"GET", "/admin/breakers"},
+		{"POST", "/admin/breakers/1/reset"},
+		{"POST", "/admin/shards/1/drain"},
+		{"POST", "/admin/shards/1/undrain"},
+	} {
+		if resp, body := do(t, req.method, srv.URL+req.path, "", auth...); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s %s: got %d %q", req.method, req.path, resp.StatusCode, body)
+		}
+	}
+	resp, body := do(t, "GET", srv.URL+"/api/fileserver/a.txt/info", "", auth...)
+	var info fileInfo
+	if err := json.Unmarshal([]byte(body), &info); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("info: got %d %q", resp.StatusCode, body)
+	}
+	if info.ShardURL != fmt.Sprintf("%s/s%d", fs.URL, info.Shard) || info.Shard == 0 {
+		t.Errorf("info shard %d at %q", info.Shard, info.ShardURL)
+	}
+	if hs, ok := httpBackend(); !ok || hs != store.(*dedupStorage).Unwrap() {
+		t.Error("httpBackend didn't find the fileservers under dedup")
+	}
+}
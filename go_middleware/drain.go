@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// draining is set once shutdown starts. Reads are still served, anything else is turned away
+// so clients send it to another replica.
+var draining atomic.Bool
+
+// rejectWhileDraining answers every request but GET and HEAD with a 503 once draining
+func rejectWhileDraining(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "server is shutting down, try another instance", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type readyResponse struct {
+	Status string          `json:"status"`
+	Shards map[string]bool `json:"shards,omitempty"` // last health probe of each shard, when probing
+}
+
+// getReady is the load balancer's readiness check, failing as soon as draining starts so new
+// traffic moves elsewhere while reads already on their way still get answered. With shard
+// probing it also fails once every shard is down. One shard down leaves most files servable,
+// and the other replicas share the same shards, so failing on that would only empty the pool.
+// With READY_MAX_WRITE_LAG it fails while the write-behind queue is stalled past it, so the
+// replica stops taking more writes it can't forward.
+func getReady(w http.ResponseWriter, r *http.Request) {
+	resp, code := readyResponse{Status: "ready"}, http.StatusOK
+	if shardHealth != nil {
+		resp.Shards = shardHealth.shards()
+		if !shardHealth.anyUp() {
+			resp.Status, code = "shards down", http.StatusServiceUnavailable
+		}
+	}
+	if limit := cfg().readyMaxWriteLag; limit > 0 && writes.oldest() > limit {
+		resp.Status, code = "write lag", http.StatusServiceUnavailable
+	}
+	if draining.Load() {
+		resp.Status, code = "draining", http.StatusServiceUnavailable
+	}
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// drain stops taking writes, flushes combined PUTs without waiting out their window, waits up
+// to DRAIN_TIMEOUT for the write-behind queue to reach the backends, then shuts server down,
+// letting requests in flight finish
+func drain(server *http.Server) {
+	draining.Store(true)
+	flushCombinedWrites()
+	slog.Info("Draining, new writes are refused", "pending", writes.depth())
+
+	deadline := time.Now().Add(cfg().drainTimeout)
+	for writes.depth() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := writes.depth(); n > 0 {
+		slog.Warn("Drain timed out with writes still queued", "pending", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg().drainTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		slog.Error("Shutdown did not finish cleanly", "err", err)
+	}
+}
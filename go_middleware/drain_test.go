@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDrainRefusesWritesKeepsReads(t *testing.T) {
+	_, srv := newTestServer(t)
+	t.Cleanup(func() { draining.Store(false) })
+	u := srv.URL + "/api/fileserver/d.txt"
+	do(t, "PUT", u, "x")
+	waitForWrites(t)
+	if resp, _ := do(t, "GET", srv.URL+"/ready", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("/ready before draining: got %d, want 200", resp.StatusCode)
+	}
+
+	// a write still queued when shutdown starts reaches the backend before drain returns
+	store = slowStorage{Storage: store, delay: 100 * time.Millisecond}
+	do(t, "PUT", srv.URL+"/api/fileserver/late.txt", "queued")
+	server := httptest.NewUnstartedServer(nil).Config
+	drain(server)
+	if n := writes.depth(); n != 0 {
+		t.Fatalf("drain returned with %d writes queued", n)
+	}
+	if _, _, err := store.Get(t.Context(), "late.txt"); err != nil {
+		t.Fatalf("queued write lost in the drain: %v", err)
+	}
+
+	for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+		resp, _ := do(t, method, u, "y")
+		if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+			t.Errorf("%s while draining: got %d, Retry-After %q", method, resp.StatusCode, resp.Header.Get("Retry-After"))
+		}
+	}
+	for _, method := range []string{"GET", "HEAD"} {
+		if resp, _ := do(t, method, u, ""); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s while draining: got %d, want 200", method, resp.StatusCode)
+		}
+	}
+	if resp, body := do(t, "GET", srv.URL+"/ready", ""); resp.StatusCode != http.StatusServiceUnavailable || body != `{"status":"draining"}` {
+		t.Fatalf("/ready while draining: got %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// etagFor derives a strong ETag from a file's content
+func etagFor(data []byte) string {
+	return fmt.Sprintf("\"%016x\"", hashBody(data))
+}
+
+// etagMatches reports whether an If-Match / If-None-Match header value matches etag.
+// The header may be "*" or a comma separated list; weak tags compare by their opaque value.
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified answers a GET or HEAD with a 304 when its If-None-Match already has etag, or
+// without one, when the file hasn't changed since If-Modified-Since. Headers set so far, like
+// Vary, go out with it, a body never does.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if !etagMatches(ifNoneMatch, etag) {
+			return false
+		}
+	} else {
+		since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		// Last-Modified only has whole seconds, so compare at that precision
+		if err != nil || modified.IsZero() || modified.Truncate(time.Second).After(since) {
+			return false
+		}
+	}
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
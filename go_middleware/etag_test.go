@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestEtagMatches(t *testing.T) {
+	etag := `"abc"`
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"x", "abc"`, true},
+		{`*`, true},
+		{`"abd"`, false},
+		{``, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, etag); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestConditionalDelete(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL)
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/b.txt"
+	do(t, "PUT", u, "v1")
+	waitFor(t, func() bool { return mr.Exists(bodyKey("b.txt")) })
+	resp, _ := do(t, "GET", u, "")
+	etag := resp.Header.Get("ETag")
+	if etag != etagFor([]byte("v1")) {
+		t.Fatalf("ETag: got %q, want %q", etag, etagFor([]byte("v1")))
+	}
+
+	resp, _ = do(t, "DELETE", u, "", "If-Match", `"stale"`)
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("stale If-Match: got %d, want 412", resp.StatusCode)
+	}
+	if _, body := do(t, "GET", u, ""); body != "v1" {
+		t.Fatalf("file after a refused DELETE: got %q, want v1", body)
+	}
+
+	// checked against storage too, not just the cache
+	mr.FlushAll()
+	resp, _ = do(t, "DELETE", u, "", "If-Match", etag)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("matching If-Match: got %d, want 200", resp.StatusCode)
+	}
+	waitFor(t, func() bool {
+		_, ok := fs.file("/b.txt")
+		return !ok
+	})
+	if resp, _ := do(t, "GET", u, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET after DELETE: got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestConditionalHead(t *testing.T) {
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/h.txt"
+	do(t, "PUT", u, "hello")
+	waitForWrites(t)
+
+	resp, body := do(t, "HEAD", u, "")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || body != "" || etag == "" {
+		t.Fatalf("HEAD: got %d %q, ETag %q", resp.StatusCode, body, etag)
+	}
+	// the same from the cache and from storage
+	for _, where := range []string{"cache", "storage"} {
+		for _, method := range []string{"HEAD", "GET"} {
+			resp, body := do(t, method, u, "", "If-None-Match", etag)
+			if resp.StatusCode != http.StatusNotModified || body != "" {
+				t.Fatalf("%s %s with a matching ETag: got %d %q", where, method, resp.StatusCode, body)
+			}
+		}
+		mr.FlushAll()
+	}
+	if resp, body := do(t, "HEAD", u, "", "If-None-Match", `"other"`); resp.StatusCode != http.StatusOK || body != "" {
+		t.Fatalf("HEAD with another ETag: got %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const eventsPath = "/api/fileserver/events"
+
+// eventsChannel is the redis pub/sub channel file changes are published on, so a client
+// streaming from one replica hears about writes finished on every other
+const eventsChannel = "file-events"
+
+// how often an idle event stream gets a comment, so proxies don't time it out
+const eventsKeepAlive = 15 * time.Second
+
+// event types, the SSE "event:" field
+const (
+	eventPut    = "put"
+	eventDelete = "delete"
+)
+
+// fileEvent is published once a write has reached the backend. Deletes aren't issued a version,
+// so they carry none.
+type fileEvent struct {
+	Event   string `json:"event"`
+	File    string `json:"file"`
+	Version int64  `json:"version,omitempty"`
+}
+
+// publishEvent announces a finished change to event streams and the webhook. Notifications
+// are best effort, a failure is logged and the change stands.
+func publishEvent(ctx context.Context, event string, fileName string, version int64) {
+	hooks.notify(event, fileName, version)
+
+	b, _ := json.Marshal(fileEvent{Event: event, File: fileName, Version: version})
+	err := redisClient.Publish(ctx, eventsChannel, b).Err()
+	if err != nil {
+		slog.Error("Redis PUBLISH error", "file", fileName, "err", err)
+	}
+}
+
+// eventsClosing is closed when the server shuts down, ending every open stream so they don't
+// hold up the drain
+var (
+	eventsClosing   = make(chan struct{})
+	closeEventsOnce sync.Once
+)
+
+// eventStreams counts the open streams against MAX_EVENT_STREAMS
+var eventStreams atomic.Int64
+
+func closeEventStreams() {
+	closeEventsOnce.Do(func() { close(eventsClosing) })
+}
+
+// streamEvents answers GET /api/fileserver/events?prefix= with a server-sent event stream of
+// put and delete events for the caller's files, optionally only those starting with prefix.
+// A file called "events" can't be read with GET while this route exists. Streams aren't held to
+// MAX_CONCURRENT_REQUESTS, past MAX_EVENT_STREAMS open ones a new one is a 503.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	open := eventStreams.Add(1)
+	defer eventStreams.Add(-1)
+	if limit := cfg().maxEventStreams; limit > 0 && open > int64(limit) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many event streams open, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	scope, err := tenantScoped(r, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	prefix := scope + normalizeFileName(r.URL.Query().Get("prefix"))
+
+	sub := redisClient.Subscribe(ctx, eventsChannel)
+	defer sub.Close()
+	// wait for the subscription so nothing published after the 200 is missed
+	_, err = sub.Receive(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Redis Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	messages := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-eventsClosing:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			var ev fileEvent
+			if json.Unmarshal([]byte(msg.Payload), &ev) != nil || !strings.HasPrefix(ev.File, prefix) {
+				continue
+			}
+			ev.File = strings.TrimPrefix(ev.File, scope)
+			b, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Event, b)
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// openEvents starts an event stream, the lines it sends arrive on the channel
+func openEvents(t *testing.T, url string) (*http.Response, <-chan string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	lines := make(chan string, 100)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+	}()
+	return resp, lines
+}
+
+func TestEventStream(t *testing.T) {
+	_, srv := newTestServer(t)
+	resp, lines := openEvents(t, srv.URL+eventsPath+"?prefix=rep")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	do(t, "PUT", srv.URL+"/api/fileserver/other", "x")
+	do(t, "PUT", srv.URL+"/api/fileserver/report", "x")
+	do(t, "DELETE", srv.URL+"/api/fileserver/report", "")
+
+	want := []string{
+		"event: put", `data: {"event":"put","file":"report","version":1}`, "",
+		"event: delete", `data: {"event":"delete","file":"report"}`, "",
+	}
+	timeout := time.After(2 * time.Second)
+	for i, line := range want {
+		select {
+		case got := <-lines:
+			if got != line {
+				t.Fatalf("line %d: got %q, want %q", i, got, line)
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %q", line)
+		}
+	}
+}
+
+func TestEventStreamsSkipConcurrencyLimit(t *testing.T) {
+	t.Setenv("MAX_CONCURRENT_REQUESTS", "1")
+	t.Setenv("MAX_QUEUED_REQUESTS", "0")
+	t.Setenv("MAX_EVENT_STREAMS", "2")
+	_, srv := newTestServer(t)
+
+	// two open streams would hold the only request slot between them
+	for range 2 {
+		if resp, _ := openEvents(t, srv.URL+eventsPath); resp.StatusCode != http.StatusOK {
+			t.Fatalf("stream: got %d, want 200", resp.StatusCode)
+		}
+	}
+	if resp, _ := do(t, "PUT", srv.URL+"/api/fileserver/a.txt", "x"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT with streams open: got %d, want 201", resp.StatusCode)
+	}
+
+	// but they have a cap of their own
+	resp, _ := do(t, "GET", srv.URL+eventsPath, "")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("stream over MAX_EVENT_STREAMS: got %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// limits on POST /api/fileserver/exists
+const (
+	maxExistsFiles     = 1000
+	maxExistsBodyBytes = 1 << 20
+)
+
+type existsRequest struct {
+	Files []string `json:"files"`
+}
+
+// checkExists answers POST /api/fileserver/exists, which file names in {"files":[...]} exist, as a
+// batch response with "exists" on every item that could be checked. Not existing is a successful
+// answer, so those are 200s too. One redis round trip covers every cached file, only misses go to
+// storage, at most EXISTS_CONCURRENCY of them at once so a big batch can't take every backend
+// connection.
+func checkExists(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req existsRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxExistsBodyBytes)).Decode(&req)
+	if err != nil {
+		http.Error(w, "invalid request body, want {\"files\":[...]}", http.StatusBadRequest)
+		return
+	}
+	if len(req.Files) > maxExistsFiles {
+		http.Error(w, fmt.Sprintf("at most %d files per request", maxExistsFiles), http.StatusBadRequest)
+		return
+	}
+
+	// map the names as given to what they're stored under
+	results := make(map[string]batchItem, len(req.Files))
+	names := make(map[string]string, len(req.Files))
+	for _, file := range req.Files {
+		name, err := resolveFileName(r, file)
+		if err != nil {
+			results[file] = batchFailure(http.StatusBadRequest, err)
+			continue
+		}
+		names[file] = name
+	}
+
+	pipe := redisClient.Pipeline()
+	cached := make(map[string]*redis.IntCmd, len(names))
+	for file, name := range names {
+		cached[file] = pipe.Exists(ctx, bodyKey(name))
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Redis Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, max(1, cfg().existsConcurrency))
+	for file, name := range names {
+		if cached[file].Val() > 0 {
+			mu.Lock()
+			results[file] = existsItem(true)
+			mu.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			item := existsItem(false)
+			exists, err := storageHas(ctx, name)
+			if err != nil {
+				slog.Error("Storage HEAD error", "file", name, "err", err)
+				item = batchFailure(storageErrorStatus(err), err)
+			} else if exists {
+				item = existsItem(true)
+			}
+			mu.Lock()
+			results[file] = item
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	writeBatch(w, results)
+}
+
+func existsItem(exists bool) batchItem {
+	return batchItem{Status: http.StatusOK, Exists: &exists}
+}
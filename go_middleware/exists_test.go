@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestExistsMixed(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	t.Setenv("EXISTS_CONCURRENCY", "4")
+	mr, srv := newTestServer(t)
+
+	// cached, stored but evicted from the cache, and missing, enough of each to overlap
+	var files []string
+	for i := range 20 {
+		cached, evicted := fmt.Sprintf("cached%d", i), fmt.Sprintf("evicted%d", i)
+		do(t, "PUT", srv.URL+"/api/fileserver/"+cached, "x")
+		do(t, "PUT", srv.URL+"/api/fileserver/"+evicted, "x")
+		files = append(files, cached, evicted, fmt.Sprintf("missing%d", i))
+	}
+	waitForWrites(t)
+	for i := range 20 {
+		mr.Del(bodyKey(fmt.Sprintf("evicted%d", i)))
+	}
+	before := fs.count(http.MethodGet)
+
+	body, _ := json.Marshal(existsRequest{Files: append(files, "..")})
+	resp, raw := do(t, "POST", srv.URL+"/api/fileserver/exists", string(body))
+	var got batchResponse
+	if err := json.Unmarshal([]byte(raw), &got); err != nil {
+		t.Fatalf("got %d %q: %v", resp.StatusCode, raw, err)
+	}
+	if resp.StatusCode != http.StatusMultiStatus || got.Summary.Failed != 1 || got.Summary.Succeeded != len(files) {
+		t.Fatalf("got %d with summary %+v", resp.StatusCode, got.Summary)
+	}
+	for _, file := range files {
+		item := got.Results[file]
+		want := file[0] != 'm'
+		if item.Status != http.StatusOK || item.Exists == nil || *item.Exists != want {
+			t.Errorf("%s: got %+v, want exists %v", file, item, want)
+		}
+	}
+	if got.Results[".."].Status != http.StatusBadRequest {
+		t.Errorf(`"..": got %+v, want a 400`, got.Results[".."])
+	}
+	// only what the cache couldn't answer went to the backend
+	if n := fs.count(http.MethodGet) - before; n != 40 {
+		t.Fatalf("%d backend reads, want 40 for the evicted and missing files", n)
+	}
+}
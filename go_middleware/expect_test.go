@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expectPut starts a PUT with Expect: 100-continue and no body yet, and reads the first
+// response, which is the 100 Continue or the early rejection
+func expectPut(t *testing.T, srvURL, name string, size int) (*http.Response, *bufio.Reader, net.Conn) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srvURL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("PUT /api/fileserver/" + name + " HTTP/1.1\r\nHost: x\r\nExpect: 100-continue\r\nContent-Length: " + strconv.Itoa(size) + "\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, br, conn
+}
+
+func TestExpectContinue(t *testing.T) {
+	t.Setenv("MAX_UPLOAD_BYTES", "10")
+	t.Setenv("ALLOWED_EXTENSIONS", "txt")
+	_, srv := newTestServer(t)
+
+	// turned away before a byte of the body is sent
+	if resp, _, _ := expectPut(t, srv.URL, "big.txt", 100); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversize upload: got %d, want 413", resp.StatusCode)
+	}
+	if resp, _, _ := expectPut(t, srv.URL, "a.exe", 5); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("disallowed extension: got %d, want 415", resp.StatusCode)
+	}
+
+	resp, br, conn := expectPut(t, srv.URL, "small.txt", 5)
+	if resp.StatusCode != http.StatusContinue {
+		t.Fatalf("acceptable upload: got %d, want 100", resp.StatusCode)
+	}
+	conn.Write([]byte("hello"))
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("after 100 Continue: got %d, want 201", resp.StatusCode)
+	}
+	waitForWrites(t)
+	if _, body := do(t, "GET", srv.URL+"/api/fileserver/small.txt", ""); body != "hello" {
+		t.Fatalf("stored: got %q", body)
+	}
+}
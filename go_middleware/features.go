@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// featureHeader switches a request onto canary behaviour, "X-Feature: streaming". Only features
+// listed in CANARY_FEATURES are honoured, anything else is ignored.
+const featureHeader = "X-Feature"
+
+// canary features, each turning one request over to a behaviour its config leaves off
+const (
+	featureStreaming     = "streaming"      // stream large GET misses, see streamThreshold
+	featureNegativeCache = "negative-cache" // remember backend 404s, as NEGATIVE_CACHE_ENABLED does
+)
+
+var knownFeatures = []string{featureStreaming, featureNegativeCache}
+
+// canaryStreamThreshold is where the streaming canary starts streaming while STREAM_THRESHOLD is 0
+const canaryStreamThreshold = 1 << 20
+
+type featuresKey struct{}
+
+// parseFeatureList reads CANARY_FEATURES, a comma separated list of features requests may turn on
+func parseFeatureList(list string) []string {
+	features := []string{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(knownFeatures, name) {
+			slog.Warn("Ignoring unknown CANARY_FEATURES entry", "feature", name)
+			continue
+		}
+		features = append(features, name)
+	}
+	return features
+}
+
+// requestFeatures stashes the canary features a request asked for with X-Feature on its context
+func requestFeatures(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var enabled []string
+		for _, value := range r.Header.Values(featureHeader) {
+			for _, name := range strings.Split(value, ",") {
+				name = strings.ToLower(strings.TrimSpace(name))
+				if slices.Contains(cfg().canaryFeatures, name) {
+					enabled = append(enabled, name)
+				}
+			}
+		}
+		if len(enabled) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), featuresKey{}, enabled))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// featureOn is true when ctx's request turned on the canary feature
+func featureOn(ctx context.Context, feature string) bool {
+	enabled, _ := ctx.Value(featuresKey{}).([]string)
+	return slices.Contains(enabled, feature)
+}
+
+// streamThreshold is STREAM_THRESHOLD, or canaryStreamThreshold for a streaming canary request
+// when STREAM_THRESHOLD leaves streaming off
+func streamThreshold(ctx context.Context) int64 {
+	if cfg().streamThreshold == 0 && featureOn(ctx, featureStreaming) {
+		return canaryStreamThreshold
+	}
+	return cfg().streamThreshold
+}
+
+// negativeCacheOn is NEGATIVE_CACHE_ENABLED, or a negative-cache canary request
+func negativeCacheOn(ctx context.Context) bool {
+	return cfg().negativeCache || featureOn(ctx, featureNegativeCache)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestParseFeatureList(t *testing.T) {
+	got := parseFeatureList(" Streaming, bogus,,negative-cache ")
+	if want := []string{featureStreaming, featureNegativeCache}; !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestCanaryStreaming(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), canaryStreamThreshold+10)
+	for _, listed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("listed=%v", listed), func(t *testing.T) {
+			if listed {
+				t.Setenv("CANARY_FEATURES", "streaming")
+			}
+			mr, srv := newTestServer(t)
+			if err := store.Put(t.Context(), "big", bytes.NewReader(big), fileMeta{}); err != nil {
+				t.Fatal(err)
+			}
+
+			// without the header the miss is buffered, as STREAM_THRESHOLD=0 says, and sent with
+			// its length
+			resp, body := do(t, "GET", srv.URL+"/api/fileserver/big", "")
+			if resp.StatusCode != http.StatusOK || body != string(big) || resp.Header.Get("Content-Length") == "" {
+				t.Fatalf("plain GET: got %d with %d bytes, Content-Length %q", resp.StatusCode, len(body), resp.Header.Get("Content-Length"))
+			}
+
+			mr.FlushAll()
+			resp, body = do(t, "GET", srv.URL+"/api/fileserver/big", "", featureHeader, "streaming")
+			if resp.StatusCode != http.StatusOK || body != string(big) {
+				t.Fatalf("canary GET: got %d with %d bytes", resp.StatusCode, len(body))
+			}
+			// a feature CANARY_FEATURES doesn't list is ignored
+			if streamed := resp.Header.Get("Content-Length") == ""; streamed != listed {
+				t.Errorf("canary GET streamed %v, want %v", streamed, listed)
+			}
+		})
+	}
+}
+
+func TestCanaryNegativeCache(t *testing.T) {
+	t.Setenv("CANARY_FEATURES", "negative-cache")
+	mr, srv := newTestServer(t)
+
+	do(t, "GET", srv.URL+"/api/fileserver/a", "")
+	do(t, "GET", srv.URL+"/api/fileserver/b", "", featureHeader, "Negative-Cache")
+	if mr.Exists(missingKey("a")) || !mr.Exists(missingKey("b")) {
+		t.Fatalf("404 remembered for a %v and b %v, want only b", mr.Exists(missingKey("a")), mr.Exists(missingKey("b")))
+	}
+}
+
+func TestStrictModeAllowsFeatureHeader(t *testing.T) {
+	for _, listed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("listed=%v", listed), func(t *testing.T) {
+			t.Setenv("STRICT_MODE", "true")
+			if listed {
+				t.Setenv("CANARY_FEATURES", "streaming")
+			}
+			_, srv := newTestServer(t)
+
+			want := http.StatusBadRequest
+			if listed {
+				want = http.StatusNotFound
+			}
+			if resp, _ := do(t, "GET", srv.URL+"/api/fileserver/f", "", featureHeader, "streaming"); resp.StatusCode != want {
+				t.Fatalf("got %d, want %d", resp.StatusCode, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type forwardedHeadersKey struct{}
+
+// forwardHeaders stashes the FORWARD_HEADERS a client sent on its request context. The context
+// travels with write-behind work, so the headers still reach the backend after the ack.
+func forwardHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded := http.Header{}
+		for _, name := range cfg().forwardHeaders {
+			for _, value := range r.Header.Values(name) {
+				forwarded.Add(name, value)
+			}
+		}
+		if len(forwarded) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), forwardedHeadersKey{}, forwarded))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setBackendHeaders copies the client's forwarded headers, the request ID and BACKEND_AUTH_HEADER
+// onto an outbound backend request. The configured auth header is set last so a client can't
+// override it.
+func setBackendHeaders(ctx context.Context, req *http.Request) {
+	if forwarded, ok := ctx.Value(forwardedHeadersKey{}).(http.Header); ok {
+		for name, values := range forwarded {
+			req.Header[name] = values
+		}
+	}
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set(cfg().requestIDHeader, id)
+	}
+	if cfg().backendAuthName != "" {
+		req.Header.Set(cfg().backendAuthName, cfg().backendAuthValue)
+	}
+}
+
+// framingHeaders describe the backend's response rather than the file, we set our own
+var framingHeaders = []string{"Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding", "Connection"}
+
+// backendResponseHeaders picks the BACKEND_RESPONSE_HEADERS off a fileserver response, for getFile
+// to pass on when it serves the file
+func backendResponseHeaders(resp *http.Response) http.Header {
+	var picked http.Header
+	for _, name := range cfg().passResponseHeaders {
+		values := resp.Header.Values(name)
+		if len(values) == 0 || slices.Contains(framingHeaders, name) {
+			continue
+		}
+		if picked == nil {
+			picked = http.Header{}
+		}
+		picked[name] = values
+	}
+	return picked
+}
+
+// parseHeaderList reads a comma separated list of header names into canonical form
+func parseHeaderList(list string) []string {
+	names := []string{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
+}
+
+// shardAuthHeader is the header SHARD_AUTH values go in, BACKEND_AUTH_HEADER's name if that's
+// set and Authorization otherwise
+func shardAuthHeader() string {
+	if cfg().backendAuthName != "" {
+		return cfg().backendAuthName
+	}
+	return "Authorization"
+}
+
+// parseShardAuth reads SHARD_AUTH, comma separated shard=value pairs like "1=Bearer abc,2=Bearer
+// def". Bad entries are skipped with a warning that names the entry's position, never its value.
+func parseShardAuth(list string) map[uint32]string {
+	auth := map[uint32]string{}
+	for i, entry := range strings.Split(list, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		shardStr, value, found := strings.Cut(entry, "=")
+		shard, err := strconv.Atoi(strings.TrimSpace(shardStr))
+		if !found || err != nil || shard < 1 || shard > shardCount || strings.TrimSpace(value) == "" {
+			slog.Warn("Ignoring invalid SHARD_AUTH entry", "position", i+1)
+			continue
+		}
+		auth[uint32(shard)] = strings.TrimSpace(value)
+	}
+	return auth
+}
+
+// parseHeaderLine splits a "Name: value" header line, returning an empty name if it has no colon
+func parseHeaderLine(line string) (name string, value string) {
+	name, value, found := strings.Cut(line, ":")
+	if !found {
+		return "", ""
+	}
+	return http.CanonicalHeaderKey(strings.TrimSpace(name)), strings.TrimSpace(value)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestForwardHeaders(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	t.Setenv("FORWARD_HEADERS", "x-client-region, traceparent")
+	t.Setenv("BACKEND_AUTH_HEADER", "Authorization: Bearer backend")
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/f"
+	headers := []string{"X-Client-Region", "eu", "X-Other", "no", "Authorization", "Bearer client"}
+
+	do(t, "PUT", u, "x", headers...)
+	waitForWrites(t)
+	mr.FlushAll()
+	do(t, "GET", u, "", headers...)
+
+	received := fs.received()
+	if len(received) != 2 {
+		t.Fatalf("backend got %d requests, want a PUT and a GET", len(received))
+	}
+	for _, req := range received {
+		if got := req.header.Get("X-Client-Region"); got != "eu" {
+			t.Errorf("%s: allowlisted header got %q, want eu", req.method, got)
+		}
+		if got := req.header.Get("X-Other"); got != "" {
+			t.Errorf("%s: header off the allowlist reached the backend as %q", req.method, got)
+		}
+		// the client's credentials are for us, the backend gets its own
+		if got := req.header.Get("Authorization"); got != "Bearer backend" {
+			t.Errorf("%s: Authorization got %q, want the backend's", req.method, got)
+		}
+	}
+}
+
+func TestShardAuth(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL+"/s#")
+	t.Setenv("SHARD_AUTH", "1=Bearer one,2=Bearer two,3=Bearer three,4=Bearer four,5=Bearer five")
+	mr, srv := newTestServer(t)
+
+	names := []string{"a", "b", "c", "d", "e", "f", "g"}
+	for _, name := range names {
+		do(t, "PUT", srv.URL+"/api/fileserver/"+name, "x")
+	}
+	waitForWrites(t)
+	mr.FlushAll()
+	for _, name := range names {
+		do(t, "GET", srv.URL+"/api/fileserver/"+name, "")
+		do(t, "DELETE", srv.URL+"/api/fileserver/"+name, "")
+	}
+	waitForWrites(t)
+
+	want := map[string]string{"/s1/": "Bearer one", "/s2/": "Bearer two", "/s3/": "Bearer three", "/s4/": "Bearer four", "/s5/": "Bearer five"}
+	for _, req := range fs.received() {
+		shard := req.path[:4]
+		if got := req.header.Get("Authorization"); got != want[shard] {
+			t.Errorf("%s %s: got Authorization %q, want %q", req.method, req.path, got, want[shard])
+		}
+	}
+	if n := len(fs.received()); n != 3*len(names) {
+		t.Fatalf("%d backend requests, want %d", n, 3*len(names))
+	}
+}
+
+func TestShardAuthKeepsSecretsOutOfLogs(t *testing.T) {
+	logs := captureLogs(t, "info")
+	auth := parseShardAuth("1=Bearer one,9=Bearer topsecret,nonsense")
+	if len(auth) != 1 || auth[1] != "Bearer one" {
+		t.Fatalf("got %v", auth)
+	}
+	out := logs()
+	for _, position := range []int{2, 3} {
+		if !strings.Contains(out, fmt.Sprintf("position=%d", position)) {
+			t.Errorf("no warning for entry %d in %q", position, out)
+		}
+	}
+	if strings.Contains(out, "topsecret") || strings.Contains(out, "nonsense") {
+		t.Fatalf("SHARD_AUTH values logged: %q", out)
+	}
+}
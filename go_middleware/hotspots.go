@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Access counts are kept in one redis sorted set per minute, "hits:<unix minute>", each expiring
+// once it falls out of HOTSPOT_WINDOW. The window slides a minute at a time, ranking unions the
+// buckets it covers.
+const (
+	hitsKeyPrefix = "hits:"
+	hotspotBucket = time.Minute
+)
+
+const (
+	// GETs waiting to be counted before new ones go uncounted
+	hotspotQueueSize = 10000
+	// most distinct files one pipeline flushes
+	maxHotspotBatch = 1000
+	// default and largest top= for GET /admin/hotspots
+	defaultHotspotTop = 10
+	maxHotspotTop     = 1000
+)
+
+// hotspotCounter counts GETs off the request path. A single worker folds whatever is queued
+// into one pipeline of ZINCRBYs, so a burst on one file is a single redis command.
+type hotspotCounter struct {
+	hits chan string
+}
+
+// hotspots is nil unless HOTSPOT_WINDOW is set
+var hotspots *hotspotCounter
+
+func newHotspotCounter() *hotspotCounter {
+	c := &hotspotCounter{hits: make(chan string, hotspotQueueSize)}
+	go c.run()
+	return c
+}
+
+// record never blocks, a full queue leaves the GET uncounted rather than hold it up
+func (c *hotspotCounter) record(fileName string) {
+	if c == nil {
+		return
+	}
+	select {
+	case c.hits <- fileName:
+	default:
+	}
+}
+
+func (c *hotspotCounter) run() {
+	for name := range c.hits {
+		counts := map[string]int64{name: 1}
+	drain:
+		for len(counts) < maxHotspotBatch {
+			select {
+			case name := <-c.hits:
+				counts[name]++
+			default:
+				break drain
+			}
+		}
+		c.flush(counts)
+	}
+}
+
+func (c *hotspotCounter) flush(counts map[string]int64) {
+	ctx := context.Background()
+	key := hitsKey(time.Now())
+
+	pipe := redisClient.Pipeline()
+	for name, n := range counts {
+		pipe.ZIncrBy(ctx, key, float64(n), name)
+	}
+	pipe.Expire(ctx, key, cfg().hotspotWindow+hotspotBucket)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		slog.Error("Could not count file accesses", "files", len(counts), "err", err)
+	}
+}
+
+func hitsKey(t time.Time) string {
+	return hitsKeyPrefix + strconv.FormatInt(t.Unix()/int64(hotspotBucket/time.Second), 10)
+}
+
+// hitsKeys are the buckets covering the window up to now, newest first
+func hitsKeys(now time.Time, window time.Duration) []string {
+	buckets := int((window + hotspotBucket - 1) / hotspotBucket)
+	keys := make([]string, 0, buckets)
+	for i := range buckets {
+		keys = append(keys, hitsKey(now.Add(-time.Duration(i)*hotspotBucket)))
+	}
+	return keys
+}
+
+type hotspot struct {
+	File     string `json:"file"`
+	Accesses int64  `json:"accesses"`
+}
+
+type hotspotsResponse struct {
+	Window string    `json:"window"`
+	Files  []hotspot `json:"files"`
+}
+
+// hotspotsHandler answers GET /admin/hotspots?top=N with the N files read most over the last
+// HOTSPOT_WINDOW, busiest first. Names are as stored, tenant prefix and all.
+func hotspotsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if hotspots == nil {
+		http.Error(w, "hotspot tracking is off, set HOTSPOT_WINDOW", http.StatusNotImplemented)
+		return
+	}
+	top := defaultHotspotTop
+	if raw := r.URL.Query().Get("top"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > maxHotspotTop {
+			http.Error(w, fmt.Sprintf("top must be an integer from 1 to %d", maxHotspotTop), http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+
+	// the union only lives inside the transaction, concurrent rankings can share its key
+	union := hitsKeyPrefix + "union"
+	pipe := redisClient.TxPipeline()
+	pipe.ZUnionStore(ctx, union, &redis.ZStore{Keys: hitsKeys(time.Now(), cfg().hotspotWindow)})
+	ranked := pipe.ZRevRangeWithScores(ctx, union, 0, int64(top-1))
+	pipe.Del(ctx, union)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Redis Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	resp := hotspotsResponse{Window: cfg().hotspotWindow.String(), Files: []hotspot{}}
+	for _, z := range ranked.Val() {
+		resp.Files = append(resp.Files, hotspot{File: z.Member.(string), Accesses: int64(z.Score)})
+	}
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
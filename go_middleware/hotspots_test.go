@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHotspots(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	t.Setenv("HOTSPOT_WINDOW", "5m")
+	_, srv := newTestServer(t)
+	auth := []string{"Authorization", "Bearer secret"}
+
+	reads := map[string]int{"a": 3, "b": 5, "c": 1}
+	for name, n := range reads {
+		do(t, "PUT", srv.URL+"/api/fileserver/"+name, "x")
+		for range n {
+			do(t, "GET", srv.URL+"/api/fileserver/"+name, "")
+		}
+	}
+
+	// counting is off the request path, so give the worker a moment to flush
+	var ranked hotspotsResponse
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp, body := do(t, "GET", srv.URL+"/admin/hotspots?top=2", "", auth...)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("hotspots: got %d %q", resp.StatusCode, body)
+		}
+		if err := json.Unmarshal([]byte(body), &ranked); err != nil {
+			t.Fatal(err)
+		}
+		if len(ranked.Files) == 2 && ranked.Files[0].Accesses == 5 && ranked.Files[1].Accesses == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("hotspots never ranked b then a: %+v", ranked)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ranked.Files[0].File != "b" || ranked.Files[1].File != "a" || ranked.Window != "5m0s" {
+		t.Fatalf("got %+v, want b then a over 5m0s", ranked)
+	}
+
+	for _, top := range []string{"0", "-1", "x", "1001"} {
+		if resp, _ := do(t, "GET", srv.URL+"/admin/hotspots?top="+top, "", auth...); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("top=%s: got %d, want 400", top, resp.StatusCode)
+		}
+	}
+	if resp, _ := do(t, "GET", srv.URL+"/admin/hotspots", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without the admin token: got %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestHotspotsOff(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	_, srv := newTestServer(t)
+	if resp, _ := do(t, "GET", srv.URL+"/admin/hotspots", "", "Authorization", "Bearer secret"); resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("got %d, want 501", resp.StatusCode)
+	}
+}
+
+func TestHitsKeys(t *testing.T) {
+	tests := []struct {
+		window time.Duration
+		want   []string
+	}{
+		{time.Minute, []string{"hits:10"}},
+		{90 * time.Second, []string{"hits:10", "hits:9"}},
+		{3 * time.Minute, []string{"hits:10", "hits:9", "hits:8"}},
+	}
+	for _, tt := range tests {
+		if got := hitsKeys(time.Unix(600, 0), tt.window); !slices.Equal(got, tt.want) {
+			t.Errorf("hitsKeys(%v) = %q, want %q", tt.window, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// index formats, picked from the Accept header
+const (
+	indexJSON = "application/json"
+	indexHTML = "text/html"
+)
+
+type indexPage struct {
+	Prefix string
+	Files  []string
+	Next   string // link to the next page, empty on the last
+}
+
+var indexTemplate = template.Must(template.New("index").Funcs(template.FuncMap{
+	"fileURL": func(name string) string { return filePathPrefix + url.PathEscape(name) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Prefix}}</title></head>
+<body>
+<h1>Index of {{.Prefix}}</h1>
+<ul>
+{{range .Files}}<li><a href="{{fileURL .}}">{{.}}</a></li>
+{{end}}</ul>
+{{if .Next}}<p><a href="{{.Next}}">Next page</a></p>
+{{end}}</body>
+</html>
+`))
+
+// isIndexPath is true for /api/fileserver/<prefix>/, which GET serves as an index when
+// INDEX_LISTINGS is on rather than having TRAILING_SLASH treat it as the file <prefix>
+func isIndexPath(r *http.Request) bool {
+	if !cfg().indexListings || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	prefix, ok := strings.CutPrefix(r.URL.Path, filePathPrefix)
+	return ok && strings.Index(prefix, "/") == len(prefix)-1 && len(prefix) > 1
+}
+
+// getIndex answers GET /api/fileserver/{prefix}/?limit=&cursor=&detail=, the files starting with
+// prefix paged like GET /api/fileserver?prefix= does. The page is the same JSON unless Accept
+// prefers text/html, which gets a page linking to each file.
+func getIndex(w http.ResponseWriter, r *http.Request) {
+	prefix := normalizeFileName(r.PathValue("prefix"))
+	resp, names, ok := listPage(w, r, prefix)
+	if !ok {
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	// q-values weigh media types the same way they do codings, ties go to JSON
+	if negotiateEncoding(r.Header.Get("Accept"), []string{indexJSON, indexHTML}) != indexHTML {
+		b, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+		return
+	}
+
+	page := indexPage{Prefix: prefix, Files: names}
+	if resp.Truncated {
+		query := r.URL.Query()
+		query.Set("cursor", resp.Cursor)
+		page.Next = "?" + query.Encode()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	indexTemplate.Execute(w, page)
+}
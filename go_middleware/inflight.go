@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	errBudgetExceeded = errors.New("too many upload bytes in flight")
+	errShortBody      = errors.New("request body is shorter than its Content-Length")
+)
+
+var inflightUploadBytes = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "middleware_inflight_upload_bytes",
+	Help: "Bytes of uploads held in memory, from reading the body until the backend write finishes.",
+})
+
+// byteBudget caps the upload bytes buffered across every request at once. Each body is held
+// until its write-behind finishes, so a per-request cap alone doesn't bound memory.
+type byteBudget struct {
+	used atomic.Int64
+	max  int64 // 0 disables the cap
+}
+
+var uploads = &byteBudget{}
+
+// reserve claims n bytes, or reports false if that would go over the cap
+func (b *byteBudget) reserve(n int64) bool {
+	for {
+		used := b.used.Load()
+		if b.max > 0 && used+n > b.max {
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+n) {
+			inflightUploadBytes.Set(float64(used + n))
+			return true
+		}
+	}
+}
+
+func (b *byteBudget) release(n int64) {
+	inflightUploadBytes.Set(float64(b.used.Add(-n)))
+}
+
+// readBody reads an upload against the budget. A declared Content-Length is reserved up front so
+// an upload that can't fit is turned away before any of it is read, bodies without one are
+// reserved as they arrive. On success the caller owns held and must release it once the body is freed.
+// A body cut short of its Content-Length fails with errShortBody unless CHECK_CONTENT_LENGTH is off,
+// in which case whatever arrived is kept.
+func (b *byteBudget) readBody(r io.Reader, contentLength int64) (body []byte, held int64, err error) {
+	if contentLength > 0 {
+		if !b.reserve(contentLength) {
+			return nil, 0, errBudgetExceeded
+		}
+		body, err = io.ReadAll(r)
+		if errors.Is(err, io.ErrUnexpectedEOF) || (err == nil && int64(len(body)) < contentLength) {
+			err = errShortBody
+			if !cfg().checkContentLength {
+				err = nil
+			}
+		}
+		if err != nil {
+			b.release(contentLength)
+			return nil, 0, err
+		}
+		// the server never reads past Content-Length, so at most this gives some back
+		b.release(contentLength - int64(len(body)))
+		return body, int64(len(body)), nil
+	}
+
+	br := &budgetReader{r: r, budget: b}
+	body, err = io.ReadAll(br)
+	if err != nil {
+		b.release(br.held)
+		return nil, 0, err
+	}
+	return body, br.held, nil
+}
+
+// budgetReader reserves bytes from a budget as they're read
+type budgetReader struct {
+	r      io.Reader
+	budget *byteBudget
+	held   int64
+}
+
+func (br *budgetReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	if n > 0 {
+		if !br.budget.reserve(int64(n)) {
+			return 0, errBudgetExceeded
+		}
+		br.held += int64(n)
+	}
+	return n, err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInflightBytesBudget(t *testing.T) {
+	t.Setenv("MAX_INFLIGHT_BYTES", "10")
+	_, srv := newTestServer(t)
+	store = slowStorage{Storage: store, delay: 200 * time.Millisecond}
+
+	// the first body stays held until its write-behind finishes
+	if resp, _ := do(t, "PUT", srv.URL+"/api/fileserver/a", "12345678"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("first PUT: got %d, want 201", resp.StatusCode)
+	}
+	if resp, _ := do(t, "PUT", srv.URL+"/api/fileserver/b", "12345678"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("PUT over the budget: got %d, want 503", resp.StatusCode)
+	}
+
+	// without a Content-Length the budget runs out part way through reading
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("123456"))
+		pw.Close()
+	}()
+	req, _ := http.NewRequest("PUT", srv.URL+"/api/fileserver/c", pr)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("chunked PUT over the budget: got %d, want 503", resp.StatusCode)
+	}
+
+	waitForWrites(t)
+	if used := uploads.used.Load(); used != 0 {
+		t.Fatalf("%d bytes still held after the writes finished", used)
+	}
+	if _, body := do(t, "GET", srv.URL+"/metrics", ""); !strings.Contains(body, "middleware_inflight_upload_bytes 0") {
+		t.Fatal("metric doesn't show the budget released")
+	}
+}
+
+// shortPut sends a PUT declaring ten bytes but carrying four, then closes its side
+func shortPut(t *testing.T, srvURL, name string) int {
+	t.Helper()
+	c, err := net.Dial("tcp", strings.TrimPrefix(srvURL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("PUT /api/fileserver/" + name + " HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\nabcd"))
+	c.(*net.TCPConn).CloseWrite()
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestShortBody(t *testing.T) {
+	for _, check := range []string{"true", "false"} {
+		t.Run(check, func(t *testing.T) {
+			t.Setenv("CHECK_CONTENT_LENGTH", check)
+			_, srv := newTestServer(t)
+			code := shortPut(t, srv.URL, "s.txt")
+			waitForWrites(t)
+			resp, body := do(t, "GET", srv.URL+"/api/fileserver/s.txt", "")
+
+			if check == "true" {
+				if code != http.StatusBadRequest {
+					t.Fatalf("short upload: got %d, want 400", code)
+				}
+				if resp.StatusCode != http.StatusNotFound {
+					t.Fatalf("GET after a rejected upload: got %d, want 404", resp.StatusCode)
+				}
+				if _, _, err := store.Get(t.Context(), "s.txt"); err == nil {
+					t.Fatal("rejected upload reached storage")
+				}
+				return
+			}
+			if code != http.StatusCreated || body != "abcd" {
+				t.Fatalf("short upload with the check off: got %d, then %q", code, body)
+			}
+		})
+	}
+}
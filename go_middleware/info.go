@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// fileInfo is the manifest served by GET /api/fileserver/{fileName}/info
+type fileInfo struct {
+	Name         string   `json:"name"`
+	Shard        uint32   `json:"shard,omitempty"`
+	ShardURL     string   `json:"shardUrl,omitempty"`
+	Size         int      `json:"size"`
+	ETag         string   `json:"etag"`
+	ContentType  string   `json:"contentType"`
+	LastModified string   `json:"lastModified,omitempty"`
+	Cached       bool     `json:"cached"`
+	Tags         []string `json:"tags"`
+}
+
+// getFileInfo gathers everything we know about a file in one place for operators. It exposes
+// backend urls, so it's registered behind requireAdmin.
+func getFileInfo(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	fileName, err := fileNameFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	unlock, ok := lockForRequest(w, r, fileName, false)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	// check before loading, which may fill the cache on a miss
+	cached, err := redisClient.Exists(ctx, bodyKey(fileName)).Result()
+	if err != nil {
+		slog.Error("Redis EXISTS error", "file", fileName, "err", err)
+	}
+
+	bodyBytes, meta, err := loadFile(ctx, fileName)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	info := fileInfo{
+		Name:        fileName,
+		Size:        len(bodyBytes),
+		ETag:        etagFor(bodyBytes),
+		ContentType: meta.ContentType,
+		Cached:      cached > 0,
+		Tags:        []string{},
+	}
+	if hs, ok := httpBackend(); ok {
+		info.ShardURL = hs.shardURL(ctx, fileName)
+		if cfg().shardingEnabled {
+			info.Shard = shardFor(ctx, fileName)
+		}
+	}
+	for key, value := range meta.Metadata {
+		info.Tags = append(info.Tags, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(info.Tags)
+
+	// an upload's recorded time wins, otherwise only some backends can say when a file was written
+	if !meta.Modified.IsZero() {
+		info.LastModified = meta.Modified.UTC().Format(time.RFC3339)
+	} else if st, ok := store.(statter); ok {
+		stat, err := st.Stat(ctx, fileName)
+		if err != nil && !errors.Is(err, errNotFound) {
+			slog.Error("Storage HEAD error", "file", fileName, "err", err)
+		}
+		if err == nil {
+			info.LastModified = stat.lastModified.UTC().Format(time.RFC3339)
+		}
+	}
+
+	b, _ := json.Marshal(info)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestFileInfo(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL+"/s#")
+	t.Setenv("ADMIN_TOKEN", "secret")
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/a.txt"
+	do(t, "PUT", u, "hello", "Content-Type", "text/csv", "X-Meta-Owner", "ops")
+	waitForWrite(t, "a.txt", func() bool { return mr.Exists(bodyKey("a.txt")) })
+
+	if resp, _ := do(t, "GET", u+"/info", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("without the admin token: got %d, want 401", resp.StatusCode)
+	}
+
+	resp, body := do(t, "GET", u+"/info", "", "Authorization", "Bearer secret")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+	var info fileInfo
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		t.Fatal(err)
+	}
+	shard := hashKey("a.txt")
+	if info.Name != "a.txt" || info.Size != 5 || info.ETag != etagFor([]byte("hello")) || info.ContentType != "text/csv" {
+		t.Errorf("file fields: %+v", info)
+	}
+	if info.Shard != shard || info.ShardURL != fmt.Sprintf("%s/s%d", fs.URL, shard) {
+		t.Errorf("shard %d at %q, want %d", info.Shard, info.ShardURL, shard)
+	}
+	if !info.Cached || info.LastModified == "" || !slices.Equal(info.Tags, []string{"owner=ops"}) {
+		t.Errorf("cache, time and tags: %+v", info)
+	}
+
+	if resp, _ := do(t, "GET", srv.URL+"/api/fileserver/missing/info", "", "Authorization", "Bearer secret"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("missing file: got %d, want 404", resp.StatusCode)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+type listResponse struct {
+	Files     any    `json:"files"` // names, or a listEntry each with ?detail=true
+	Truncated bool   `json:"truncated"`
+	Cursor    string `json:"cursor,omitempty"`
+}
+
+// listEntry describes a file in a ?detail=true listing. Sizes and etags come from the cache,
+// backends that can stat a file fill in the size for the rest, etag is left out when all we
+// could do is stat.
+type listEntry struct {
+	Name         string `json:"name"`
+	Size         *int64 `json:"size,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// listFiles answers GET /api/fileserver?prefix=&limit=&cursor=&detail=, the caller's file names in
+// order. A page never holds more than LIST_MAX_RESULTS whatever limit asks for. When there are
+// more, truncated is set and cursor is passed back to get the next page.
+func listFiles(w http.ResponseWriter, r *http.Request) {
+	resp, _, ok := listPage(w, r, normalizeFileName(r.URL.Query().Get("prefix")))
+	if !ok {
+		return
+	}
+
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// listPage is the page of the caller's files starting with prefix that r's limit, cursor and
+// detail ask for, along with the names on it. When the request is bad or storage fails, the
+// error has been written and ok is false.
+func listPage(w http.ResponseWriter, r *http.Request, prefix string) (resp listResponse, names []string, ok bool) {
+	query := r.URL.Query()
+
+	detail := false
+	if raw := query.Get("detail"); raw != "" {
+		var err error
+		detail, err = strconv.ParseBool(raw)
+		if err != nil {
+			http.Error(w, "detail must be true or false", http.StatusBadRequest)
+			return resp, nil, false
+		}
+	}
+
+	limit := cfg().listMaxResults
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return resp, nil, false
+		}
+		if limit <= 0 || n < limit {
+			limit = n
+		}
+	}
+	after, err := decodeCursor(query.Get("cursor"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return resp, nil, false
+	}
+
+	// the tenant namespace is scoped like any file name, with an empty name to list all of it
+	scope, err := tenantScoped(r, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return resp, nil, false
+	}
+
+	stored, err := store.List(r.Context(), scope+prefix)
+	if err != nil {
+		slog.Error("Storage LIST error", "prefix", scope+prefix, "err", err)
+		writeStorageError(w, err)
+		return resp, nil, false
+	}
+
+	names = []string{}
+	for _, name := range clientNames(stored, scope) {
+		if after != "" && name <= after {
+			continue
+		}
+		if limit > 0 && len(names) == limit {
+			resp.Truncated = true
+			resp.Cursor = encodeCursor(names[len(names)-1])
+			break
+		}
+		names = append(names, name)
+	}
+	resp.Files = names
+	if detail {
+		resp.Files = describeFiles(r.Context(), scope, names)
+	}
+	return resp, names, true
+}
+
+// describeFiles looks up each name on a listing page, a cache hit has everything and otherwise
+// the backend is asked for a stat if it can give one. A file that can't be described is still
+// listed, by name alone.
+func describeFiles(ctx context.Context, scope string, names []string) []listEntry {
+	st, canStat := store.(statter)
+	entries := make([]listEntry, 0, len(names))
+	for _, name := range names {
+		entry := listEntry{Name: name}
+		bodyBytes, meta, err := cacheGet(ctx, scope+name)
+		if err == nil {
+			size := int64(len(bodyBytes))
+			entry.Size, entry.ETag = &size, etagFor(bodyBytes)
+		}
+		if err == nil && !meta.Modified.IsZero() {
+			entry.LastModified = meta.Modified.UTC().Format(time.RFC3339)
+		} else if canStat {
+			stat, err := st.Stat(ctx, scope+name)
+			if err != nil && !errors.Is(err, errNotFound) {
+				slog.Error("Storage HEAD error", "file", scope+name, "err", err)
+			}
+			if err == nil {
+				if entry.Size == nil {
+					entry.Size = &stat.size
+				}
+				entry.LastModified = stat.lastModified.UTC().Format(time.RFC3339)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// clientNames drops what storage holds for our own bookkeeping, older versions, trashed copies
+// and precompressed variants, and anything outside scope, leaving the names clients wrote
+// without the scope. stored is sorted, and so is the result.
+func clientNames(stored []string, scope string) []string {
+	names := []string{}
+	for _, name := range stored {
+		name, ok := strings.CutPrefix(name, scope)
+		if !ok || strings.Contains(name, "/") || versionSuffix.MatchString(name) || isTrashName(name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	if !cfg().precompress {
+		return names
+	}
+
+	// a variant is only recognisable by its original sitting next to it
+	originals := []string{}
+	for _, name := range names {
+		if !isVariantOf(names, name) {
+			originals = append(originals, name)
+		}
+	}
+	return originals
+}
+
+func isVariantOf(names []string, name string) bool {
+	for _, enc := range cfg().compressionAlgos {
+		if base, ok := strings.CutSuffix(name, encodings[enc].suffix); ok {
+			if _, found := slices.BinarySearch(names, base); found {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cursors are the last name of the previous page, encoded so they stay opaque and url safe
+func encodeCursor(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	name, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", errInvalidCursor
+	}
+	return string(name), nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestListMaxResults(t *testing.T) {
+	t.Setenv("LIST_MAX_RESULTS", "3")
+	_, srv := newTestServer(t)
+	var want []string
+	for i := range 7 {
+		name := fmt.Sprintf("f%d", i)
+		do(t, "PUT", srv.URL+"/api/fileserver/"+name, "x")
+		want = append(want, name)
+	}
+	do(t, "PUT", srv.URL+"/api/fileserver/other", "x")
+	waitForWrites(t)
+
+	// the client asks for 50 a page, the cap holds it to 3
+	var got []string
+	cursor := ""
+	for pages := 1; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("more than 3 pages, got %v so far", got)
+		}
+		resp, body := do(t, "GET", srv.URL+"/api/fileserver?prefix=f&limit=50&cursor="+url.QueryEscape(cursor), "")
+		var page struct {
+			Files     []string `json:"files"`
+			Truncated bool     `json:"truncated"`
+			Cursor    string   `json:"cursor"`
+		}
+		if err := json.Unmarshal([]byte(body), &page); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("page %d: got %d %q", pages, resp.StatusCode, body)
+		}
+		if len(page.Files) > 3 {
+			t.Fatalf("page %d has %d files, over the cap", pages, len(page.Files))
+		}
+		got = append(got, page.Files...)
+		if !page.Truncated {
+			break
+		}
+		if page.Cursor == "" {
+			t.Fatalf("page %d is truncated without a cursor", pages)
+		}
+		cursor = page.Cursor
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("paged through %v, want %v", got, want)
+	}
+
+	if resp, _ := do(t, "GET", srv.URL+"/api/fileserver?cursor=***", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad cursor: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestListDetail(t *testing.T) {
+	mr, srv := newTestServer(t)
+	do(t, "PUT", srv.URL+"/api/fileserver/a", "hello")
+	do(t, "PUT", srv.URL+"/api/fileserver/b", "")
+	do(t, "PUT", srv.URL+"/api/fileserver/c", "worlds")
+	waitForWrites(t)
+	// c's size has to come from storage
+	mr.Del(bodyKey("c"))
+
+	resp, body := do(t, "GET", srv.URL+"/api/fileserver?detail=true&limit=5", "")
+	var page struct {
+		Files []listEntry `json:"files"`
+	}
+	if resp.StatusCode != http.StatusOK || json.Unmarshal([]byte(body), &page) != nil || len(page.Files) != 3 {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+	for i, size := range []int64{5, 0, 6} {
+		f := page.Files[i]
+		if f.Size == nil || *f.Size != size || f.LastModified == "" {
+			t.Errorf("%s: got %+v, want size %d and a lastModified", f.Name, f, size)
+		}
+	}
+	// only the cache knows etags
+	if page.Files[0].ETag == "" || page.Files[2].ETag != "" {
+		t.Errorf("etags: got %q for a cached file and %q for an uncached one", page.Files[0].ETag, page.Files[2].ETag)
+	}
+
+	// the cap holds for detailed pages too
+	t.Setenv("LIST_MAX_RESULTS", "2")
+	current.Store(loadConfig())
+	_, body = do(t, "GET", srv.URL+"/api/fileserver?detail=true", "")
+	var capped struct {
+		Files     []listEntry `json:"files"`
+		Truncated bool        `json:"truncated"`
+	}
+	if json.Unmarshal([]byte(body), &capped) != nil || len(capped.Files) != 2 || !capped.Truncated {
+		t.Fatalf("capped detail page: %q", body)
+	}
+
+	if resp, _ := do(t, "GET", srv.URL+"/api/fileserver?detail=maybe", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("detail=maybe: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestIndexListings(t *testing.T) {
+	t.Setenv("INDEX_LISTINGS", "true")
+	t.Setenv("TRAILING_SLASH", trailingSlashStrip)
+	_, srv := newTestServer(t)
+	for _, name := range []string{"rep-a", "rep-b", "rep-", "other"} {
+		do(t, "PUT", srv.URL+"/api/fileserver/"+name, "x:"+name)
+	}
+	waitForWrites(t)
+
+	resp, body := do(t, "GET", srv.URL+"/api/fileserver/rep-/", "", "Accept", "application/json")
+	var page struct {
+		Files []string `json:"files"`
+	}
+	if err := json.Unmarshal([]byte(body), &page); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("JSON index: got %d %q", resp.StatusCode, body)
+	}
+	if want := []string{"rep-", "rep-a", "rep-b"}; !slices.Equal(page.Files, want) {
+		t.Fatalf("JSON index listed %q, want %q", page.Files, want)
+	}
+
+	// a browser gets HTML, paged with a link to the next page
+	resp, body = do(t, "GET", srv.URL+"/api/fileserver/rep-/?limit=2", "", "Accept", "text/html,*/*;q=0.8")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("HTML index: got %d as %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(body, `href="/api/fileserver/rep-a"`) || strings.Contains(body, "rep-b") || !strings.Contains(body, "cursor=") {
+		t.Fatalf("HTML index page one: %s", body)
+	}
+
+	// other methods on an index path still reach the file TRAILING_SLASH strips it to
+	if resp, _ := do(t, "PUT", srv.URL+"/api/fileserver/rep-/", "y"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT rep-/: got %d, want 201", resp.StatusCode)
+	}
+	waitForWrites(t)
+	if _, body := do(t, "GET", srv.URL+"/api/fileserver/rep-", ""); body != "y" {
+		t.Fatalf("GET rep-: got %q, want y", body)
+	}
+	if _, body := do(t, "GET", srv.URL+"/api/fileserver/other", ""); body != "x:other" {
+		t.Fatalf("GET other: got %q", body)
+	}
+}
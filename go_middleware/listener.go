@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"net"
+)
+
+// listen binds addr for the public server with the TCP_KEEPALIVE settings applied to every
+// accepted connection. Go already sets SO_REUSEADDR on listening sockets, so a restart can
+// rebind while old connections sit in TIME_WAIT, and sizes the accept backlog from
+// net.core.somaxconn, which is where to raise it under connection churn.
+func listen(ctx context.Context, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAliveConfig: net.KeepAliveConfig{
+		Enable:   cfg().tcpKeepAlive,
+		Idle:     cfg().tcpKeepAliveIdle,
+		Interval: cfg().tcpKeepAliveInterval,
+		Count:    cfg().tcpKeepAliveCount,
+	}}
+	if !cfg().tcpKeepAlive {
+		lc.KeepAlive = -1
+	}
+	return lc.Listen(ctx, "tcp", addr)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestListen(t *testing.T) {
+	for _, keepAlive := range []bool{true, false} {
+		t.Run("TCP_KEEPALIVE="+strconv.FormatBool(keepAlive), func(t *testing.T) {
+			t.Setenv("TCP_KEEPALIVE", strconv.FormatBool(keepAlive))
+			t.Setenv("TCP_KEEPALIVE_IDLE", "30s")
+			t.Setenv("TCP_KEEPALIVE_INTERVAL", "5s")
+			t.Setenv("TCP_KEEPALIVE_COUNT", "3")
+			newTestServer(t)
+
+			ln, err := listen(t.Context(), "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := &http.Server{Handler: routes()}
+			go server.Serve(ln)
+			defer server.Close()
+
+			if resp, body := do(t, "GET", "http://"+ln.Addr().String()+"/health", ""); resp.StatusCode != http.StatusOK {
+				t.Fatalf("health through the listener: got %d %q", resp.StatusCode, body)
+			}
+		})
+	}
+}
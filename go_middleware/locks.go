@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// rwLock is a reader/writer lock whose acquisition can be abandoned through a context,
+// which sync.RWMutex doesn't allow. Waiting writers hold off new readers so a steady
+// stream of GETs can't starve a PUT.
+type rwLock struct {
+	mu             sync.Mutex
+	readers        int
+	writer         bool
+	writersWaiting int
+	released       chan struct{} // closed and replaced every time the lock is released
+}
+
+func newRWLock() *rwLock {
+	return &rwLock{released: make(chan struct{})}
+}
+
+func (l *rwLock) Lock(ctx context.Context) error {
+	l.mu.Lock()
+	l.writersWaiting++
+	defer func() {
+		l.writersWaiting--
+		l.mu.Unlock()
+	}()
+
+	for l.writer || l.readers > 0 {
+		if err := l.wait(ctx); err != nil {
+			// readers may have been held back for us
+			l.notify()
+			return err
+		}
+	}
+	l.writer = true
+	return nil
+}
+
+func (l *rwLock) Unlock() {
+	l.mu.Lock()
+	l.writer = false
+	l.notify()
+	l.mu.Unlock()
+}
+
+func (l *rwLock) RLock(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.writer || l.writersWaiting > 0 {
+		if err := l.wait(ctx); err != nil {
+			return err
+		}
+	}
+	l.readers++
+	return nil
+}
+
+func (l *rwLock) RUnlock() {
+	l.mu.Lock()
+	l.readers--
+	if l.readers == 0 {
+		l.notify()
+	}
+	l.mu.Unlock()
+}
+
+// wait releases mu until the lock changes hands or ctx is done. Callers hold mu.
+func (l *rwLock) wait(ctx context.Context) error {
+	released := l.released
+	l.mu.Unlock()
+	defer l.mu.Lock()
+
+	select {
+	case <-released:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// notify wakes every waiter so they can retry. Callers hold mu.
+func (l *rwLock) notify() {
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// io blocking to maintain most recent data
+type keyedLocks struct {
+	mu    sync.Mutex
+	locks map[string]*rwLock
+}
+
+func newKeyedLocks() *keyedLocks {
+	return &keyedLocks{locks: make(map[string]*rwLock)}
+}
+
+func (k *keyedLocks) get(key string) *rwLock {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = newRWLock()
+		k.locks[key] = l
+	}
+	k.mu.Unlock()
+	return l
+}
+
+// lockForRequest takes fileName's lock (exclusive for writers) on behalf of a request. If
+// LOCK_TIMEOUT passes first it answers with a 503 itself and returns ok == false.
+func lockForRequest(w http.ResponseWriter, r *http.Request, fileName string, exclusive bool) (unlock func(), ok bool) {
+	lock := fileLocks.get(fileName)
+	ctx, cancel := context.WithTimeout(r.Context(), cfg().lockTimeout)
+	defer cancel()
+
+	acquire, release := lock.RLock, lock.RUnlock
+	if exclusive {
+		acquire, release = lock.Lock, lock.Unlock
+	}
+
+	if err := acquire(ctx); err != nil {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "timed out waiting for file lock", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return release, true
+}
+
+// keyedSemaphore caps how many holders each key can have at once
+type keyedSemaphore struct {
+	mu    sync.Mutex
+	limit int
+	slots map[string]*semaphoreSlots
+}
+
+type semaphoreSlots struct {
+	held chan struct{}
+	refs int // holders plus waiters, the entry is dropped when this reaches 0
+}
+
+func newKeyedSemaphore(limit int) *keyedSemaphore {
+	return &keyedSemaphore{limit: limit, slots: make(map[string]*semaphoreSlots)}
+}
+
+// acquire waits for one of key's slots until ctx is done
+func (k *keyedSemaphore) acquire(ctx context.Context, key string) (release func(), err error) {
+	k.mu.Lock()
+	s, ok := k.slots[key]
+	if !ok {
+		s = &semaphoreSlots{held: make(chan struct{}, k.limit)}
+		k.slots[key] = s
+	}
+	s.refs++
+	k.mu.Unlock()
+
+	select {
+	case s.held <- struct{}{}:
+		return func() {
+			<-s.held
+			k.unref(key, s)
+		}, nil
+	case <-ctx.Done():
+		k.unref(key, s)
+		return nil, ctx.Err()
+	}
+}
+
+func (k *keyedSemaphore) unref(key string, s *semaphoreSlots) {
+	k.mu.Lock()
+	s.refs--
+	if s.refs == 0 {
+		delete(k.slots, key)
+	}
+	k.mu.Unlock()
+}
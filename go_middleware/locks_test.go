@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRWLockTimesOut(t *testing.T) {
+	l := newRWLock()
+	l.Lock(context.Background())
+
+	// a reader gives up on a held write lock once its deadline passes
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.RLock(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RLock on a held lock: got %v, want DeadlineExceeded", err)
+	}
+	l.Unlock()
+
+	if err := l.RLock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.RLock(context.Background()); err != nil {
+		t.Fatalf("second reader: %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Lock(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Lock under readers: got %v, want DeadlineExceeded", err)
+	}
+
+	// the abandoned writer mustn't keep new readers out
+	if err := l.RLock(context.Background()); err != nil {
+		t.Fatalf("reader after an abandoned writer: %v", err)
+	}
+	l.RUnlock()
+
+	locked := make(chan struct{})
+	go func() {
+		l.Lock(context.Background())
+		close(locked)
+	}()
+	l.RUnlock()
+	l.RUnlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("writer not woken once the readers left")
+	}
+	l.Unlock()
+}
+
+func TestLockTimeoutAnswers503(t *testing.T) {
+	fs := newFakeFileserver(t)
+	fs.files["/held.txt"] = fakeFile{body: []byte("x")}
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL)
+	t.Setenv("LOCK_TIMEOUT", "20ms")
+	_, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/held.txt"
+
+	lock := fileLocks.get("held.txt")
+	lock.Lock(context.Background())
+	resp, _ := do(t, "GET", u, "")
+	lock.Unlock()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("GET on a held lock: got %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	resp, _ = do(t, "GET", u, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET once released: got %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestKeyedSemaphore(t *testing.T) {
+	sem := newKeyedSemaphore(2)
+	ctx := context.Background()
+	release1, _ := sem.acquire(ctx, "hot")
+	release2, _ := sem.acquire(ctx, "hot")
+
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := sem.acquire(timeout, "hot"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("third holder: got %v, want DeadlineExceeded", err)
+	}
+	release, err := sem.acquire(ctx, "cold")
+	if err != nil {
+		t.Fatalf("other key: %v", err)
+	}
+	release()
+
+	release1()
+	release3, err := sem.acquire(ctx, "hot")
+	if err != nil {
+		t.Fatalf("after a release: %v", err)
+	}
+	release2()
+	release3()
+	if len(sem.slots) != 0 {
+		t.Fatalf("%d keys left with no holders", len(sem.slots))
+	}
+}
+
+func TestPerFileReaderCap(t *testing.T) {
+	entered := make(chan struct{}, 2)
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hot" {
+			entered <- struct{}{}
+			<-release
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", backend.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	t.Setenv("MAX_READERS_PER_FILE", "2")
+	t.Setenv("READER_WAIT_TIMEOUT", "20ms")
+	_, srv := newTestServer(t)
+
+	statuses := make(chan int, 2)
+	for range 2 {
+		go func() {
+			resp, err := http.Get(srv.URL + "/api/fileserver/hot")
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	// reads of one file are coalesced, so only one of them reaches the backend
+	<-entered
+	time.Sleep(20 * time.Millisecond)
+
+	resp, _ := do(t, "GET", srv.URL+"/api/fileserver/hot", "")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("reader over the cap: got %d, want 503", resp.StatusCode)
+	}
+	resp, body := do(t, "GET", srv.URL+"/api/fileserver/cold", "")
+	if resp.StatusCode != http.StatusOK || body != "/cold" {
+		t.Fatalf("another file: got %d %q", resp.StatusCode, body)
+	}
+
+	close(release)
+	for range 2 {
+		if status := <-statuses; status != http.StatusOK {
+			t.Fatalf("reader under the cap: got %d, want 200", status)
+		}
+	}
+}
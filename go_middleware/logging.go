@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logLevel is shared by the default logger so the level can be changed while running
+var logLevel = new(slog.LevelVar)
+
+// parseLogLevel maps LOG_LEVEL onto a slog level, anything unrecognised is info
+func parseLogLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+func setupLogging(level string) {
+	logLevel.Set(parseLogLevel(level))
+	handler := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})
+	slog.SetDefault(slog.New(requestIDLogHandler{handler}))
+}
+
+// requestIDLogHandler adds a request_id to records logged with a request's context, so
+// *Context log lines can be matched up with the backend's
+type requestIDLogHandler struct {
+	slog.Handler
+}
+
+func (h requestIDLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDLogHandler) WithGroup(name string) slog.Handler {
+	return requestIDLogHandler{h.Handler.WithGroup(name)}
+}
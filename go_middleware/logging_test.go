@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLogs points setupLogging's output at a file for the rest of the test and returns a
+// func reading back what was logged
+func captureLogs(t *testing.T, level string) func() string {
+	f, err := os.CreateTemp(t.TempDir(), "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr, logger, oldLevel := os.Stderr, slog.Default(), logLevel.Level()
+	t.Cleanup(func() {
+		os.Stderr = stderr
+		slog.SetDefault(logger)
+		logLevel.Set(oldLevel)
+	})
+	os.Stderr = f
+	setupLogging(level)
+	return func() string {
+		b, _ := os.ReadFile(f.Name())
+		return string(b)
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	tests := []struct {
+		level     string
+		wantDebug bool
+		wantInfo  bool
+	}{
+		{"debug", true, true},
+		{"info", false, true},
+		{"", false, true},
+		{"WARN", false, false},
+		{"error", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			logs := captureLogs(t, tt.level)
+			slog.Debug("a debug line")
+			slog.Info("an info line")
+			slog.Error("an error line")
+
+			out := logs()
+			if got := strings.Contains(out, "a debug line"); got != tt.wantDebug {
+				t.Errorf("debug line logged: %v, want %v", got, tt.wantDebug)
+			}
+			if got := strings.Contains(out, "an info line"); got != tt.wantInfo {
+				t.Errorf("info line logged: %v, want %v", got, tt.wantInfo)
+			}
+			if !strings.Contains(out, "an error line") {
+				t.Errorf("error line missing from %q", out)
+			}
+		})
+	}
+}
+
+func TestRequestLinesOnlyAtDebug(t *testing.T) {
+	for _, level := range []string{"info", "debug"} {
+		t.Run(level, func(t *testing.T) {
+			logs := captureLogs(t, level)
+			_, srv := newTestServer(t)
+			do(t, "GET", srv.URL+"/api/fileserver/missing", "")
+
+			logged := strings.Contains(logs(), "Cache Miss!")
+			if logged != (level == "debug") {
+				t.Fatalf("cache miss logged at %s: %v", level, logged)
+			}
+		})
+	}
+}
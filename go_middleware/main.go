@@ -4,244 +4,1020 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+	"time"
 
-	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/sync/singleflight"
 )
 
-// io blocking to maintain most recent data
-type keyedLocks struct {
-	mu    sync.Mutex
-	locks map[string]*sync.RWMutex
-}
-
-func newKeyedLocks() *keyedLocks {
-	return &keyedLocks{locks: make(map[string]*sync.RWMutex)}
+// backend requests get client spans and carry the caller's traceparent
+var httpClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport), CheckRedirect: checkBackendRedirect}
+var redisClient *redis.Client
+var fileLocks = newKeyedLocks()
+var fileReaders *keyedSemaphore
+var loads singleflight.Group
+var store Storage
+
+func hashBody(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
 }
 
-func (k *keyedLocks) get(key string) *sync.RWMutex {
-	k.mu.Lock()
-	l, ok := k.locks[key]
-	if !ok {
-		l = &sync.RWMutex{}
-		k.locks[key] = l
+func main() {
+	loadDotEnv()
+	current.Store(loadConfig())
+	setupLogging(cfg().logLevel)
+	if !cfg().shardingEnabled && strings.Contains(cfg().fileServerURL, "#") {
+		slog.Error("FILE_SERVER_URL has a # shard placeholder but SHARDING_ENABLED=false", "url", cfg().fileServerURL)
+		os.Exit(1)
 	}
-	k.mu.Unlock()
-	return l
-}
 
-var httpClient = &http.Client{}
-var redisClient *redis.Client
-var fileLocks = newKeyedLocks()
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		slog.Error("Could not set up tracing", "err", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
 
-func hashKey(key string) uint32 {
-	h := fnv.New32a()
-	h.Write([]byte(key))
-	return (h.Sum32() % 5) + 1
-}
+	store, err = newStorage(cfg())
+	if err != nil {
+		slog.Error("Could not set up storage", "err", err)
+		os.Exit(1)
+	}
+	if cfg().dedup {
+		store = newDedupStorage(store)
+	}
 
-func main() {
-	godotenv.Load()
 	redisClient = redis.NewClient(&redis.Options{
 		Addr:     os.Getenv("REDIS_URL"),
 		Password: "", // No password set
 		DB:       0,  // Use default DB
 	})
+	if err := redisotel.InstrumentTracing(redisClient); err != nil {
+		slog.Error("Could not instrument redis", "err", err)
+	}
+
+	uploads.max = cfg().maxInflightBytes
+	extensionTypes = parseExtensionTypes(cfg().contentTypeExts)
+
+	if hs, ok := httpBackend(); ok && cfg().shardHealthInterval > 0 {
+		shardHealth = newShardProber(httpClient, hs)
+		go shardHealth.run(context.Background())
+	}
+
+	if cfg().drFileServerURL != "" {
+		if err := checkURLTemplate("DR_FILE_SERVER_URL", cfg().drFileServerURL); err != nil {
+			slog.Error("Could not set up DR mirroring", "err", err)
+			os.Exit(1)
+		}
+		dr = newDRMirror(newHTTPStorage(httpClient, cfg().drFileServerURL), cfg().drQueueSize)
+	}
+
+	if cfg().webhookURL != "" {
+		if err := checkURLTemplate("WEBHOOK_URL", cfg().webhookURL); err != nil {
+			slog.Error("Could not set up webhooks", "err", err)
+			os.Exit(1)
+		}
+		hooks = newWebhookNotifier(cfg().webhookURL, cfg().webhookSecret, cfg().webhookQueueSize)
+	}
 
+	if cfg().maxWriteLag > 0 {
+		go watchWriteLag(context.Background())
+	}
+
+	if cfg().hotspotWindow > 0 {
+		hotspots = newHotspotCounter()
+	}
+
+	if cfg().softDelete {
+		go sweepTrash(context.Background())
+	}
+	resumeMoves(context.Background())
+
+	if cfg().maxReadersPerFile > 0 {
+		fileReaders = newKeyedSemaphore(cfg().maxReadersPerFile)
+	}
+
+	if cfg().enablePprof {
+		go func() {
+			slog.Info("Admin server listening", "addr", cfg().adminAddr)
+			err := http.ListenAndServe(cfg().adminAddr, adminRoutes())
+			slog.Error("Admin server stopped", "err", err)
+		}()
+	}
+
+	slog.Info("Server listening", "addr", "localhost:"+os.Getenv("PORT"))
+	server := &http.Server{
+		Addr:              ":" + os.Getenv("PORT"),
+		Handler:           routes(),
+		ReadHeaderTimeout: cfg().readHeaderTimeout,
+		ReadTimeout:       cfg().readTimeout,
+	}
+	server.RegisterOnShutdown(closeEventStreams)
+
+	// SIGTERM drains first, Serve returns as soon as the listener closes so wait for that
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		<-signals
+		drain(server)
+	}()
+
+	ln, err := listen(context.Background(), server.Addr)
+	if err != nil {
+		slog.Error("Could not listen", "addr", server.Addr, "err", err)
+		os.Exit(1)
+	}
+	err = server.Serve(ln)
+	if !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Server stopped", "err", err)
+		os.Exit(1)
+	}
+	<-stopped
+}
+
+// routes builds the handler chain served on PORT
+func routes() http.Handler {
 	// a request multiplexer distributes requests to their corresponding url endpoints or "patterns"
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", handleRoot)
-	mux.HandleFunc("GET /health", getHealth)
-	mux.HandleFunc("PUT /api/fileserver/{fileName}", putFile)
-	mux.HandleFunc("GET /api/fileserver/{fileName}", getFile)
-	mux.HandleFunc("DELETE /api/fileserver/{fileName}", deleteFile)
+	datasets := parseDatasetLabels(cfg().datasetLabels)
+	mux.HandleFunc("/", strictRoot(handleRoot))
+	mux.HandleFunc("GET /health", strict(requestRules{}, getHealth))
+	mux.HandleFunc("GET /ready", strict(requestRules{}, getReady))
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /api/fileserver", strict(listRules, listFiles))
+	mux.HandleFunc("PUT /api/fileserver/{fileName}", countFileRequests(datasets, strict(putRules, putFile)))
+	mux.HandleFunc("GET /api/fileserver/{fileName}", countFileRequests(datasets, strict(getRules, getFile)))
+	mux.HandleFunc("DELETE /api/fileserver/{fileName}", countFileRequests(datasets, strict(deleteRules, deleteFile)))
+	mux.HandleFunc("PATCH /api/fileserver/{fileName}", countFileRequests(datasets, strict(requestRules{}, patchFile)))
+	mux.HandleFunc("POST /api/fileserver/exists", strict(requestRules{}, checkExists))
+	mux.HandleFunc("POST /api/fileserver/archive", strict(requestRules{}, archiveFiles))
+	mux.HandleFunc("GET "+eventsPath, strict(requestRules{query: []string{"prefix"}}, streamEvents))
+	mux.HandleFunc("GET /api/fileserver/{fileName}/versions", strict(requestRules{}, listVersions))
+	mux.HandleFunc("GET /api/fileserver/{fileName}/status", strict(requestRules{query: []string{"version"}}, getWriteStatus))
+	mux.Handle("GET /api/fileserver/{fileName}/info", requireAdmin(strict(requestRules{}, getFileInfo)))
+	mux.HandleFunc("POST /api/fileserver/{fileName}/restore", strict(requestRules{}, restoreFile))
+	mux.HandleFunc("POST /api/fileserver/{fileName}/move", strict(requestRules{query: []string{"to"}}, moveFile))
+	mux.Handle("POST /api/fileserver/{fileName}/purge-cache", requireAdmin(strict(requestRules{}, purgeCache)))
+	mux.Handle("POST /admin/reload", requireAdmin(strict(requestRules{}, reloadHandler)))
+	mux.Handle("GET /admin/breakers", requireAdmin(strict(requestRules{}, breakersHandler)))
+	mux.Handle("POST /admin/breakers/{shard}/reset", requireAdmin(strict(requestRules{}, resetBreakerHandler)))
+	mux.Handle("POST /admin/reconcile", requireAdmin(strict(requestRules{}, reconcileHandler)))
+	mux.Handle("POST /admin/shards/{shard}/drain", requireAdmin(strict(requestRules{}, shardDrainHandler(true))))
+	mux.Handle("POST /admin/shards/{shard}/undrain", requireAdmin(strict(requestRules{}, shardDrainHandler(false))))
+	mux.Handle("GET /admin/hotspots", requireAdmin(strict(requestRules{query: []string{"top"}}, hotspotsHandler)))
+
+	// without these any other method on a file path would fall through to the "/" catch-all
+	mux.HandleFunc("/api/fileserver", methodNotAllowed("GET", "HEAD"))
+	mux.HandleFunc("/api/fileserver/{fileName}", methodNotAllowed("GET", "HEAD", "PUT", "PATCH", "DELETE"))
+	mux.HandleFunc("/api/fileserver/{fileName}/versions", methodNotAllowed("GET", "HEAD"))
+	mux.HandleFunc("/api/fileserver/{fileName}/status", methodNotAllowed("GET", "HEAD"))
+	mux.HandleFunc("/api/fileserver/{fileName}/info", methodNotAllowed("GET", "HEAD"))
+	mux.HandleFunc("/api/fileserver/{fileName}/restore", methodNotAllowed("POST"))
+	mux.HandleFunc("/api/fileserver/{fileName}/move", methodNotAllowed("POST"))
+	mux.HandleFunc("/api/fileserver/{fileName}/purge-cache", methodNotAllowed("POST"))
+	mux.HandleFunc("/admin/reload", methodNotAllowed("POST"))
+	mux.HandleFunc("/admin/breakers", methodNotAllowed("GET", "HEAD"))
+	mux.HandleFunc("/admin/breakers/{shard}/reset", methodNotAllowed("POST"))
+	mux.HandleFunc("/admin/reconcile", methodNotAllowed("POST"))
+	mux.HandleFunc("/admin/shards/{shard}/drain", methodNotAllowed("POST"))
+	mux.HandleFunc("/admin/shards/{shard}/undrain", methodNotAllowed("POST"))
+	mux.HandleFunc("/admin/hotspots", methodNotAllowed("GET"))
+	if cfg().indexListings {
+		mux.HandleFunc("GET /api/fileserver/{prefix}/{$}", strict(indexRules, getIndex))
+		mux.HandleFunc("/api/fileserver/{prefix}/{$}", methodNotAllowed("GET", "HEAD"))
+	}
 
-	log.Printf("Server listening to localhost:%s...", os.Getenv("PORT"))
-	http.ListenAndServe(":"+os.Getenv("PORT"), mux)
+	var handler http.Handler = cleanFilePaths(trailingSlash(mux))
+	if cfg().allowShardOverride {
+		handler = shardOverride(handler)
+	}
+	if len(cfg().forwardHeaders) > 0 {
+		handler = forwardHeaders(handler)
+	}
+	if len(cfg().canaryFeatures) > 0 {
+		handler = requestFeatures(handler)
+	}
+	if cfg().maxConcurrentRequests > 0 {
+		handler = newConcurrencyLimiter(cfg().maxConcurrentRequests, cfg().maxQueuedRequests, cfg().queueTimeout).wrap(handler)
+	}
+	handler = rejectWhileDraining(handler)
+	if cfg().securityHeaders {
+		handler = securityHeaders(handler)
+	}
+	// wrapped last, so draining and the concurrency limit see the overridden method
+	if cfg().allowMethodOverride {
+		handler = methodOverride(handler)
+	}
+	return traceServer(requestIDs(handler))
 }
 
+// what each file handler reads off a request, enforced in STRICT_MODE
+var (
+	putRules    = requestRules{headers: []string{overrideShardHeader, uploadTimeHeader, failOnConflictHeader}, headerPrefixes: []string{metaHeaderPrefix}}
+	getRules    = requestRules{query: []string{"version", "contentType", "encoding"}, headers: []string{"X-Min-Version", overrideShardHeader, noCompressionHeader}}
+	deleteRules = requestRules{headers: []string{overrideShardHeader}}
+	listRules   = requestRules{query: []string{"prefix", "limit", "cursor", "detail"}}
+	indexRules  = requestRules{query: []string{"limit", "cursor", "detail"}}
+)
+
+const rootGreeting = "You've reached my fileserver middleware!\n"
+
+// handleRoot and getHealth set their headers up front so HEAD, which monitoring tools probe
+// with, gets exactly what GET does without relying on net/http sniffing the body
 func handleRoot(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "You've reached my fileserver middleware!\n")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(rootGreeting)))
+	io.WriteString(w, rootGreeting)
+}
+
+// methodNotAllowed answers a 405 listing the methods a path does support
+func methodNotAllowed(allowed ...string) http.HandlerFunc {
+	allow := strings.Join(allowed, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+	}
 }
 
 func getHealth(w http.ResponseWriter, r *http.Request) {
-	resp := map[string]bool{"ok": true}
+	resp := healthResponse{
+		OK:            true,
+		Version:       version,
+		Commit:        commit,
+		UptimeSeconds: int64(time.Since(startedAt).Seconds()),
+		StartedAt:     startedAt.UTC().Format(time.RFC3339),
+	}
 	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
 	w.WriteHeader(http.StatusOK)
 	w.Write(b)
 }
 
 func putFile(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	log.Println("PUT", r.URL.Path)
+	// the write outlives the request, so keep its values (trace) but not its cancellation
+	ctx := context.WithoutCancel(r.Context())
+	slog.DebugContext(ctx, "PUT", "path", r.URL.Path)
 	// get url param
-	fileName := r.PathValue("fileName")
-	if fileName == "" {
-		http.Error(w, "no file name given", http.StatusBadRequest)
+	fileName, err := fileNameFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// get the shard from hash of filename
-	shard := strconv.Itoa(int(hashKey(fileName)))
-	shardUrl := strings.Replace(os.Getenv("FILE_SERVER_URL"), "#", shard, -1)
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch != "" && ifNoneMatch != "*" {
+		http.Error(w, "only If-None-Match: * is supported on PUT", http.StatusBadRequest)
+		return
+	}
+	modified, err := uploadTime(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !extensionAllowed(fileName) {
+		http.Error(w, "file extension is not in ALLOWED_EXTENSIONS", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if rejectDrainedShard(w, ctx, fileName) {
+		return
+	}
 
-	// read body
-	bodyBytes, err := io.ReadAll(r.Body)
+	// the backends are falling behind, so push back rather than ack more than they can absorb
+	if writes.overloaded() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "backend writes are lagging, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	// everything that can turn an upload away is checked before the first read of its body. The
+	// server only sends 100 Continue to an Expect: 100-continue client on that read, so a client
+	// that waits for it never sends a body we'd reject.
+	if limit := cfg().maxUploadBytes; limit > 0 {
+		if r.ContentLength > limit {
+			http.Error(w, "upload is larger than MAX_UPLOAD_BYTES", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// bodies without a Content-Length are cut off as they go past it
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+
+	allowed, wait, err := claimWriteSlot(ctx, fileName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Redis Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+		http.Error(w, "file was written too recently, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	// read body, counting it against MAX_INFLIGHT_BYTES until the write is done with it
+	bodyBytes, held, err := uploads.readBody(uploadBody(w, r), r.ContentLength)
+	if err != nil {
+		// an upload that never arrived shouldn't hold off the next write
+		releaseWriteSlot(ctx, fileName)
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "upload is larger than MAX_UPLOAD_BYTES", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if errors.Is(err, errBudgetExceeded) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		http.Error(w, "timed out reading request body", http.StatusRequestTimeout)
+		return
+	}
+	if errors.Is(err, errShortBody) {
+		// a truncated upload must never be forwarded as if it were the whole file
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error reading request body", http.StatusInternalServerError)
 		return
 	}
 	r.Body.Close() // Close body after reading bytes
+	release := func() { uploads.release(held) }
+	meta := metaFromRequest(r)
+	meta.Modified = modified
+
+	if ifNoneMatch == "*" {
+		createFile(w, r, ctx, fileName, bodyBytes, meta, release)
+		return
+	}
+
+	// the token lets a client read its own write back from any replica with X-Min-Version
+	version, err := nextVersion(ctx, fileName)
+	if err != nil {
+		release()
+		releaseWriteSlot(ctx, fileName)
+		http.Error(w, fmt.Sprintf("Redis Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	failOnConflict := r.Header.Get(failOnConflictHeader) != ""
+	if cfg().writeCombineWindow > 0 && !waitForQueuedWrite() && !failOnConflict {
+		putCombined(w, r, ctx, fileName, &combinedWrite{ctx: ctx, body: bodyBytes, meta: meta, version: version, release: release})
+		return
+	}
+
+	// queue the write before acking, so it lands in arrival order with the file's other writes
+	enqueued := writes.enqueue()
+	written := make(chan error, 1)
+	write := func() {
+		defer writes.done(enqueued)
+		defer release()
+		written <- writeFile(ctx, fileName, bodyBytes, meta, version)
+	}
+	if failOnConflict {
+		if fileOps.enqueuePutUnlessConflict(fileName, hashBody(bodyBytes), write) {
+			writes.done(enqueued)
+			release()
+			releaseWriteSlot(ctx, fileName)
+			http.Error(w, "conflict, another write to this file is still in flight", http.StatusConflict)
+			return
+		}
+	} else if fileOps.enqueuePut(fileName, hashBody(bodyBytes), write) {
+		slog.Warn("Conflicting concurrent PUT, last writer wins", "file", fileName)
+	}
+	if waitForQueuedWrite() {
+		if err := <-written; err != nil {
+			releaseWriteSlot(ctx, fileName)
+			writeStorageError(w, err)
+			return
+		}
+	}
 
 	// send back early response
-	w.WriteHeader(http.StatusCreated)
+	ackWrite(w, r, version)
 	flusher, ok := w.(http.Flusher)
 	if ok {
 		flusher.Flush()
 	}
+}
 
-	go func(fileName string, data []byte) {
-		// lock access to file while writing
-		lock := fileLocks.get(fileName)
-		lock.Lock()
-		defer lock.Unlock()
+// failOnConflictHeader on a PUT asks for a 409 rather than last-writer-wins when another PUT of
+// the file with a different body hasn't finished yet, so the client can retry from fresh state
+const failOnConflictHeader = "X-Fail-On-Conflict"
+
+// putCombined is the write-behind PUT with WRITE_COMBINE_WINDOW, folding PUTs to fileName that
+// arrive within the window into one backend write of the newest body. Every PUT still gets its
+// own X-Version, versions folded away are never stored on their own.
+func putCombined(w http.ResponseWriter, r *http.Request, ctx context.Context, fileName string, write *combinedWrite) {
+	enqueued := writes.enqueue()
+	merged := fileOps.enqueueCombined(fileName, write, func(write *combinedWrite) {
+		defer writes.done(enqueued)
+		defer write.release()
+		if write.combined > 0 {
+			slog.Debug("Combined PUTs into one write", "file", fileName, "combined", write.combined+1)
+		}
+		err := writeFile(write.ctx, fileName, write.body, write.meta, write.version)
+		if err != nil && len(write.folded) > 0 {
+			if err := markFailed(write.ctx, fileName, write.folded...); err != nil {
+				slog.Error("Redis version error", "file", fileName, "err", err)
+			}
+		}
+	})
+	if merged {
+		// the write already queued carries this body now
+		writes.done(enqueued)
+	}
+
+	ackWrite(w, r, write.version)
+}
 
-		// update cache cache
-		err = redisClient.Set(ctx, fileName, bodyBytes, 0).Err()
+// createFile handles a create-only PUT (If-None-Match: *). The name is reserved in redis so one
+// creator wins across replicas, then the winner checks the file doesn't exist yet from the
+// file's queue, behind any writes still in flight. Only that check holds up the response,
+// the write itself is still write-behind. release frees the body's share of MAX_INFLIGHT_BYTES.
+// A create that isn't accepted gives back its MIN_WRITE_INTERVAL slot.
+func createFile(w http.ResponseWriter, r *http.Request, ctx context.Context, fileName string, bodyBytes []byte, meta fileMeta, release func()) {
+	reserved, err := reserveName(ctx, fileName)
+	if err != nil {
+		release()
+		releaseWriteSlot(ctx, fileName)
+		http.Error(w, fmt.Sprintf("Redis Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !reserved {
+		release()
+		releaseWriteSlot(ctx, fileName)
+		http.Error(w, "precondition failed, file is being created", http.StatusPreconditionFailed)
+		return
+	}
+
+	version, err := nextVersion(ctx, fileName)
+	if err != nil {
+		release()
+		releaseName(ctx, fileName)
+		releaseWriteSlot(ctx, fileName)
+		http.Error(w, fmt.Sprintf("Redis Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	checked := make(chan error, 1)
+	written := make(chan error, 1)
+	enqueued := writes.enqueue()
+	fileOps.enqueuePut(fileName, hashBody(bodyBytes), func() {
+		defer writes.done(enqueued)
+		defer release()
+		defer releaseName(ctx, fileName)
+
+		exists, err := fileExists(ctx, fileName)
+		if err == nil && exists {
+			err = errFileExists
+		}
+		checked <- err
 		if err != nil {
-			log.Println("Redis SET error")
+			return
 		}
+		written <- writeFile(ctx, fileName, bodyBytes, meta, version)
+	})
+
+	err = <-checked
+	if err == nil && waitForQueuedWrite() {
+		err = <-written
+	}
+	if err != nil {
+		releaseWriteSlot(ctx, fileName)
+	}
+	if errors.Is(err, errFileExists) {
+		http.Error(w, "precondition failed, file already exists", http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	ackWrite(w, r, version)
+}
+
+// writeFile stores a PUT's body in the backend and then the cache. It runs from the file's queue.
+// Failures are logged here, the error is only for callers that still have something to undo
+// or a WRITE_THROUGH client to answer.
+func writeFile(ctx context.Context, fileName string, bodyBytes []byte, meta fileMeta, version int64) error {
+	// lock the file while writing. the client is acked without waiting on this, so wait as long as it takes
+	lock := fileLocks.get(fileName)
+	lock.Lock(ctx)
+	defer lock.Unlock()
+
+	// variants go first so the plain file never advertises one that isn't there
+	if cfg().precompress {
+		meta.Encodings = putVariants(ctx, fileName, bodyBytes, meta)
+	}
+
+	// the backend is the source of truth, so only touch the cache once it has the data.
+	// readers are blocked on the lock until both are updated.
+	err := putVerified(ctx, fileName, bodyBytes, meta)
+	if err != nil {
+		slog.ErrorContext(ctx, "Storage PUT error", "file", fileName, "err", err)
+		recordWriteFailure("PUT", err)
+		if err := markFailed(ctx, fileName, version); err != nil {
+			slog.Error("Redis version error", "file", fileName, "err", err)
+		}
+		// the backend may hold anything now, so leave reads to it rather than the old cached copy
+		cacheDel(ctx, fileName)
+		invalidateRanges(ctx, fileName)
+		return err
+	}
+	dr.mirrorPut(ctx, fileName, bodyBytes, meta)
 
-		// make new request to fileserver
-		req, err := http.NewRequest(http.MethodPut, shardUrl+"/"+fileName, bytes.NewBuffer(bodyBytes))
+	// update cache, dropping the entry if it can't be set so it never disagrees with the backend.
+	// Without CACHE_ON_WRITE the old entry is just dropped and the next GET caches the new body.
+	if cacheable(meta.ContentType) && cfg().cacheOnWrite {
+		err = cacheSet(ctx, fileName, bodyBytes, meta)
 		if err != nil {
-			http.Error(w, "Could not create client request", http.StatusInternalServerError)
-			return
+			slog.Error("Redis SET error", "file", fileName, "err", err)
+			cacheDel(ctx, fileName)
 		}
-		req.Header.Set("Content-Type", "text/plain")
+	} else {
+		err = cacheDel(ctx, fileName)
+	}
+	if err != nil && cfg().requireCacheOnWrite {
+		// the old copy may still be cached, a WRITE_THROUGH client is told rather than left to read it
+		return fmt.Errorf("%w: %v", errCacheUnavailable, err)
+	}
+	invalidateRanges(ctx, fileName)
+
+	if cfg().versioning {
+		storeVersion(ctx, fileName, bodyBytes, meta, version)
+	}
 
-		// send request to fileserver
-		_, err = httpClient.Do(req)
+	err = markWritten(ctx, fileName, version)
+	if err != nil {
+		slog.Error("Redis version error", "file", fileName, "err", err)
+	}
+	publishEvent(ctx, eventPut, fileName, version)
+	return nil
+}
+
+// putVariants stores a copy of data precompressed with each COMPRESSION_ALGO, returning the
+// encodings that were stored. Files that don't shrink get no variant, and any left over from an
+// earlier upload is removed. Callers hold the file's write lock.
+func putVariants(ctx context.Context, fileName string, data []byte, meta fileMeta) []string {
+	var stored []string
+	for _, enc := range cfg().compressionAlgos {
+		name := variantName(fileName, enc)
+		compressed, err := compressBytes(enc, data)
+		if err != nil || len(compressed) >= len(data) {
+			cacheDel(ctx, name)
+			store.Delete(ctx, name)
+			continue
+		}
+
+		variantMeta := fileMeta{ContentType: meta.ContentType}
+		err = store.Put(ctx, name, bytes.NewReader(compressed), variantMeta)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Fileserver Error: %s", err.Error()), http.StatusInternalServerError)
-			return
+			slog.Error("Storage PUT error", "file", name, "err", err)
+			continue
+		}
+		if !cacheable(meta.ContentType) || !cfg().cacheOnWrite {
+			cacheDel(ctx, name)
+		} else if err = cacheSet(ctx, name, compressed, variantMeta); err != nil {
+			slog.Error("Redis SET error", "file", name, "err", err)
+			cacheDel(ctx, name)
 		}
-	}(fileName, bodyBytes)
+		stored = append(stored, enc)
+	}
+	return stored
 }
 
 func getFile(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+	ctx := r.Context()
 
-	log.Println("GET", r.URL.Path)
+	slog.DebugContext(ctx, "GET", "path", r.URL.Path)
 
-	fileName := r.PathValue("fileName")
-	if fileName == "" {
-		http.Error(w, "no file name given", http.StatusBadRequest)
+	fileName, err := fileNameFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	hotspots.record(fileName)
 
-	lock := fileLocks.get(fileName)
-	lock.RLock()
-	defer lock.RUnlock()
-
-	var bodyBytes []byte
-	var responseCode int
+	if cacheExcluded(fileName) {
+		w.Header().Set("X-Cache", "BYPASS")
+	}
+	if contentType := r.URL.Query().Get("contentType"); contentType != "" {
+		if !mediaTypePattern.MatchString(contentType) {
+			http.Error(w, "invalid contentType, want a media type like text/plain", http.StatusBadRequest)
+			return
+		}
+		w = &contentTypeWriter{ResponseWriter: w, contentType: contentType}
+	}
+	textEncoding := r.URL.Query().Get("encoding")
+	if textEncoding != "" {
+		if _, ok := textEncodings[textEncoding]; !ok {
+			http.Error(w, "invalid encoding, use base64 or hex", http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Range") != "" || r.URL.Query().Has("version") {
+			http.Error(w, "encoding can't be combined with Range or version", http.StatusBadRequest)
+			return
+		}
+	}
 
-	// check cache
-	val, err := redisClient.Get(ctx, fileName).Result()
-	if err == nil { // cache hit
+	// read-your-writes, hold off until the write behind the client's token has landed.
+	// This happens before taking the file lock, which that write needs.
+	if minVersion := r.Header.Get("X-Min-Version"); minVersion != "" {
+		n, err := strconv.ParseInt(minVersion, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid X-Min-Version", http.StatusBadRequest)
+			return
+		}
+		err = waitForVersion(ctx, fileName, n)
+		if errors.Is(err, errVersionNotReady) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Redis Error: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+	}
 
-		bodyBytes = []byte(val)
-		responseCode = 200
+	if fileReaders != nil {
+		waitCtx, cancel := context.WithTimeout(ctx, cfg().readerWaitTimeout)
+		release, err := fileReaders.acquire(waitCtx, fileName)
+		cancel()
+		if err != nil {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many concurrent reads of this file", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+	}
 
-	} else { // cache miss so make request to fileserver
-		log.Println("Cache Miss!")
+	unlock, ok := lockForRequest(w, r, fileName, false)
+	if !ok {
+		return
+	}
+	defer unlock()
 
-		// get the shard from hash of filename
-		shard := strconv.Itoa(int(hashKey(fileName)))
-		shardUrl := strings.Replace(os.Getenv("FILE_SERVER_URL"), "#", shard, -1)
+	if version := r.URL.Query().Get("version"); version != "" && cfg().versioning {
+		serveVersion(w, ctx, fileName, version)
+		return
+	}
 
-		// make new request to fileserver
-		req, err := http.NewRequest(http.MethodGet, shardUrl+"/"+fileName, nil)
-		if err != nil {
-			http.Error(w, "Could not create client request", http.StatusInternalServerError)
+	// a combined PUT may still be holding back the newest body, the backend and cache don't have
+	// it yet so ranges are cut from it too
+	bodyBytes, meta, pending := fileOps.pendingWrite(fileName)
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		if pending {
+			writeRange(w, r, bodyBytes, meta)
 			return
 		}
+		serveRange(w, r, fileName)
+		return
+	}
 
-		// send request to fileserver
-		resp, err := httpClient.Do(req)
+	if pending {
+		// a combined PUT is still holding back the newest body, the backend and cache don't have it
+	} else if knownMissing(ctx, fileName) {
+		err = errNotFound
+	} else if streamThreshold(ctx) > 0 && textEncoding == "" {
+		bodyBytes, meta, err = cacheGet(ctx, fileName)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Fileserver Error: %s", err.Error()), http.StatusInternalServerError)
+			slog.Debug("Cache Miss!", "file", fileName)
+			var streamed bool
+			bodyBytes, meta, streamed, err = fetchOrStream(w, ctx, fileName)
+			if streamed {
+				return
+			}
+		}
+	} else if cfg().cacheCompression && textEncoding == "" {
+		var served bool
+		bodyBytes, meta, served, err = loadOrServeCompressed(w, r, fileName)
+		if served {
 			return
 		}
+	} else if cfg().cacheTTL > 0 {
+		bodyBytes, meta, err = loadFresh(ctx, fileName)
+	} else if !cfg().cacheOnWrite {
+		bodyBytes, meta, err = readRepair(ctx, fileName)
+	} else {
+		bodyBytes, meta, err = loadFile(ctx, fileName)
+	}
+	if err != nil {
+		if errors.Is(err, errNotFound) && !pending {
+			rememberMissing(ctx, fileName)
+		}
+		writeStorageError(w, err)
+		return
+	}
 
-		// create body of response
-		bodyBytes, err = io.ReadAll(resp.Body)
-		responseCode = resp.StatusCode
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Reading fileserver body error: %s", err.Error()), http.StatusInternalServerError)
-			return
+	if textEncoding != "" {
+		serveTextEncoded(w, r, bodyBytes, meta, textEncoding)
+		return
+	}
+
+	if len(meta.Encodings) > 0 {
+		w.Header().Add("Vary", "Accept-Encoding")
+		w.Header().Add("Vary", noCompressionHeader)
+		if enc := negotiateEncoding(r.Header.Get("Accept-Encoding"), meta.Encodings); enc != "" && compressionWanted(r) {
+			compressed, _, err := loadFile(ctx, variantName(fileName, enc))
+			if err == nil {
+				if notModified(w, r, etagFor(compressed), meta.Modified) {
+					return
+				}
+				meta.writeHeaders(w.Header())
+				w.Header().Set("Content-Encoding", enc)
+				w.Header().Set("Content-Length", strconv.Itoa(len(compressed)))
+				w.Header().Set("ETag", etagFor(compressed))
+				w.WriteHeader(http.StatusOK)
+				w.Write(compressed)
+				return
+			}
+			slog.Warn("Could not load compressed variant, serving plain file", "file", fileName, "encoding", enc, "err", err)
 		}
-		defer resp.Body.Close()
 	}
 
-	w.WriteHeader(responseCode)
+	// HEAD is routed here too, so it gets the same 304s, and the server drops its body
+	if notModified(w, r, etagFor(bodyBytes), meta.Modified) {
+		return
+	}
+	meta.writeHeaders(w.Header())
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.Itoa(len(bodyBytes)))
+	w.Header().Set("ETag", etagFor(bodyBytes))
+	w.WriteHeader(http.StatusOK)
 	w.Write(bodyBytes)
 }
 
 func deleteFile(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+	// the delete outlives the request, so keep its values (trace) but not its cancellation
+	ctx := context.WithoutCancel(r.Context())
+
+	slog.DebugContext(ctx, "DELETE", "path", r.URL.Path)
 
-	log.Println("DELETE", r.URL.Path)
+	fileName, err := fileNameFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rejectDrainedShard(w, ctx, fileName) {
+		return
+	}
 
-	fileName := r.PathValue("fileName")
-	if fileName == "" {
-		http.Error(w, "no file name given", http.StatusBadRequest)
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		// the check has to see every write queued before it, so wait our turn and answer inline
+		done := make(chan struct{})
+		fileOps.enqueue(fileName, func() {
+			defer close(done)
+			deleteIfMatch(w, r, fileName, ifMatch)
+		})
+		<-done
 		return
 	}
 
+	enqueued := writes.enqueue()
+	deleted := make(chan error, 1)
+	fileOps.enqueueDelete(fileName, func() {
+		defer writes.done(enqueued)
+		lock := fileLocks.get(fileName)
+		lock.Lock(ctx)
+		defer lock.Unlock()
+
+		deleted <- deleteFileOrTrash(ctx, fileName)
+	})
+	if waitForQueuedWrite() {
+		if err := <-deleted; err != nil {
+			writeStorageError(w, err)
+			return
+		}
+	}
+
 	w.WriteHeader(http.StatusOK)
 	flusher, ok := w.(http.Flusher)
 	if ok {
 		flusher.Flush()
 	}
+}
 
-	go func(fileName string) {
-		lock := fileLocks.get(fileName)
-		lock.Lock()
-		defer lock.Unlock()
+// deleteIfMatch deletes fileName only if its current ETag matches ifMatch. The check and the
+// delete happen under one write lock, so this runs inline rather than write-behind.
+// Callers run it from the file's queue.
+func deleteIfMatch(w http.ResponseWriter, r *http.Request, fileName string, ifMatch string) {
+	ctx := r.Context()
 
-		// update cache cache
-		err := redisClient.Del(ctx, fileName).Err()
-		if err != nil {
-			log.Println("Redis DELETE error")
+	unlock, ok := lockForRequest(w, r, fileName, true)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	bodyBytes, _, err := loadFile(ctx, fileName)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "precondition failed, file does not exist", http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	if !etagMatches(ifMatch, etagFor(bodyBytes)) {
+		http.Error(w, "precondition failed, file has changed", http.StatusPreconditionFailed)
+		return
+	}
+
+	if err := deleteFileOrTrash(ctx, fileName); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// removeFile drops fileName from the cache and storage. Callers hold the file's write lock.
+func removeFile(ctx context.Context, fileName string) error {
+	err := cacheDel(ctx, fileName)
+	if err != nil {
+		slog.Error("Redis DELETE error", "file", fileName, "err", err)
+	}
+	invalidateRanges(ctx, fileName)
+
+	if cfg().precompress {
+		for _, enc := range cfg().compressionAlgos {
+			cacheDel(ctx, variantName(fileName, enc))
+			store.Delete(ctx, variantName(fileName, enc))
+		}
+	}
+	if cfg().versioning {
+		dropVersions(ctx, fileName)
+	}
+
+	err = store.Delete(ctx, fileName)
+	if err != nil {
+		slog.ErrorContext(ctx, "Storage DELETE error", "file", fileName, "err", err)
+		recordWriteFailure("DELETE", err)
+		return err
+	}
+	dr.mirrorDelete(ctx, fileName)
+	publishEvent(ctx, eventDelete, fileName, 0)
+	return nil
+}
+
+// purgeCache drops fileName's cache entries but leaves storage alone, so the next GET goes to
+// the backend. Redis is our only cache tier, so the count reported is 0 or 1.
+func purgeCache(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	fileName, err := fileNameFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	unlock, ok := lockForRequest(w, r, fileName, true)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	names := []string{fileName}
+	if cfg().precompress {
+		for _, enc := range cfg().compressionAlgos {
+			names = append(names, variantName(fileName, enc))
 		}
+	}
+	keys := []string{}
+	pipe := redisClient.TxPipeline()
+	for _, name := range names {
+		keys = append(keys, bodyKey(name), metaKey(name))
+		dropLegacyBodyIn(ctx, pipe, name)
+	}
+	removed := pipe.Del(ctx, keys...)
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Redis Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	invalidateRanges(ctx, fileName)
 
-		// get the shard from hash of filename
-		shard := strconv.Itoa(int(hashKey(fileName)))
-		shardUrl := strings.Replace(os.Getenv("FILE_SERVER_URL"), "#", shard, -1)
+	tiers := 0
+	if removed.Val() > 0 {
+		tiers++
+	}
+	b, _ := json.Marshal(map[string]int{"tiersPurged": tiers})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
 
-		// make new request to fileserver
-		req, err := http.NewRequest(http.MethodDelete, shardUrl+"/"+fileName, nil)
+// loadFile returns fileName's bytes and metadata from the cache, falling back to storage.
+// Callers hold the file's lock.
+func loadFile(ctx context.Context, fileName string) ([]byte, fileMeta, error) {
+	bodyBytes, meta, err := cacheGet(ctx, fileName)
+	if err == nil {
+		return bodyBytes, meta, nil
+	}
+	slog.Debug("Cache Miss!", "file", fileName)
+
+	// concurrent misses on the same file share one backend fetch, which mustn't be cut short
+	// just because the request that started it went away
+	result, err, _ := loads.Do(fileName, func() (interface{}, error) {
+		body, meta, err := store.Get(context.WithoutCancel(ctx), fileName)
 		if err != nil {
-			http.Error(w, "Could not create client request", http.StatusInternalServerError)
-			return
+			return nil, err
 		}
+		defer body.Close()
 
-		// send request to fileserver
-		_, err = httpClient.Do(req)
+		bodyBytes, err := io.ReadAll(body)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Fileserver Error: %s", err.Error()), http.StatusInternalServerError)
-			return
+			return nil, fmt.Errorf("reading fileserver body: %w", err)
 		}
-	}(fileName)
+		return loadedFile{bodyBytes: bodyBytes, meta: meta}, nil
+	})
+	if err != nil {
+		return nil, fileMeta{}, err
+	}
+
+	loaded := result.(loadedFile)
+	return loaded.bodyBytes, loaded.meta, nil
+}
+
+type loadedFile struct {
+	bodyBytes []byte
+	meta      fileMeta
+}
+
+// 404_RESPONSE_FORMAT values
+const (
+	notFoundPassthrough = "passthrough" // the plain text "File not found." the fileservers answer with
+	notFoundJSON        = "json"        // {"error": "file not found", "status": 404}
+)
+
+// writeNotFound answers a missing file in 404_RESPONSE_FORMAT, anything unrecognised is passthrough
+func writeNotFound(w http.ResponseWriter) {
+	if cfg().notFoundFormat != notFoundJSON {
+		http.Error(w, "File not found.", http.StatusNotFound)
+		return
+	}
+	b, _ := json.Marshal(map[string]any{"error": "file not found", "status": http.StatusNotFound})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write(b)
+}
+
+// writeStorageError maps a Storage error onto the response, passing backend statuses through
+func writeStorageError(w http.ResponseWriter, err error) {
+	status := storageErrorStatus(err)
+	switch {
+	case errors.Is(err, errNotFound):
+		writeNotFound(w)
+	case status == http.StatusInternalServerError:
+		http.Error(w, fmt.Sprintf("Fileserver Error: %s", err.Error()), status)
+	default:
+		http.Error(w, err.Error(), status)
+	}
+}
+
+// storageErrorStatus is the http status a Storage error is reported with
+func storageErrorStatus(err error) int {
+	var statusErr *statusError
+	switch {
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errInvalidName):
+		return http.StatusBadRequest
+	case errors.Is(err, errResponseTooLarge), errors.Is(err, errBackendRedirect):
+		return http.StatusBadGateway
+	case errors.Is(err, errBreakerOpen):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errNotSupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, errCacheUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &statusErr):
+		return statusErr.status
+	default:
+		return http.StatusInternalServerError
+	}
 }
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestServer runs the handlers against an in-process redis and, unless the test sets STORAGE
+// itself, the memory backend, so no test needs a real redis or fileserver. Config is read from
+// the environment here, set it with t.Setenv before calling. Tests that need a backend of their
+// own swap store afterwards.
+func newTestServer(t *testing.T) (*miniredis.Miniredis, *httptest.Server) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	redisClient = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	if os.Getenv("STORAGE") == "" {
+		t.Setenv("STORAGE", "memory")
+	}
+	if os.Getenv("STORAGE") == "fs" && os.Getenv("FS_ROOT") == "" {
+		t.Setenv("FS_ROOT", t.TempDir())
+	}
+	current.Store(loadConfig())
+	var err error
+	store, err = newStorage(cfg())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg().dedup {
+		store = newDedupStorage(store)
+	}
+
+	// everything else main builds from config, fresh so one test's can't leak into the next
+	uploads.max = cfg().maxInflightBytes
+	extensionTypes = parseExtensionTypes(cfg().contentTypeExts)
+	fileReaders, hotspots, dr, hooks, shardHealth = nil, nil, nil, nil, nil
+	if cfg().maxReadersPerFile > 0 {
+		fileReaders = newKeyedSemaphore(cfg().maxReadersPerFile)
+	}
+	if cfg().hotspotWindow > 0 {
+		hotspots = newHotspotCounter()
+	}
+	draining.Store(false)
+	flushCombined, flushCombinedOnce = make(chan struct{}), sync.Once{}
+
+	srv := httptest.NewServer(routes())
+	t.Cleanup(srv.Close)
+	// nothing of this test's may still be writing when the next one swaps the globals
+	t.Cleanup(func() { waitForWrites(t) })
+	return mr, srv
+}
+
+// waitFor polls cond until it holds, for checking the effects of write-behind goroutines
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition never held")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitForWrite waits for cond, then for the write-behind goroutine that made it true to finish,
+// which holds fileName's lock until it's done
+func waitForWrite(t *testing.T, fileName string, cond func() bool) {
+	t.Helper()
+	waitFor(t, cond)
+	lock := fileLocks.get(fileName)
+	lock.Lock(context.Background())
+	lock.Unlock()
+}
+
+// waitForWrites waits until every acked write-behind op has finished against the backend
+func waitForWrites(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		writes.mu.Lock()
+		pending := writes.pending
+		writes.mu.Unlock()
+		if pending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d write-behind ops still pending", pending)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// do sends a request with headers given as name, value pairs and returns the response with
+// its body read
+func do(t *testing.T, method, url, body string, headers ...string) (*http.Response, string) {
+	t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, string(b)
+}
+
+func TestPutGetDelete(t *testing.T) {
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/a.txt"
+
+	resp, _ := do(t, "PUT", u, "hello world")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: got %d, want 201", resp.StatusCode)
+	}
+	waitForWrites(t)
+
+	resp, body := do(t, "GET", u, "")
+	if resp.StatusCode != http.StatusOK || body != "hello world" {
+		t.Fatalf("GET: got %d %q", resp.StatusCode, body)
+	}
+
+	// with the cache gone the file comes back from storage
+	mr.FlushAll()
+	resp, body = do(t, "GET", u, "")
+	if resp.StatusCode != http.StatusOK || body != "hello world" {
+		t.Fatalf("GET miss: got %d %q", resp.StatusCode, body)
+	}
+
+	resp, _ = do(t, "DELETE", u, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE: got %d, want 200", resp.StatusCode)
+	}
+	waitForWrites(t)
+	resp, _ = do(t, "GET", u, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET after DELETE: got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestGetMissingFile(t *testing.T) {
+	_, srv := newTestServer(t)
+	resp, _ := do(t, "GET", srv.URL+"/api/fileserver/nope", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestOverwrite(t *testing.T) {
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/a.txt"
+	do(t, "PUT", u, "v1")
+	do(t, "PUT", u, "v2")
+	waitForWrites(t)
+
+	_, body := do(t, "GET", u, "")
+	if body != "v2" {
+		t.Fatalf("cached: got %q, want v2", body)
+	}
+	mr.FlushAll()
+	_, body = do(t, "GET", u, "")
+	if body != "v2" {
+		t.Fatalf("stored: got %q, want v2", body)
+	}
+}
+
+func TestRoot(t *testing.T) {
+	_, srv := newTestServer(t)
+	resp, body := do(t, "GET", srv.URL+"/", "")
+	if resp.StatusCode != http.StatusOK || body != "You've reached my fileserver middleware!\n" {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestConcurrentPutsAgree(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/race.txt"
+
+	for i := range 20 {
+		var wg sync.WaitGroup
+		for _, body := range []string{"first", "second"} {
+			wg.Go(func() { do(t, "PUT", u, body) })
+		}
+		wg.Wait()
+		// both writes have reached the backend, and the last one holds the file's lock until
+		// it has updated the cache too
+		waitFor(t, func() bool { return fs.count(http.MethodPut) == 2*(i+1) })
+		lock := fileLocks.get("race.txt")
+		lock.Lock(context.Background())
+		lock.Unlock()
+
+		cached, err := mr.Get(bodyKey("race.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, _ := fs.file("/race.txt")
+		if cached != stored {
+			t.Fatalf("cache has %q, backend %q", cached, stored)
+		}
+	}
+}
+
+func TestContentLengthOnCacheHit(t *testing.T) {
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", newFakeFileserver(t).URL)
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/a.txt"
+	do(t, "PUT", u, "twelve bytes")
+	waitFor(t, func() bool { return mr.Exists(bodyKey("a.txt")) })
+
+	for _, method := range []string{"GET", "HEAD"} {
+		resp, _ := do(t, method, u, "")
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Length") != "12" {
+			t.Fatalf("%s: got %d with Content-Length %q, want 12", method, resp.StatusCode, resp.Header.Get("Content-Length"))
+		}
+	}
+}
+
+func TestPurgeCacheKeepsBackendFile(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/p.txt"
+	do(t, "PUT", u, "data")
+	waitForWrites(t)
+
+	if resp, _ := do(t, "POST", u+"/purge-cache", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("without the admin token: got %d, want 401", resp.StatusCode)
+	}
+	resp, body := do(t, "POST", u+"/purge-cache", "", "Authorization", "Bearer secret")
+	if resp.StatusCode != http.StatusOK || body != `{"tiersPurged":1}` {
+		t.Fatalf("purge: got %d %q", resp.StatusCode, body)
+	}
+	if mr.Exists(bodyKey("p.txt")) {
+		t.Fatal("file still cached after a purge")
+	}
+
+	// the next GET is a miss served from the backend, which still has the file
+	resp, body = do(t, "GET", u, "")
+	if resp.StatusCode != http.StatusOK || body != "data" {
+		t.Fatalf("GET after purge: got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestUnsupportedMethods(t *testing.T) {
+	_, srv := newTestServer(t)
+	tests := []struct {
+		method, path, allow string
+	}{
+		{"POST", "/api/fileserver/a.txt", "GET, HEAD, PUT, PATCH, DELETE"},
+		{"OPTIONS", "/api/fileserver/a.txt", "GET, HEAD, PUT, PATCH, DELETE"},
+		{"DELETE", "/api/fileserver/a.txt/versions", "GET, HEAD"},
+		{"DELETE", "/api/fileserver/a.txt/info", "GET, HEAD"},
+		{"GET", "/api/fileserver/a.txt/purge-cache", "POST"},
+		{"POST", "/api/fileserver", "GET, HEAD"},
+		{"GET", "/api/fileserver/a.txt/move", "POST"},
+	}
+	for _, tt := range tests {
+		resp, _ := do(t, tt.method, srv.URL+tt.path, "")
+		if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != tt.allow {
+			t.Errorf("%s %s: got %d, Allow %q, want 405 with %q", tt.method, tt.path, resp.StatusCode, resp.Header.Get("Allow"), tt.allow)
+		}
+	}
+}
+
+func TestBadFileNames(t *testing.T) {
+	_, srv := newTestServer(t)
+	for _, name := range []string{"a%2Fb", "a%5Cb", "%2E%2E", "nul%00byte"} {
+		for _, method := range []string{"PUT", "GET", "DELETE"} {
+			resp, _ := do(t, method, srv.URL+"/api/fileserver/"+name, "x")
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("%s %s: got %d, want 400", method, name, resp.StatusCode)
+			}
+		}
+	}
+}
+
+func TestHealthReportsVersionAndUptime(t *testing.T) {
+	_, srv := newTestServer(t)
+	health := func() healthResponse {
+		resp, body := do(t, "GET", srv.URL+"/health", "")
+		var h healthResponse
+		if err := json.Unmarshal([]byte(body), &h); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("got %d %q: %v", resp.StatusCode, body, err)
+		}
+		return h
+	}
+
+	first := health()
+	if !first.OK || first.Version != version || first.Commit != commit {
+		t.Fatalf("got %+v", first)
+	}
+	if _, err := time.Parse(time.RFC3339, first.StartedAt); err != nil {
+		t.Fatalf("startedAt: %v", err)
+	}
+
+	// rather than sleep for a second of uptime, start the process earlier
+	defer func(s time.Time) { startedAt = s }(startedAt)
+	startedAt = startedAt.Add(-5 * time.Second)
+	if second := health(); second.UptimeSeconds < first.UptimeSeconds+5 {
+		t.Fatalf("uptime went from %d to %d, want at least 5 more", first.UptimeSeconds, second.UptimeSeconds)
+	}
+}
+
+func TestHeadMatchesGet(t *testing.T) {
+	_, srv := newTestServer(t)
+	for _, path := range []string{"/health", "/ready", "/"} {
+		get, _ := do(t, "GET", srv.URL+path, "")
+		head, body := do(t, "HEAD", srv.URL+path, "")
+		if head.StatusCode != get.StatusCode || body != "" {
+			t.Errorf("HEAD %s: got %d with %d bytes, want %d and no body", path, head.StatusCode, len(body), get.StatusCode)
+		}
+		for _, name := range []string{"Content-Type", "Content-Length"} {
+			if head.Header.Get(name) != get.Header.Get(name) {
+				t.Errorf("HEAD %s: %s %q, GET has %q", path, name, head.Header.Get(name), get.Header.Get(name))
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// metaHeaderPrefix marks request/response headers carrying user metadata, e.g. X-Meta-Owner: alice
+const metaHeaderPrefix = "X-Meta-"
+
+// fileMeta is what we keep about a file besides its bytes
+type fileMeta struct {
+	ContentType string
+	Metadata    map[string]string // lower-cased keys without the X-Meta- prefix
+	Encodings   []string          // precompressed copies stored under variantName, in order of preference
+	Modified    time.Time         `json:",omitzero"` // when the file was uploaded, or its X-Upload-Time
+	Backend     http.Header       `json:"-"`         // BACKEND_RESPONSE_HEADERS from an http backend read, never stored or cached
+}
+
+// mediaTypePattern is what a ?contentType= override may be, a type/subtype with optional parameters
+var mediaTypePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]*/[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]*(\s*;\s*[A-Za-z0-9!#$&^_.+-]+=("[^"\\]*"|[A-Za-z0-9!#$&^_.+-]+))*$`)
+
+// contentTypeWriter serves a file as the GET's ?contentType= whatever type it was stored with.
+// Only successful responses are changed, errors keep their own type.
+type contentTypeWriter struct {
+	http.ResponseWriter
+	contentType string
+	wroteHeader bool
+}
+
+func (w *contentTypeWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status < 300 {
+		w.Header().Set("Content-Type", w.contentType)
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *contentTypeWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the connection underneath
+func (w *contentTypeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+const uploadTimeHeader = "X-Upload-Time"
+
+var errUploadTime = errors.New("invalid X-Upload-Time, want an RFC 3339 time no later than now")
+
+// uploadTime is when a PUT counts as modifying its file, now unless a migration sets an earlier
+// X-Upload-Time. Times ahead of us by more than UPLOAD_TIME_SKEW are refused.
+func uploadTime(r *http.Request) (time.Time, error) {
+	now := time.Now()
+	value := r.Header.Get(uploadTimeHeader)
+	if value == "" {
+		return now, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil || t.After(now.Add(cfg().uploadTimeSkew)) {
+		return time.Time{}, errUploadTime
+	}
+	return t, nil
+}
+
+// metaFromRequest picks the content type and X-Meta-* headers off an upload. An upload sent
+// without a type, or as generic application/octet-stream, gets its extension's if it has one.
+func metaFromRequest(r *http.Request) fileMeta {
+	meta := fileMeta{ContentType: r.Header.Get("Content-Type")}
+	if meta.ContentType == "" || meta.ContentType == "application/octet-stream" {
+		if t := typeByExtension(r.PathValue("fileName")); t != "" {
+			meta.ContentType = t
+		}
+	}
+	for name, values := range r.Header {
+		key, ok := strings.CutPrefix(name, metaHeaderPrefix)
+		if !ok || key == "" || len(values) == 0 {
+			continue
+		}
+		if meta.Metadata == nil {
+			meta.Metadata = make(map[string]string)
+		}
+		meta.Metadata[strings.ToLower(key)] = values[0]
+	}
+	return meta
+}
+
+// writeHeaders sets the content type and X-Meta-* headers on a response, and X-Cache: BYPASS
+// when the type is one we never cache. A file just read from an http backend brings its
+// allowlisted response headers too.
+func (m fileMeta) writeHeaders(h http.Header) {
+	// ours go on after, so a backend header can't override them
+	for name, values := range m.Backend {
+		h[name] = values
+	}
+	if m.ContentType != "" {
+		h.Set("Content-Type", m.ContentType)
+	}
+	if !cacheable(m.ContentType) {
+		h.Set("X-Cache", "BYPASS")
+	}
+	if !m.Modified.IsZero() {
+		h.Set("Last-Modified", m.Modified.UTC().Format(http.TimeFormat))
+	}
+	for key, value := range m.Metadata {
+		h.Set(metaHeaderPrefix+key, value)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUploadTime(t *testing.T) {
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/old.txt"
+	if resp, _ := do(t, "PUT", u, "x", uploadTimeHeader, "2020-01-02T03:04:05Z"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: got %d, want 201", resp.StatusCode)
+	}
+	waitForWrites(t)
+
+	// from the cache and from storage
+	for _, where := range []string{"cache", "storage"} {
+		resp, _ := do(t, "GET", u, "")
+		if got := resp.Header.Get("Last-Modified"); got != "Thu, 02 Jan 2020 03:04:05 GMT" {
+			t.Fatalf("%s: Last-Modified %q", where, got)
+		}
+		mr.FlushAll()
+	}
+	if resp, _ := do(t, "GET", u, "", "If-Modified-Since", "Fri, 03 Jan 2020 00:00:00 GMT"); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("If-Modified-Since after the upload time: got %d, want 304", resp.StatusCode)
+	}
+	if resp, _ := do(t, "GET", u, "", "If-Modified-Since", "Wed, 01 Jan 2020 00:00:00 GMT"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("If-Modified-Since before the upload time: got %d, want 200", resp.StatusCode)
+	}
+
+	for _, bad := range []string{time.Now().Add(time.Hour).Format(time.RFC3339), "yesterday"} {
+		if resp, _ := do(t, "PUT", u, "x", uploadTimeHeader, bad); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("X-Upload-Time %q: got %d, want 400", bad, resp.StatusCode)
+		}
+	}
+
+	// without the header it's the time of the upload
+	do(t, "PUT", srv.URL+"/api/fileserver/new.txt", "x")
+	waitForWrites(t)
+	resp, _ := do(t, "GET", srv.URL+"/api/fileserver/new.txt", "")
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil || time.Since(modified) > time.Minute {
+		t.Fatalf("Last-Modified %q without X-Upload-Time", resp.Header.Get("Last-Modified"))
+	}
+}
+
+func TestContentTypeOverride(t *testing.T) {
+	_, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/c.csv"
+	do(t, "PUT", u, "a,b", "Content-Type", "text/csv")
+	waitForWrites(t)
+
+	if resp, _ := do(t, "GET", u, ""); resp.Header.Get("Content-Type") != "text/csv" {
+		t.Fatalf("stored type: got %q", resp.Header.Get("Content-Type"))
+	}
+	resp, body := do(t, "GET", u+"?contentType=application/octet-stream", "")
+	if resp.Header.Get("Content-Type") != "application/octet-stream" || body != "a,b" {
+		t.Fatalf("override: got %q %q", resp.Header.Get("Content-Type"), body)
+	}
+	resp, _ = do(t, "GET", u+"?contentType=text/plain%3B%20charset=utf-8", "", "Range", "bytes=0-0")
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatalf("override on a range: got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	for _, bad := range []string{"text", "text/plain%0d%0aX-Evil:%201", "a/b%3Bc"} {
+		if resp, _ := do(t, "GET", u+"?contentType="+bad, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("contentType=%s: got %d, want 400", bad, resp.StatusCode)
+		}
+	}
+	// a 404 isn't dressed up as the type asked for
+	resp, _ = do(t, "GET", srv.URL+"/api/fileserver/missing?contentType=image/png", "")
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Content-Type") == "image/png" {
+		t.Fatalf("missing file: got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestExtensionTypes(t *testing.T) {
+	t.Setenv("CONTENT_TYPE_EXTENSIONS", "log=text/x-log, bad, .x=not a type,.Data=application/x-data")
+	_, srv := newTestServer(t)
+
+	tests := []struct {
+		name, contentType, want string
+	}{
+		{"a.csv", "", "text/csv"},
+		{"b.MD", "", "text/markdown"},
+		{"c.log", "", "text/x-log"},           // CONTENT_TYPE_EXTENSIONS replaces a default
+		{"d.data", "", "application/x-data"},  // or adds one
+		{"e.json", "", "application/json"},    // the rest fall back to Go's table
+		{"f.x", "", ""},                       // a skipped entry types nothing
+		{"g.csv", "text/plain", "text/plain"}, // an upload's own type always wins
+		{"noext", "", ""},
+	}
+	for _, tt := range tests {
+		var headers []string
+		if tt.contentType != "" {
+			headers = []string{"Content-Type", tt.contentType}
+		}
+		do(t, "PUT", srv.URL+"/api/fileserver/"+tt.name, "x,y", headers...)
+		waitForWrites(t)
+		body, meta, err := store.Get(t.Context(), tt.name)
+		if err != nil {
+			t.Fatalf("%s in storage: %v", tt.name, err)
+		}
+		body.Close()
+		if meta.ContentType != tt.want {
+			t.Errorf("%s stored as %q, want %q", tt.name, meta.ContentType, tt.want)
+		}
+	}
+}
+
+func TestAllowedExtensions(t *testing.T) {
+	t.Setenv("ALLOWED_EXTENSIONS", "txt, .CSV")
+	_, srv := newTestServer(t)
+	for name, want := range map[string]int{
+		"a.txt": http.StatusCreated,
+		"b.Csv": http.StatusCreated,
+		"c.exe": http.StatusUnsupportedMediaType,
+		"noext": http.StatusUnsupportedMediaType,
+	} {
+		if resp, _ := do(t, "PUT", srv.URL+"/api/fileserver/"+name, "x"); resp.StatusCode != want {
+			t.Errorf("PUT %s: got %d, want %d", name, resp.StatusCode, want)
+		}
+	}
+	waitForWrites(t)
+	if resp, _ := do(t, "GET", srv.URL+"/api/fileserver/c.exe", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of a refused upload: got %d, want 404", resp.StatusCode)
+	}
+
+	// a move can't sneak a file past the list either
+	if resp, _ := do(t, "POST", srv.URL+"/api/fileserver/a.txt/move?to=a.exe", ""); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("move to a disallowed extension: got %d, want 415", resp.StatusCode)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const methodOverrideHeader = "X-Http-Method-Override"
+
+// overridableMethods are what a POST may ask to be handled as
+var overridableMethods = []string{http.MethodPut, http.MethodDelete}
+
+// methodOverride lets clients that can only send GET and POST, like HTML forms and some
+// proxies, reach PUT and DELETE with a POST carrying X-HTTP-Method-Override. Only POSTs are
+// rewritten, a GET claiming to be a DELETE could be replayed by any cache or crawler. The
+// header is dropped once applied so the handler, and STRICT_MODE, see a plain PUT or DELETE.
+func methodOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// methods are matched case-insensitively, so "delete" works as well as "DELETE"
+		method := strings.ToUpper(strings.TrimSpace(r.Header.Get(methodOverrideHeader)))
+		if method == "" || r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !slices.Contains(overridableMethods, method) {
+			http.Error(w, fmt.Sprintf("%s must be one of %s", methodOverrideHeader, strings.Join(overridableMethods, ", ")), http.StatusBadRequest)
+			return
+		}
+
+		r2 := r.Clone(r.Context())
+		r2.Method = method
+		r2.Header.Del(methodOverrideHeader)
+		next.ServeHTTP(w, r2)
+	})
+}
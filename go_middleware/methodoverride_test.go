@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestMethodOverride(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		t.Run("ALLOW_METHOD_OVERRIDE="+strconv.FormatBool(enabled), func(t *testing.T) {
+			t.Setenv("ALLOW_METHOD_OVERRIDE", strconv.FormatBool(enabled))
+			// the header is dropped once applied, so STRICT_MODE has nothing to refuse
+			t.Setenv("STRICT_MODE", "true")
+			_, srv := newTestServer(t)
+			u := srv.URL + "/api/fileserver/f"
+			do(t, "PUT", u, "x")
+			waitForWrites(t)
+
+			resp, _ := do(t, "POST", u, "", "X-HTTP-Method-Override", "DELETE")
+			waitForWrites(t)
+			get, _ := do(t, "GET", u, "")
+			if !enabled {
+				if get.StatusCode != http.StatusOK {
+					t.Fatalf("POST with the header ignored: got %d, and the file was deleted", resp.StatusCode)
+				}
+				return
+			}
+			if resp.StatusCode >= 300 || get.StatusCode != http.StatusNotFound {
+				t.Fatalf("POST as DELETE: got %d, then GET %d", resp.StatusCode, get.StatusCode)
+			}
+
+			if resp, _ := do(t, "POST", u, "y", "X-HTTP-Method-Override", "PUT"); resp.StatusCode != http.StatusCreated {
+				t.Errorf("POST as PUT: got %d, want 201", resp.StatusCode)
+			}
+			for _, method := range []string{"PATCH", "GET", "remove"} {
+				if resp, _ := do(t, "POST", u, "", "X-HTTP-Method-Override", method); resp.StatusCode != http.StatusBadRequest {
+					t.Errorf("POST as %s: got %d, want 400", method, resp.StatusCode)
+				}
+			}
+
+			// the method is matched case-insensitively, like everywhere else
+			waitForWrites(t)
+			resp, _ = do(t, "POST", u, "", "X-HTTP-Method-Override", " delete ")
+			waitForWrites(t)
+			if get, _ := do(t, "GET", u, ""); resp.StatusCode >= 300 || get.StatusCode != http.StatusNotFound {
+				t.Errorf("POST as lower-case delete: got %d, then GET %d", resp.StatusCode, get.StatusCode)
+			}
+		})
+	}
+}
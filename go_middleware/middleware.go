@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// concurrencyLimiter admits up to cap(slots) requests at once. Up to cap(queue)
+// more may wait briefly for a slot; anything beyond that is shed with a 503.
+type concurrencyLimiter struct {
+	slots   chan struct{}
+	queue   chan struct{}
+	timeout time.Duration
+}
+
+func newConcurrencyLimiter(maxInFlight int, maxQueued int, timeout time.Duration) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		slots:   make(chan struct{}, maxInFlight),
+		queue:   make(chan struct{}, maxQueued),
+		timeout: timeout,
+	}
+}
+
+func (l *concurrencyLimiter) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// health checks and scrapes must keep answering even when we're saturated. Event streams
+		// stay open for as long as their client does, so they'd hold a slot each for good, they
+		// have MAX_EVENT_STREAMS instead.
+		if r.URL.Path == "/health" || r.URL.Path == "/ready" || r.URL.Path == "/metrics" || r.URL.Path == eventsPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !l.acquire() {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "server is overloaded, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		defer l.release()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *concurrencyLimiter) acquire() bool {
+	// fast path, a slot is free
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	// otherwise take a place in the queue, or give up if it's full
+	select {
+	case l.queue <- struct{}{}:
+	default:
+		return false
+	}
+	defer func() { <-l.queue }()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiterSheds(t *testing.T) {
+	entered := make(chan struct{}, 2)
+	release := make(chan struct{})
+	limiter := newConcurrencyLimiter(2, 0, 10*time.Millisecond)
+	srv := httptest.NewServer(limiter.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+	})))
+	defer srv.Close()
+
+	admitted := make(chan int, 2)
+	for range 2 {
+		go func() {
+			resp, err := http.Get(srv.URL + "/slow")
+			if err != nil {
+				admitted <- 0
+				return
+			}
+			resp.Body.Close()
+			admitted <- resp.StatusCode
+		}()
+	}
+	<-entered
+	<-entered
+
+	resp, _ := do(t, "GET", srv.URL+"/slow", "")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("over the limit: got %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	resp, _ = do(t, "GET", srv.URL+"/health", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/health while saturated: got %d, want 200", resp.StatusCode)
+	}
+
+	close(release)
+	for range 2 {
+		if status := <-admitted; status != http.StatusOK {
+			t.Fatalf("admitted request: got %d, want 200", status)
+		}
+	}
+}
+
+func TestConcurrencyLimiterQueues(t *testing.T) {
+	release := make(chan struct{})
+	limiter := newConcurrencyLimiter(1, 1, time.Second)
+	srv := httptest.NewServer(limiter.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})))
+	defer srv.Close()
+
+	go http.Get(srv.URL)
+	time.Sleep(20 * time.Millisecond)
+	// the slot frees up while the second request waits for it
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	resp, _ := do(t, "GET", srv.URL, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("queued request: got %d, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var drLag = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "middleware_dr_lag_seconds",
+	Help: "Time from queueing to replicating the write last mirrored to the DR cluster.",
+})
+
+var drQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "middleware_dr_queue_depth",
+	Help: "Writes waiting to be mirrored to the DR cluster.",
+})
+
+var drFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "middleware_dr_failures_total",
+	Help: "Writes never mirrored to the DR cluster, dropped on a full queue or after running out of retries.",
+}, []string{"reason"})
+
+// mirrorOp is a write to repeat on the DR cluster, a delete when del is set
+type mirrorOp struct {
+	ctx    context.Context
+	name   string
+	body   []byte
+	meta   fileMeta
+	del    bool
+	queued time.Time
+}
+
+// drMirror replicates writes to DR_FILE_SERVER_URL, best-effort and off the write path. A single
+// worker drains the queue so a file's writes reach the DR cluster in the order they landed here.
+type drMirror struct {
+	backend Storage
+	ops     chan mirrorOp
+}
+
+// dr is nil unless DR_FILE_SERVER_URL is set
+var dr *drMirror
+
+func newDRMirror(backend Storage, queueSize int) *drMirror {
+	m := &drMirror{backend: backend, ops: make(chan mirrorOp, queueSize)}
+	go m.run()
+	return m
+}
+
+// mirrorPut queues a successful write for the DR cluster. Callers hold the file's write lock.
+func (m *drMirror) mirrorPut(ctx context.Context, fileName string, bodyBytes []byte, meta fileMeta) {
+	if m == nil {
+		return
+	}
+	meta.Encodings = nil // variants stay on the primary
+	m.enqueue(mirrorOp{ctx: ctx, name: fileName, body: bodyBytes, meta: meta})
+}
+
+// mirrorDelete queues a successful delete for the DR cluster. Callers hold the file's write lock.
+func (m *drMirror) mirrorDelete(ctx context.Context, fileName string) {
+	if m == nil {
+		return
+	}
+	m.enqueue(mirrorOp{ctx: ctx, name: fileName, del: true})
+}
+
+// enqueue never blocks, a full queue drops the write rather than hold up the primary
+func (m *drMirror) enqueue(op mirrorOp) {
+	// the DR cluster has its own shard layout, a shard forced for the primary means nothing there
+	op.ctx = withoutShardOverride(context.WithoutCancel(op.ctx))
+	op.queued = time.Now()
+	select {
+	case m.ops <- op:
+		drQueueDepth.Set(float64(len(m.ops)))
+	default:
+		drFailures.WithLabelValues("queue_full").Inc()
+		slog.Warn("DR queue full, write not mirrored", "file", op.name)
+	}
+}
+
+func (m *drMirror) run() {
+	for op := range m.ops {
+		drQueueDepth.Set(float64(len(m.ops)))
+		err := m.apply(op)
+		for attempt := 0; err != nil && attempt < cfg().drRetries && retryAllowed(op.ctx); attempt++ {
+			time.Sleep(retryWait(err, cfg().drRetryBackoff<<attempt))
+			err = m.apply(op)
+		}
+		if err != nil {
+			drFailures.WithLabelValues("retries_exhausted").Inc()
+			slog.Error("Could not mirror write to DR", "file", op.name, "delete", op.del, "err", err)
+			continue
+		}
+		drLag.Set(time.Since(op.queued).Seconds())
+	}
+}
+
+func (m *drMirror) apply(op mirrorOp) error {
+	if op.del {
+		return m.backend.Delete(op.ctx, op.name)
+	}
+	return m.backend.Put(op.ctx, op.name, bytes.NewReader(op.body), op.meta)
+}
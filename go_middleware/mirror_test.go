@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMirrorToDR(t *testing.T) {
+	primary, drServer := newFakeFileserver(t), newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", primary.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	_, srv := newTestServer(t)
+	dr = newDRMirror(newHTTPStorage(http.DefaultClient, drServer.URL), 10)
+	u := srv.URL + "/api/fileserver/a.txt"
+
+	// mirroring is off the write path, so the DR copy can land a little after the primary's
+	eventually := func(what string, ok func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); !ok(); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal(what)
+			}
+		}
+	}
+
+	do(t, "PUT", u, "replicated")
+	waitForWrites(t)
+	if body, _ := primary.file("/a.txt"); body != "replicated" {
+		t.Fatalf("primary has %q", body)
+	}
+	eventually("PUT never reached the DR cluster", func() bool {
+		body, _ := drServer.file("/a.txt")
+		return body == "replicated"
+	})
+
+	do(t, "DELETE", u, "")
+	waitForWrites(t)
+	eventually("DELETE never reached the DR cluster", func() bool {
+		_, ok := drServer.file("/a.txt")
+		return !ok
+	})
+	if _, ok := primary.file("/a.txt"); ok {
+		t.Fatal("primary still has the file")
+	}
+}
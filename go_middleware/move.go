@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// movesKey is a redis hash of moves being made by copying, from name to its moveIntent. An
+// intent is recorded before the copy starts and cleared once the original is gone, so a
+// restart can finish whatever a crash interrupted.
+const movesKey = "moves"
+
+type moveIntent struct {
+	To      string `json:"to"`
+	Version int64  `json:"version"`
+	Copied  bool   `json:"copied"` // to is written, only deleting from is left
+}
+
+// moveFile answers POST /api/fileserver/{fileName}/move?to=, renaming the file and replacing
+// anything already at to. Backends that can rename natively do it in one step, the rest copy
+// and then delete, which resumeMoves finishes after a crash.
+func moveFile(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+
+	from, err := fileNameFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("to") == "" {
+		http.Error(w, "to is required", http.StatusBadRequest)
+		return
+	}
+	to, err := resolveFileName(r, r.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if to == from {
+		http.Error(w, "can't move a file onto itself", http.StatusBadRequest)
+		return
+	}
+	if !extensionAllowed(to) {
+		http.Error(w, "file extension is not in ALLOWED_EXTENSIONS", http.StatusUnsupportedMediaType)
+		return
+	}
+	if rejectDrainedShard(w, ctx, from) || rejectDrainedShard(w, ctx, to) {
+		return
+	}
+
+	version, err := nextVersion(ctx, to)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Redis Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	// moves write both files, so they take their turn behind the PUTs and DELETEs queued for either
+	moved := make(chan error, 1)
+	enqueued := writes.enqueue()
+	fileOps.enqueueBoth(from, to, func() {
+		defer writes.done(enqueued)
+		if rn, ok := store.(renamer); ok {
+			moved <- renameMove(ctx, rn, from, to, version)
+		} else {
+			moved <- copyMove(ctx, from, to, version)
+		}
+	})
+
+	err = <-moved
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.Header().Set("X-Version", strconv.FormatInt(version, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// renameMove moves from to to with the backend's own rename, then brings the cache, variants,
+// versions and DR cluster up to date the way writeFile and removeFile would. It runs from
+// both files' queues.
+func renameMove(ctx context.Context, rn renamer, from string, to string, version int64) error {
+	// both files change, lock them in name order so two moves between the same pair can't
+	// deadlock, and before reading from so it can't change between the read and the rename
+	first, second := from, to
+	if second < first {
+		first, second = second, first
+	}
+	fileLocks.get(first).Lock(ctx)
+	defer fileLocks.get(first).Unlock()
+	fileLocks.get(second).Lock(ctx)
+	defer fileLocks.get(second).Unlock()
+
+	bodyBytes, meta, err := loadFile(ctx, from)
+	if err != nil {
+		return err
+	}
+
+	if cfg().precompress {
+		for _, enc := range cfg().compressionAlgos {
+			cacheDel(ctx, variantName(to, enc))
+			store.Delete(ctx, variantName(to, enc))
+		}
+	}
+	err = rn.Rename(ctx, from, to)
+	if err != nil {
+		slog.Error("Storage RENAME error", "file", from, "to", to, "err", err)
+		recordWriteFailure("RENAME", err)
+		return err
+	}
+	for _, enc := range meta.Encodings {
+		cacheDel(ctx, variantName(from, enc))
+		err = rn.Rename(ctx, variantName(from, enc), variantName(to, enc))
+		if err != nil {
+			// reads of to fall back to the plain file without it
+			slog.Error("Storage RENAME error", "file", variantName(from, enc), "err", err)
+		}
+	}
+
+	cacheDel(ctx, from)
+	invalidateRanges(ctx, from)
+	if cacheable(meta.ContentType) && cfg().cacheOnWrite {
+		err = cacheSet(ctx, to, bodyBytes, meta)
+		if err != nil {
+			slog.Error("Redis SET error", "file", to, "err", err)
+			cacheDel(ctx, to)
+		}
+	} else {
+		cacheDel(ctx, to)
+	}
+	invalidateRanges(ctx, to)
+
+	if cfg().versioning {
+		dropVersions(ctx, from)
+		storeVersion(ctx, to, bodyBytes, meta, version)
+	}
+	err = markWritten(ctx, to, version)
+	if err != nil {
+		slog.Error("Redis version error", "file", to, "err", err)
+	}
+
+	dr.mirrorPut(ctx, to, bodyBytes, meta)
+	dr.mirrorDelete(ctx, from)
+	publishEvent(ctx, eventPut, to, version)
+	publishEvent(ctx, eventDelete, from, 0)
+	return nil
+}
+
+// copyMove moves from to to by writing a copy and then deleting the original, recording its
+// progress in movesKey first. It runs from both files' queues.
+func copyMove(ctx context.Context, from string, to string, version int64) error {
+	err := recordMove(ctx, from, moveIntent{To: to, Version: version})
+	if err != nil {
+		return err
+	}
+
+	bodyBytes, meta, err := loadFile(ctx, from)
+	if err == nil {
+		// writeFile precompresses the copy afresh
+		meta.Encodings = nil
+		err = writeFile(ctx, to, bodyBytes, meta, version)
+	}
+	if err != nil {
+		// nothing was moved, or not all of it, so there's nothing for a restart to finish
+		redisClient.HDel(ctx, movesKey, from)
+		return err
+	}
+
+	err = recordMove(ctx, from, moveIntent{To: to, Version: version, Copied: true})
+	if err != nil {
+		return err
+	}
+	return finishMove(ctx, from)
+}
+
+// finishMove deletes a copied move's original and forgets the move. An original that's already
+// gone leaves nothing to finish, so the move is forgotten then too.
+func finishMove(ctx context.Context, from string) error {
+	lock := fileLocks.get(from)
+	lock.Lock(ctx)
+	err := removeFile(ctx, from)
+	lock.Unlock()
+	if err != nil && !errors.Is(err, errNotFound) {
+		return err
+	}
+	return redisClient.HDel(ctx, movesKey, from).Err()
+}
+
+func recordMove(ctx context.Context, from string, intent moveIntent) error {
+	b, _ := json.Marshal(intent)
+	return redisClient.HSet(ctx, movesKey, from, b).Err()
+}
+
+// resumeMoves finishes the copy and delete moves a crash or failed delete left in movesKey.
+// Moves that were still copying are copied again from the original, which is still in place.
+func resumeMoves(ctx context.Context) {
+	intents, err := redisClient.HGetAll(ctx, movesKey).Result()
+	if err != nil {
+		slog.Error("Redis HGETALL error", "err", err)
+		return
+	}
+	for from, raw := range intents {
+		var intent moveIntent
+		if json.Unmarshal([]byte(raw), &intent) != nil {
+			slog.Error("Dropping unreadable move intent", "file", from)
+			redisClient.HDel(ctx, movesKey, from)
+			continue
+		}
+
+		resume := func() {
+			var err error
+			if intent.Copied {
+				err = finishMove(ctx, from)
+			} else {
+				err = copyMove(ctx, from, intent.To, intent.Version)
+			}
+			if errors.Is(err, errNotFound) {
+				// the original went some other way before the copy, there's nothing left to move.
+				// forget the move, replayed later it could copy over a new file at the destination
+				redisClient.HDel(ctx, movesKey, from)
+				return
+			}
+			if err != nil {
+				slog.Error("Could not resume move", "file", from, "to", intent.To, "err", err)
+				return
+			}
+			slog.Info("Resumed interrupted move", "file", from, "to", intent.To)
+		}
+		if intent.Copied {
+			fileOps.enqueue(from, resume)
+		} else {
+			fileOps.enqueueBoth(from, intent.To, resume)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// noRename hides the backend's native rename, so moves copy and delete
+type noRename struct{ Storage }
+
+func TestMove(t *testing.T) {
+	mr, srv := newTestServer(t)
+	do(t, "PUT", srv.URL+"/api/fileserver/a", "hello", "Content-Type", "text/csv")
+	waitForWrites(t)
+
+	resp, _ := do(t, "POST", srv.URL+"/api/fileserver/a/move?to=b", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Version") == "" {
+		t.Fatalf("move: got %d, X-Version %q", resp.StatusCode, resp.Header.Get("X-Version"))
+	}
+	if resp, _ := do(t, "GET", srv.URL+"/api/fileserver/a", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET a after the move: got %d, want 404", resp.StatusCode)
+	}
+	mr.FlushAll()
+	resp, body := do(t, "GET", srv.URL+"/api/fileserver/b", "")
+	if body != "hello" || resp.Header.Get("Content-Type") != "text/csv" {
+		t.Errorf("GET b from storage: got %q as %q", body, resp.Header.Get("Content-Type"))
+	}
+
+	for _, query := range []string{"", "?to=b", "?to=.."} {
+		if resp, _ := do(t, "POST", srv.URL+"/api/fileserver/b/move"+query, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("move%s: got %d, want 400", query, resp.StatusCode)
+		}
+	}
+	if resp, _ := do(t, "POST", srv.URL+"/api/fileserver/nope/move?to=x", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("moving a missing file: got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestMoveWaitsForBothQueues(t *testing.T) {
+	for _, native := range []bool{true, false} {
+		_, srv := newTestServer(t)
+		if !native {
+			store = noRename{store}
+		}
+		do(t, "PUT", srv.URL+"/api/fileserver/a", "from a")
+		waitForWrites(t)
+
+		// hold up b's queue, the move has to wait its turn there as well as in a's
+		release := make(chan struct{})
+		fileOps.enqueue("b", func() { <-release })
+		moved := make(chan int, 1)
+		go func() {
+			resp, _ := do(t, "POST", srv.URL+"/api/fileserver/a/move?to=b", "")
+			moved <- resp.StatusCode
+		}()
+
+		select {
+		case code := <-moved:
+			t.Fatalf("native %v: move answered %d while b's queue was busy", native, code)
+		case <-time.After(100 * time.Millisecond):
+		}
+		writes.mu.Lock()
+		pending := writes.pending
+		writes.mu.Unlock()
+		if pending != 1 {
+			t.Errorf("native %v: %d writes pending while the move waited, want 1", native, pending)
+		}
+
+		close(release)
+		if code := <-moved; code != http.StatusOK {
+			t.Fatalf("native %v: move got %d", native, code)
+		}
+		if _, body := do(t, "GET", srv.URL+"/api/fileserver/b", ""); body != "from a" {
+			t.Errorf("native %v: GET b got %q, want the moved file", native, body)
+		}
+	}
+}
+
+func TestMovesBetweenAPairDontDeadlock(t *testing.T) {
+	_, srv := newTestServer(t)
+	do(t, "PUT", srv.URL+"/api/fileserver/a", "a")
+	do(t, "PUT", srv.URL+"/api/fileserver/b", "b")
+	waitForWrites(t)
+
+	done := make(chan int, 2)
+	for _, path := range []string{"/api/fileserver/a/move?to=b", "/api/fileserver/b/move?to=a"} {
+		go func() {
+			resp, _ := do(t, "POST", srv.URL+path, "")
+			done <- resp.StatusCode
+		}()
+	}
+	for range 2 {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("moves between a and b deadlocked")
+		}
+	}
+}
+
+func TestMoveFallbackResume(t *testing.T) {
+	mr, srv := newTestServer(t)
+	store = noRename{store}
+	do(t, "PUT", srv.URL+"/api/fileserver/a", "one")
+	waitForWrites(t)
+	resp, _ := do(t, "POST", srv.URL+"/api/fileserver/a/move?to=b", "")
+	if resp.StatusCode != http.StatusOK || mr.Exists(movesKey) {
+		t.Fatalf("copied move: got %d, intent left behind %v", resp.StatusCode, mr.Exists(movesKey))
+	}
+	mr.FlushAll()
+	if _, body := do(t, "GET", srv.URL+"/api/fileserver/b", ""); body != "one" {
+		t.Fatalf("GET b: got %q, want one", body)
+	}
+
+	// c was interrupted while copying, so it's copied again and then deleted. e was
+	// interrupted after copying, only its delete is left.
+	do(t, "PUT", srv.URL+"/api/fileserver/c", "two")
+	do(t, "PUT", srv.URL+"/api/fileserver/e", "three")
+	do(t, "PUT", srv.URL+"/api/fileserver/f", "three")
+	waitForWrites(t)
+	mr.HSet(movesKey, "c", `{"to":"d","version":7}`)
+	mr.HSet(movesKey, "e", `{"to":"f","version":1,"copied":true}`)
+	mr.HSet(movesKey, "gone", `{"to":"x","version":1}`)
+	resumeMoves(context.Background())
+	deadline := time.Now().Add(5 * time.Second)
+	for mr.Exists(movesKey) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mr.FlushAll()
+
+	want := map[string]string{"c": "File not found.\n", "d": "two", "e": "File not found.\n", "f": "three", "x": "File not found.\n"}
+	for name, wantBody := range want {
+		if _, body := do(t, "GET", srv.URL+"/api/fileserver/"+name, ""); body != wantBody {
+			t.Errorf("GET %s: got %q, want %q", name, body, wantBody)
+		}
+	}
+}
+
+func TestResumeForgetsMovesOfMissingFiles(t *testing.T) {
+	// the fake fileserver answers a DELETE of a missing file with a 404, unlike the memory backend
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", newFakeFileserver(t).URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	mr, srv := newTestServer(t)
+	// neither original exists, one move was still copying and the other only had its delete left
+	mr.HSet(movesKey, "gone", `{"to":"x","version":1}`)
+	mr.HSet(movesKey, "deleted", `{"to":"y","version":1,"copied":true}`)
+	resumeMoves(context.Background())
+	waitFor(t, func() bool { return !mr.Exists(movesKey) })
+
+	// a new file at the destination isn't touched by a later resume
+	do(t, "PUT", srv.URL+"/api/fileserver/x", "new")
+	waitForWrites(t)
+	resumeMoves(context.Background())
+	waitForWrites(t)
+	if _, body := do(t, "GET", srv.URL+"/api/fileserver/x", ""); body != "new" {
+		t.Fatalf("GET x: got %q, want new", body)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	errEmptyName    = errors.New("no file name given")
+	errNameTooLong  = fmt.Errorf("%w, longer than MAX_FILENAME_LENGTH", errInvalidName)
+	errReservedName = fmt.Errorf("%w, reserved on Windows", errInvalidName)
+)
+
+// windowsDeviceName matches names Windows reserves for devices, with or without an extension
+var windowsDeviceName = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[0-9]|lpt[0-9])(\.|$)`)
+
+// fileNameFromRequest reads the {fileName} path value, normalized, validated and scoped to the
+// caller's tenant, so every handler hashes, caches and stores a file under the same name
+func fileNameFromRequest(r *http.Request) (string, error) {
+	return resolveFileName(r, r.PathValue("fileName"))
+}
+
+// resolveFileName is fileNameFromRequest for a name given some other way, like in a request body
+func resolveFileName(r *http.Request, raw string) (string, error) {
+	name := normalizeFileName(raw)
+	if (cfg().versioning && versionSuffix.MatchString(name)) || (cfg().softDelete && isTrashName(name)) ||
+		(cfg().dedup && isBlobName(name)) {
+		return name, errInvalidName
+	}
+	if err := validateFileName(name); err != nil {
+		return name, err
+	}
+	return tenantScoped(r, name)
+}
+
+// normalizeFileName folds names that clients consider equal, e.g. Report.txt and report.txt,
+// onto one entry when NORMALIZE_FILENAMES is on. Otherwise names are case sensitive as given.
+func normalizeFileName(name string) string {
+	if !cfg().normalizeFileNames {
+		return name
+	}
+	return strings.ToLower(norm.NFC.String(name))
+}
+
+// validateFileName is shared by every handler so all backends see the same names.
+// It refuses anything a storage backend could resolve outside its namespace, names over
+// MAX_FILENAME_LENGTH bytes and, with WINDOWS_SAFE_NAMES, names a Windows-backed backend
+// couldn't store.
+func validateFileName(name string) error {
+	if name == "" {
+		return errEmptyName
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return errInvalidName
+	}
+	if limit := cfg().maxFileNameLength; limit > 0 && len(name) > limit {
+		return errNameTooLong
+	}
+	if cfg().windowsSafeNames && (strings.Trim(name, ".") == "" || windowsDeviceName.MatchString(name)) {
+		return errReservedName
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNormalizeFilenames(t *testing.T) {
+	for _, enabled := range []string{"false", "true"} {
+		t.Run(enabled, func(t *testing.T) {
+			t.Setenv("NORMALIZE_FILENAMES", enabled)
+			mr, srv := newTestServer(t)
+			do(t, "PUT", srv.URL+"/api/fileserver/Report.txt", "x")
+			// "é" precomposed, fetched below as "e" and a combining acute
+			do(t, "PUT", srv.URL+"/api/fileserver/caf%C3%A9", "y")
+			cached := "Report.txt"
+			if enabled == "true" {
+				cached = "report.txt"
+			}
+			waitFor(t, func() bool { return mr.Exists(bodyKey(cached)) && mr.Exists(bodyKey("café")) })
+
+			resp, body := do(t, "GET", srv.URL+"/api/fileserver/report.txt", "")
+			resp2, body2 := do(t, "GET", srv.URL+"/api/fileserver/CAFE%CC%81", "")
+			if enabled == "false" {
+				if resp.StatusCode != http.StatusNotFound || resp2.StatusCode != http.StatusNotFound {
+					t.Fatalf("names differing in case or form: got %d and %d, want 404s", resp.StatusCode, resp2.StatusCode)
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusOK || body != "x" || resp2.StatusCode != http.StatusOK || body2 != "y" {
+				t.Fatalf("names differing in case or form: got %d %q and %d %q", resp.StatusCode, body, resp2.StatusCode, body2)
+			}
+			// one cache entry each, under the normalized name
+			if keys := mr.Keys(); !mr.Exists(bodyKey("report.txt")) || !mr.Exists(bodyKey("café")) || mr.Exists(bodyKey("Report.txt")) {
+				t.Fatalf("cache keys: %v", keys)
+			}
+		})
+	}
+}
+
+func TestNamesDontCollideWithBookkeeping(t *testing.T) {
+	_, srv := newTestServer(t)
+	api := srv.URL + "/api/fileserver/"
+	for _, name := range []string{"versions:x.txt", "meta:x.txt", "missing:x.txt", "pointers"} {
+		if resp, _ := do(t, "PUT", api+name, "squatter", "Content-Type", "text/csv"); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("PUT %s: got %d, want 201", name, resp.StatusCode)
+		}
+	}
+	waitForWrites(t)
+
+	resp, body := do(t, "PUT", api+"x.txt", "mine", "Content-Type", "text/plain")
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("X-Version") != "1" {
+		t.Fatalf("PUT x.txt: got %d %q, X-Version %q", resp.StatusCode, body, resp.Header.Get("X-Version"))
+	}
+	waitForWrites(t)
+	resp, body = do(t, "GET", api+"x.txt", "")
+	if body != "mine" || resp.Header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("GET x.txt: got %q as %q", body, resp.Header.Get("Content-Type"))
+	}
+	if _, body := do(t, "GET", api+"versions:x.txt", ""); body != "squatter" {
+		t.Fatalf("GET versions:x.txt: got %q", body)
+	}
+}
+
+func TestFileNameRules(t *testing.T) {
+	tests := []struct {
+		name          string
+		plain, strict int // plainly, and with MAX_FILENAME_LENGTH=10 and WINDOWS_SAFE_NAMES
+	}{
+		{"short", http.StatusCreated, http.StatusCreated},
+		{"exactly10c", http.StatusCreated, http.StatusCreated},
+		{"elevenchars", http.StatusCreated, http.StatusBadRequest},
+		{"CON", http.StatusCreated, http.StatusBadRequest},
+		{"nul.txt", http.StatusCreated, http.StatusBadRequest},
+		{"com1", http.StatusCreated, http.StatusBadRequest},
+		{"...", http.StatusCreated, http.StatusBadRequest},
+		{"console", http.StatusCreated, http.StatusCreated},
+	}
+	for _, mode := range []string{"plain", "strict"} {
+		t.Run(mode, func(t *testing.T) {
+			if mode == "strict" {
+				t.Setenv("MAX_FILENAME_LENGTH", "10")
+				t.Setenv("WINDOWS_SAFE_NAMES", "true")
+			}
+			_, srv := newTestServer(t)
+			for _, tt := range tests {
+				want := tt.plain
+				if mode == "strict" {
+					want = tt.strict
+				}
+				if resp, body := do(t, "PUT", srv.URL+"/api/fileserver/"+tt.name, "x"); resp.StatusCode != want {
+					t.Errorf("PUT %s: got %d %q, want %d", tt.name, resp.StatusCode, body, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const overrideShardHeader = "X-Override-Shard"
+
+type overrideShardKey struct{}
+
+// shardOverride lets integration tests and canaries pin a request to one fileserver with
+// X-Override-Shard: N. Only admin callers may, and the shard rides on the context so every
+// backend request the handler makes, including write-behind, goes to it.
+func shardOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(overrideShardHeader)
+		if value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !isAdmin(r) {
+			http.Error(w, overrideShardHeader+" needs the admin token", http.StatusForbidden)
+			return
+		}
+		shard, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || shard < 1 || shard > shardCount {
+			http.Error(w, fmt.Sprintf("%s must be a shard from 1 to %d", overrideShardHeader, shardCount), http.StatusBadRequest)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), overrideShardKey{}, uint32(shard))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// withoutShardOverride drops a forced shard from ctx, for backends with their own shard layout
+func withoutShardOverride(ctx context.Context) context.Context {
+	return context.WithValue(ctx, overrideShardKey{}, nil)
+}
+
+func overrideShard(ctx context.Context) (uint32, bool) {
+	shard, ok := ctx.Value(overrideShardKey{}).(uint32)
+	return shard, ok
+}
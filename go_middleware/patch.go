@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errBadContentRange = errors.New("invalid Content-Range, want bytes X-Y/* or bytes X-Y/<size>")
+
+// contentRange is a PATCH's "bytes X-Y/size", size is -1 for "*"
+type contentRange struct {
+	byteRange
+	size int64
+}
+
+func parseContentRange(header string) (contentRange, error) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return contentRange{}, errBadContentRange
+	}
+	span, size, found := strings.Cut(spec, "/")
+	if !found {
+		return contentRange{}, errBadContentRange
+	}
+	startStr, endStr, found := strings.Cut(span, "-")
+	if !found {
+		return contentRange{}, errBadContentRange
+	}
+	start, err1 := strconv.ParseInt(startStr, 10, 64)
+	end, err2 := strconv.ParseInt(endStr, 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		return contentRange{}, errBadContentRange
+	}
+
+	cr := contentRange{byteRange: byteRange{start: start, end: end}, size: -1}
+	if size != "*" {
+		cr.size, err1 = strconv.ParseInt(size, 10, 64)
+		if err1 != nil || cr.size < 0 {
+			return contentRange{}, errBadContentRange
+		}
+	}
+	return cr, nil
+}
+
+// patchFile answers PATCH /api/fileserver/{fileName} with Content-Range: bytes X-Y/*, overwriting
+// bytes X through Y of the file with the body, which must be exactly that long. The file keeps
+// its size, a range reaching past its end is a 416, and so is a Content-Range size that isn't
+// the file's. ALLOWED_EXTENSIONS and MIN_WRITE_INTERVAL apply as they do to a PUT, but unlike a
+// PUT the client waits for the write, the 416 can't be known before. The exception is a PATCH
+// landing on a combined PUT still held for WRITE_COMBINE_WINDOW, which already knows the body,
+// so the PATCH is applied to it and answered right away, and written along with it.
+func patchFile(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+
+	fileName, err := fileNameFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cr, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength >= 0 && r.ContentLength != cr.length() {
+		http.Error(w, "body length doesn't match Content-Range", http.StatusBadRequest)
+		return
+	}
+	if !extensionAllowed(fileName) {
+		http.Error(w, "file extension is not in ALLOWED_EXTENSIONS", http.StatusUnsupportedMediaType)
+		return
+	}
+	if rejectDrainedShard(w, ctx, fileName) {
+		return
+	}
+
+	if writes.overloaded() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "backend writes are lagging, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	if limit := cfg().maxUploadBytes; limit > 0 && cr.length() > limit {
+		http.Error(w, "upload is larger than MAX_UPLOAD_BYTES", http.StatusRequestEntityTooLarge)
+		return
+	}
+	allowed, wait, err := claimWriteSlot(ctx, fileName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Redis Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+		http.Error(w, "file was written too recently, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	// a body without a Content-Length is cut off once it runs past the range
+	r.Body = http.MaxBytesReader(w, r.Body, cr.length())
+	bodyBytes, held, err := uploads.readBody(uploadBody(w, r), r.ContentLength)
+	if err != nil {
+		releaseWriteSlot(ctx, fileName)
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "body length doesn't match Content-Range", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errBudgetExceeded) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		http.Error(w, "timed out reading request body", http.StatusRequestTimeout)
+		return
+	}
+	if errors.Is(err, errShortBody) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		return
+	}
+	r.Body.Close()
+	defer uploads.release(held)
+	if int64(len(bodyBytes)) != cr.length() {
+		releaseWriteSlot(ctx, fileName)
+		http.Error(w, "body length doesn't match Content-Range", http.StatusBadRequest)
+		return
+	}
+
+	version, err := nextVersion(ctx, fileName)
+	if err != nil {
+		releaseWriteSlot(ctx, fileName)
+		http.Error(w, fmt.Sprintf("Redis Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	// a combined PUT still held back has the current body at hand, so the PATCH joins its write
+	if cfg().writeCombineWindow > 0 {
+		size, held, err := fileOps.patchCombined(fileName, cr, bodyBytes, version)
+		if held {
+			finishPatch(w, ctx, fileName, version, size, err)
+			return
+		}
+	}
+
+	// read, modify and write all run from the file's queue, so no other write lands in between
+	size := int64(-1)
+	patched := make(chan error, 1)
+	enqueued := writes.enqueue()
+	fileOps.enqueue(fileName, func() {
+		defer writes.done(enqueued)
+		current, meta, err := loadFile(ctx, fileName)
+		if err != nil {
+			patched <- err
+			return
+		}
+		size = int64(len(current))
+		if cr.end >= size || (cr.size >= 0 && cr.size != size) {
+			patched <- errRangeNotSatisfiable
+			return
+		}
+
+		// current may be the cache's or a shared load's copy
+		next := slices.Clone(current)
+		copy(next[cr.start:], bodyBytes)
+		meta.Encodings, meta.Modified = nil, time.Now()
+		patched <- writeFile(ctx, fileName, next, meta, version)
+	})
+
+	finishPatch(w, ctx, fileName, version, size, <-patched)
+}
+
+// finishPatch answers a PATCH whose write came back with err, size is the file's at the time
+func finishPatch(w http.ResponseWriter, ctx context.Context, fileName string, version, size int64, err error) {
+	if err != nil {
+		releaseWriteSlot(ctx, fileName)
+	}
+	if errors.Is(err, errRangeNotSatisfiable) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.Header().Set("X-Version", strconv.FormatInt(version, 10))
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPatchRange(t *testing.T) {
+	_, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/p"
+	do(t, "PUT", u, "hello world")
+	waitForWrites(t)
+
+	resp, body := do(t, "PATCH", u, "WOR", "Content-Range", "bytes 6-8/*")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Version") == "" {
+		t.Fatalf("PATCH: got %d %q", resp.StatusCode, body)
+	}
+	if _, body := do(t, "GET", u, ""); body != "hello WORld" {
+		t.Fatalf("GET after PATCH: got %q", body)
+	}
+
+	tests := []struct {
+		name, url, body, contentRange string
+		want                          int
+	}{
+		{"past the end", u, "xyz", "bytes 9-11/*", http.StatusRequestedRangeNotSatisfiable},
+		{"wrong size", u, "x", "bytes 0-0/12", http.StatusRequestedRangeNotSatisfiable},
+		{"body longer than the range", u, "xy", "bytes 0-0/*", http.StatusBadRequest},
+		{"no unit", u, "x", "0-0", http.StatusBadRequest},
+		{"missing file", srv.URL + "/api/fileserver/missing", "x", "bytes 0-0/*", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if resp, _ := do(t, "PATCH", tt.url, tt.body, "Content-Range", tt.contentRange); resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+	resp, _ = do(t, "PATCH", u, "xyz", "Content-Range", "bytes 9-11/*")
+	if got := resp.Header.Get("Content-Range"); got != "bytes */11" {
+		t.Errorf("416 Content-Range: got %q, want bytes */11", got)
+	}
+	if _, body := do(t, "GET", u, ""); body != "hello WORld" {
+		t.Fatalf("refused PATCHes changed the file to %q", body)
+	}
+}
+
+func TestPatchFollowsPutRules(t *testing.T) {
+	t.Setenv("ALLOWED_EXTENSIONS", ".txt")
+	t.Setenv("MIN_WRITE_INTERVAL", "1h")
+	t.Setenv("DATASET_LABELS", "p-=patched")
+	_, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/p-a.txt"
+	do(t, "PUT", u, "hello")
+	waitForWrites(t)
+
+	if resp, _ := do(t, "PATCH", srv.URL+"/api/fileserver/p-a.csv", "H", "Content-Range", "bytes 0-0/*"); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("PATCH outside ALLOWED_EXTENSIONS: got %d, want 415", resp.StatusCode)
+	}
+
+	// MIN_WRITE_INTERVAL counts PATCHes like PUTs, and a refused one doesn't use up the slot
+	if resp, _ := do(t, "PATCH", u, "H", "Content-Range", "bytes 0-0/*"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("PATCH right after the PUT: got %d, want 429", resp.StatusCode)
+	}
+	redisClient.Del(t.Context(), lastWriteKey("p-a.txt"))
+	if resp, _ := do(t, "PATCH", u, "HELLOX", "Content-Range", "bytes 0-5/*"); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("PATCH past the end: got %d, want 416", resp.StatusCode)
+	}
+	before := testutil.ToFloat64(fileRequests.WithLabelValues("PATCH", "patched", "200"))
+	if resp, _ := do(t, "PATCH", u, "H", "Content-Range", "bytes 0-0/*"); resp.StatusCode != http.StatusOK {
+		t.Errorf("PATCH after the refused one: got %d, want 200", resp.StatusCode)
+	}
+	resp, _ := do(t, "PATCH", u, "E", "Content-Range", "bytes 1-1/*")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("PATCH right after a PATCH: got %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	if got := testutil.ToFloat64(fileRequests.WithLabelValues("PATCH", "patched", "200")) - before; got != 1 {
+		t.Errorf("PATCH 200s counted went up by %v, want 1", got)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// fileQueues runs each file's write-behind operations one at a time in the order the requests
+// arrived, so a PUT and a DELETE acked back to back can't land the other way round. Files
+// don't wait on each other, each busy file gets its own worker goroutine.
+type fileQueues struct {
+	mu     sync.Mutex
+	queues map[string]*fileQueue
+}
+
+type fileQueue struct {
+	ops      []func()
+	putHash  uint64 // body hash of the newest PUT queued since the last DELETE, until it has run
+	hasPut   bool
+	putGen   uint64         // counts PUTs queued, so one that has run only clears hasPut if it's still the newest
+	combined *combinedWrite // the newest op when it's a combined PUT, which may still take more
+}
+
+var fileOps = newFileQueues()
+
+func newFileQueues() *fileQueues {
+	return &fileQueues{queues: make(map[string]*fileQueue)}
+}
+
+// enqueue appends op to key's queue, starting a worker for it if there isn't one running
+func (q *fileQueues) enqueue(key string, op func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.push(key, op)
+}
+
+// enqueueBoth is enqueue for an op that changes two files. It runs once it has reached the front
+// of both a's and b's queues, holding the first to get there until it returns. Both are pushed
+// under one lock, so every queue sees these ops in the same order and two of them can't each
+// hold a queue the other is waiting for.
+func (q *fileQueues) enqueueBoth(a string, b string, op func()) {
+	var arrived atomic.Int32
+	finished := make(chan struct{})
+	join := func() {
+		if arrived.Add(1) == 1 {
+			<-finished
+			return
+		}
+		op()
+		close(finished)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.push(a, join)
+	q.push(b, join)
+}
+
+// enqueuePut is enqueue for a PUT, reporting whether a PUT with a different body is still queued
+// ahead of it. Only the last one will stick.
+func (q *fileQueues) enqueuePut(key string, bodyHash uint64, op func()) (conflict bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	fq, ok := q.queues[key]
+	conflict = ok && fq.hasPut && fq.putHash != bodyHash
+	q.pushPut(key, bodyHash, op)
+	return conflict
+}
+
+// enqueuePutUnlessConflict is enqueuePut for a PUT with X-Fail-On-Conflict, which isn't queued
+// at all when a PUT with a different body is queued or running ahead of it
+func (q *fileQueues) enqueuePutUnlessConflict(key string, bodyHash uint64, op func()) (conflict bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if fq, ok := q.queues[key]; ok && fq.hasPut && fq.putHash != bodyHash {
+		return true
+	}
+	q.pushPut(key, bodyHash, op)
+	return false
+}
+
+// enqueueDelete is enqueue for a DELETE, which supersedes any PUTs queued before it
+func (q *fileQueues) enqueueDelete(key string, op func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	fq := q.push(key, op)
+	fq.hasPut = false
+}
+
+// push adds op to key's queue. Callers hold mu.
+func (q *fileQueues) push(key string, op func()) *fileQueue {
+	fq, running := q.queues[key]
+	if !running {
+		fq = &fileQueue{}
+		q.queues[key] = fq
+		go q.drain(key, fq)
+	}
+	fq.ops = append(fq.ops, op)
+	fq.combined = nil
+	return fq
+}
+
+// pushPut is push for a PUT, which other PUTs conflict with from when it's queued until it has
+// run. Callers hold mu.
+func (q *fileQueues) pushPut(key string, bodyHash uint64, op func()) *fileQueue {
+	var fq *fileQueue
+	var gen uint64
+	fq = q.push(key, func() {
+		op()
+		q.mu.Lock()
+		if fq.putGen == gen {
+			fq.hasPut = false
+		}
+		q.mu.Unlock()
+	})
+	fq.putGen++
+	gen = fq.putGen
+	fq.putHash, fq.hasPut = bodyHash, true
+	return fq
+}
+
+// drain runs key's operations until the queue is empty, then retires it
+func (q *fileQueues) drain(key string, fq *fileQueue) {
+	for {
+		q.mu.Lock()
+		if len(fq.ops) == 0 {
+			delete(q.queues, key)
+			q.mu.Unlock()
+			return
+		}
+		op := fq.ops[0]
+		fq.ops[0] = nil
+		fq.ops = fq.ops[1:]
+		q.mu.Unlock()
+
+		op()
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPutDeleteOrdering(t *testing.T) {
+	mr, srv := newTestServer(t)
+	store = slowStorage{Storage: store, delay: 20 * time.Millisecond}
+	u := srv.URL + "/api/fileserver/o.txt"
+
+	for _, last := range []string{"PUT", "DELETE"} {
+		// acked faster than the backend takes them, so they pile up in the file's queue
+		do(t, "PUT", u, "a")
+		do(t, "DELETE", u, "")
+		do(t, "PUT", u, "b")
+		do(t, "DELETE", u, "")
+		do(t, "PUT", u, "final")
+		if last == "DELETE" {
+			do(t, "DELETE", u, "")
+		}
+		waitForWrites(t)
+
+		for _, source := range []string{"cache", "storage"} {
+			if source == "storage" {
+				mr.FlushAll()
+			}
+			resp, body := do(t, "GET", u, "")
+			if last == "PUT" && (resp.StatusCode != http.StatusOK || body != "final") {
+				t.Fatalf("ending in a PUT, from %s: got %d %q, want final", source, resp.StatusCode, body)
+			}
+			if last == "DELETE" && resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("ending in a DELETE, from %s: got %d, want 404", source, resp.StatusCode)
+			}
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// range cache modes
+const (
+	rangeCacheFull  = "full"  // fetch and cache the whole object, serve ranges out of it
+	rangeCacheRange = "range" // cache each fetched range on its own key
+)
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// byteRange is an inclusive [start, end] span of a file
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+func (br byteRange) length() int64 {
+	return br.end - br.start + 1
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.end, size)
+}
+
+// parseByteRange parses a single "bytes=" range against a file of the given size.
+// ok is false for headers we don't handle (multiple ranges, other units), in which
+// case the caller should ignore the header and serve the whole file.
+func parseByteRange(header string, size int64) (br byteRange, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return byteRange{}, false, nil
+	}
+
+	startStr, endStr, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return byteRange{}, false, nil
+	}
+
+	if startStr == "" {
+		// suffix range, the last N bytes
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || n < 0 {
+			return byteRange{}, false, nil
+		}
+		if n == 0 || size == 0 {
+			return byteRange{}, true, errRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return byteRange{start: size - n, end: size - 1}, true, nil
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false, nil
+	}
+	if start >= size {
+		return byteRange{}, true, errRangeNotSatisfiable
+	}
+
+	end := size - 1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return byteRange{}, false, nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return byteRange{start: start, end: end}, true, nil
+}
+
+func rangeCacheKey(fileName string, rangeHeader string) string {
+	return "range:" + fileName + ":" + rangeHeader
+}
+
+// rangeIndexKey is a redis set holding every range key cached for a file, so writes can drop them all
+func rangeIndexKey(fileName string) string {
+	return "ranges:" + fileName
+}
+
+// invalidateRanges drops every cached range of fileName. Callers hold the file's write lock.
+func invalidateRanges(ctx context.Context, fileName string) {
+	indexKey := rangeIndexKey(fileName)
+	keys, err := redisClient.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		slog.Error("Redis SMEMBERS error", "file", fileName, "err", err)
+		return
+	}
+
+	err = redisClient.Del(ctx, append(keys, indexKey)...).Err()
+	if err != nil {
+		slog.Error("Redis DELETE error", "file", fileName, "err", err)
+	}
+}
+
+// conditional is whether r needs the whole file's ETag or mtime to be answered
+func conditional(r *http.Request) bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" || r.Header.Get("If-Range") != ""
+}
+
+// serveRange answers a Range request. Callers hold the file's read lock.
+func serveRange(w http.ResponseWriter, r *http.Request, fileName string) {
+	ctx := r.Context()
+
+	// a cached range knows nothing about the rest of the file, so conditional requests are
+	// answered from the whole of it in either mode
+	if cfg().rangeCacheMode == rangeCacheRange && !conditional(r) {
+		serveCachedRange(w, ctx, fileName, r.Header.Get("Range"))
+		return
+	}
+
+	// full mode, serve out of the cached object and populate it on a miss. Misses take the same
+	// shared load as a plain GET, with its negative cache and CACHE_TTL early refresh
+	var bodyBytes []byte
+	var meta fileMeta
+	var err error
+	if knownMissing(ctx, fileName) {
+		err = errNotFound
+	} else if cfg().cacheTTL > 0 {
+		bodyBytes, meta, err = loadFresh(ctx, fileName)
+	} else {
+		bodyBytes, meta, err = readRepair(ctx, fileName)
+	}
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			rememberMissing(ctx, fileName)
+		}
+		writeStorageError(w, err)
+		return
+	}
+
+	writeRange(w, r, bodyBytes, meta)
+}
+
+// serveCachedRange serves a range out of its own cache entry, fetching just that
+// range from the backend on a miss.
+func serveCachedRange(w http.ResponseWriter, ctx context.Context, fileName string, rangeHeader string) {
+	key := rangeCacheKey(fileName, rangeHeader)
+	excluded := cacheExcluded(fileName)
+
+	var cached map[string]string
+	var err error
+	if !excluded {
+		cached, err = redisClient.HGetAll(ctx, key).Result()
+	}
+	if err == nil && len(cached) > 0 {
+		w.Header().Set("Content-Range", cached["contentRange"])
+		w.Header().Set("Content-Length", strconv.Itoa(len(cached["body"])))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(cached["body"]))
+		return
+	}
+	slog.Debug("Cache Miss!", "file", fileName)
+
+	body, contentRange, err := getRange(ctx, fileName, rangeHeader)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	defer body.Close()
+
+	bodyBytes, err := io.ReadAll(body)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("reading fileserver body: %w", err))
+		return
+	}
+
+	if contentRange == "" {
+		// backend sent the whole file, so cut the range out ourselves
+		size := int64(len(bodyBytes))
+		br, ok, err := parseByteRange(rangeHeader, size)
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusOK)
+			w.Write(bodyBytes)
+			return
+		}
+		contentRange = br.contentRange(size)
+		bodyBytes = bodyBytes[br.start : br.end+1]
+	}
+
+	// range fetches don't carry the content type, so they're cached like a file without one
+	if cacheable("") && !excluded {
+		ttl := cacheTTL()
+		pipe := redisClient.TxPipeline()
+		pipe.HSet(ctx, key, "body", bodyBytes, "contentRange", contentRange)
+		pipe.SAdd(ctx, rangeIndexKey(fileName), key)
+		if ttl > 0 {
+			pipe.PExpire(ctx, key, ttl)
+			// the index has to outlive every range in it, or a write could leave one behind. Jitter
+			// never stretches a TTL past twice CACHE_TTL.
+			pipe.PExpire(ctx, rangeIndexKey(fileName), 2*cfg().cacheTTL)
+		}
+		_, err = pipe.Exec(ctx)
+		if err != nil {
+			slog.Error("Redis range SET error", "file", fileName, "err", err)
+		}
+	}
+
+	w.Header().Set("Content-Range", contentRange)
+	w.Header().Set("Content-Length", strconv.Itoa(len(bodyBytes)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(bodyBytes)
+}
+
+// writeRange writes the requested range of a fully loaded file, with the same ETag, 304s and
+// headers as a full GET. A file that no longer matches If-Range is sent whole.
+func writeRange(w http.ResponseWriter, r *http.Request, bodyBytes []byte, meta fileMeta) {
+	etag := etagFor(bodyBytes)
+	if notModified(w, r, etag, meta.Modified) {
+		return
+	}
+	meta.writeHeaders(w.Header())
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", etag)
+
+	rangeHeader := r.Header.Get("Range")
+	if !ifRangeMatches(r.Header.Get("If-Range"), etag, meta.Modified) {
+		rangeHeader = ""
+	}
+	size := int64(len(bodyBytes))
+	br, ok, err := parseByteRange(rangeHeader, size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	if !ok {
+		w.Header().Set("Content-Length", strconv.Itoa(len(bodyBytes)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(bodyBytes)
+		return
+	}
+
+	w.Header().Set("Content-Range", br.contentRange(size))
+	w.Header().Set("Content-Length", strconv.FormatInt(br.length(), 10))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(bodyBytes[br.start : br.end+1])
+}
+
+// ifRangeMatches is whether an If-Range header lets a range be served. It has to be empty, the
+// file's ETag, or exactly its Last-Modified date, a weak ETag never matches.
+func ifRangeMatches(header string, etag string, modified time.Time) bool {
+	if header == "" {
+		return true
+	}
+	if strings.HasPrefix(header, `"`) {
+		return header == etag
+	}
+	date, err := http.ParseTime(header)
+	return err == nil && !modified.IsZero() && modified.Truncate(time.Second).Equal(date)
+}
+
+// getRange reads a range from storage when the backend supports it, otherwise the whole file
+func getRange(ctx context.Context, fileName string, rangeHeader string) (io.ReadCloser, string, error) {
+	if rg, ok := store.(rangeGetter); ok {
+		return rg.GetRange(ctx, fileName, rangeHeader)
+	}
+
+	body, _, err := store.Get(ctx, fileName)
+	return body, "", err
+}
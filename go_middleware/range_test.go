@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		header string
+		want   byteRange
+		ok     bool
+		err    error
+	}{
+		{"bytes=0-4", byteRange{0, 4}, true, nil},
+		{"bytes=6-", byteRange{6, 9}, true, nil},
+		{"bytes=-3", byteRange{7, 9}, true, nil},
+		{"bytes=5-100", byteRange{5, 9}, true, nil},
+		{"bytes=10-", byteRange{}, true, errRangeNotSatisfiable},
+		{"bytes=0-1,3-4", byteRange{}, false, nil},
+		{"items=0-4", byteRange{}, false, nil},
+		{"bytes=4-2", byteRange{}, false, nil},
+	}
+	for _, tt := range tests {
+		got, ok, err := parseByteRange(tt.header, 10)
+		if got != tt.want || ok != tt.ok || err != tt.err {
+			t.Errorf("parseByteRange(%q) = %v, %v, %v, want %v, %v, %v", tt.header, got, ok, err, tt.want, tt.ok, tt.err)
+		}
+	}
+}
+
+func TestRangeOnColdKey(t *testing.T) {
+	for _, mode := range []string{rangeCacheFull, rangeCacheRange} {
+		t.Run(mode, func(t *testing.T) {
+			t.Setenv("RANGE_CACHE_MODE", mode)
+			fs := newFakeFileserver(t)
+			fs.files["/a.txt"] = fakeFile{body: []byte("hello world")}
+			t.Setenv("STORAGE", "http")
+			t.Setenv("FILE_SERVER_URL", fs.URL)
+			_, srv := newTestServer(t)
+			u := srv.URL + "/api/fileserver/a.txt"
+
+			resp, body := do(t, "GET", u, "", "Range", "bytes=6-10")
+			if resp.StatusCode != http.StatusPartialContent || body != "world" {
+				t.Fatalf("range: got %d %q", resp.StatusCode, body)
+			}
+			if got := resp.Header.Get("Content-Range"); got != "bytes 6-10/11" {
+				t.Fatalf("Content-Range: got %q", got)
+			}
+			// again, now from whatever the cold read cached
+			_, body = do(t, "GET", u, "", "Range", "bytes=6-10")
+			if body != "world" {
+				t.Fatalf("cached range: got %q", body)
+			}
+
+			resp, body = do(t, "GET", u, "")
+			if resp.StatusCode != http.StatusOK || body != "hello world" {
+				t.Fatalf("full GET after range: got %d %q", resp.StatusCode, body)
+			}
+
+			resp, _ = do(t, "GET", u, "", "Range", "bytes=20-")
+			if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+				t.Fatalf("out of bounds: got %d, want 416", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestConditionalRanges(t *testing.T) {
+	for _, mode := range []string{rangeCacheFull, rangeCacheRange} {
+		t.Run(mode, func(t *testing.T) {
+			t.Setenv("RANGE_CACHE_MODE", mode)
+			_, srv := newTestServer(t)
+			u := srv.URL + "/api/fileserver/a.txt"
+			do(t, "PUT", u, "hello world")
+			waitForWrites(t)
+			full, _ := do(t, "GET", u, "")
+			etag := full.Header.Get("ETag")
+
+			// a fresh range answers like a fresh file does
+			if resp, _ := do(t, "GET", u, "", "Range", "bytes=6-10", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+				t.Errorf("range with a current If-None-Match: got %d, want 304", resp.StatusCode)
+			}
+			if resp, _ := do(t, "GET", u, "", "Range", "bytes=6-10", "If-Modified-Since", full.Header.Get("Last-Modified")); resp.StatusCode != http.StatusNotModified {
+				t.Errorf("range with a current If-Modified-Since: got %d, want 304", resp.StatusCode)
+			}
+			resp, body := do(t, "GET", u, "", "Range", "bytes=6-10", "If-Range", etag)
+			if resp.StatusCode != http.StatusPartialContent || body != "world" || resp.Header.Get("ETag") != etag {
+				t.Errorf("range with a current If-Range: got %d %q, ETag %q", resp.StatusCode, body, resp.Header.Get("ETag"))
+			}
+
+			// a stale If-Range gets the whole file
+			resp, body = do(t, "GET", u, "", "Range", "bytes=6-10", "If-Range", `"stale"`, "If-None-Match", `"stale"`)
+			if resp.StatusCode != http.StatusOK || body != "hello world" {
+				t.Errorf("range with a stale If-Range: got %d %q, want the whole file", resp.StatusCode, body)
+			}
+			resp, body = do(t, "GET", u+"?contentType=text/csv", "", "Range", "bytes=0-4", "If-Range", etag)
+			if resp.StatusCode != http.StatusPartialContent || body != "hello" || resp.Header.Get("Content-Type") != "text/csv" {
+				t.Errorf("range with a contentType override: got %d %q as %q", resp.StatusCode, body, resp.Header.Get("Content-Type"))
+			}
+		})
+	}
+}
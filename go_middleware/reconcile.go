@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// what reconciling a file did, reported as its batch item's "action"
+const (
+	reconcileInSync      = "in-sync"     // cache and backend agree, or there's nothing cached to compare
+	reconcileRepushed    = "repushed"    // the backend had lost the file, the cached copy was written back
+	reconcileInvalidated = "invalidated" // the backend holds something else, the cache entry was dropped
+)
+
+// most files one POST /admin/reconcile may name, and the size of its body
+const (
+	maxReconcileFiles     = 1000
+	maxReconcileBodyBytes = 1 << 20
+)
+
+type reconcileRequest struct {
+	Files []string `json:"files"`
+}
+
+// reconcileHandler answers POST /admin/reconcile, comparing the cached copy of each file in
+// {"files":[...]} against the backend's and repairing any that disagree. An empty body or list
+// checks every file PUT through the middleware. The backend is the source of truth, so a
+// mismatch drops the cache entry, only a file the backend no longer has at all gets the cached
+// copy written back. The answer is a batch response with each file's "action".
+func reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+
+	var req reconcileRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxReconcileBodyBytes)).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid request body, want {\"files\":[...]} or nothing", http.StatusBadRequest)
+		return
+	}
+	if len(req.Files) > maxReconcileFiles {
+		http.Error(w, fmt.Sprintf("at most %d files per request", maxReconcileFiles), http.StatusBadRequest)
+		return
+	}
+
+	results := map[string]batchItem{}
+	names := map[string]string{}
+	if len(req.Files) == 0 {
+		known, err := knownFiles(ctx)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Redis Error: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		for _, name := range known {
+			names[name] = name
+		}
+	}
+	for _, file := range req.Files {
+		name, err := resolveFileName(r, file)
+		if err != nil {
+			results[file] = batchFailure(http.StatusBadRequest, err)
+			continue
+		}
+		names[file] = name
+	}
+
+	// each file waits its turn behind its queued writes, which would otherwise look like divergence
+	for file, name := range names {
+		done := make(chan batchItem, 1)
+		fileOps.enqueue(name, func() {
+			done <- reconcileFile(ctx, name)
+		})
+		results[file] = <-done
+	}
+
+	writeBatch(w, results)
+}
+
+// knownFiles is every file a PUT has been issued for, from the version counters
+func knownFiles(ctx context.Context) ([]string, error) {
+	names := []string{}
+	iter := redisClient.Scan(ctx, 0, versionKey("*"), 0).Iterator()
+	for iter.Next(ctx) {
+		names = append(names, strings.TrimPrefix(iter.Val(), versionKey("")))
+	}
+	return names, iter.Err()
+}
+
+// reconcileFile runs from the file's queue
+func reconcileFile(ctx context.Context, fileName string) batchItem {
+	lock := fileLocks.get(fileName)
+	lock.Lock(ctx)
+	defer lock.Unlock()
+
+	cached, meta, err := cacheGet(ctx, fileName)
+	if errors.Is(err, redis.Nil) {
+		return reconcileItem(reconcileInSync)
+	}
+	if err != nil {
+		return batchFailure(http.StatusInternalServerError, fmt.Errorf("Redis Error: %w", err))
+	}
+
+	stored, err := storedBytes(ctx, fileName)
+	if errors.Is(err, errNotFound) {
+		err = putVerified(ctx, fileName, cached, meta)
+		if err != nil {
+			slog.Error("Storage PUT error", "file", fileName, "err", err)
+			return batchFailure(storageErrorStatus(err), err)
+		}
+		slog.Warn("Backend had lost a cached file, wrote it back", "file", fileName)
+		return reconcileItem(reconcileRepushed)
+	}
+	if err != nil {
+		slog.Error("Storage GET error", "file", fileName, "err", err)
+		return batchFailure(storageErrorStatus(err), err)
+	}
+
+	if etagFor(stored) == etagFor(cached) {
+		return reconcileItem(reconcileInSync)
+	}
+	err = cacheDel(ctx, fileName)
+	if err != nil {
+		return batchFailure(http.StatusInternalServerError, fmt.Errorf("Redis Error: %w", err))
+	}
+	invalidateRanges(ctx, fileName)
+	slog.Warn("Cache disagreed with the backend, dropped it", "file", fileName)
+	return reconcileItem(reconcileInvalidated)
+}
+
+// storedBytes reads a file straight from storage, past the cache
+func storedBytes(ctx context.Context, fileName string) ([]byte, error) {
+	body, _, err := store.Get(ctx, fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	bodyBytes, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("reading fileserver body: %w", err)
+	}
+	return bodyBytes, nil
+}
+
+func reconcileItem(action string) batchItem {
+	return batchItem{Status: http.StatusOK, Action: action}
+}
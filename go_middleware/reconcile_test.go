@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReconcileRepairsDivergence(t *testing.T) {
+	t.Setenv("STORAGE", "fs")
+	t.Setenv("ADMIN_TOKEN", "secret")
+	_, srv := newTestServer(t)
+	do(t, "PUT", srv.URL+"/api/fileserver/ok", "same")
+	do(t, "PUT", srv.URL+"/api/fileserver/lost", "cached copy")
+	do(t, "PUT", srv.URL+"/api/fileserver/stale", "old")
+	waitForWrites(t)
+
+	// the backend loses one file and another changes under the cache
+	root := cfg().fsRoot
+	if err := os.Remove(filepath.Join(root, "lost")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "stale"), []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, raw := do(t, "POST", srv.URL+"/admin/reconcile", "", "Authorization", "Bearer secret")
+	var got batchResponse
+	if err := json.Unmarshal([]byte(raw), &got); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %q", resp.StatusCode, raw)
+	}
+	for name, action := range map[string]string{"ok": "in-sync", "lost": "repushed", "stale": "invalidated"} {
+		if got.Results[name].Action != action {
+			t.Errorf("%s: got %+v, want %s", name, got.Results[name], action)
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(root, "lost")); err != nil || string(data) != "cached copy" {
+		t.Fatalf("lost file not repushed: %q, %v", data, err)
+	}
+	if _, body := do(t, "GET", srv.URL+"/api/fileserver/stale", ""); body != "new" {
+		t.Fatalf("stale file still served from the cache: %q", body)
+	}
+
+	resp, raw = do(t, "POST", srv.URL+"/admin/reconcile", `{"files":["ok",".."]}`, "Authorization", "Bearer secret")
+	if resp.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("with a bad name: got %d %q, want 207", resp.StatusCode, raw)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/joho/godotenv"
+)
+
+// reloadable names what POST /admin/reload picks up. These are only read per request, so a new
+// value applies from the next one. Everything else is fixed until a restart, in particular
+// PORT and ADMIN_ADDR (listeners are bound once), READ_HEADER_TIMEOUT, READ_TIMEOUT and the
+// TCP_KEEPALIVE settings (set on the listener), STORAGE and FILE_SERVER_URL with its shard
+// count (files would map to different shards), MAX_CONCURRENT_REQUESTS, MAX_QUEUED_REQUESTS and
+// QUEUE_TIMEOUT (the limiter is sized at startup), MAX_READERS_PER_FILE, MAX_INFLIGHT_BYTES and
+// ADMIN_TOKEN.
+var reloadable = []string{
+	"LOG_LEVEL",
+	"LOCK_TIMEOUT",
+	"READER_WAIT_TIMEOUT",
+	"MIN_VERSION_WAIT",
+	"WRITE_LATENCY_THRESHOLD",
+	"MIN_WRITE_INTERVAL",
+	"CACHEABLE_CONTENT_TYPES",
+	"BODY_READ_TIMEOUT",
+	"RETRY_BUDGET",
+}
+
+// dotenvKeys are the variables .env has set, which a later read of it may change or unset.
+// Anything else in the environment was there when the process started, and wins over .env.
+var (
+	dotenvMu   sync.Mutex
+	dotenvKeys = map[string]bool{}
+)
+
+// loadDotEnv sets each variable in .env that the process wasn't started with, like
+// godotenv.Load. Read again, it also picks up values changed in the file and unsets the ones
+// removed from it, so they go back to their defaults.
+func loadDotEnv() error {
+	dotenvMu.Lock()
+	defer dotenvMu.Unlock()
+
+	values, err := godotenv.Read()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for key := range dotenvKeys {
+		if _, ok := values[key]; !ok {
+			os.Unsetenv(key)
+			delete(dotenvKeys, key)
+		}
+	}
+	for key, value := range values {
+		if _, set := os.LookupEnv(key); set && !dotenvKeys[key] {
+			continue
+		}
+		os.Setenv(key, value)
+		dotenvKeys[key] = true
+	}
+	return nil
+}
+
+// reloadConfig re-reads .env, the only part of the environment that can change under a running
+// process, and swaps in a config with the reloadable settings updated
+func reloadConfig() error {
+	err := loadDotEnv()
+	if err != nil {
+		return err
+	}
+
+	fresh := loadConfig()
+	next := *cfg()
+	next.logLevel = fresh.logLevel
+	next.lockTimeout = fresh.lockTimeout
+	next.readerWaitTimeout = fresh.readerWaitTimeout
+	next.minVersionWait = fresh.minVersionWait
+	next.writeLatencyThreshold = fresh.writeLatencyThreshold
+	next.minWriteInterval = fresh.minWriteInterval
+	next.cacheableTypes = fresh.cacheableTypes
+	next.bodyReadTimeout = fresh.bodyReadTimeout
+	next.retryBudget = fresh.retryBudget
+	current.Store(&next)
+
+	logLevel.Set(parseLogLevel(next.logLevel))
+	return nil
+}
+
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	err := reloadConfig()
+	if err != nil {
+		http.Error(w, "could not reload config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Config reloaded", "logLevel", cfg().logLevel)
+
+	b, _ := json.Marshal(map[string][]string{"reloaded": reloadable})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
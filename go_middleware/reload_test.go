@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadLogLevel(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	t.Setenv("LOG_LEVEL", "")
+	os.Unsetenv("LOG_LEVEL")
+	t.Setenv("LOCK_TIMEOUT", "1s")
+	t.Setenv("MAX_READERS_PER_FILE", "4")
+	t.Cleanup(func() { dotenvKeys = map[string]bool{} })
+	logs := captureLogs(t, "info")
+	_, srv := newTestServer(t)
+
+	// reload reads .env from the working directory, for whatever the environment doesn't set
+	dir := t.TempDir()
+	t.Chdir(dir)
+	writeEnv := func(env string) {
+		if err := os.WriteFile(filepath.Join(dir, ".env"), []byte(env), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeEnv("LOG_LEVEL=debug\nLOCK_TIMEOUT=9s\nMAX_READERS_PER_FILE=99\n")
+
+	if resp, _ := do(t, "POST", srv.URL+"/admin/reload", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("without the admin token: got %d, want 401", resp.StatusCode)
+	}
+	resp, body := do(t, "POST", srv.URL+"/admin/reload", "", "Authorization", "Bearer secret")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"LOG_LEVEL"`) {
+		t.Fatalf("reload: got %d %q", resp.StatusCode, body)
+	}
+	if logLevel.Level() != slog.LevelDebug || cfg().logLevel != "debug" {
+		t.Fatalf("log level after reload: %v", logLevel.Level())
+	}
+	slog.Debug("after reload")
+	if !strings.Contains(logs(), "after reload") {
+		t.Fatal("debug line not logged at the reloaded level")
+	}
+	if cfg().lockTimeout != time.Second {
+		t.Fatalf("LOCK_TIMEOUT from the environment should win over .env, got %v", cfg().lockTimeout)
+	}
+	if cfg().maxReadersPerFile != 4 {
+		t.Fatalf("MAX_READERS_PER_FILE isn't reloadable, but changed to %d", cfg().maxReadersPerFile)
+	}
+
+	// a setting taken out of .env goes back to its default
+	writeEnv("LOCK_TIMEOUT=9s\n")
+	if resp, body := do(t, "POST", srv.URL+"/admin/reload", "", "Authorization", "Bearer secret"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("second reload: got %d %q", resp.StatusCode, body)
+	}
+	if cfg().logLevel != "info" || cfg().lockTimeout != time.Second {
+		t.Fatalf("after LOG_LEVEL left .env: log level %q, lock timeout %v", cfg().logLevel, cfg().lockTimeout)
+	}
+}
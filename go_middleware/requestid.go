@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// longest client-supplied request ID we'll adopt, anything longer gets a fresh one
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// requestIDs gives every request an ID, the client's REQUEST_ID_HEADER if it sent a usable one
+// or a generated one otherwise. The ID is echoed on the response and kept on the context, which
+// write-behind work carries, so backend requests and log lines can be tied back to it.
+func requestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(cfg().requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(cfg().requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestIDFrom is the ID requestIDs gave ctx's request, or "" outside of one
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID takes printable ASCII only, so an ID can't smuggle anything into headers or logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDReachesBackend(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	mr, srv := newTestServer(t)
+	logs := captureLogs(t, "debug")
+	u := srv.URL + "/api/fileserver/r.txt"
+
+	resp, _ := do(t, "PUT", u, "x", "X-Request-ID", "client-id-1")
+	if got := resp.Header.Get("X-Request-ID"); got != "client-id-1" {
+		t.Fatalf("PUT echoed request ID %q", got)
+	}
+	waitForWrites(t)
+	mr.FlushAll()
+	// an unusable ID is replaced, the generated one is what goes on
+	get, _ := do(t, "GET", u, "", "X-Request-ID", "bad id")
+	del, _ := do(t, "DELETE", u, "")
+	waitForWrites(t)
+
+	ids := map[string]string{
+		http.MethodPut:    "client-id-1",
+		http.MethodGet:    get.Header.Get("X-Request-ID"),
+		http.MethodDelete: del.Header.Get("X-Request-ID"),
+	}
+	for method, id := range ids {
+		if len(id) == 0 || id == "bad id" {
+			t.Fatalf("%s: got request ID %q", method, id)
+		}
+	}
+	for _, req := range fs.received() {
+		if got := req.header.Get("X-Request-ID"); got != ids[req.method] {
+			t.Errorf("backend %s: got X-Request-ID %q, want %q", req.method, got, ids[req.method])
+		}
+	}
+	for method, id := range ids {
+		if !strings.Contains(logs(), "request_id="+id) {
+			t.Errorf("no log line for the %s carries request_id=%s", method, id)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var retryBudgetUtilization = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "middleware_retry_budget_utilization",
+	Help: "Share of this second's RETRY_BUDGET spent across all replicas, as last seen here.",
+})
+
+var retriesDenied = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "middleware_retries_denied_total",
+	Help: "Backend retries skipped because the retry budget was spent.",
+})
+
+func retryBudgetKey(second int64) string {
+	return "retrybudget:" + strconv.FormatInt(second, 10)
+}
+
+// retryAllowed spends one retry from RETRY_BUDGET. The budget is shared by every replica through
+// a redis counter per second, so however many requests are failing the backends see at most
+// that many retries a second on top. Once it's spent, callers give up rather than retry, and
+// if redis can't be asked they do the same.
+func retryAllowed(ctx context.Context) bool {
+	budget := int64(cfg().retryBudget)
+	if budget <= 0 {
+		return true
+	}
+
+	key := retryBudgetKey(time.Now().Unix())
+	pipe := redisClient.TxPipeline()
+	used := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, 2*time.Second)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		slog.Error("Redis retry budget error", "err", err)
+		return false
+	}
+
+	retryBudgetUtilization.Set(min(1, float64(used.Val())/float64(budget)))
+	if used.Val() > budget {
+		retriesDenied.Inc()
+		return false
+	}
+	return true
+}
+
+// retryWait is how long to wait before retrying after err, backoff unless the backend answered
+// with a Retry-After asking for longer. A 429 retried any sooner only adds to the overload, but
+// MAX_RETRY_AFTER bounds the wait so one backend can't stall a retry loop indefinitely.
+func retryWait(err error, backoff time.Duration) time.Duration {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.retryAfter > backoff {
+		return min(statusErr.retryAfter, max(backoff, cfg().maxRetryAfter))
+	}
+	return backoff
+}
+
+// parseRetryAfter reads a Retry-After header, either delay-seconds or an HTTP-date, as a wait
+// from now. Anything missing, malformed or in the past is 0.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(0, time.Duration(seconds)*time.Second)
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(0, at.Sub(now))
+	}
+	return 0
+}
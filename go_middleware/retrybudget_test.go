@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRetryBudgetRunsOut(t *testing.T) {
+	t.Setenv("RETRY_BUDGET", "3")
+	newTestServer(t)
+
+	// the budget is per second, so start over if the calls straddle one
+	for {
+		start := time.Now().Unix()
+		denied := testutil.ToFloat64(retriesDenied)
+		var allowed []bool
+		for range 5 {
+			allowed = append(allowed, retryAllowed(t.Context()))
+		}
+		if time.Now().Unix() != start {
+			continue
+		}
+
+		want := []bool{true, true, true, false, false}
+		for i := range want {
+			if allowed[i] != want[i] {
+				t.Fatalf("retries allowed: got %v, want %v", allowed, want)
+			}
+		}
+		if got := testutil.ToFloat64(retriesDenied) - denied; got != 2 {
+			t.Fatalf("denied retries went up by %v, want 2", got)
+		}
+		if got := testutil.ToFloat64(retryBudgetUtilization); got != 1 {
+			t.Fatalf("utilization: got %v, want 1", got)
+		}
+		return
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	t.Setenv("MAX_RETRY_AFTER", "5s")
+	current.Store(loadConfig())
+	backoff := 100 * time.Millisecond
+
+	tests := []struct {
+		name string
+		err  error
+		want time.Duration
+	}{
+		{"not a status", errNotFound, backoff},
+		{"503 without Retry-After", &statusError{op: "GET", status: http.StatusServiceUnavailable}, backoff},
+		{"429 asking for 2s", &statusError{op: "GET", status: http.StatusTooManyRequests, retryAfter: 2 * time.Second}, 2 * time.Second},
+		{"429 asking for an hour", &statusError{op: "GET", status: http.StatusTooManyRequests, retryAfter: time.Hour}, 5 * time.Second},
+		{"429 asking for less than the backoff", &statusError{op: "GET", status: http.StatusTooManyRequests, retryAfter: 10 * time.Millisecond}, backoff},
+	}
+	for _, tt := range tests {
+		if got := retryWait(tt.err, backoff); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"3", 3 * time.Second},
+		{now.Add(5 * time.Second).Format(http.TimeFormat), 5 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"-2", 0},
+		{"soon", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestBackendRetryHonoursRetryAfter(t *testing.T) {
+	var mu sync.Mutex
+	var gets []time.Time
+	var puts []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+			gets = append(gets, time.Now())
+			if len(gets) == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write([]byte("hello"))
+		case http.MethodPut:
+			b, _ := io.ReadAll(r.Body)
+			puts = append(puts, string(b))
+			if len(puts) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}
+	}))
+	defer backend.Close()
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", backend.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	t.Setenv("WRITE_THROUGH", "true")
+	t.Setenv("BACKEND_RETRY_BACKOFF", "10ms")
+	_, srv := newTestServer(t)
+
+	resp, body := do(t, "GET", srv.URL+"/api/fileserver/r.txt", "")
+	if resp.StatusCode != http.StatusOK || body != "hello" {
+		t.Fatalf("GET: got %d %q", resp.StatusCode, body)
+	}
+	mu.Lock()
+	if len(gets) != 2 || gets[1].Sub(gets[0]) < time.Second {
+		t.Fatalf("backend GETs at %v, want a retry a second after the 429", gets)
+	}
+	mu.Unlock()
+
+	// a retried PUT sends the whole body again
+	if resp, _ := do(t, "PUT", srv.URL+"/api/fileserver/w.txt", "written"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: got %d, want 201 after the retry", resp.StatusCode)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(puts) != 2 || puts[1] != "written" {
+		t.Fatalf("backend PUTs got %q", puts)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	for _, enabled := range []string{"true", "false"} {
+		t.Run(enabled, func(t *testing.T) {
+			t.Setenv("SECURITY_HEADERS", enabled)
+			_, srv := newTestServer(t)
+			u := srv.URL + "/api/fileserver/s.html"
+			do(t, "PUT", u, "<p>hi</p>", "Content-Type", "text/html")
+			waitForWrites(t)
+
+			resp, _ := do(t, "GET", u, "")
+			h := resp.Header
+			if h.Get("Content-Type") != "text/html" || h.Get("Content-Length") != "9" {
+				t.Fatalf("content headers: %v", h)
+			}
+			// plain http, never HSTS
+			if h.Get("Strict-Transport-Security") != "" {
+				t.Fatal("Strict-Transport-Security over plain http")
+			}
+			if enabled == "false" {
+				if h.Get("X-Content-Type-Options") != "" || h.Get("X-Frame-Options") != "" {
+					t.Fatalf("security headers with SECURITY_HEADERS off: %v", h)
+				}
+				return
+			}
+			if h.Get("X-Content-Type-Options") != "nosniff" || h.Get("X-Frame-Options") != "DENY" || h.Get("Referrer-Policy") != "no-referrer" {
+				t.Fatalf("security headers: %v", h)
+			}
+		})
+	}
+}
+
+func TestHSTSOverTLS(t *testing.T) {
+	t.Setenv("HSTS_MAX_AGE", "1h")
+	newTestServer(t)
+	srv := httptest.NewTLSServer(routes())
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Strict-Transport-Security"); got != "max-age=3600; includeSubDomains" {
+		t.Fatalf("Strict-Transport-Security: got %q", got)
+	}
+}
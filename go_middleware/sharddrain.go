@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// isDraining is true for a shard taken out of service with POST /admin/shards/{shard}/drain.
+// Shard 0, sharding off, can't be drained.
+func (s *httpStorage) isDraining(shard uint32) bool {
+	return shard != 0 && s.draining[shard].Load()
+}
+
+// rejectDrainedShard turns away a write to a file whose shard is draining, answering 503 so
+// clients retry once it's back. Writes already queued still go through, wait for /ready's queue
+// to empty before taking the fileserver down.
+func rejectDrainedShard(w http.ResponseWriter, ctx context.Context, fileName string) bool {
+	hs, ok := httpBackend()
+	if !ok || !hs.isDraining(hs.shardOf(ctx, fileName)) {
+		return false
+	}
+	w.Header().Set("Retry-After", "60")
+	http.Error(w, "the file's shard is draining for maintenance, try again later", http.StatusServiceUnavailable)
+	return true
+}
+
+// shardDrainHandler answers POST /admin/shards/{shard}/drain and /undrain. A draining shard
+// takes no new writes and its reads go to READ_FALLBACK_SHARDS first, the cache still serves
+// what it holds. The state is this replica's alone, drain every replica before maintenance.
+func shardDrainHandler(draining bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hs, ok := httpBackend()
+		if !ok || !cfg().shardingEnabled {
+			http.Error(w, "draining needs STORAGE=http with SHARDING_ENABLED", http.StatusNotImplemented)
+			return
+		}
+		shard, err := strconv.ParseUint(r.PathValue("shard"), 10, 32)
+		if err != nil || shard < 1 || shard > shardCount {
+			http.Error(w, fmt.Sprintf("shard must be from 1 to %d", shardCount), http.StatusBadRequest)
+			return
+		}
+
+		if was := hs.draining[shard].Swap(draining); was != draining {
+			slog.Info("Shard drain changed", "shard", shard, "draining", draining)
+		}
+
+		b, _ := json.Marshal(map[string]any{"shard": shard, "draining": draining})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
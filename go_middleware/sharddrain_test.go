@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestShardDrain(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL+"/s#")
+	t.Setenv("READ_FALLBACK_SHARDS", "1")
+	t.Setenv("ADMIN_TOKEN", "secret")
+	mr, srv := newTestServer(t)
+	auth := []string{"Authorization", "Bearer secret"}
+	u := srv.URL + "/api/fileserver/a.txt"
+	shard := hashKey("a.txt")
+	drainURL := fmt.Sprintf("%s/admin/shards/%d/drain", srv.URL, shard)
+	// a copy one shard round the ring, as a replica would have
+	fs.files[fmt.Sprintf("/s%d/a.txt", nextShard(shard))] = fakeFile{body: []byte("replica")}
+
+	if resp, _ := do(t, "POST", drainURL, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("without the admin token: got %d, want 401", resp.StatusCode)
+	}
+	resp, body := do(t, "POST", drainURL, "", auth...)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"draining":true`) {
+		t.Fatalf("drain: got %d %q", resp.StatusCode, body)
+	}
+	for _, bad := range []string{"0", "6", "x"} {
+		if resp, _ := do(t, "POST", srv.URL+"/admin/shards/"+bad+"/drain", "", auth...); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("drain shard %s: got %d, want 400", bad, resp.StatusCode)
+		}
+	}
+
+	for _, method := range []string{"PUT", "DELETE"} {
+		if resp, _ := do(t, method, u, "x"); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+			t.Fatalf("%s to a draining shard: got %d, want 503 with Retry-After", method, resp.StatusCode)
+		}
+	}
+	if n := len(fs.received()); n != 0 {
+		t.Fatalf("%d requests reached the fileservers, want none", n)
+	}
+
+	// reads go round the drained shard, and the cache still answers
+	if resp, body := do(t, "GET", u, ""); resp.StatusCode != http.StatusOK || body != "replica" {
+		t.Fatalf("GET from the fallback: got %d %q", resp.StatusCode, body)
+	}
+	for _, req := range fs.received() {
+		if strings.HasPrefix(req.path, fmt.Sprintf("/s%d/", shard)) {
+			t.Fatalf("the drained shard was asked for %s %s", req.method, req.path)
+		}
+	}
+	mr.Set(bodyKey("a.txt"), "cached")
+	if _, body := do(t, "GET", u, ""); body != "cached" {
+		t.Fatalf("GET from the cache: got %q", body)
+	}
+
+	do(t, "POST", fmt.Sprintf("%s/admin/shards/%d/undrain", srv.URL, shard), "", auth...)
+	if resp, _ := do(t, "PUT", u, "x"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT after undrain: got %d, want 201", resp.StatusCode)
+	}
+	waitForWrites(t)
+	if _, ok := fs.file(fmt.Sprintf("/s%d/a.txt", shard)); !ok {
+		t.Fatal("write after undrain didn't reach the shard")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// most of a health response read when looking for SHARD_HEALTH_BODY
+const maxHealthBodyBytes = 64 << 10
+
+var shardUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "middleware_shard_up",
+	Help: "Whether the fileserver shard passed its last health probe, 1 or 0.",
+}, []string{"shard"})
+
+// shardProber checks every fileserver's health endpoint in the background. Fileservers answer
+// health at different paths with different bodies, so the probe is set by SHARD_HEALTH_PATH,
+// SHARD_HEALTH_STATUS and SHARD_HEALTH_BODY.
+type shardProber struct {
+	client  *http.Client
+	storage *httpStorage
+	targets []uint32 // every shard, or just shard 0 with sharding off
+	up      []atomic.Bool
+}
+
+// shardHealth is nil unless STORAGE is http and SHARD_HEALTH_INTERVAL is set
+var shardHealth *shardProber
+
+func newShardProber(client *http.Client, s *httpStorage) *shardProber {
+	targets := []uint32{0}
+	if cfg().shardingEnabled {
+		targets = targets[:0]
+		for shard := uint32(1); shard <= shardCount; shard++ {
+			targets = append(targets, shard)
+		}
+	}
+	return &shardProber{client: client, storage: s, targets: targets, up: make([]atomic.Bool, len(targets))}
+}
+
+// run probes every shard straight away and then every SHARD_HEALTH_INTERVAL until ctx is done
+func (p *shardProber) run(ctx context.Context) {
+	ticker := time.NewTicker(cfg().shardHealthInterval)
+	defer ticker.Stop()
+	for {
+		p.probeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *shardProber) probeAll(ctx context.Context) {
+	for i, target := range p.targets {
+		healthy := p.probe(ctx, target)
+		if was := p.up[i].Swap(healthy); was != healthy {
+			slog.Info("Shard health changed", "shard", i+1, "healthy", healthy)
+		}
+		value := 0.0
+		if healthy {
+			value = 1
+		}
+		shardUp.WithLabelValues(strconv.Itoa(i + 1)).Set(value)
+	}
+}
+
+// probe is healthy when shard's health path answers SHARD_HEALTH_STATUS, with a body
+// containing SHARD_HEALTH_BODY if that's set, within SHARD_HEALTH_TIMEOUT
+func (p *shardProber) probe(ctx context.Context, shard uint32) bool {
+	ctx, cancel := context.WithTimeout(ctx, cfg().shardHealthTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.storage.shardBaseURL(shard)+cfg().shardHealthPath, nil)
+	if err != nil {
+		return false
+	}
+	setBackendHeaders(ctx, req)
+	p.storage.setShardAuth(req, shard)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != cfg().shardHealthStatus {
+		return false
+	}
+	if cfg().shardHealthBody == "" {
+		return true
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBodyBytes))
+	return err == nil && strings.Contains(string(body), cfg().shardHealthBody)
+}
+
+// shards reports each shard's last probe, keyed by shard number
+func (p *shardProber) shards() map[string]bool {
+	shards := make(map[string]bool, len(p.up))
+	for i := range p.up {
+		shards[strconv.Itoa(i+1)] = p.up[i].Load()
+	}
+	return shards
+}
+
+// anyUp is false once every shard has failed its probe, when there's nothing left to serve from
+func (p *shardProber) anyUp() bool {
+	for i := range p.up {
+		if p.up[i].Load() {
+			return true
+		}
+	}
+	return false
+}
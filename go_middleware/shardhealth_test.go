@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShardHealthProbe(t *testing.T) {
+	var healthy atomic.Bool
+	var wrongPath atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/internal/status" {
+			wrongPath.Add(1)
+			return
+		}
+		if healthy.Load() {
+			w.Write([]byte(`{"ok":true}`))
+		} else {
+			w.Write([]byte(`{"ok":false}`))
+		}
+	}))
+	defer backend.Close()
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", backend.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	t.Setenv("SHARD_HEALTH_PATH", "/internal/status")
+	t.Setenv("SHARD_HEALTH_BODY", `"ok":true`)
+	_, srv := newTestServer(t)
+	shardHealth = newShardProber(http.DefaultClient, backendOf(t))
+	defer func() { shardHealth = nil }()
+	ready := func() (int, readyResponse) {
+		resp, body := do(t, "GET", srv.URL+"/ready", "")
+		var r readyResponse
+		if err := json.Unmarshal([]byte(body), &r); err != nil {
+			t.Fatalf("got %d %q", resp.StatusCode, body)
+		}
+		return resp.StatusCode, r
+	}
+
+	// answering 200 isn't enough without the expected body
+	shardHealth.probeAll(context.Background())
+	if code, r := ready(); code != http.StatusServiceUnavailable || r.Shards["1"] {
+		t.Fatalf("unhealthy body: got %d %+v", code, r)
+	}
+
+	healthy.Store(true)
+	shardHealth.probeAll(context.Background())
+	if code, r := ready(); code != http.StatusOK || !r.Shards["1"] {
+		t.Fatalf("healthy: got %d %+v", code, r)
+	}
+	if n := wrongPath.Load(); n != 0 {
+		t.Fatalf("%d probes missed SHARD_HEALTH_PATH", n)
+	}
+
+	t.Setenv("SHARD_HEALTH_STATUS", "204")
+	current.Store(loadConfig())
+	shardHealth.probeAll(context.Background())
+	if shardHealth.anyUp() {
+		t.Fatal("a 200 counted as healthy with SHARD_HEALTH_STATUS=204")
+	}
+}
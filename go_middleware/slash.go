@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// TRAILING_SLASH modes for file paths like /api/fileserver/report.txt/
+const (
+	trailingSlashStrip    = "strip"    // serve the path without its trailing slashes
+	trailingSlashRedirect = "redirect" // 308 to the path without them, method and body kept
+	trailingSlashOff      = "off"      // leave the path alone, so it falls through to "/"
+)
+
+const filePathPrefix = "/api/fileserver/"
+
+// trailingSlash routes file paths with trailing slashes to the same handler as without, before
+// the mux sees them. Otherwise /api/fileserver/x/ matches no file pattern and ends up at the
+// catch-all, which answers 200 to any method. Index paths are left for getIndex.
+func trailingSlash(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		trimmed := strings.TrimRight(path, "/")
+		if cfg().trailingSlash == trailingSlashOff || trimmed == path || len(trimmed) < len(filePathPrefix) ||
+			!strings.HasPrefix(path, filePathPrefix) || isIndexPath(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		u := *r.URL
+		u.Path = trimmed
+		u.RawPath = strings.TrimRight(u.RawPath, "/")
+		if cfg().trailingSlash == trailingSlashRedirect {
+			http.Redirect(w, r, u.RequestURI(), http.StatusPermanentRedirect)
+			return
+		}
+
+		r2 := r.Clone(r.Context())
+		r2.URL = &u
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// cleanFilePaths collapses duplicate slashes and resolves "." and ".." segments in file paths,
+// like /api/fileserver//a or /api/fileserver/x/../a, before anything hashes or forwards the
+// name. Left to the mux they'd be redirected, and a ".." could send the client on to another
+// endpoint entirely, so a path climbing out of /api/fileserver/ is a 400. Paths are cleaned
+// escaped, a %2F inside a name isn't a separator and still fails name validation.
+func cleanFilePaths(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		escaped := r.URL.EscapedPath()
+		rest, ok := strings.CutPrefix(escaped, filePathPrefix)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		segments := []string{}
+		for _, segment := range strings.Split(rest, "/") {
+			switch segment {
+			case "", ".":
+			case "..":
+				if len(segments) == 0 {
+					http.Error(w, "path escapes "+filePathPrefix, http.StatusBadRequest)
+					return
+				}
+				segments = segments[:len(segments)-1]
+			default:
+				segments = append(segments, segment)
+			}
+		}
+		cleaned := filePathPrefix + strings.Join(segments, "/")
+		// TRAILING_SLASH and index listings still get to see one
+		if strings.HasSuffix(rest, "/") && len(segments) > 0 {
+			cleaned += "/"
+		}
+		if cleaned == escaped {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		path, err := url.PathUnescape(cleaned)
+		if err != nil {
+			http.Error(w, "invalid path escape", http.StatusBadRequest)
+			return
+		}
+		u := *r.URL
+		u.Path, u.RawPath = path, cleaned
+		r2 := r.Clone(r.Context())
+		r2.URL = &u
+		next.ServeHTTP(w, r2)
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestTrailingSlash(t *testing.T) {
+	for _, mode := range []string{trailingSlashStrip, trailingSlashRedirect, trailingSlashOff} {
+		t.Run(mode, func(t *testing.T) {
+			t.Setenv("TRAILING_SLASH", mode)
+			_, srv := newTestServer(t)
+			u := srv.URL + "/api/fileserver/a.txt"
+			do(t, "PUT", u, "hello")
+			waitForWrites(t)
+
+			req, _ := http.NewRequest("GET", u+"//?x=1", nil)
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			switch mode {
+			case trailingSlashStrip:
+				// the catch-all would answer 200 too, so it's the body that shows getFile served it
+				if resp, body := do(t, "GET", u+"//?x=1", ""); resp.StatusCode != http.StatusOK || body != "hello" {
+					t.Fatalf("GET with a trailing slash: got %d %q", resp.StatusCode, body)
+				}
+				if resp, _ := do(t, "POST", u+"/", ""); resp.StatusCode != http.StatusMethodNotAllowed {
+					t.Fatalf("POST with a trailing slash: got %d, want 405", resp.StatusCode)
+				}
+			case trailingSlashRedirect:
+				if resp.StatusCode != http.StatusPermanentRedirect || resp.Header.Get("Location") != "/api/fileserver/a.txt?x=1" {
+					t.Fatalf("GET with a trailing slash: got %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+				}
+			case trailingSlashOff:
+				if _, body := do(t, "GET", u+"/", ""); body == "hello" {
+					t.Fatal("trailing slash served the file with TRAILING_SLASH=off")
+				}
+			}
+		})
+	}
+}
+
+func TestCleanFilePaths(t *testing.T) {
+	t.Setenv("TRAILING_SLASH", trailingSlashStrip)
+	t.Setenv("VERSIONING", "true")
+	_, srv := newTestServer(t)
+	if resp, _ := do(t, "PUT", srv.URL+"/api/fileserver//a", "x"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT //a: got %d, want 201", resp.StatusCode)
+	}
+	waitForWrites(t)
+
+	// sent as is, a client following redirects would hide one from the mux
+	get := func(path string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	for _, path := range []string{"/api/fileserver/a", "/api/fileserver/./a", "/api/fileserver/x/../a", "/api/fileserver///a/", "/api/fileserver/a/."} {
+		if code, body := get(path); code != http.StatusOK || body != "x" {
+			t.Errorf("GET %s: got %d %q, want the file", path, code, body)
+		}
+	}
+	for _, path := range []string{"/api/fileserver/../admin/reload", "/api/fileserver/a/../../health", "/api/fileserver/a%2F..%2Fb"} {
+		if code, _ := get(path); code != http.StatusBadRequest {
+			t.Errorf("GET %s: got %d, want 400", path, code)
+		}
+	}
+	// cleaning keeps the rest of the route
+	if code, body := get("/api/fileserver/a/./versions"); code != http.StatusOK {
+		t.Errorf("GET a/./versions: got %d %q, want 200", code, body)
+	}
+}
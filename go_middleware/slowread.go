@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// deadlineReader makes an upload keep moving. Every Read gets BODY_READ_TIMEOUT from the moment
+// it starts, capped at READ_TIMEOUT into the request, so a client trickling bytes is cut off
+// instead of holding its connection and the handler for as long as it likes. A read past its
+// deadline fails with an error matching os.ErrDeadlineExceeded.
+type deadlineReader struct {
+	r        io.Reader
+	rc       *http.ResponseController
+	timeout  time.Duration
+	deadline time.Time // zero when READ_TIMEOUT is off
+}
+
+// uploadBody wraps r's body in a deadlineReader, or returns it as is with BODY_READ_TIMEOUT off
+func uploadBody(w http.ResponseWriter, r *http.Request) io.Reader {
+	c := cfg()
+	if c.bodyReadTimeout <= 0 {
+		return r.Body
+	}
+
+	dr := &deadlineReader{r: r.Body, rc: http.NewResponseController(w), timeout: c.bodyReadTimeout}
+	if c.readTimeout > 0 {
+		dr.deadline = time.Now().Add(c.readTimeout)
+	}
+	return dr
+}
+
+func (dr *deadlineReader) Read(p []byte) (int, error) {
+	deadline := time.Now().Add(dr.timeout)
+	if !dr.deadline.IsZero() && dr.deadline.Before(deadline) {
+		deadline = dr.deadline
+	}
+	// not every ResponseWriter has a connection underneath, those just read without a deadline
+	dr.rc.SetReadDeadline(deadline)
+	n, err := dr.r.Read(p)
+	if err == io.EOF {
+		// the body is all in, don't leave a deadline behind for the rest of the request
+		dr.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTricklingUploadTimesOut(t *testing.T) {
+	t.Setenv("BODY_READ_TIMEOUT", "50ms")
+	_, srv := newTestServer(t)
+	c, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// a couple of bytes, then nothing, well past BODY_READ_TIMEOUT
+	start := time.Now()
+	c.Write([]byte("PUT /api/fileserver/slow.txt HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\nab"))
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Fatalf("trickling upload: got %d, want 408", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("took %v to time out", elapsed)
+	}
+
+	waitForWrites(t)
+	if resp, _ := do(t, "GET", srv.URL+"/api/fileserver/slow.txt", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET after the timeout: got %d, want 404", resp.StatusCode)
+	}
+}
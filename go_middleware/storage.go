@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	errNotFound     = errors.New("file not found")
+	errNotSupported = errors.New("operation not supported by this storage backend")
+)
+
+// Storage is where files ultimately live. Handlers only talk to the cache and a Storage,
+// so backends can be swapped with the STORAGE env var.
+type Storage interface {
+	Put(ctx context.Context, name string, r io.Reader, meta fileMeta) error
+	Get(ctx context.Context, name string) (io.ReadCloser, fileMeta, error)
+	Delete(ctx context.Context, name string) error
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// rangeGetter is implemented by backends that can return part of a file without sending all of it.
+// An empty contentRange means the backend ignored the range and returned the whole file.
+type rangeGetter interface {
+	GetRange(ctx context.Context, name string, rangeHeader string) (body io.ReadCloser, contentRange string, err error)
+}
+
+// statter is implemented by backends that can describe a file without sending it, like a HEAD
+type statter interface {
+	Stat(ctx context.Context, name string) (fileStat, error)
+}
+
+// renamer is implemented by backends that can rename a file in one step, so a move is never
+// left with the file in both places or neither
+type renamer interface {
+	Rename(ctx context.Context, from string, to string) error
+}
+
+// unwrapper is implemented by storage layered over another backend, like DEDUP_ENABLED's
+type unwrapper interface {
+	Unwrap() Storage
+}
+
+// httpBackend is the sharded http fileservers store keeps files on, under any layers on top of
+// them. ok is false for the other backends.
+func httpBackend() (hs *httpStorage, ok bool) {
+	s := store
+	for {
+		if hs, ok := s.(*httpStorage); ok {
+			return hs, true
+		}
+		u, ok := s.(unwrapper)
+		if !ok {
+			return nil, false
+		}
+		s = u.Unwrap()
+	}
+}
+
+type fileStat struct {
+	size         int64
+	lastModified time.Time
+}
+
+var backendWriteFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "middleware_backend_write_failures_total",
+	Help: "File PUTs and DELETEs the backend refused or never answered, by the status it gave or \"error\" for none.",
+}, []string{"op", "status"})
+
+// recordWriteFailure counts a file write or delete that failed against the backend
+func recordWriteFailure(op string, err error) {
+	status := "error"
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		status = strconv.Itoa(statusErr.status)
+	}
+	backendWriteFailures.WithLabelValues(op, status).Inc()
+}
+
+// statusError is returned when a backend answers with an unexpected http status
+type statusError struct {
+	op         string
+	status     int
+	retryAfter time.Duration // how long the backend asked us to wait with Retry-After, if it did
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("fileserver %s returned status %d", e.op, e.status)
+}
+
+func newStorage(c *config) (Storage, error) {
+	switch c.storage {
+	case "http":
+		if err := checkURLTemplate("FILE_SERVER_URL", c.fileServerURL); err != nil {
+			return nil, err
+		}
+		hs := newHTTPStorage(httpClient, c.fileServerURL)
+		hs.shardAuth = parseShardAuth(c.shardAuth)
+		hs.retry = true
+		return hs, nil
+	case "fs":
+		return newFSStorage(c.fsRoot)
+	case "s3":
+		return newS3Storage(c)
+	case "memory":
+		return newMemStorage(), nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE %q, expected http, fs, s3 or memory", c.storage)
+	}
+}
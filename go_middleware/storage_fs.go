@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var errInvalidName = errors.New("invalid file name")
+
+// internal directories under the root, hidden from List
+const (
+	fsMetaDir = ".meta" // <name>.json sidecar per file holding its fileMeta
+	fsTempDir = ".tmp"  // uploads in progress, renamed into place once complete
+)
+
+// fsStorage keeps one file per name under a root directory on local disk
+type fsStorage struct {
+	root string
+}
+
+func newFSStorage(root string) (*fsStorage, error) {
+	for _, dir := range []string{root, filepath.Join(root, fsMetaDir), filepath.Join(root, fsTempDir)} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &fsStorage{root: root}, nil
+}
+
+// path joins name onto the root, refusing anything that could land outside it
+func (s *fsStorage) path(name string) (string, error) {
+	if !filepath.IsLocal(name) || strings.HasPrefix(name, ".") {
+		return "", errInvalidName
+	}
+	return filepath.Join(s.root, name), nil
+}
+
+func (s *fsStorage) metaPath(name string) string {
+	return filepath.Join(s.root, fsMetaDir, name+".json")
+}
+
+func (s *fsStorage) Put(ctx context.Context, name string, r io.Reader, meta fileMeta) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file first so readers never see a partial upload
+	tmp, err := os.CreateTemp(filepath.Join(s.root, fsTempDir), "upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	return s.writeMeta(name, meta)
+}
+
+func (s *fsStorage) Get(ctx context.Context, name string) (io.ReadCloser, fileMeta, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, fileMeta{}, err
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fileMeta{}, errNotFound
+	}
+	if err != nil {
+		return nil, fileMeta{}, err
+	}
+
+	meta, err := s.readMeta(name)
+	if err != nil {
+		file.Close()
+		return nil, fileMeta{}, err
+	}
+	return file, meta, nil
+}
+
+func (s *fsStorage) Stat(ctx context.Context, name string) (fileStat, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return fileStat{}, err
+	}
+
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fileStat{}, errNotFound
+	}
+	if err != nil {
+		return fileStat{}, err
+	}
+	return fileStat{size: info.Size(), lastModified: info.ModTime()}, nil
+}
+
+func (s *fsStorage) Delete(ctx context.Context, name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// missing files count as already deleted, same as the fileservers
+	err = os.Remove(s.metaPath(name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Rename moves the file in one os.Rename, replacing whatever was at to. Its metadata sidecar
+// follows straight after, a crash in between leaves to with the data but not the metadata.
+func (s *fsStorage) Rename(ctx context.Context, from string, to string) error {
+	fromPath, err := s.path(from)
+	if err != nil {
+		return err
+	}
+	toPath, err := s.path(to)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(toPath), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(fromPath, toPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.metaPath(to)), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(s.metaPath(from), s.metaPath(to))
+	if errors.Is(err, fs.ErrNotExist) {
+		// from had no sidecar, so neither should to
+		err = os.Remove(s.metaPath(to))
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *fsStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	names := []string{}
+	err := filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel == fsMetaDir || rel == fsTempDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *fsStorage) writeMeta(name string, meta fileMeta) error {
+	path := s.metaPath(name)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// readMeta loads a file's sidecar, files written without one just have empty metadata
+func (s *fsStorage) readMeta(name string) (fileMeta, error) {
+	data, err := os.ReadFile(s.metaPath(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fileMeta{}, nil
+	}
+	if err != nil {
+		return fileMeta{}, err
+	}
+
+	var meta fileMeta
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
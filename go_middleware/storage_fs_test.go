@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFSStorageThroughHandlers(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("STORAGE", "fs")
+	t.Setenv("FS_ROOT", root)
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/notes.txt"
+
+	do(t, "PUT", u, "on disk", "Content-Type", "text/markdown", "X-Meta-Owner", "ops")
+	waitFor(t, func() bool {
+		b, err := os.ReadFile(filepath.Join(root, "notes.txt"))
+		return err == nil && string(b) == "on disk"
+	})
+
+	mr.FlushAll()
+	resp, body := do(t, "GET", u, "")
+	if resp.StatusCode != http.StatusOK || body != "on disk" {
+		t.Fatalf("GET: got %d %q", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/markdown" {
+		t.Errorf("Content-Type: got %q, want text/markdown", got)
+	}
+	if got := resp.Header.Get("X-Meta-Owner"); got != "ops" {
+		t.Errorf("X-Meta-Owner: got %q, want ops", got)
+	}
+
+	do(t, "DELETE", u, "")
+	waitFor(t, func() bool {
+		_, err := os.Stat(filepath.Join(root, "notes.txt"))
+		return os.IsNotExist(err)
+	})
+	resp, _ = do(t, "GET", u, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET after DELETE: got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestFSStorage(t *testing.T) {
+	s, err := newFSStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, name := range []string{"a.txt", "dir/b.txt", "dir/c.txt"} {
+		if err := s.Put(ctx, name, strings.NewReader(name), fileMeta{ContentType: "text/plain"}); err != nil {
+			t.Fatalf("Put %s: %v", name, err)
+		}
+	}
+
+	body, meta, err := s.Get(ctx, "dir/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(body)
+	body.Close()
+	if string(b) != "dir/b.txt" || meta.ContentType != "text/plain" {
+		t.Fatalf("Get: got %q, %+v", b, meta)
+	}
+
+	// the metadata and temp directories never show up as files
+	names, err := s.List(ctx, "")
+	if err != nil || !slices.Equal(names, []string{"a.txt", "dir/b.txt", "dir/c.txt"}) {
+		t.Fatalf("List: got %v, %v", names, err)
+	}
+	names, err = s.List(ctx, "dir/")
+	if err != nil || !slices.Equal(names, []string{"dir/b.txt", "dir/c.txt"}) {
+		t.Fatalf("List dir/: got %v, %v", names, err)
+	}
+
+	if err := s.Delete(ctx, "dir/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Get(ctx, "dir/b.txt"); !errors.Is(err, errNotFound) {
+		t.Fatalf("Get after Delete: got %v, want errNotFound", err)
+	}
+	// deleting what's already gone is fine, like on the fileservers
+	if err := s.Delete(ctx, "dir/b.txt"); err != nil {
+		t.Fatalf("second Delete: %v", err)
+	}
+}
+
+func TestFSStorageRejectsEscapes(t *testing.T) {
+	root := t.TempDir()
+	s, err := newFSStorage(filepath.Join(root, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, name := range []string{"../outside", "dir/../../outside", "/etc/passwd", ".meta/a.txt.json", ".tmp/x", ""} {
+		if err := s.Put(ctx, name, strings.NewReader("x"), fileMeta{}); !errors.Is(err, errInvalidName) {
+			t.Errorf("Put %q: got %v, want errInvalidName", name, err)
+		}
+		if _, _, err := s.Get(ctx, name); !errors.Is(err, errInvalidName) {
+			t.Errorf("Get %q: got %v, want errInvalidName", name, err)
+		}
+		if err := s.Delete(ctx, name); !errors.Is(err, errInvalidName) {
+			t.Errorf("Delete %q: got %v, want errInvalidName", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "outside")); !os.IsNotExist(err) {
+		t.Fatalf("file written outside the root: %v", err)
+	}
+}
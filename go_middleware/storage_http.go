@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// httpStorage spreads files over the sharded fileservers by hashing their names
+type httpStorage struct {
+	client    *http.Client
+	shardAuth map[uint32]string // SHARD_AUTH credentials by shard, the DR cluster has none
+	// FILE_SERVER_URL, or DR_FILE_SERVER_URL for the DR cluster, resolved for each shard up
+	// front. Shard 0 is the template as is, for sharding off.
+	baseURLs [shardCount + 1]string
+	// shards drained for maintenance by POST /admin/shards/{shard}/drain, indexed by shard
+	draining [shardCount + 1]atomic.Bool
+	// each shard's circuit breaker, indexed by shard, shard 0 for sharding off. See
+	// BREAKER_FAILURES.
+	breakers [shardCount + 1]circuitBreaker
+	// retry failed requests with BACKEND_RETRIES. Off for the DR cluster, its mirror has
+	// retries of its own.
+	retry bool
+}
+
+func newHTTPStorage(client *http.Client, urlTemplate string) *httpStorage {
+	s := &httpStorage{client: client}
+	s.baseURLs[0] = urlTemplate
+	for shard := uint32(1); shard <= shardCount; shard++ {
+		s.baseURLs[shard] = strings.Replace(urlTemplate, "#", strconv.Itoa(int(shard)), -1)
+	}
+	return s
+}
+
+// shardCount is the number of fileservers, numbered 1 to shardCount
+const shardCount = 5
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return (h.Sum32() % shardCount) + 1
+}
+
+// nextShard is the shard after shard on the ring, wrapping back to 1
+func nextShard(shard uint32) uint32 {
+	return shard%shardCount + 1
+}
+
+// shardURL resolves the fileserver base url for fileName. With sharding enabled the
+// "#" in the url template is replaced by the file's shard number, otherwise every file
+// goes to the template as is.
+func (s *httpStorage) shardURL(ctx context.Context, fileName string) string {
+	return s.shardBaseURL(s.shardOf(ctx, fileName))
+}
+
+// shardOf is the shard fileName is stored on, 0 with sharding off
+func (s *httpStorage) shardOf(ctx context.Context, fileName string) uint32 {
+	if !cfg().shardingEnabled {
+		return 0
+	}
+	return shardFor(ctx, fileName)
+}
+
+// shardFor is fileName's shard, unless the request forced one with X-Override-Shard
+func shardFor(ctx context.Context, fileName string) uint32 {
+	if shard, ok := overrideShard(ctx); ok {
+		return shard
+	}
+	return hashKey(fileName)
+}
+
+// checkURLTemplate makes sure every shard url a template resolves to is a usable http(s) url, so
+// a typo fails at startup instead of as an opaque 500 on every request
+func checkURLTemplate(envName string, template string) error {
+	if template == "" {
+		return fmt.Errorf("%s is not set", envName)
+	}
+	for shard := uint32(1); shard <= shardCount; shard++ {
+		resolved := strings.Replace(template, "#", strconv.Itoa(int(shard)), -1)
+		u, err := url.Parse(resolved)
+		if err != nil {
+			return fmt.Errorf("%s resolves to an invalid url %q: %w", envName, resolved, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s resolves to %q, which needs an http:// or https:// scheme and a host", envName, resolved)
+		}
+	}
+	return nil
+}
+
+// fileURL is a file's url on a fileserver. Handlers get names already decoded from the path,
+// so they're escaped again here, otherwise a space or "?" would break the request.
+func fileURL(baseURL string, name string) string {
+	return baseURL + "/" + url.PathEscape(name)
+}
+
+// shardBaseURL is shard's base url, shard 0 being the template untouched for sharding off
+func (s *httpStorage) shardBaseURL(shard uint32) string {
+	return s.baseURLs[shard]
+}
+
+// setShardAuth puts shard's SHARD_AUTH credentials on a backend request, replacing any
+// BACKEND_AUTH_HEADER value. Call it after setBackendHeaders.
+func (s *httpStorage) setShardAuth(req *http.Request, shard uint32) {
+	if value, ok := s.shardAuth[shard]; ok {
+		req.Header.Set(shardAuthHeader(), value)
+	}
+}
+
+// Put can only be retried when r can be rewound, which the bodies we write always can
+func (s *httpStorage) Put(ctx context.Context, name string, r io.Reader, meta fileMeta) error {
+	seeker, rewindable := r.(io.Seeker)
+	attempt := func() error {
+		if rewindable {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		return s.put(ctx, name, r, meta)
+	}
+	if !rewindable {
+		return attempt()
+	}
+	return s.withRetries(ctx, attempt)
+}
+
+func (s *httpStorage) put(ctx context.Context, name string, r io.Reader, meta fileMeta) error {
+	shard := s.shardOf(ctx, name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, fileURL(s.shardBaseURL(shard), name), r)
+	if err != nil {
+		return err
+	}
+	setBackendHeaders(ctx, req)
+	s.setShardAuth(req, shard)
+	req.Header.Set("Content-Type", "text/plain")
+	if meta.ContentType != "" {
+		req.Header.Set("Content-Type", meta.ContentType)
+	}
+
+	resp, err := s.do(req, shard)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return backendStatusError("PUT", resp)
+	}
+	return nil
+}
+
+// withRetries runs attempt, and again up to BACKEND_RETRIES times while it fails in a way worth
+// retrying and RETRY_BUDGET allows, waiting retryWait between tries so a 429's Retry-After is
+// honoured
+func (s *httpStorage) withRetries(ctx context.Context, attempt func() error) error {
+	err := attempt()
+	if !s.retry {
+		return err
+	}
+	for n := 0; retryable(ctx, err) && n < cfg().backendRetries && retryAllowed(ctx); n++ {
+		wait := retryWait(err, cfg().backendRetryBackoff<<n)
+		slog.DebugContext(ctx, "Retrying fileserver request", "attempt", n+1, "wait", wait, "err", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		err = attempt()
+	}
+	return err
+}
+
+// retryable is whether err is a fileserver failing for now, overloaded with a 429, a 5xx other
+// than 501 Not Implemented, or no answer at all. An open breaker, a request the caller gave up
+// on, or anything the fileserver answered on purpose would only fail again.
+func retryable(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil || errors.Is(err, errBreakerOpen) {
+		return false
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return retryableStatus(statusErr.status)
+	}
+	return !errors.Is(err, errNotFound) && !errors.Is(err, errBackendRedirect) && !errors.Is(err, errResponseTooLarge)
+}
+
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || (status >= 500 && status != http.StatusNotImplemented)
+}
+
+// Get only recovers the content type and BACKEND_RESPONSE_HEADERS, the fileservers don't keep
+// other metadata
+func (s *httpStorage) Get(ctx context.Context, name string) (io.ReadCloser, fileMeta, error) {
+	resp, err := s.get(ctx, name, "")
+	if err != nil {
+		return nil, fileMeta{}, err
+	}
+	return resp.Body, fileMeta{ContentType: resp.Header.Get("Content-Type"), Backend: backendResponseHeaders(resp)}, nil
+}
+
+func (s *httpStorage) GetRange(ctx context.Context, name string, rangeHeader string) (io.ReadCloser, string, error) {
+	resp, err := s.get(ctx, name, rangeHeader)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		return resp.Body, resp.Header.Get("Content-Range"), nil
+	}
+	return resp.Body, "", nil
+}
+
+func (s *httpStorage) get(ctx context.Context, name string, rangeHeader string) (*http.Response, error) {
+	shard := s.shardOf(ctx, name)
+	// a draining shard is about to go away, so its reads try the fallbacks first
+	drained := s.isDraining(shard)
+	if drained {
+		if resp, ok := s.getFromFallbacks(ctx, name, rangeHeader); ok {
+			return resp, nil
+		}
+	}
+
+	var resp *http.Response
+	err := s.withRetries(ctx, func() error {
+		var err error
+		resp, err = s.getFrom(ctx, shard, name, rangeHeader)
+		if err == nil && retryableStatus(resp.StatusCode) {
+			resp.Body.Close()
+			return backendStatusError("GET", resp)
+		}
+		return err
+	})
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		// the primary answered, just not well, so there's nothing the fallbacks could add
+		return nil, err
+	}
+	if err != nil && !drained {
+		// the primary is unreachable, but the file may have been written further round the ring
+		// while it was down. Only a hit on a fallback counts, otherwise report the original error.
+		if resp, ok := s.getFromFallbacks(ctx, name, rangeHeader); ok {
+			return resp, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return capResponse(resp)
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, errNotFound
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		// only reached with FOLLOW_BACKEND_REDIRECTS off. The location is internal, so it's logged, not passed on
+		resp.Body.Close()
+		slog.Warn("Fileserver redirected a GET", "file", name, "status", resp.StatusCode, "location", resp.Header.Get("Location"))
+		return nil, errBackendRedirect
+	default:
+		resp.Body.Close()
+		return nil, backendStatusError("GET", resp)
+	}
+}
+
+func (s *httpStorage) Delete(ctx context.Context, name string) error {
+	return s.withRetries(ctx, func() error { return s.delete(ctx, name) })
+}
+
+func (s *httpStorage) delete(ctx context.Context, name string) error {
+	shard := s.shardOf(ctx, name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, fileURL(s.shardBaseURL(shard), name), nil)
+	if err != nil {
+		return err
+	}
+	setBackendHeaders(ctx, req)
+	s.setShardAuth(req, shard)
+
+	resp, err := s.do(req, shard)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode >= 300 {
+		return backendStatusError("DELETE", resp)
+	}
+	return nil
+}
+
+// backendStatusError reports a fileserver response we didn't expect, keeping any Retry-After
+// for whoever retries it
+func backendStatusError(op string, resp *http.Response) error {
+	return &statusError{op: op, status: resp.StatusCode, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+}
+
+func (s *httpStorage) getFrom(ctx context.Context, shard uint32, name string, rangeHeader string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL(s.shardBaseURL(shard), name), nil)
+	if err != nil {
+		return nil, err
+	}
+	setBackendHeaders(ctx, req)
+	s.setShardAuth(req, shard)
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+
+	return s.do(req, shard)
+}
+
+// getFromFallbacks probes up to READ_FALLBACK_SHARDS shards after name's primary, when it's
+// unreachable or draining. A forced shard is meant to be the only one asked, so it gets no
+// fallbacks.
+func (s *httpStorage) getFromFallbacks(ctx context.Context, name string, rangeHeader string) (*http.Response, bool) {
+	if _, forced := overrideShard(ctx); !cfg().shardingEnabled || forced {
+		return nil, false
+	}
+
+	shard := hashKey(name)
+	for i := 0; i < cfg().readFallbackShards && i < shardCount-1; i++ {
+		shard = nextShard(shard)
+		resp, err := s.getFrom(ctx, shard, name, rangeHeader)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+			slog.Warn("Read served by fallback shard", "file", name, "shard", shard)
+			resp, err = capResponse(resp)
+			return resp, err == nil
+		}
+		resp.Body.Close()
+	}
+	return nil, false
+}
+
+var errBackendRedirect = errors.New("fileserver answered with a redirect")
+
+// checkBackendRedirect is the backend client's CheckRedirect. Redirects are handed back as the
+// response unless FOLLOW_BACKEND_REDIRECTS is on, a fileserver sending us elsewhere is more
+// likely misconfigured than moved. Followed ones stop after 10 hops like the default client.
+func checkBackendRedirect(req *http.Request, via []*http.Request) error {
+	if !cfg().followRedirects {
+		return http.ErrUseLastResponse
+	}
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 fileserver redirects")
+	}
+	return nil
+}
+
+var errResponseTooLarge = errors.New("fileserver response is larger than MAX_BACKEND_RESPONSE_BYTES")
+
+// capResponse holds a backend body to MAX_BACKEND_RESPONSE_BYTES, so a misbehaving fileserver
+// can't make us buffer whatever it sends. A declared length over the cap fails straight away,
+// otherwise reading past it fails with errResponseTooLarge rather than quietly truncating.
+func capResponse(resp *http.Response) (*http.Response, error) {
+	limit := cfg().maxResponseBytes
+	if limit <= 0 {
+		return resp, nil
+	}
+	if resp.ContentLength > limit {
+		resp.Body.Close()
+		return nil, errResponseTooLarge
+	}
+	resp.Body = &cappedBody{r: io.LimitReader(resp.Body, limit+1), c: resp.Body, remaining: limit}
+	return resp, nil
+}
+
+type cappedBody struct {
+	r         io.Reader
+	c         io.Closer
+	remaining int64
+}
+
+func (b *cappedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return 0, errResponseTooLarge
+	}
+	return n, err
+}
+
+func (b *cappedBody) Close() error {
+	return b.c.Close()
+}
+
+// List isn't possible, the fileservers have no listing endpoint
+func (s *httpStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	return nil, errNotSupported
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFileserver stands in for the fileservers, keeping files in memory by request path and
+// recording every request. Point FILE_SERVER_URL at its URL, with a "/s#" path to tell the
+// shards apart.
+type fakeFileserver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	files    map[string]fakeFile
+	requests []fakeRequest
+}
+
+type fakeFile struct {
+	body        []byte
+	contentType string
+}
+
+type fakeRequest struct {
+	method      string
+	path        string
+	escapedPath string
+	header      http.Header
+}
+
+func newFakeFileserver(t *testing.T) *fakeFileserver {
+	f := &fakeFileserver{files: map[string]fakeFile{}}
+	f.Server = httptest.NewServer(f)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeFileserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, fakeRequest{method: r.Method, path: r.URL.Path, escapedPath: r.URL.EscapedPath(), header: r.Header.Clone()})
+
+	switch r.Method {
+	case http.MethodPut:
+		f.files[r.URL.Path] = fakeFile{body: body, contentType: r.Header.Get("Content-Type")}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		file, ok := f.files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", file.contentType)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(string(file.body)))
+	case http.MethodDelete:
+		if _, ok := f.files[r.URL.Path]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(f.files, r.URL.Path)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// file is the body stored at path, ok is false if there isn't one
+func (f *fakeFileserver) file(path string) (body string, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, ok := f.files[path]
+	return string(file.body), ok
+}
+
+// received is every request so far, oldest first
+func (f *fakeFileserver) received() []fakeRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeRequest(nil), f.requests...)
+}
+
+// count is how many requests with method have come in
+func (f *fakeFileserver) count(method string) int {
+	n := 0
+	for _, req := range f.received() {
+		if req.method == method {
+			n++
+		}
+	}
+	return n
+}
+
+// backendOf is the http fileservers the test server stores on, under dedup or not
+func backendOf(t *testing.T) *httpStorage {
+	t.Helper()
+	hs, ok := httpBackend()
+	if !ok {
+		t.Fatal("storage isn't the http fileservers")
+	}
+	return hs
+}
+
+func TestShardingDisabled(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	_, srv := newTestServer(t)
+
+	for i := range 20 {
+		do(t, "PUT", fmt.Sprintf("%s/api/fileserver/file%d", srv.URL, i), "x")
+	}
+	waitFor(t, func() bool { return fs.count(http.MethodPut) == 20 })
+	for i := range 20 {
+		path := fmt.Sprintf("/file%d", i)
+		if _, ok := fs.file(path); !ok {
+			t.Errorf("file%d not stored at %s", i, path)
+		}
+	}
+}
+
+func TestShardingSpreadsFiles(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL+"/s#")
+	_, srv := newTestServer(t)
+
+	shards := map[string]bool{}
+	for i := range 50 {
+		name := fmt.Sprintf("file%d", i)
+		do(t, "PUT", srv.URL+"/api/fileserver/"+name, "x")
+		path := fmt.Sprintf("/s%d/%s", hashKey(name), name)
+		waitFor(t, func() bool {
+			_, ok := fs.file(path)
+			return ok
+		})
+		shards[strings.Split(path, "/")[1]] = true
+	}
+	if len(shards) != shardCount {
+		t.Fatalf("50 files landed on %d shards, want all %d", len(shards), shardCount)
+	}
+}
+
+func TestReadFallsBackWhenPrimaryIsDown(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL+"/s#")
+	t.Setenv("READ_FALLBACK_SHARDS", "2")
+	_, srv := newTestServer(t)
+
+	// the file was written one shard round the ring while its primary was down, and still is
+	name := "report.txt"
+	primary := hashKey(name)
+	fs.files[fmt.Sprintf("/s%d/%s", nextShard(primary), name)] = fakeFile{body: []byte("from the fallback")}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	backendOf(t).baseURLs[primary] = down.URL
+
+	resp, body := do(t, "GET", srv.URL+"/api/fileserver/"+name, "")
+	if resp.StatusCode != http.StatusOK || body != "from the fallback" {
+		t.Fatalf("GET with the primary down: got %d %q", resp.StatusCode, body)
+	}
+
+	// a primary that answers, even with a 404, is trusted
+	backendOf(t).baseURLs[primary] = fmt.Sprintf("%s/s%d", fs.URL, primary)
+	redisClient.FlushAll(t.Context())
+	resp, _ = do(t, "GET", srv.URL+"/api/fileserver/"+name, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET with the primary up: got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestBackendURLEscapesNames(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	_, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/my%20r%C3%A9sum%C3%A9%3F.txt"
+
+	do(t, "PUT", u, "cv")
+	waitForWrites(t)
+	redisClient.FlushAll(t.Context())
+	resp, body := do(t, "GET", u, "")
+	if resp.StatusCode != http.StatusOK || body != "cv" {
+		t.Fatalf("GET: got %d %q", resp.StatusCode, body)
+	}
+	for _, req := range fs.received() {
+		if req.path != "/my résumé?.txt" || req.escapedPath != "/my%20r%C3%A9sum%C3%A9%3F.txt" {
+			t.Errorf("%s: backend got path %q, escaped %q", req.method, req.path, req.escapedPath)
+		}
+	}
+}
+
+func TestShardOverride(t *testing.T) {
+	name := "f.txt"
+	forced := nextShard(hashKey(name))
+	for _, enabled := range []string{"true", "false"} {
+		t.Run(enabled, func(t *testing.T) {
+			fs := newFakeFileserver(t)
+			t.Setenv("STORAGE", "http")
+			t.Setenv("FILE_SERVER_URL", fs.URL+"/s#")
+			t.Setenv("ALLOW_SHARD_OVERRIDE", enabled)
+			t.Setenv("ADMIN_TOKEN", "secret")
+			_, srv := newTestServer(t)
+			u := srv.URL + "/api/fileserver/" + name
+			shard := fmt.Sprint(forced)
+
+			if enabled == "true" {
+				if resp, _ := do(t, "PUT", u, "x", overrideShardHeader, shard); resp.StatusCode != http.StatusForbidden {
+					t.Fatalf("override without the admin token: got %d, want 403", resp.StatusCode)
+				}
+				for _, bad := range []string{"0", "6", "two"} {
+					if resp, _ := do(t, "PUT", u, "x", overrideShardHeader, bad, "Authorization", "Bearer secret"); resp.StatusCode != http.StatusBadRequest {
+						t.Fatalf("override to shard %q: got %d, want 400", bad, resp.StatusCode)
+					}
+				}
+			}
+
+			do(t, "PUT", u, "x", overrideShardHeader, shard, "Authorization", "Bearer secret")
+			waitForWrites(t)
+			want := forced
+			if enabled == "false" {
+				want = hashKey(name)
+			}
+			reqs := fs.received()
+			if path := fmt.Sprintf("/s%d/%s", want, name); len(reqs) != 1 || reqs[0].path != path {
+				t.Fatalf("backend requests %v, want one PUT to %s", reqs, path)
+			}
+		})
+	}
+}
+
+func TestMaxBackendResponseBytes(t *testing.T) {
+	// one backend answer with a Content-Length and one streamed without
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := strings.Repeat("x", 100)
+		if r.URL.Path == "/chunked" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte(body))
+	}))
+	defer backend.Close()
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", backend.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	t.Setenv("MAX_BACKEND_RESPONSE_BYTES", "50")
+	_, srv := newTestServer(t)
+
+	for _, name := range []string{"sized", "chunked"} {
+		if resp, _ := do(t, "GET", srv.URL+"/api/fileserver/"+name, ""); resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("%s body over the limit: got %d, want 502", name, resp.StatusCode)
+		}
+	}
+
+	t.Setenv("MAX_BACKEND_RESPONSE_BYTES", "100")
+	current.Store(loadConfig())
+	if resp, body := do(t, "GET", srv.URL+"/api/fileserver/chunked", ""); resp.StatusCode != http.StatusOK || len(body) != 100 {
+		t.Fatalf("body at the limit: got %d with %d bytes", resp.StatusCode, len(body))
+	}
+}
+
+func TestBackendRedirect(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			w.Write([]byte("here"))
+			return
+		}
+		http.Redirect(w, r, "/moved", http.StatusFound)
+	}))
+	defer backend.Close()
+	for _, follow := range []string{"false", "true"} {
+		t.Run(follow, func(t *testing.T) {
+			t.Setenv("STORAGE", "http")
+			t.Setenv("FILE_SERVER_URL", backend.URL)
+			t.Setenv("SHARDING_ENABLED", "false")
+			t.Setenv("FOLLOW_BACKEND_REDIRECTS", follow)
+			_, srv := newTestServer(t)
+
+			resp, body := do(t, "GET", srv.URL+"/api/fileserver/x", "")
+			if follow == "true" {
+				if resp.StatusCode != http.StatusOK || body != "here" {
+					t.Fatalf("followed redirect: got %d %q", resp.StatusCode, body)
+				}
+				return
+			}
+			// the location is the fileserver's, never handed to the client
+			if resp.StatusCode != http.StatusBadGateway || resp.Header.Get("Location") != "" {
+				t.Fatalf("redirect not followed: got %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+			}
+		})
+	}
+}
+
+func TestCheckURLTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string // in the error, empty for a valid template
+	}{
+		{"http://fileserver#:8080/api/fileserver", ""},
+		{"http://localhost:9000/api/fileserver", ""},
+		{"", "is not set"},
+		{"fileserver#:8080", "needs an http:// or https:// scheme"},
+		{"http://file server#", "invalid url"},
+		{"http://fs#:99999x", "invalid url"},
+	}
+	for _, tt := range tests {
+		err := checkURLTemplate("FILE_SERVER_URL", tt.template)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%q: %v", tt.template, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "FILE_SERVER_URL") || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want an error about FILE_SERVER_URL saying %q", tt.template, err, tt.want)
+		}
+	}
+
+	// newStorage refuses a bad template, so main exits at startup rather than 500 on each request
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", "fileserver#")
+	if _, err := newStorage(loadConfig()); err == nil {
+		t.Fatal("newStorage accepted a FILE_SERVER_URL without a scheme")
+	}
+}
+
+func TestBackendResponseHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-thing")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("X-Custom", "yes")
+		w.Header().Set("X-Internal", "no")
+		w.Write([]byte("body"))
+	}))
+	defer backend.Close()
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", backend.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	t.Setenv("BACKEND_RESPONSE_HEADERS", "Cache-Control, X-Custom")
+	_, srv := newTestServer(t)
+
+	resp, body := do(t, "GET", srv.URL+"/api/fileserver/h.bin", "")
+	if resp.StatusCode != http.StatusOK || body != "body" {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+	for name, want := range map[string]string{"Content-Type": "application/x-thing", "Cache-Control": "max-age=60", "X-Custom": "yes", "X-Internal": ""} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestShardBaseURLs(t *testing.T) {
+	s := newHTTPStorage(http.DefaultClient, "http://fs#.internal:80/#")
+	if got := s.shardBaseURL(0); got != "http://fs#.internal:80/#" {
+		t.Errorf("shard 0: got %q, want the template as is", got)
+	}
+	for shard := uint32(1); shard <= shardCount; shard++ {
+		if got, want := s.shardBaseURL(shard), fmt.Sprintf("http://fs%d.internal:80/%d", shard, shard); got != want {
+			t.Errorf("shard %d: got %q, want %q", shard, got, want)
+		}
+	}
+
+	// resolved up front, so picking a file's shard doesn't build a string per request
+	t.Setenv("SHARDING_ENABLED", "true")
+	current.Store(loadConfig())
+	ctx := t.Context()
+	if allocs := testing.AllocsPerRun(100, func() { s.shardBaseURL(s.shardOf(ctx, "report.txt")) }); allocs != 0 {
+		t.Errorf("resolving a shard url allocated %v times, want 0", allocs)
+	}
+}
+
+func BenchmarkShardBaseURL(b *testing.B) {
+	b.Setenv("SHARDING_ENABLED", "true")
+	current.Store(loadConfig())
+	s := newHTTPStorage(http.DefaultClient, "http://fs#.internal:80/#")
+	ctx := b.Context()
+	b.ReportAllocs()
+	for b.Loop() {
+		s.shardBaseURL(s.shardOf(ctx, "report.txt"))
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memStorage keeps files in process memory. Nothing survives a restart, it's for local runs and
+// for wiring the handlers up without a fileserver.
+type memStorage struct {
+	mu    sync.RWMutex
+	files map[string]memFile
+}
+
+type memFile struct {
+	data     []byte
+	meta     fileMeta
+	modified time.Time
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{files: make(map[string]memFile)}
+}
+
+func (s *memStorage) Put(ctx context.Context, name string, r io.Reader, meta fileMeta) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	meta.Metadata = maps.Clone(meta.Metadata)
+
+	s.mu.Lock()
+	s.files[name] = memFile{data: data, meta: meta, modified: time.Now()}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memStorage) Get(ctx context.Context, name string) (io.ReadCloser, fileMeta, error) {
+	s.mu.RLock()
+	file, ok := s.files[name]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fileMeta{}, errNotFound
+	}
+	return io.NopCloser(bytes.NewReader(file.data)), file.meta, nil
+}
+
+func (s *memStorage) Stat(ctx context.Context, name string) (fileStat, error) {
+	s.mu.RLock()
+	file, ok := s.files[name]
+	s.mu.RUnlock()
+	if !ok {
+		return fileStat{}, errNotFound
+	}
+	return fileStat{size: int64(len(file.data)), lastModified: file.modified}, nil
+}
+
+// Delete of a missing file succeeds, same as the fileservers
+func (s *memStorage) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	delete(s.files, name)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memStorage) Rename(ctx context.Context, from string, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, ok := s.files[from]
+	if !ok {
+		return errNotFound
+	}
+	s.files[to] = file
+	delete(s.files, from)
+	return nil
+}
+
+func (s *memStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	s.mu.RLock()
+	names := []string{}
+	for name := range s.files {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(names)
+	return names, nil
+}
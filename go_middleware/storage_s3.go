@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3Storage keeps each file as an object under prefix in an S3 (or MinIO) bucket
+type s3Storage struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func newS3Storage(c *config) (*s3Storage, error) {
+	if c.s3Bucket == "" {
+		return nil, errors.New("S3_BUCKET is required when STORAGE=s3")
+	}
+
+	var opts []func(*awsconfig.LoadOptions) error
+	if c.s3Region != "" {
+		opts = append(opts, awsconfig.WithRegion(c.s3Region))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if c.s3Endpoint != "" {
+			// MinIO and friends, which don't do virtual-hosted buckets
+			o.BaseEndpoint = aws.String(c.s3Endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	return &s3Storage{client: client, bucket: c.s3Bucket, prefix: c.s3Prefix}, nil
+}
+
+func (s *s3Storage) key(name string) string {
+	return s.prefix + name
+}
+
+// s3UploadTimeKey is the object metadata entry fileMeta.Modified is kept in, hidden from X-Meta-*
+const s3UploadTimeKey = "upload-time"
+
+func (s *s3Storage) Put(ctx context.Context, name string, r io.Reader, meta fileMeta) error {
+	// the sdk needs a seekable body to sign the payload
+	body, ok := r.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	metadata := meta.Metadata
+	if !meta.Modified.IsZero() {
+		metadata = maps.Clone(meta.Metadata)
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		metadata[s3UploadTimeKey] = meta.Modified.UTC().Format(time.RFC3339Nano)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(s.key(name)),
+		Body:     body,
+		Metadata: metadata,
+	}
+	if meta.ContentType != "" {
+		input.ContentType = aws.String(meta.ContentType)
+	}
+
+	_, err := s.client.PutObject(ctx, input)
+	return s3Error("PUT", err)
+}
+
+func (s *s3Storage) Get(ctx context.Context, name string) (io.ReadCloser, fileMeta, error) {
+	out, err := s.getObject(ctx, name, "")
+	if err != nil {
+		return nil, fileMeta{}, err
+	}
+	meta := fileMeta{ContentType: aws.ToString(out.ContentType), Metadata: out.Metadata}
+	if value, ok := meta.Metadata[s3UploadTimeKey]; ok {
+		meta.Modified, _ = time.Parse(time.RFC3339Nano, value)
+		delete(meta.Metadata, s3UploadTimeKey)
+	}
+	return out.Body, meta, nil
+}
+
+func (s *s3Storage) GetRange(ctx context.Context, name string, rangeHeader string) (io.ReadCloser, string, error) {
+	out, err := s.getObject(ctx, name, rangeHeader)
+	if err != nil {
+		return nil, "", err
+	}
+	return out.Body, aws.ToString(out.ContentRange), nil
+}
+
+func (s *s3Storage) getObject(ctx context.Context, name string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	}
+	if rangeHeader != "" {
+		input.Range = aws.String(rangeHeader)
+	}
+
+	out, err := s.client.GetObject(ctx, input)
+	return out, s3Error("GET", err)
+}
+
+func (s *s3Storage) Stat(ctx context.Context, name string) (fileStat, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err != nil {
+		return fileStat{}, s3Error("HEAD", err)
+	}
+	return fileStat{size: aws.ToInt64(out.ContentLength), lastModified: aws.ToTime(out.LastModified)}, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	return s3Error("DELETE", err)
+}
+
+func (s *s3Storage) List(ctx context.Context, prefix string) ([]string, error) {
+	names := []string{}
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.key(prefix)),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, s3Error("LIST", err)
+		}
+		for _, obj := range page.Contents {
+			names = append(names, strings.TrimPrefix(aws.ToString(obj.Key), s.prefix))
+		}
+	}
+	return names, nil
+}
+
+// s3Error maps sdk errors onto the Storage errors handlers understand
+func s3Error(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return errNotFound
+	}
+
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		if respErr.HTTPStatusCode() == 404 {
+			return errNotFound
+		}
+		return &statusError{op: op, status: respErr.HTTPStatusCode()}
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+// newFakeS3 serves an in-memory S3 API with bucket "test" and points the sdk's credentials at it
+func newFakeS3(t *testing.T) (*s3mem.Backend, string) {
+	backend := s3mem.New()
+	err := backend.CreateBucket("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(gofakes3.New(backend).Server())
+	t.Cleanup(srv.Close)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	return backend, srv.URL
+}
+
+func TestS3Storage(t *testing.T) {
+	_, endpoint := newFakeS3(t)
+	s, err := newS3Storage(&config{s3Bucket: "test", s3Prefix: "files/", s3Region: "us-east-1", s3Endpoint: endpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	meta := fileMeta{ContentType: "text/csv", Metadata: map[string]string{"owner": "ops"}}
+	if err := s.Put(ctx, "a.csv", strings.NewReader("x,y\n1,2\n"), meta); err != nil {
+		t.Fatal(err)
+	}
+	body, got, err := s.Get(ctx, "a.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(body)
+	body.Close()
+	if string(b) != "x,y\n1,2\n" || got.ContentType != "text/csv" || got.Metadata["owner"] != "ops" {
+		t.Fatalf("Get: got %q, %+v", b, got)
+	}
+
+	ranged, contentRange, err := s.GetRange(ctx, "a.csv", "bytes=4-6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = io.ReadAll(ranged)
+	ranged.Close()
+	if string(b) != "1,2" || contentRange != "bytes 4-6/8" {
+		t.Fatalf("GetRange: got %q, %q", b, contentRange)
+	}
+
+	names, err := s.List(ctx, "")
+	if err != nil || !slices.Equal(names, []string{"a.csv"}) {
+		t.Fatalf("List: got %v, %v", names, err)
+	}
+
+	if err := s.Delete(ctx, "a.csv"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Get(ctx, "a.csv"); !errors.Is(err, errNotFound) {
+		t.Fatalf("Get after Delete: got %v, want errNotFound", err)
+	}
+}
+
+func TestS3StorageThroughHandlers(t *testing.T) {
+	backend, endpoint := newFakeS3(t)
+	t.Setenv("STORAGE", "s3")
+	t.Setenv("S3_BUCKET", "test")
+	t.Setenv("S3_PREFIX", "files/")
+	t.Setenv("S3_REGION", "us-east-1")
+	t.Setenv("S3_ENDPOINT", endpoint)
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/a.txt"
+
+	do(t, "PUT", u, "in a bucket", "Content-Type", "text/plain")
+	waitFor(t, func() bool {
+		obj, err := backend.HeadObject("test", "files/a.txt")
+		return err == nil && obj.Size == int64(len("in a bucket"))
+	})
+
+	mr.FlushAll()
+	resp, body := do(t, "GET", u, "")
+	if resp.StatusCode != http.StatusOK || body != "in a bucket" {
+		t.Fatalf("GET: got %d %q", resp.StatusCode, body)
+	}
+}
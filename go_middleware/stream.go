@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// fetchOrStream handles a GET cache miss when streamThreshold is set. Files up to the threshold
+// are read into memory, cached on the way through and handed back for getFile to serve as usual.
+// Anything larger is copied straight from storage to the client, so at most threshold bytes of it
+// are ever held, and streamed is true. Streamed responses have no ETag or compressed variants,
+// both need the whole body up front. Callers hold the file's read lock.
+func fetchOrStream(w http.ResponseWriter, ctx context.Context, fileName string) (bodyBytes []byte, meta fileMeta, streamed bool, err error) {
+	body, meta, err := store.Get(ctx, fileName)
+	if err != nil {
+		return nil, fileMeta{}, false, err
+	}
+	defer body.Close()
+
+	threshold := streamThreshold(ctx)
+	head, err := io.ReadAll(io.LimitReader(body, threshold+1))
+	if err != nil {
+		return nil, fileMeta{}, false, fmt.Errorf("reading fileserver body: %w", err)
+	}
+
+	if int64(len(head)) <= threshold {
+		if cacheable(meta.ContentType) {
+			err = cacheSet(ctx, fileName, head, meta)
+			if err != nil {
+				slog.Error("Redis SET error", "file", fileName, "err", err)
+			}
+		}
+		return head, meta, false, nil
+	}
+
+	meta.Encodings = nil
+	meta.writeHeaders(w.Header())
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(http.StatusOK)
+	w.Write(head)
+	_, err = io.Copy(w, body)
+	if err != nil {
+		// the status is already out, all we can do is cut the response short
+		slog.Warn("Streaming GET interrupted", "file", fileName, "err", err)
+	}
+	return nil, meta, true, nil
+}
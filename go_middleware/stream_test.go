@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestStreamLargeMiss(t *testing.T) {
+	t.Setenv("STREAM_THRESHOLD", "1024")
+	mr, srv := newTestServer(t)
+	big := bytes.Repeat([]byte("abcdefgh"), 1<<17) // 1 MiB
+	if err := store.Put(t.Context(), "big", bytes.NewReader(big), fileMeta{ContentType: "application/x-big"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(t.Context(), "small", bytes.NewReader([]byte("tiny")), fileMeta{}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body := do(t, "GET", srv.URL+"/api/fileserver/big", "")
+	if resp.StatusCode != http.StatusOK || body != string(big) {
+		t.Fatalf("big: got %d with %d bytes", resp.StatusCode, len(body))
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/x-big" {
+		t.Fatalf("big: Content-Type %q", got)
+	}
+	if mr.Exists(bodyKey("big")) {
+		t.Fatal("a file over the threshold was cached")
+	}
+
+	// under the threshold the miss is buffered and served as before
+	resp, body = do(t, "GET", srv.URL+"/api/fileserver/small", "")
+	if body != "tiny" || resp.Header.Get("ETag") == "" || !mr.Exists(bodyKey("small")) {
+		t.Fatalf("small: got %q, ETag %q, cached %v", body, resp.Header.Get("ETag"), mr.Exists(bodyKey("small")))
+	}
+
+	if resp, _ := do(t, "GET", srv.URL+"/api/fileserver/none", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("missing file: got %d, want 404", resp.StatusCode)
+	}
+}
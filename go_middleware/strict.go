@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// requestRules lists what a handler understands beyond standard HTTP headers. In STRICT_MODE
+// anything else is refused with a 400 rather than silently ignored.
+type requestRules struct {
+	query          []string // allowed query parameters
+	headers        []string // allowed X- extension headers, canonical form
+	headerPrefixes []string // allowed X- header prefixes, e.g. X-Meta-
+}
+
+// proxyHeaders are added by load balancers and tracing in front of us, so every route accepts
+// them, along with whatever REQUEST_ID_HEADER names
+var proxyHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip"}
+
+// strict enforces rules on h when STRICT_MODE is on, and is a no-op otherwise
+func strict(rules requestRules, h http.HandlerFunc) http.HandlerFunc {
+	if !cfg().strictMode {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := rules.check(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (rules requestRules) check(r *http.Request) error {
+	for param := range r.URL.Query() {
+		if !slices.Contains(rules.query, param) {
+			return fmt.Errorf("unexpected query parameter %q", param)
+		}
+	}
+
+	// standard headers come from every client library, only our own X- namespace is checked
+	for name := range r.Header {
+		if !strings.HasPrefix(name, "X-") || slices.Contains(rules.headers, name) || slices.Contains(proxyHeaders, name) ||
+			name == http.CanonicalHeaderKey(cfg().requestIDHeader) ||
+			slices.Contains(cfg().forwardHeaders, name) || (cfg().multiTenant && name == tenantHeader) ||
+			(len(cfg().canaryFeatures) > 0 && name == featureHeader) {
+			continue
+		}
+		if !hasAnyPrefix(name, rules.headerPrefixes) {
+			return fmt.Errorf("unexpected header %q", name)
+		}
+	}
+	return nil
+}
+
+// strictRoot stands in for the "/" catch-all in STRICT_MODE, which otherwise answers any
+// method on any unmatched path
+func strictRoot(h http.HandlerFunc) http.HandlerFunc {
+	if !cfg().strictMode {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.Error(w, "unknown path", http.StatusBadRequest)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusBadRequest)
+			return
+		}
+		strict(requestRules{}, h)(w, r)
+	}
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestStrictMode(t *testing.T) {
+	for _, strict := range []string{"false", "true"} {
+		t.Run(strict, func(t *testing.T) {
+			t.Setenv("STRICT_MODE", strict)
+			mr, srv := newTestServer(t)
+			u := srv.URL + "/api/fileserver/a"
+			do(t, "PUT", u, "x")
+			waitFor(t, func() bool { return mr.Exists(bodyKey("a")) })
+
+			want := http.StatusOK
+			if strict == "true" {
+				want = http.StatusBadRequest
+			}
+			if resp, _ := do(t, "GET", u+"?foo=1", ""); resp.StatusCode != want {
+				t.Errorf("unexpected query parameter: got %d, want %d", resp.StatusCode, want)
+			}
+			if resp, _ := do(t, "GET", u, "", "X-Bogus", "1"); resp.StatusCode != want {
+				t.Errorf("unexpected header: got %d, want %d", resp.StatusCode, want)
+			}
+
+			// what the route does read, and what proxies add, always goes through
+			if resp, _ := do(t, "GET", u, "", "X-Forwarded-For", "10.0.0.1", "X-Request-Id", "abc"); resp.StatusCode != http.StatusOK {
+				t.Errorf("known parameters and headers: got %d, want 200", resp.StatusCode)
+			}
+			if resp, _ := do(t, "PUT", u, "y", "X-Meta-Owner", "ops"); resp.StatusCode != http.StatusCreated {
+				t.Errorf("PUT with X-Meta-*: got %d, want 201", resp.StatusCode)
+			}
+			waitForWrite(t, "a", func() bool {
+				cached, _ := mr.Get(bodyKey("a"))
+				return cached == "y"
+			})
+		})
+	}
+}
+
+func TestStrictModeAcceptsConfiguredRequestIDHeader(t *testing.T) {
+	t.Setenv("STRICT_MODE", "true")
+	t.Setenv("REQUEST_ID_HEADER", "X-Correlation-ID")
+	_, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/a"
+
+	resp, _ := do(t, "PUT", u, "x", "X-Correlation-ID", "abc")
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("X-Correlation-ID") != "abc" {
+		t.Fatalf("configured request ID header: got %d, echoed %q", resp.StatusCode, resp.Header.Get("X-Correlation-ID"))
+	}
+	// the default name is just another unknown header now
+	if resp, _ := do(t, "GET", u, "", "X-Request-Id", "abc"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("X-Request-Id with another header configured: got %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	tenantHeader = "X-Tenant"
+	tenantPrefix = "tenant:"
+)
+
+// tenantID is what a tenant may be called, it ends up in cache keys and storage paths
+var tenantID = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+var (
+	errNoTenant      = errors.New("X-Tenant header is required")
+	errInvalidTenant = errors.New("invalid X-Tenant, use up to 63 lower-case letters, digits, - and _")
+)
+
+// tenantScoped puts a validated file name under the calling tenant's namespace when
+// MULTI_TENANT is on. Every key and storage path is derived from the scoped name, so a tenant
+// can only ever address its own files.
+func tenantScoped(r *http.Request, name string) (string, error) {
+	if !cfg().multiTenant {
+		return name, nil
+	}
+
+	tenant := r.Header.Get(tenantHeader)
+	if tenant == "" {
+		return "", errNoTenant
+	}
+	if !tenantID.MatchString(tenant) {
+		return "", errInvalidTenant
+	}
+	// tenant ids can't contain a colon, so this can't be forged from another tenant's names.
+	// a slash would read as a path segment to an http fileserver, so it's not used here
+	return tenantPrefix + tenant + ":" + name, nil
+}
+
+// unscoped is a stored name without the tenant scope tenantScoped put on it, the name as the
+// tenant sees it
+func unscoped(name string) string {
+	if !cfg().multiTenant {
+		return name
+	}
+	rest, ok := strings.CutPrefix(name, tenantPrefix)
+	if !ok {
+		return name
+	}
+	if _, fileName, ok := strings.Cut(rest, ":"); ok {
+		return fileName
+	}
+	return name
+}
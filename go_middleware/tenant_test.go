@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTenantsDontCollide(t *testing.T) {
+	testTenantsDontCollide(t)
+}
+
+// the http backend sends each scoped name as one path segment, which a fileserver that routes
+// on "/" can only serve if the scoping adds none
+func TestTenantsDontCollideOverHTTP(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	testTenantsDontCollide(t)
+
+	for _, req := range fs.received() {
+		if strings.Count(req.path, "/") != 1 || strings.Contains(req.escapedPath, "%2F") {
+			t.Errorf("%s: backend got path %q, escaped %q, want one segment", req.method, req.path, req.escapedPath)
+		}
+	}
+	if body, ok := fs.file("/tenant:globex:same.txt"); !ok || body != "from globex" {
+		t.Fatalf("backend has %q for globex, want %q", body, "from globex")
+	}
+}
+
+func testTenantsDontCollide(t *testing.T) {
+	t.Helper()
+	t.Setenv("MULTI_TENANT", "true")
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/same.txt"
+	do(t, "PUT", u, "from acme", tenantHeader, "acme")
+	do(t, "PUT", u, "from globex", tenantHeader, "globex")
+	waitForWrites(t)
+
+	// from the cache, then from storage
+	for _, where := range []string{"cache", "storage"} {
+		_, a := do(t, "GET", u, "", tenantHeader, "acme")
+		_, b := do(t, "GET", u, "", tenantHeader, "globex")
+		if a != "from acme" || b != "from globex" {
+			t.Fatalf("%s: acme got %q, globex %q", where, a, b)
+		}
+		mr.FlushAll()
+	}
+
+	do(t, "DELETE", u, "", tenantHeader, "acme")
+	waitForWrites(t)
+	if resp, _ := do(t, "GET", u, "", tenantHeader, "acme"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("acme after its DELETE: got %d, want 404", resp.StatusCode)
+	}
+	if _, body := do(t, "GET", u, "", tenantHeader, "globex"); body != "from globex" {
+		t.Fatalf("globex after acme's DELETE: got %q", body)
+	}
+
+	for _, tenant := range []string{"", "../acme", "Acme", "acme/x"} {
+		if resp, _ := do(t, "GET", u, "", tenantHeader, tenant); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("tenant %q: got %d, want 400", tenant, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+)
+
+// bodyEncodingHeader names the ?encoding= a GET body was sent in
+const bodyEncodingHeader = "X-Body-Encoding"
+
+// textEncodings are what GET ?encoding= can turn a body into, for clients that only handle text
+var textEncodings = map[string]func([]byte) string{
+	"base64": base64.StdEncoding.EncodeToString,
+	"hex":    hex.EncodeToString,
+}
+
+// serveTextEncoded sends bodyBytes as text/plain in encoding, with the stored type in
+// X-Original-Content-Type. The ETag is the encoded body's, it's a different representation.
+func serveTextEncoded(w http.ResponseWriter, r *http.Request, bodyBytes []byte, meta fileMeta, encoding string) {
+	encoded := []byte(textEncodings[encoding](bodyBytes))
+	if notModified(w, r, etagFor(encoded), meta.Modified) {
+		return
+	}
+
+	meta.writeHeaders(w.Header())
+	if meta.ContentType != "" {
+		w.Header().Set("X-Original-Content-Type", meta.ContentType)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=us-ascii")
+	w.Header().Set(bodyEncodingHeader, encoding)
+	w.Header().Set("Content-Length", strconv.Itoa(len(encoded)))
+	w.Header().Set("ETag", etagFor(encoded))
+	w.WriteHeader(http.StatusOK)
+	w.Write(encoded)
+}
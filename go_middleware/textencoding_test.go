@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+func TestTextEncoding(t *testing.T) {
+	_, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/blob.bin"
+	raw := "\x00\x01hello\xff"
+	do(t, "PUT", u, raw, "Content-Type", "application/octet-stream")
+	waitForWrites(t)
+
+	resp, body := do(t, "GET", u+"?encoding=base64", "")
+	decoded, err := base64.StdEncoding.DecodeString(body)
+	if resp.StatusCode != http.StatusOK || err != nil || string(decoded) != raw {
+		t.Fatalf("base64: got %d %q, decoding to %q, %v", resp.StatusCode, body, decoded, err)
+	}
+	if resp.Header.Get("X-Body-Encoding") != "base64" || resp.Header.Get("Content-Type") != "text/plain; charset=us-ascii" {
+		t.Fatalf("base64 headers: %v", resp.Header)
+	}
+
+	resp, body = do(t, "GET", u+"?encoding=hex", "")
+	if body != "000168656c6c6fff" || resp.Header.Get("X-Original-Content-Type") != "application/octet-stream" {
+		t.Fatalf("hex: got %q with %v", body, resp.Header)
+	}
+
+	tests := []struct {
+		url, rangeHeader string
+		status           int
+	}{
+		{u + "?encoding=rot13", "", http.StatusBadRequest},
+		{u + "?encoding=hex", "bytes=0-1", http.StatusBadRequest},
+		{srv.URL + "/api/fileserver/nope?encoding=hex", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		var headers []string
+		if tt.rangeHeader != "" {
+			headers = []string{"Range", tt.rangeHeader}
+		}
+		if resp, _ := do(t, "GET", tt.url, "", headers...); resp.StatusCode != tt.status {
+			t.Errorf("%s with Range %q: got %d, want %d", tt.url, tt.rangeHeader, resp.StatusCode, tt.status)
+		}
+	}
+}
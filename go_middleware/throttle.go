@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+func lastWriteKey(fileName string) string {
+	return "lastwrite:" + fileName
+}
+
+// claimWriteSlot enforces MIN_WRITE_INTERVAL. The key lives for one interval after each accepted
+// write, so while it's there any other write is too soon. wait is how long until the next one
+// is allowed, for Retry-After.
+func claimWriteSlot(ctx context.Context, fileName string) (ok bool, wait time.Duration, err error) {
+	if cfg().minWriteInterval <= 0 {
+		return true, 0, nil
+	}
+
+	ok, err = redisClient.SetNX(ctx, lastWriteKey(fileName), 1, cfg().minWriteInterval).Result()
+	if err != nil || ok {
+		return ok, 0, err
+	}
+
+	wait, err = redisClient.PTTL(ctx, lastWriteKey(fileName)).Result()
+	if err != nil || wait <= 0 {
+		// the key expired in between, or lost its TTL somehow, so one interval is a safe guess
+		wait = cfg().minWriteInterval
+	}
+	return false, wait, nil
+}
+
+// releaseWriteSlot gives back a slot claimed for a write that was never accepted
+func releaseWriteSlot(ctx context.Context, fileName string) {
+	if cfg().minWriteInterval > 0 {
+		redisClient.Del(ctx, lastWriteKey(fileName))
+	}
+}
+
+// retryAfterSeconds rounds a wait up to the whole seconds Retry-After takes, at least 1
+func retryAfterSeconds(wait time.Duration) int {
+	return max(1, int(math.Ceil(wait.Seconds())))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMinWriteInterval(t *testing.T) {
+	t.Setenv("MIN_WRITE_INTERVAL", "200ms")
+	mr, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/a.txt"
+
+	if resp, _ := do(t, "PUT", u, "v1"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("first PUT: got %d, want 201", resp.StatusCode)
+	}
+	resp, _ := do(t, "PUT", u, "v2")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("PUT inside the interval: got %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	// other files aren't held off
+	if resp, _ := do(t, "PUT", srv.URL+"/api/fileserver/b.txt", "x"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT of another file: got %d, want 201", resp.StatusCode)
+	}
+
+	mr.FastForward(200 * time.Millisecond)
+	if resp, _ := do(t, "PUT", u, "v3"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT after the interval: got %d, want 201", resp.StatusCode)
+	}
+}
+
+func TestRejectedWriteFreesItsSlot(t *testing.T) {
+	t.Setenv("MIN_WRITE_INTERVAL", "1h")
+	_, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/a.txt"
+	resp, _ := do(t, "PUT", u, "x")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: got %d, want 201", resp.StatusCode)
+	}
+	waitForWrites(t)
+	// start the creates below with the interval clear
+	redisClient.Del(t.Context(), lastWriteKey("a.txt"))
+
+	// a create-only PUT of a file that's already there is refused, and mustn't count as a write
+	for range 2 {
+		if resp, _ := do(t, "PUT", u, "y", "If-None-Match", "*"); resp.StatusCode != http.StatusPreconditionFailed {
+			t.Fatalf("create-only PUT of an existing file: got %d, want 412", resp.StatusCode)
+		}
+	}
+	if resp, _ := do(t, "PUT", u, "z"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT after refused creates: got %d, want 201", resp.StatusCode)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestGetSpanTree(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	fs := newFakeFileserver(t)
+	fs.files["/a.txt"] = fakeFile{body: []byte("traced")}
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	_, srv := newTestServer(t)
+	if err := redisotel.InstrumentTracing(redisClient); err != nil {
+		t.Fatal(err)
+	}
+
+	do(t, "GET", srv.URL+"/api/fileserver/a.txt", "")
+	provider.ForceFlush(t.Context())
+
+	var root tracetest.SpanStub
+	for _, s := range exporter.GetSpans() {
+		if !s.Parent.IsValid() {
+			root = s
+		}
+	}
+	if root.Name != "GET" || root.SpanKind != trace.SpanKindServer {
+		t.Fatalf("root span: got %q %v, want a GET server span", root.Name, root.SpanKind)
+	}
+
+	var cacheChild, backendChild bool
+	for _, s := range exporter.GetSpans() {
+		if s.Parent.SpanID() != root.SpanContext.SpanID() {
+			continue
+		}
+		cacheChild = cacheChild || strings.HasPrefix(s.Name, "redis.")
+		backendChild = backendChild || (s.Name == "HTTP GET" && s.SpanKind == trace.SpanKindClient)
+	}
+	if !cacheChild || !backendChild {
+		t.Fatalf("children of the GET span: cache %v, backend %v", cacheChild, backendChild)
+	}
+
+	// and the fileserver was told which trace it's part of
+	traceparent := fs.received()[0].header.Get("Traceparent")
+	if !strings.Contains(traceparent, root.SpanContext.TraceID().String()) {
+		t.Fatalf("backend traceparent %q isn't in trace %s", traceparent, root.SpanContext.TraceID())
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// trashPrefix is the storage namespace soft-deleted files are moved into, clients can't use it
+const trashPrefix = "trash:"
+
+// trashKey is a redis sorted set of trashed file names, scored by when they're purged
+const trashKey = "trash"
+
+var errNotInTrash = errors.New("file is not in the trash")
+
+func trashName(fileName string) string {
+	return trashPrefix + fileName
+}
+
+// deleteFileOrTrash is what a DELETE does to a file, a hard delete or with SOFT_DELETE a move
+// into the trash. Callers hold the file's write lock.
+func deleteFileOrTrash(ctx context.Context, fileName string) error {
+	if !cfg().softDelete {
+		return removeFile(ctx, fileName)
+	}
+
+	bodyBytes, meta, err := loadFile(ctx, fileName)
+	if errors.Is(err, errNotFound) {
+		// nothing to keep, but still clear out any leftovers
+		return removeFile(ctx, fileName)
+	}
+	if err != nil {
+		slog.Error("Storage GET error", "file", fileName, "err", err)
+		return err
+	}
+
+	// the trash copy has to be safe before the original goes
+	meta.Encodings = nil
+	err = store.Put(ctx, trashName(fileName), bytes.NewReader(bodyBytes), meta)
+	if err != nil {
+		slog.Error("Storage PUT error", "file", trashName(fileName), "err", err)
+		return err
+	}
+	expiry := time.Now().Add(cfg().trashTTL)
+	err = redisClient.ZAdd(ctx, trashKey, redis.Z{Score: float64(expiry.Unix()), Member: fileName}).Err()
+	if err != nil {
+		slog.Error("Redis ZADD error", "file", fileName, "err", err)
+	}
+
+	return removeFile(ctx, fileName)
+}
+
+// restoreFile answers POST /api/fileserver/{fileName}/restore, writing the trashed copy back as
+// a new version of the file
+func restoreFile(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+
+	fileName, err := fileNameFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !cfg().softDelete {
+		http.Error(w, "soft delete is not enabled", http.StatusNotFound)
+		return
+	}
+	if rejectDrainedShard(w, ctx, fileName) {
+		return
+	}
+
+	version, err := nextVersion(ctx, fileName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Redis Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	// restores are writes, so they take their turn behind the file's queued PUTs and DELETEs
+	restored := make(chan error, 1)
+	enqueued := writes.enqueue()
+	fileOps.enqueue(fileName, func() {
+		defer writes.done(enqueued)
+		restored <- restoreFromTrash(ctx, fileName, version)
+	})
+
+	err = <-restored
+	if errors.Is(err, errNotInTrash) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.Header().Set("X-Version", strconv.FormatInt(version, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// restoreFromTrash runs from the file's queue
+func restoreFromTrash(ctx context.Context, fileName string, version int64) error {
+	_, err := redisClient.ZScore(ctx, trashKey, fileName).Result()
+	if errors.Is(err, redis.Nil) {
+		return errNotInTrash
+	}
+	if err != nil {
+		return err
+	}
+
+	body, meta, err := store.Get(ctx, trashName(fileName))
+	if errors.Is(err, errNotFound) {
+		redisClient.ZRem(ctx, trashKey, fileName)
+		return errNotInTrash
+	}
+	if err != nil {
+		return err
+	}
+	bodyBytes, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return fmt.Errorf("reading trashed body: %w", err)
+	}
+
+	err = writeFile(ctx, fileName, bodyBytes, meta, version)
+	if err != nil {
+		return err
+	}
+	return dropTrashed(ctx, fileName)
+}
+
+// dropTrashed deletes fileName's trash copy for good. Callers run it from the file's queue.
+func dropTrashed(ctx context.Context, fileName string) error {
+	err := store.Delete(ctx, trashName(fileName))
+	if err != nil {
+		slog.Error("Storage DELETE error", "file", trashName(fileName), "err", err)
+		return err
+	}
+	return redisClient.ZRem(ctx, trashKey, fileName).Err()
+}
+
+// sweepTrash purges trashed files past TRASH_TTL every TRASH_SWEEP_INTERVAL until ctx is done
+func sweepTrash(ctx context.Context) {
+	ticker := time.NewTicker(cfg().trashSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		expired, err := redisClient.ZRangeByScore(ctx, trashKey, &redis.ZRangeBy{Min: "-inf", Max: now}).Result()
+		if err != nil {
+			slog.Error("Redis ZRANGEBYSCORE error", "err", err)
+			continue
+		}
+		for _, fileName := range expired {
+			enqueued := writes.enqueue()
+			purged := make(chan struct{})
+			fileOps.enqueue(fileName, func() {
+				defer close(purged)
+				defer writes.done(enqueued)
+				// a restore or a newer delete may have got in first
+				score, err := redisClient.ZScore(ctx, trashKey, fileName).Result()
+				if err != nil || score > float64(time.Now().Unix()) {
+					return
+				}
+				if dropTrashed(ctx, fileName) == nil {
+					slog.Info("Purged trashed file", "file", fileName)
+				}
+			})
+			if cfg().syncBackgroundOps {
+				<-purged
+			}
+		}
+	}
+}
+
+// isTrashName reports whether a client-supplied name would land in the trash namespace
+func isTrashName(fileName string) bool {
+	return strings.HasPrefix(fileName, trashPrefix)
+}
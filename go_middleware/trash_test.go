@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSoftDeleteRestore(t *testing.T) {
+	t.Setenv("SOFT_DELETE", "true")
+	_, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/t.txt"
+	do(t, "PUT", u, "keep me", "Content-Type", "text/csv")
+	waitForWrites(t)
+
+	do(t, "DELETE", u, "")
+	waitForWrites(t)
+	if resp, _ := do(t, "GET", u, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET of a trashed file: got %d, want 404", resp.StatusCode)
+	}
+
+	if resp, _ := do(t, "POST", u+"/restore", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("restore: got %d, want 200", resp.StatusCode)
+	}
+	resp, body := do(t, "GET", u, "")
+	if body != "keep me" || resp.Header.Get("Content-Type") != "text/csv" {
+		t.Fatalf("restored file: got %q, %q", body, resp.Header.Get("Content-Type"))
+	}
+	if resp, _ := do(t, "POST", u+"/restore", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("restoring twice: got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestTrashPurgedAfterTTL(t *testing.T) {
+	t.Setenv("SOFT_DELETE", "true")
+	t.Setenv("TRASH_TTL", "100ms")
+	t.Setenv("TRASH_SWEEP_INTERVAL", "20ms")
+	_, srv := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sweepTrash(ctx)
+
+	u := srv.URL + "/api/fileserver/t.txt"
+	do(t, "PUT", u, "gone soon")
+	waitForWrites(t)
+	do(t, "DELETE", u, "")
+	waitForWrites(t)
+
+	time.Sleep(300 * time.Millisecond)
+	if resp, _ := do(t, "POST", u+"/restore", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("restore after TRASH_TTL: got %d, want 404", resp.StatusCode)
+	}
+	if _, _, err := store.Get(ctx, trashName("t.txt")); err == nil {
+		t.Fatal("trashed copy still in storage after the sweep")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var errVerifyMismatch = errors.New("backend content does not match what was written")
+
+var writeVerifyFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "middleware_write_verification_failures_total",
+	Help: "Backend writes whose read-back didn't match, counted once per attempt.",
+})
+
+// putVerified stores a file and, with VERIFY_WRITES, reads it back to confirm the backend really
+// has it, putting it again up to VERIFY_RETRIES times on a mismatch while the retry budget
+// allows, backing off between tries like other backend retries. Callers hold the file's write
+// lock.
+func putVerified(ctx context.Context, fileName string, bodyBytes []byte, meta fileMeta) error {
+	for attempt := 0; ; attempt++ {
+		err := store.Put(ctx, fileName, bytes.NewReader(bodyBytes), meta)
+		if err != nil || !cfg().verifyWrites {
+			return err
+		}
+
+		err = verifyStored(ctx, fileName, bodyBytes)
+		if err == nil {
+			return nil
+		}
+		writeVerifyFailures.Inc()
+		if attempt >= cfg().verifyRetries || !retryAllowed(ctx) {
+			return err
+		}
+		slog.Warn("Write verification failed, retrying", "file", fileName, "attempt", attempt+1, "err", err)
+		// a read-back refused with a 429 gets the wait its Retry-After asked for
+		time.Sleep(retryWait(err, cfg().backendRetryBackoff<<attempt))
+	}
+}
+
+// verifyStored compares what storage returns for fileName against what we wrote
+func verifyStored(ctx context.Context, fileName string, bodyBytes []byte) error {
+	if st, ok := store.(statter); ok {
+		// a cheap size check first, most lost writes show up here without fetching anything
+		stat, err := st.Stat(ctx, fileName)
+		if err != nil {
+			return fmt.Errorf("verifying write: %w", err)
+		}
+		if stat.size != int64(len(bodyBytes)) {
+			return fmt.Errorf("%w, stored %d bytes of %d", errVerifyMismatch, stat.size, len(bodyBytes))
+		}
+	}
+
+	body, _, err := store.Get(ctx, fileName)
+	if err != nil {
+		return fmt.Errorf("verifying write: %w", err)
+	}
+	defer body.Close()
+
+	stored, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("verifying write: %w", err)
+	}
+	if hashBody(stored) != hashBody(bodyBytes) {
+		return fmt.Errorf("%w, stored %d bytes of %d", errVerifyMismatch, len(stored), len(bodyBytes))
+	}
+	return nil
+}
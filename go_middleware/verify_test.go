@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// lossyStorage stores an empty body for the first drop Puts, like a backend losing uploads
+type lossyStorage struct {
+	Storage
+	drop atomic.Int32
+	puts atomic.Int32
+}
+
+func (s *lossyStorage) Put(ctx context.Context, name string, r io.Reader, meta fileMeta) error {
+	s.puts.Add(1)
+	if s.drop.Add(-1) >= 0 {
+		return s.Storage.Put(ctx, name, strings.NewReader(""), meta)
+	}
+	return s.Storage.Put(ctx, name, r, meta)
+}
+
+func TestVerifyWritesCatchesDroppedBody(t *testing.T) {
+	t.Setenv("VERIFY_WRITES", "true")
+	mr, srv := newTestServer(t)
+	lossy := &lossyStorage{Storage: store}
+	lossy.drop.Store(1)
+	store = lossy
+	failures := testutil.ToFloat64(writeVerifyFailures)
+
+	u := srv.URL + "/api/fileserver/v.txt"
+	do(t, "PUT", u, "hello world")
+	waitForWrites(t)
+	if n := lossy.puts.Load(); n != 2 {
+		t.Fatalf("%d backend puts, want the dropped one retried once", n)
+	}
+	if got := testutil.ToFloat64(writeVerifyFailures) - failures; got != 1 {
+		t.Fatalf("verification failures went up by %v, want 1", got)
+	}
+	mr.FlushAll()
+	if _, body := do(t, "GET", u, ""); body != "hello world" {
+		t.Fatalf("stored: got %q", body)
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import "time"
+
+// set at build time, e.g. go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD)"
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+var startedAt = time.Now()
+
+// healthResponse is the body of GET /health
+type healthResponse struct {
+	OK            bool   `json:"ok"`
+	Version       string `json:"version"`
+	Commit        string `json:"commit"`
+	UptimeSeconds int64  `json:"uptimeSeconds"`
+	StartedAt     string `json:"startedAt"`
+}
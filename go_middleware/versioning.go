@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// versionSuffix matches the names older versions are stored under, which clients can't use
+var versionSuffix = regexp.MustCompile(`@v[0-9]+$`)
+
+// versionName is where version of fileName is kept in storage when VERSIONING is on
+func versionName(fileName string, version int64) string {
+	return fmt.Sprintf("%s@v%d", fileName, version)
+}
+
+// versionListKey is a redis sorted set of the versions kept for a file, scored by version
+func versionListKey(fileName string) string {
+	return "versionlist:" + fileName
+}
+
+// storeVersion keeps a copy of a write under versionName and trims the oldest past MAX_VERSIONS.
+// Callers hold the file's write lock.
+func storeVersion(ctx context.Context, fileName string, bodyBytes []byte, meta fileMeta, version int64) {
+	err := store.Put(ctx, versionName(fileName, version), bytes.NewReader(bodyBytes), meta)
+	if err != nil {
+		slog.Error("Storage PUT error", "file", versionName(fileName, version), "err", err)
+		return
+	}
+
+	key := versionListKey(fileName)
+	member := strconv.FormatInt(version, 10)
+	err = redisClient.ZAdd(ctx, key, redis.Z{Score: float64(version), Member: member}).Err()
+	if err != nil {
+		slog.Error("Redis ZADD error", "file", fileName, "err", err)
+		return
+	}
+
+	if cfg().maxVersions <= 0 {
+		return
+	}
+
+	// everything but the newest MAX_VERSIONS
+	stale, err := redisClient.ZRange(ctx, key, 0, int64(-cfg().maxVersions-1)).Result()
+	if err != nil {
+		slog.Error("Redis ZRANGE error", "file", fileName, "err", err)
+		return
+	}
+	for _, member := range stale {
+		old, _ := strconv.ParseInt(member, 10, 64)
+		err := store.Delete(ctx, versionName(fileName, old))
+		if err != nil {
+			slog.Error("Storage DELETE error", "file", versionName(fileName, old), "err", err)
+			continue
+		}
+		cacheDel(ctx, versionName(fileName, old))
+		redisClient.ZRem(ctx, key, member)
+	}
+}
+
+// dropVersions deletes every kept version of fileName. Callers hold the file's write lock.
+func dropVersions(ctx context.Context, fileName string) {
+	key := versionListKey(fileName)
+	members, err := redisClient.ZRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		slog.Error("Redis ZRANGE error", "file", fileName, "err", err)
+		return
+	}
+	for _, member := range members {
+		version, _ := strconv.ParseInt(member, 10, 64)
+		cacheDel(ctx, versionName(fileName, version))
+		err := store.Delete(ctx, versionName(fileName, version))
+		if err != nil {
+			slog.Error("Storage DELETE error", "file", versionName(fileName, version), "err", err)
+		}
+	}
+	redisClient.Del(ctx, key)
+}
+
+// listVersions answers GET /api/fileserver/{fileName}/versions, newest first
+func listVersions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	fileName, err := fileNameFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !cfg().versioning {
+		http.Error(w, "versioning is not enabled", http.StatusNotFound)
+		return
+	}
+
+	members, err := redisClient.ZRevRange(ctx, versionListKey(fileName), 0, -1).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Redis Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if len(members) == 0 {
+		writeNotFound(w)
+		return
+	}
+
+	versions := make([]int64, 0, len(members))
+	for _, member := range members {
+		version, _ := strconv.ParseInt(member, 10, 64)
+		versions = append(versions, version)
+	}
+	b, _ := json.Marshal(map[string]any{"name": fileName, "current": versions[0], "versions": versions})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// serveVersion answers GET ?version=N out of the copy kept for that version. Callers hold the file's read lock.
+func serveVersion(w http.ResponseWriter, ctx context.Context, fileName string, versionParam string) {
+	version, err := strconv.ParseInt(versionParam, 10, 64)
+	if err != nil || version < 1 {
+		http.Error(w, "invalid version", http.StatusBadRequest)
+		return
+	}
+
+	bodyBytes, meta, err := loadFile(ctx, versionName(fileName, version))
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	meta.writeHeaders(w.Header())
+	w.Header().Set("X-Version", strconv.FormatInt(version, 10))
+	w.Header().Set("Content-Length", strconv.Itoa(len(bodyBytes)))
+	w.Header().Set("ETag", etagFor(bodyBytes))
+	w.WriteHeader(http.StatusOK)
+	w.Write(bodyBytes)
+}
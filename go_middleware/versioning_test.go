@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestVersioning(t *testing.T) {
+	t.Setenv("VERSIONING", "true")
+	t.Setenv("MAX_VERSIONS", "2")
+	_, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/doc"
+	for i := 1; i <= 3; i++ {
+		do(t, "PUT", u, fmt.Sprint("body", i))
+	}
+	waitForWrites(t)
+
+	if _, body := do(t, "GET", u, ""); body != "body3" {
+		t.Fatalf("current version: got %q, want body3", body)
+	}
+	// only the newest MAX_VERSIONS are kept
+	if _, body := do(t, "GET", u+"/versions", ""); body != `{"current":3,"name":"doc","versions":[3,2]}` {
+		t.Fatalf("listing: got %s", body)
+	}
+	if resp, body := do(t, "GET", u+"?version=2", ""); resp.StatusCode != http.StatusOK || body != "body2" {
+		t.Fatalf("old version: got %d %q, want body2", resp.StatusCode, body)
+	}
+	if resp, _ := do(t, "GET", u+"?version=1", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("pruned version: got %d, want 404", resp.StatusCode)
+	}
+	// names that look like a version's storage name are refused
+	if resp, _ := do(t, "PUT", u+"@v9", "x"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("PUT to a version name: got %d, want 400", resp.StatusCode)
+	}
+
+	do(t, "DELETE", u, "")
+	waitForWrites(t)
+	if resp, _ := do(t, "GET", u+"?version=2", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("old version after DELETE: got %d, want 404", resp.StatusCode)
+	}
+}
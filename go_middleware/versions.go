@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// how often a GET waiting on X-Min-Version rechecks the written version
+const minVersionPoll = 20 * time.Millisecond
+
+var errVersionNotReady = errors.New("requested version is not written yet")
+
+// versionKey is a redis hash per file shared by every replica. "issued" counts PUTs as they're
+// acked, "written" is the newest of those the backend and cache hold.
+func versionKey(fileName string) string {
+	return "versions:" + fileName
+}
+
+// nextVersion hands out the token returned as X-Version on a PUT
+func nextVersion(ctx context.Context, fileName string) (int64, error) {
+	return redisClient.HIncrBy(ctx, versionKey(fileName), "issued", 1).Result()
+}
+
+// writes from different replicas can finish out of order, so written only ever moves forward
+var raiseVersionField = redis.NewScript(`
+local current = tonumber(redis.call("HGET", KEYS[1], ARGV[1]) or "0")
+if tonumber(ARGV[2]) > current then
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+end
+return 0
+`)
+
+// markWritten records that version has reached the backend and cache. Callers hold the file's write lock.
+func markWritten(ctx context.Context, fileName string, version int64) error {
+	return raiseVersionField.Run(ctx, redisClient, []string{versionKey(fileName)}, "written", version).Err()
+}
+
+// most refused versions failedKey keeps per file, older ones drop off and read as written once
+// a newer version is
+const maxFailedVersions = 1000
+
+// failedKey is a redis sorted set per file of the versions the backend refused, scored by version.
+// Failures can land out of order and behind later successes, so they're kept one by one rather
+// than as a high-water mark like written.
+func failedKey(fileName string) string {
+	return "failed:" + fileName
+}
+
+// markFailed records that the backend refused versions, for GET /api/fileserver/{fileName}/status
+func markFailed(ctx context.Context, fileName string, versions ...int64) error {
+	members := make([]redis.Z, 0, len(versions))
+	for _, version := range versions {
+		members = append(members, redis.Z{Score: float64(version), Member: version})
+	}
+	pipe := redisClient.TxPipeline()
+	pipe.ZAdd(ctx, failedKey(fileName), members...)
+	pipe.ZRemRangeByRank(ctx, failedKey(fileName), 0, -maxFailedVersions-1)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// waitForVersion blocks until fileName's written version is at least minVersion, giving up
+// with errVersionNotReady after MIN_VERSION_WAIT
+func waitForVersion(ctx context.Context, fileName string, minVersion int64) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg().minVersionWait)
+	defer cancel()
+
+	ticker := time.NewTicker(minVersionPoll)
+	defer ticker.Stop()
+	for {
+		written, err := redisClient.HGet(ctx, versionKey(fileName), "written").Result()
+		if err != nil && ctx.Err() != nil {
+			// MIN_VERSION_WAIT ran out while redis was answering
+			return errVersionNotReady
+		}
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		if n, _ := strconv.ParseInt(written, 10, 64); n >= minVersion {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errVersionNotReady
+		case <-ticker.C:
+		}
+	}
+}
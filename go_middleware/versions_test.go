@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMinVersionReadsYourWrites(t *testing.T) {
+	t.Setenv("MIN_VERSION_WAIT", "200ms")
+	_, srv := newTestServer(t)
+	store = slowStorage{Storage: store, delay: 30 * time.Millisecond}
+	u := srv.URL + "/api/fileserver/v.txt"
+
+	for i := 1; i <= 3; i++ {
+		body := fmt.Sprint("v", i)
+		resp, _ := do(t, "PUT", u, body)
+		version := resp.Header.Get("X-Version")
+		if version != fmt.Sprint(i) {
+			t.Fatalf("PUT %d: X-Version %q", i, version)
+		}
+		// straight after the ack, well before the slow backend has it
+		resp, got := do(t, "GET", u, "", "X-Min-Version", version)
+		if resp.StatusCode != http.StatusOK || got != body {
+			t.Fatalf("GET at X-Min-Version %s: got %d %q, want %q", version, resp.StatusCode, got, body)
+		}
+	}
+
+	if resp, _ := do(t, "GET", u, "", "X-Min-Version", "99"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("version never written: got %d, want 503", resp.StatusCode)
+	}
+	if resp, _ := do(t, "GET", u, "", "X-Min-Version", "soon"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("malformed X-Min-Version: got %d, want 400", resp.StatusCode)
+	}
+}
+
+// stallHGets holds every HGET until its context is done, like a redis too busy to answer in time
+type stallHGets struct{}
+
+func (stallHGets) DialHook(next redis.DialHook) redis.DialHook { return next }
+func (stallHGets) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func (stallHGets) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() == "hget" {
+			<-ctx.Done()
+			cmd.SetErr(ctx.Err())
+			return ctx.Err()
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func TestMinVersionTimesOutInRedis(t *testing.T) {
+	t.Setenv("MIN_VERSION_WAIT", "50ms")
+	_, srv := newTestServer(t)
+	redisClient.AddHook(stallHGets{})
+
+	// the deadline passes inside the poll rather than between polls, it's still a 503
+	resp, body := do(t, "GET", srv.URL+"/api/fileserver/v.txt", "", "X-Min-Version", "1")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("GET past MIN_VERSION_WAIT: got %d %q, want 503 with Retry-After", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// webhookSignatureHeader carries "sha256=<hex>", the HMAC-SHA256 of the body keyed with
+// WEBHOOK_SECRET, so receivers can check a callback came from us
+const webhookSignatureHeader = "X-Webhook-Signature"
+
+// webhookTimeout bounds each delivery attempt, a slow receiver only holds up the webhook queue
+const webhookTimeout = 10 * time.Second
+
+var webhookFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "middleware_webhook_failures_total",
+	Help: "File change notifications never delivered to WEBHOOK_URL, dropped on a full queue or after running out of retries.",
+}, []string{"reason"})
+
+type webhookPayload struct {
+	Event     string    `json:"event"`
+	File      string    `json:"file"`
+	Version   int64     `json:"version,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// webhookNotifier posts file change events to WEBHOOK_URL, best-effort and off the write path.
+// A single worker drains the queue so a receiver sees a file's events in the order they happened.
+type webhookNotifier struct {
+	client *http.Client
+	url    string
+	secret []byte
+	events chan webhookPayload
+}
+
+// hooks is nil unless WEBHOOK_URL is set
+var hooks *webhookNotifier
+
+func newWebhookNotifier(url string, secret string, queueSize int) *webhookNotifier {
+	n := &webhookNotifier{
+		client: &http.Client{Timeout: webhookTimeout},
+		url:    url,
+		secret: []byte(secret),
+		events: make(chan webhookPayload, queueSize),
+	}
+	go n.run()
+	return n
+}
+
+// notify never blocks, a full queue drops the event rather than hold up the write
+func (n *webhookNotifier) notify(event string, fileName string, version int64) {
+	if n == nil {
+		return
+	}
+	payload := webhookPayload{Event: event, File: fileName, Version: version, Timestamp: time.Now().UTC()}
+	select {
+	case n.events <- payload:
+	default:
+		webhookFailures.WithLabelValues("queue_full").Inc()
+		slog.Warn("Webhook queue full, event not delivered", "file", fileName, "event", event)
+	}
+}
+
+func (n *webhookNotifier) run() {
+	for payload := range n.events {
+		body, _ := json.Marshal(payload)
+		err := n.deliver(body)
+		for attempt := 0; err != nil && attempt < cfg().webhookRetries; attempt++ {
+			time.Sleep(cfg().webhookRetryBackoff << attempt)
+			err = n.deliver(body)
+		}
+		if err != nil {
+			webhookFailures.WithLabelValues("retries_exhausted").Inc()
+			slog.Error("Could not deliver webhook", "file", payload.File, "event", payload.Event, "err", err)
+		}
+	}
+}
+
+func (n *webhookNotifier) deliver(body []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(n.secret) > 0 {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(n.secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook receiver returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func signWebhook(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookSignedAndRetried(t *testing.T) {
+	t.Setenv("WEBHOOK_RETRY_BACKOFF", "10ms")
+	_, srv := newTestServer(t)
+
+	type delivery struct {
+		body      []byte
+		signature string
+	}
+	got := make(chan delivery, 4)
+	var attempts atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first attempt fails, the retry has to deliver it
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		got <- delivery{b, r.Header.Get(webhookSignatureHeader)}
+	}))
+	defer receiver.Close()
+	hooks = newWebhookNotifier(receiver.URL, "s3cret", 10)
+	defer func() { hooks = nil }()
+
+	do(t, "PUT", srv.URL+"/api/fileserver/w.txt", "x")
+
+	select {
+	case d := <-got:
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(d.body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); d.signature != want {
+			t.Fatalf("signature %q, want %q", d.signature, want)
+		}
+		var p webhookPayload
+		if err := json.Unmarshal(d.body, &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Event != eventPut || p.File != "w.txt" || p.Version != 1 || p.Timestamp.IsZero() {
+			t.Fatalf("got payload %s", d.body)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("webhook never delivered")
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Fatalf("%d delivery attempts, want 2", n)
+	}
+}
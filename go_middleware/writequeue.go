@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// weight of each new sample in the moving average, higher reacts faster
+const writeLatencyAlpha = 0.2
+
+var writeQueueLatency = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "middleware_write_queue_latency_seconds",
+	Help: "Moving average of the time from acking a write-behind request to the backend finishing it.",
+})
+
+var writeQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "middleware_write_queue_depth",
+	Help: "Write-behind operations acked but not yet finished against the backend.",
+})
+
+var writeQueueOldest = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "middleware_write_queue_oldest_seconds",
+	Help: "Age of the oldest write-behind operation acked but not yet finished against the backend, 0 when none are.",
+}, func() float64 { return writes.oldest().Seconds() })
+
+var writeLagAlerts = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "middleware_write_lag_alerts_total",
+	Help: "Times the oldest write-behind operation went past MAX_WRITE_LAG.",
+})
+
+// how often watchWriteLag checks the oldest pending write against MAX_WRITE_LAG
+const writeLagCheckInterval = time.Second
+
+// writeQueue tracks how far the write-behind goroutines lag behind the acks we've sent
+type writeQueue struct {
+	mu      sync.Mutex
+	pending int
+	avg     time.Duration
+	acked   map[int64]int // pending writes by when they were acked, in unix nanoseconds
+}
+
+var writes = &writeQueue{acked: map[int64]int{}}
+
+// waitForQueuedWrite is whether a write is answered only once its queued backend and cache work
+// has finished, with WRITE_THROUGH or SYNC_BACKGROUND_OPS
+func waitForQueuedWrite() bool {
+	return cfg().writeThrough || cfg().syncBackgroundOps
+}
+
+// enqueue records an acked write, pass the returned time to done once the backend has it
+func (q *writeQueue) enqueue() time.Time {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending++
+	q.acked[now.UnixNano()]++
+	writeQueueDepth.Set(float64(q.pending))
+	return now
+}
+
+func (q *writeQueue) done(enqueued time.Time) {
+	latency := time.Since(enqueued)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending--
+	if q.acked[enqueued.UnixNano()]--; q.acked[enqueued.UnixNano()] <= 0 {
+		delete(q.acked, enqueued.UnixNano())
+	}
+	if q.pending == 0 {
+		// nothing is waiting any more, so the backend has caught up whatever the history says
+		q.avg = 0
+	} else if q.avg == 0 {
+		q.avg = latency
+	} else {
+		q.avg += time.Duration(writeLatencyAlpha * float64(latency-q.avg))
+	}
+	writeQueueDepth.Set(float64(q.pending))
+	writeQueueLatency.Set(q.avg.Seconds())
+}
+
+// depth is the number of acked writes the backend hasn't finished yet
+func (q *writeQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+// overloaded reports whether the queue is lagging by more than WRITE_LATENCY_THRESHOLD. The
+// average only moves when a write finishes, so a backend that has stopped finishing any is
+// caught by the oldest pending write instead.
+func (q *writeQueue) overloaded() bool {
+	threshold := cfg().writeLatencyThreshold
+	if threshold <= 0 {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.avg > threshold || q.oldestLocked() > threshold
+}
+
+// oldest is how long the longest waiting acked write has been pending, 0 when none are
+func (q *writeQueue) oldest() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.oldestLocked()
+}
+
+// oldestLocked is oldest for callers holding q.mu
+func (q *writeQueue) oldestLocked() time.Duration {
+	if len(q.acked) == 0 {
+		return 0
+	}
+	first := int64(math.MaxInt64)
+	for acked := range q.acked {
+		first = min(first, acked)
+	}
+	return time.Since(time.Unix(0, first))
+}
+
+// watchWriteLag logs an alert when the oldest acked write has been waiting on the backend for
+// longer than MAX_WRITE_LAG, a sign the write-behind queue has stalled and a crash would lose
+// it, and again once it catches up
+func watchWriteLag(ctx context.Context) {
+	ticker := time.NewTicker(writeLagCheckInterval)
+	defer ticker.Stop()
+	alerting := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		lag := writes.oldest()
+		if lag > cfg().maxWriteLag && !alerting {
+			alerting = true
+			writeLagAlerts.Inc()
+			slog.Error("Write-behind queue is lagging past MAX_WRITE_LAG", "oldest", lag, "pending", writes.depth())
+		} else if lag <= cfg().maxWriteLag && alerting {
+			alerting = false
+			slog.Info("Write-behind queue caught up", "oldest", lag, "pending", writes.depth())
+		}
+	}
+}
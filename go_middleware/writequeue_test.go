@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+)
+
+// slowStorage takes delay over every Put, like a backend falling behind
+type slowStorage struct {
+	Storage
+	delay time.Duration
+}
+
+func (s slowStorage) Put(ctx context.Context, name string, r io.Reader, meta fileMeta) error {
+	time.Sleep(s.delay)
+	return s.Storage.Put(ctx, name, r, meta)
+}
+
+func TestWriteLatencyBackpressure(t *testing.T) {
+	t.Setenv("WRITE_LATENCY_THRESHOLD", "50ms")
+	_, srv := newTestServer(t)
+	store = slowStorage{Storage: store, delay: 80 * time.Millisecond}
+
+	shed := false
+	deadline := time.Now().Add(2 * time.Second)
+	for i := 0; !shed && time.Now().Before(deadline); i++ {
+		resp, _ := do(t, "PUT", fmt.Sprintf("%s/api/fileserver/f%d", srv.URL, i), "x")
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			shed = true
+			if resp.Header.Get("Retry-After") == "" {
+				t.Error("shed PUT without Retry-After")
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !shed {
+		t.Fatal("PUTs never shed while the backend lagged")
+	}
+	if _, body := do(t, "GET", srv.URL+"/metrics", ""); !strings.Contains(body, "middleware_write_queue_latency_seconds") {
+		t.Error("latency gauge missing from /metrics")
+	}
+
+	// once the backend catches up, writes are taken again
+	waitForWrites(t)
+	if resp, _ := do(t, "PUT", srv.URL+"/api/fileserver/after", "x"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT once caught up: got %d, want 201", resp.StatusCode)
+	}
+}
+
+// blockedStorage holds every Put until release is closed
+type blockedStorage struct {
+	Storage
+	release chan struct{}
+}
+
+func (s blockedStorage) Put(ctx context.Context, name string, r io.Reader, meta fileMeta) error {
+	<-s.release
+	return s.Storage.Put(ctx, name, r, meta)
+}
+
+func TestStalledBackendSheds(t *testing.T) {
+	t.Setenv("WRITE_LATENCY_THRESHOLD", "50ms")
+	_, srv := newTestServer(t)
+	release := make(chan struct{})
+	store = blockedStorage{Storage: store, release: release}
+
+	// no write finishes, so there's no average to go on
+	if resp, _ := do(t, "PUT", srv.URL+"/api/fileserver/a", "x"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("first PUT: got %d, want 201", resp.StatusCode)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if resp, _ := do(t, "PUT", srv.URL+"/api/fileserver/b", "x"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("PUT with the backend stalled: got %d, want 503", resp.StatusCode)
+	}
+
+	close(release)
+	waitForWrites(t)
+	if resp, _ := do(t, "PUT", srv.URL+"/api/fileserver/b", "x"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT once the backend recovered: got %d, want 201", resp.StatusCode)
+	}
+}
+
+func TestBackendWriteFailures(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", backend.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	t.Setenv("BACKEND_RETRY_BACKOFF", "1ms")
+	_, srv := newTestServer(t)
+	failures := func(op string) float64 { return testutil.ToFloat64(backendWriteFailures.WithLabelValues(op, "500")) }
+
+	// write-behind has already answered, so the failure is only counted
+	before := failures("PUT")
+	if resp, _ := do(t, "PUT", srv.URL+"/api/fileserver/wb.txt", "x"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("write-behind PUT: got %d, want 201", resp.StatusCode)
+	}
+	waitForWrites(t)
+	if got := failures("PUT"); got != before+1 {
+		t.Fatalf("write-behind failures went from %v to %v, want one more", before, got)
+	}
+
+	// write-through hands the backend's refusal to the client
+	t.Setenv("WRITE_THROUGH", "true")
+	current.Store(loadConfig())
+	before = failures("PUT")
+	if resp, _ := do(t, "PUT", srv.URL+"/api/fileserver/wt.txt", "x"); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("write-through PUT: got %d, want 500", resp.StatusCode)
+	}
+	if got := failures("PUT"); got != before+1 {
+		t.Fatalf("write-through failures went from %v to %v, want one more", before, got)
+	}
+	before = failures("DELETE")
+	if resp, _ := do(t, "DELETE", srv.URL+"/api/fileserver/wt.txt", ""); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("write-through DELETE: got %d, want 500", resp.StatusCode)
+	}
+	if got := failures("DELETE"); got != before+1 {
+		t.Fatalf("DELETE failures went from %v to %v, want one more", before, got)
+	}
+}
+
+func TestFailOnConflict(t *testing.T) {
+	_, srv := newTestServer(t)
+	store = slowStorage{Storage: store, delay: 100 * time.Millisecond}
+	u := srv.URL + "/api/fileserver/cf.txt"
+
+	if resp, _ := do(t, "PUT", u, "first"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("first PUT: got %d, want 201", resp.StatusCode)
+	}
+	// the first is still on its way to the backend
+	if resp, _ := do(t, "PUT", u, "second", failOnConflictHeader, "1"); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("conflicting PUT: got %d, want 409", resp.StatusCode)
+	}
+	if resp, _ := do(t, "PUT", u, "first", failOnConflictHeader, "1"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT of the same body: got %d, want 201, it's no conflict", resp.StatusCode)
+	}
+	// without the header it's last writer wins
+	if resp, _ := do(t, "PUT", u, "second"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT without the header: got %d, want 201", resp.StatusCode)
+	}
+
+	waitForWrites(t)
+	if resp, _ := do(t, "PUT", u, "third", failOnConflictHeader, "1"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT once writes settled: got %d, want 201", resp.StatusCode)
+	}
+	waitForWrites(t)
+	if got := stored(t, "cf.txt"); got != "third" {
+		t.Fatalf("backend has %q, want third", got)
+	}
+}
+
+func TestFailOnConflictAfterPutRan(t *testing.T) {
+	_, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/ran.txt"
+
+	if resp, _ := do(t, "PUT", u, "A"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("first PUT: got %d, want 201", resp.StatusCode)
+	}
+	// something else queued behind the PUT keeps the file's queue alive after the PUT has run
+	started, hold := make(chan struct{}), make(chan struct{})
+	fileOps.enqueue("ran.txt", func() {
+		close(started)
+		<-hold
+	})
+	<-started
+
+	resp, _ := do(t, "PUT", u, "B", failOnConflictHeader, "1")
+	close(hold)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT after the first one ran: got %d, want 201", resp.StatusCode)
+	}
+	waitForWrites(t)
+	if got := stored(t, "ran.txt"); got != "B" {
+		t.Fatalf("backend has %q, want B", got)
+	}
+}
+
+func TestSyncBackgroundOps(t *testing.T) {
+	fs := newFakeFileserver(t)
+	t.Setenv("STORAGE", "http")
+	t.Setenv("FILE_SERVER_URL", fs.URL)
+	t.Setenv("SHARDING_ENABLED", "false")
+	t.Setenv("SYNC_BACKGROUND_OPS", "true")
+	t.Setenv("ASYNC_WRITE_ACCEPTED", "true")
+	t.Setenv("SOFT_DELETE", "true")
+	_, srv := newTestServer(t)
+	u := srv.URL + "/api/fileserver/s.txt"
+
+	// every check is straight after the response, no waitForWrites
+	if resp, _ := do(t, "PUT", u, "synced"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: got %d, want 201 as the write has landed", resp.StatusCode)
+	}
+	if got, ok := fs.file("/s.txt"); !ok || got != "synced" {
+		t.Fatalf("backend after PUT: %q, %v", got, ok)
+	}
+
+	do(t, "DELETE", u, "")
+	if _, ok := fs.file("/s.txt"); ok {
+		t.Fatal("backend still has the file after DELETE")
+	}
+	if got, ok := fs.file("/" + trashName("s.txt")); !ok || got != "synced" {
+		t.Fatalf("trash after DELETE: %q, %v", got, ok)
+	}
+
+	do(t, "POST", u+"/restore", "")
+	if got, ok := fs.file("/s.txt"); !ok || got != "synced" {
+		t.Fatalf("backend after restore: %q, %v", got, ok)
+	}
+
+	do(t, "POST", u+"/move?to=moved.txt", "")
+	if got, ok := fs.file("/moved.txt"); !ok || got != "synced" {
+		t.Fatalf("backend after move: %q, %v", got, ok)
+	}
+	if _, ok := fs.file("/s.txt"); ok {
+		t.Fatal("backend still has the original after move")
+	}
+}
+
+// failCacheSets fails every pipeline that sets a cached body, like a redis out of memory
+type failCacheSets struct{}
+
+func (failCacheSets) DialHook(next redis.DialHook) redis.DialHook          { return next }
+func (failCacheSets) ProcessHook(next redis.ProcessHook) redis.ProcessHook { return next }
+
+func (failCacheSets) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			if cmd.Name() == "set" {
+				return errors.New("OOM command not allowed")
+			}
+		}
+		return next(ctx, cmds)
+	}
+}
+
+func TestRequireCacheOnWrite(t *testing.T) {
+	for _, required := range []bool{false, true} {
+		t.Run(fmt.Sprintf("REQUIRE_CACHE_ON_WRITE=%v", required), func(t *testing.T) {
+			t.Setenv("WRITE_THROUGH", "true")
+			t.Setenv("REQUIRE_CACHE_ON_WRITE", strconv.FormatBool(required))
+			_, srv := newTestServer(t)
+			redisClient.AddHook(failCacheSets{})
+
+			want := http.StatusCreated
+			if required {
+				want = http.StatusServiceUnavailable
+			}
+			if resp, body := do(t, "PUT", srv.URL+"/api/fileserver/f", "x"); resp.StatusCode != want {
+				t.Fatalf("PUT: got %d %q, want %d", resp.StatusCode, body, want)
+			}
+			// the backend has it either way
+			if _, body := do(t, "GET", srv.URL+"/api/fileserver/f", ""); body != "x" {
+				t.Errorf("GET: got %q, want x", body)
+			}
+		})
+	}
+}
+
+func TestWriteLag(t *testing.T) {
+	t.Setenv("MAX_WRITE_LAG", "300ms")
+	t.Setenv("READY_MAX_WRITE_LAG", "300ms")
+	_, srv := newTestServer(t)
+	release := make(chan struct{})
+	store = blockedStorage{Storage: store, release: release}
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go watchWriteLag(ctx)
+	alerts := testutil.ToFloat64(writeLagAlerts)
+
+	if resp, _ := do(t, "PUT", srv.URL+"/api/fileserver/f", "x"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: got %d, want 201", resp.StatusCode)
+	}
+	time.Sleep(100 * time.Millisecond)
+	first := testutil.ToFloat64(writeQueueOldest)
+	if resp, _ := do(t, "GET", srv.URL+"/ready", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("ready under READY_MAX_WRITE_LAG: got %d, want 200", resp.StatusCode)
+	}
+
+	// past the first check, the write has waited over both limits
+	time.Sleep(writeLagCheckInterval + 200*time.Millisecond)
+	if second := testutil.ToFloat64(writeQueueOldest); first <= 0 || second <= first {
+		t.Errorf("oldest write age went from %v to %v, want it growing", first, second)
+	}
+	if got := testutil.ToFloat64(writeLagAlerts) - alerts; got != 1 {
+		t.Errorf("%v lag alerts, want 1", got)
+	}
+	if resp, _ := do(t, "GET", srv.URL+"/ready", ""); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("ready past READY_MAX_WRITE_LAG: got %d, want 503", resp.StatusCode)
+	}
+
+	close(release)
+	waitForWrites(t)
+	if got := testutil.ToFloat64(writeQueueOldest); got != 0 {
+		t.Errorf("oldest write age %v once the backend caught up, want 0", got)
+	}
+	if resp, _ := do(t, "GET", srv.URL+"/ready", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("ready once caught up: got %d, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// states reported by GET /api/fileserver/{fileName}/status
+const (
+	writePending = "pending" // acked and still queued for the backend
+	writeWritten = "written" // the backend has it, or a newer version that replaced it
+	writeFailed  = "failed"  // the backend refused it, or the newer version it was combined into
+)
+
+type writeStatus struct {
+	Version int64  `json:"version"`
+	State   string `json:"state"`
+}
+
+// ackWrite answers a PUT with its X-Version token. A write-through PUT has reached the backend
+// by now and is a 201. A write-behind one only has its place in the file's queue, so with
+// ASYNC_WRITE_ACCEPTED it's a 202 with a Location to check on it instead.
+func ackWrite(w http.ResponseWriter, r *http.Request, version int64) {
+	w.Header().Set("X-Version", strconv.FormatInt(version, 10))
+	if waitForQueuedWrite() || !cfg().asyncWriteAccepted {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s%s/status?version=%d", filePathPrefix, url.PathEscape(r.PathValue("fileName")), version))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// getWriteStatus answers GET /api/fileserver/{fileName}/status?version=, whether the PUT that got
+// version as its X-Version has been forwarded to the backend yet. Without version it's the
+// newest PUT. Versions never issued are a 404.
+func getWriteStatus(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	fileName, err := fileNameFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	versions, err := redisClient.HGetAll(ctx, versionKey(fileName)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		http.Error(w, fmt.Sprintf("Redis Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	issued, _ := strconv.ParseInt(versions["issued"], 10, 64)
+	written, _ := strconv.ParseInt(versions["written"], 10, 64)
+
+	version := issued
+	if raw := r.URL.Query().Get("version"); raw != "" {
+		version, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || version <= 0 {
+			http.Error(w, "version must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if version <= 0 || version > issued {
+		http.Error(w, "no write with that version", http.StatusNotFound)
+		return
+	}
+
+	// a refused version stays failed even once a newer one is written. Any other at or below
+	// written is in, or was replaced by one that is.
+	_, err = redisClient.ZScore(ctx, failedKey(fileName), strconv.FormatInt(version, 10)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		http.Error(w, fmt.Sprintf("Redis Error: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	status := writeStatus{Version: version, State: writePending}
+	if err == nil {
+		status.State = writeFailed
+	} else if version <= written {
+		status.State = writeWritten
+	}
+	b, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// refusingStorage fails every Put of a body starting with "bad"
+type refusingStorage struct{ Storage }
+
+func (s refusingStorage) Put(ctx context.Context, name string, r io.Reader, meta fileMeta) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(string(b), "bad") {
+		return errors.New("refused")
+	}
+	return s.Storage.Put(ctx, name, strings.NewReader(string(b)), meta)
+}
+
+func writeState(t *testing.T, url string) string {
+	t.Helper()
+	resp, body := do(t, "GET", url, "")
+	var status writeStatus
+	if err := json.Unmarshal([]byte(body), &status); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: got %d %q", url, resp.StatusCode, body)
+	}
+	return status.State
+}
+
+func TestWriteStatus(t *testing.T) {
+	t.Setenv("ASYNC_WRITE_ACCEPTED", "true")
+	_, srv := newTestServer(t)
+	release := make(chan struct{})
+	store = blockedStorage{Storage: refusingStorage{store}, release: release}
+	u := srv.URL + "/api/fileserver/w%20x"
+
+	resp, _ := do(t, "PUT", u, "one")
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusAccepted || location != "/api/fileserver/w%20x/status?version=1" {
+		t.Fatalf("PUT: got %d, Location %q", resp.StatusCode, location)
+	}
+	if state := writeState(t, srv.URL+location); state != writePending {
+		t.Errorf("queued write is %s, want pending", state)
+	}
+	close(release)
+	waitForWrites(t)
+
+	// version 2 is refused, 3 then lands over it
+	do(t, "PUT", u, "bad")
+	waitForWrites(t)
+	do(t, "PUT", u, "three")
+	waitForWrites(t)
+	for version, want := range map[int]string{1: writeWritten, 2: writeFailed, 3: writeWritten} {
+		if state := writeState(t, fmt.Sprintf("%s/status?version=%d", u, version)); state != want {
+			t.Errorf("version %d is %s, want %s", version, state, want)
+		}
+	}
+	if state := writeState(t, u+"/status"); state != writeWritten {
+		t.Errorf("newest write is %s, want written", state)
+	}
+
+	for query, want := range map[string]int{"?version=9": http.StatusNotFound, "?version=0": http.StatusBadRequest, "?version=x": http.StatusBadRequest} {
+		if resp, _ := do(t, "GET", u+"/status"+query, ""); resp.StatusCode != want {
+			t.Errorf("status%s: got %d, want %d", query, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestWriteStatusFoldedVersions(t *testing.T) {
+	t.Setenv("ASYNC_WRITE_ACCEPTED", "true")
+	t.Setenv("WRITE_COMBINE_WINDOW", "100ms")
+	_, srv := newTestServer(t)
+	store = refusingStorage{store}
+	u := srv.URL + "/api/fileserver/f"
+
+	// all three go to the backend as one write of the last, which is refused
+	for _, body := range []string{"one", "two", "bad"} {
+		do(t, "PUT", u, body)
+	}
+	waitForWrites(t)
+	for version := 1; version <= 3; version++ {
+		if state := writeState(t, fmt.Sprintf("%s/status?version=%d", u, version)); state != writeFailed {
+			t.Errorf("version %d is %s, want failed with the write it was folded into", version, state)
+		}
+	}
+}